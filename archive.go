@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var archiveMember string
+
+// gcodeExtensions are the file types picked from a zip archive when no
+// member is selected.
+var gcodeExtensions = []string{".nc", ".gcode", ".ngc", ".gc", ".tap", ".cnc", ".txt"}
+
+// multiCloser reads from one reader and closes several resources.
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	var first error
+	for _, c := range m.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// decompressInput transparently unpacks gzip and zip inputs, judging by
+// their name.
+func decompressInput(in *jobInput) (*jobInput, error) {
+	lower := strings.ToLower(in.name)
+	switch {
+	case strings.HasSuffix(lower, ".gz"), strings.HasSuffix(lower, ".gzip"):
+		return gunzipInput(in)
+	case strings.HasSuffix(lower, ".zip"):
+		return unzipInput(in)
+	}
+	return in, nil
+}
+
+// gunzipInput decompresses to a temporary file since the size must be
+// known before sending.
+func gunzipInput(in *jobInput) (*jobInput, error) {
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		zap.L().Error("Could not read gzip input", zap.String("file", in.name), zap.Error(err))
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "send-carbide-*.nc")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(tmp, gz)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		zap.L().Error("Could not decompress gzip input", zap.String("file", in.name), zap.Error(err))
+		return nil, err
+	}
+	name := in.name[:strings.LastIndex(in.name, ".")]
+	return &jobInput{ReadCloser: &tempFile{tmp}, name: name, size: size, path: tmp.Name()}, nil
+}
+
+// unzipInput opens the member selected with -member, which may be a name
+// or a pattern, or otherwise the only gcode file in the archive.
+func unzipInput(in *jobInput) (*jobInput, error) {
+	zipPath, err := localCopy(in)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		in.Close()
+		zap.L().Error("Could not read zip input", zap.String("file", in.name), zap.Error(err))
+		return nil, err
+	}
+	var matches []*zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if archiveMember != "" {
+			full, _ := path.Match(archiveMember, f.Name)
+			base, _ := path.Match(archiveMember, path.Base(f.Name))
+			if full || base {
+				matches = append(matches, f)
+			}
+		} else if isGcodeName(f.Name) {
+			matches = append(matches, f)
+		}
+	}
+	if len(matches) != 1 {
+		zr.Close()
+		in.Close()
+		var names []string
+		for _, f := range matches {
+			names = append(names, f.Name)
+		}
+		if len(matches) == 0 {
+			zap.L().Error("no gcode file found in archive", zap.String("file", in.name), zap.String("member", archiveMember))
+			return nil, fmt.Errorf("no gcode file matching %q in %s", archiveMember, in.name)
+		}
+		zap.L().Error("several files in archive match, select one with -member", zap.String("file", in.name), zap.Strings("matches", names))
+		return nil, fmt.Errorf("several files in %s match: %s", in.name, strings.Join(names, ", "))
+	}
+	member, err := matches[0].Open()
+	if err != nil {
+		zr.Close()
+		in.Close()
+		return nil, err
+	}
+	zap.L().Info("sending archive member", zap.String("archive", in.name), zap.String("member", matches[0].Name))
+	return &jobInput{
+		ReadCloser: &multiCloser{Reader: member, closers: []io.Closer{member, zr, in}},
+		name:       path.Base(matches[0].Name),
+		size:       int64(matches[0].UncompressedSize64),
+	}, nil
+}
+
+func isGcodeName(name string) bool {
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(path.Base(lower), ".") || strings.HasPrefix(lower, "__macosx/") {
+		return false
+	}
+	for _, ext := range gcodeExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
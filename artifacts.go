@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errUnknownArtifact = errors.New("unknown artifact")
+
+// artifactStore keeps a copy of every job the daemon sent, named by the
+// SHA-256 of its content, so a job can be sent again exactly as it ran
+// after the CAM output was regenerated. Sending the same content again
+// keeps one copy, whose age counts from the last send.
+type artifactStore struct {
+	mu      sync.Mutex
+	backend artifactBackend
+	// retention is how long a copy is kept after its last send, 0 for
+	// ever
+	retention time.Duration
+	// limit is the most the copies may take together, the least recently
+	// sent are removed past it, 0 for no limit
+	limit int64
+}
+
+// openArtifactStore keeps the copies in a directory, or in the database
+// of a storage URL. An empty location or "off" returns nil, which keeps
+// nothing.
+func openArtifactStore(location string, retention time.Duration, limit int64) (*artifactStore, error) {
+	if location == "" || location == "off" {
+		return nil, nil
+	}
+	var backend artifactBackend
+	if isDatabase(location) {
+		db, err := openSQLStore(location)
+		if err != nil {
+			return nil, err
+		}
+		backend = db
+	} else {
+		if err := os.MkdirAll(location, 0o755); err != nil {
+			return nil, err
+		}
+		backend = artifactFiles(location)
+	}
+	return &artifactStore{backend: backend, retention: retention, limit: limit}, nil
+}
+
+// keep copies the file at path into the store and returns its hash and
+// where the copy is, for a directory. A failure is logged, the job was
+// sent.
+func (s *artifactStore) keep(path string) (hash, kept string) {
+	if s == nil {
+		return "", ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		zap.L().Warn("failed to keep artifact", zap.String("path", path), zap.Error(err))
+		return "", ""
+	}
+	defer f.Close()
+	if hash, err = contentHash(f); err != nil {
+		zap.L().Warn("failed to keep artifact", zap.String("path", path), zap.Error(err))
+		return "", ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kept, ok := s.backend.touch(hash); ok {
+		return hash, kept
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		zap.L().Warn("failed to keep artifact", zap.String("path", path), zap.Error(err))
+		return "", ""
+	}
+	if kept, err = s.backend.put(hash, f); err != nil {
+		zap.L().Warn("failed to keep artifact", zap.String("path", path), zap.String("sha256", hash), zap.Error(err))
+		return "", ""
+	}
+	zap.L().Debug("kept artifact", zap.String("sha256", hash), zap.String("artifact", kept))
+	s.backend.prune(s.retention, s.limit)
+	return hash, kept
+}
+
+// contentHash is the SHA-256 of what r reads, as artifacts are named.
+func contentHash(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// open returns the copy of the content with the hash.
+func (s *artifactStore) open(hash string) (artifactReader, error) {
+	if s == nil || len(hash) != sha256.Size*2 || strings.Trim(hash, "0123456789abcdef") != "" {
+		return nil, errUnknownArtifact
+	}
+	return s.backend.open(hash)
+}
+
+// artifactFiles keeps the copies as files of a directory, by the first two
+// digits of their hash.
+type artifactFiles string
+
+func (dir artifactFiles) path(hash string) string {
+	return filepath.Join(string(dir), hash[:2], hash+".nc")
+}
+
+func (dir artifactFiles) touch(hash string) (string, bool) {
+	now := time.Now()
+	return dir.path(hash), os.Chtimes(dir.path(hash), now, now) == nil
+}
+
+// put writes the copy through a temporary file, so a copy cut short by a
+// crash is never taken for the job.
+func (dir artifactFiles) put(hash string, r io.Reader) (string, error) {
+	kept := dir.path(hash)
+	if err := os.MkdirAll(filepath.Dir(kept), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(kept), ".artifact-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), kept)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return kept, nil
+}
+
+func (dir artifactFiles) open(hash string) (artifactReader, error) {
+	f, err := os.Open(dir.path(hash))
+	if os.IsNotExist(err) {
+		return nil, errUnknownArtifact
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// prune removes the copies past the retention, then the least recently
+// sent ones until the rest fit the limit.
+func (dir artifactFiles) prune(retention time.Duration, limit int64) {
+	type artifact struct {
+		path string
+		size int64
+		sent time.Time
+	}
+	var artifacts []artifact
+	var total int64
+	filepath.Walk(string(dir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".nc" {
+			return nil
+		}
+		if retention > 0 && time.Since(info.ModTime()) > retention {
+			zap.L().Debug("removing expired artifact", zap.String("artifact", path), zap.Time("sent", info.ModTime()))
+			os.Remove(path)
+			return nil
+		}
+		artifacts = append(artifacts, artifact{path: path, size: info.Size(), sent: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if limit <= 0 || total <= limit {
+		return
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].sent.Before(artifacts[j].sent)
+	})
+	// The newest copy stays even when it alone is past the limit
+	for _, a := range artifacts[:len(artifacts)-1] {
+		if total <= limit {
+			break
+		}
+		zap.L().Debug("removing artifact past the limit", zap.String("artifact", a.path), zap.Int64("size", a.size))
+		os.Remove(a.path)
+		total -= a.size
+	}
+}
+
+// pruneArtifacts removes expired copies hourly, for a daemon that sends
+// nothing for a while, until stop is closed.
+func (d *daemon) pruneArtifacts(stop <-chan struct{}) {
+	defer d.workers.Done()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		d.artifacts.mu.Lock()
+		d.artifacts.backend.prune(d.artifacts.retention, d.artifacts.limit)
+		d.artifacts.mu.Unlock()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleArtifact answers the kept copy of a job, by the sha256 of a job or
+// history entry.
+func (d *daemon) handleArtifact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	hash := strings.TrimPrefix(r.URL.Path, "/artifacts/")
+	f, err := d.artifacts.open(hash)
+	if errors.Is(err, errUnknownArtifact) {
+		writeError(w, http.StatusNotFound, "%v %q", err, hash)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to open artifact: %v", err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain")
+	http.ServeContent(w, r, hash+".nc", time.Time{}, f)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// auditEntry is one line of the daemon's audit log: who did what to which
+// job and machine, and how it went.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Client is who made the request, see clientIdentity, or the
+	// submitter of the job for sends
+	Client  string `json:"client"`
+	Remote  string `json:"remote,omitempty"`
+	Action  string `json:"action"`
+	Job     string `json:"job,omitempty"`
+	Machine string `json:"machine,omitempty"`
+	Name    string `json:"name,omitempty"`
+	// Request is the method and path of a denied request
+	Request string `json:"request,omitempty"`
+	Result  string `json:"result"`
+}
+
+// auditLog appends entries to a file that is only ever added to, separate
+// from the logs, which may be rotated away or filtered by level.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// auditPath returns the default audit log location, next to the config
+// file.
+func auditPath() string {
+	if configPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configPath), "audit.jsonl")
+}
+
+// openAuditLog opens the audit log for appending. An empty path or "off"
+// returns nil, which records nothing.
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" || path == "off" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, f: f}, nil
+}
+
+// record writes an entry and syncs it to disk, so it survives a crash right
+// after. Failures are logged, the request has already been handled.
+func (a *auditLog) record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(data, '\n')); err != nil {
+		zap.L().Error("failed to write audit entry", zap.String("path", a.path), zap.Error(err))
+		return
+	}
+	if err := a.f.Sync(); err != nil {
+		zap.L().Warn("failed to sync audit log", zap.String("path", a.path), zap.Error(err))
+	}
+}
+
+// request records an API request by the client that made it.
+func (a *auditLog) request(r *http.Request, entry auditEntry) {
+	entry.Client = clientIdentity(r)
+	entry.Remote = clientAddress(r)
+	a.record(entry)
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+type identityKey struct{}
+
+// withIdentity notes who a request authenticated as.
+func withIdentity(r *http.Request, identity string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// clientIdentity is who a request authenticated as: "user <name>",
+// "token <hash>" or "anonymous" on an open listener.
+func clientIdentity(r *http.Request) string {
+	if identity, ok := r.Context().Value(identityKey{}).(string); ok {
+		return identity
+	}
+	return "anonymous"
+}
+
+// tokenIdentity names a token by the start of its hash, which tells tokens
+// apart in the audit log without recording them.
+func tokenIdentity(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token " + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// apiToken is sent to the daemon API as a bearer token.
+var apiToken string
+
+// daemonConfig is the daemon section of the config file.
+type daemonConfig struct {
+	// Listeners replace -listen, each with its own credentials.
+	Listeners []listenerConfig `yaml:"listeners"`
+	// Roles limit which machines the users of the listeners may send to,
+	// by role name
+	Roles map[string]roleConfig `yaml:"roles"`
+	// Routes pick the machine of jobs submitted without one, the first
+	// that matches
+	Routes []jobRoute `yaml:"routes"`
+}
+
+// listenerConfig is an address the daemon API listens on and who may use
+// it. A listener without tokens or users is open to anyone who can reach
+// it.
+type listenerConfig struct {
+	Address string `yaml:"address"`
+	// Tokens are accepted as "Authorization: Bearer <token>".
+	Tokens []string `yaml:"tokens"`
+	// Users maps basic auth user names to their passwords, for browsers.
+	Users map[string]string `yaml:"users"`
+}
+
+func (l listenerConfig) open() bool {
+	return len(l.Tokens) == 0 && len(l.Users) == 0
+}
+
+// authorized returns who a request authenticated as with one of the
+// listener's tokens or user passwords, see clientIdentity. ok is false when
+// it carries neither.
+func (l listenerConfig) authorized(r *http.Request) (identity string, ok bool) {
+	if user, password, ok := r.BasicAuth(); ok {
+		want, known := l.Users[user]
+		// Compare against something for unknown users too, so they take
+		// as long as wrong passwords
+		if subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1 && known {
+			return "user " + user, true
+		}
+		return "", false
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	for _, want := range l.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+			return tokenIdentity(token), true
+		}
+	}
+	return "", false
+}
+
+// authenticate rejects requests to next that aren't authorized on the
+// listener, and records the rejections in the audit log.
+func (l listenerConfig) authenticate(next http.Handler, audit *auditLog) http.Handler {
+	if l.open() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identity, ok := l.authorized(r); ok {
+			next.ServeHTTP(w, withIdentity(r, identity))
+			return
+		}
+		if healthPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		zap.L().Warn("unauthorized request", zap.String("listen", l.Address), zap.String("remote", clientAddress(r)),
+			zap.String("method", r.Method), zap.String("path", r.URL.Path))
+		denied := r
+		if user, _, ok := r.BasicAuth(); ok {
+			denied = withIdentity(r, "user "+user)
+		}
+		audit.request(denied, auditEntry{Action: "denied", Request: r.Method + " " + r.URL.Path, Result: "unauthorized"})
+		if len(l.Users) > 0 {
+			// Lets browsers ask for the user name and password
+			w.Header().Set("WWW-Authenticate", `Basic realm="send-carbide"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="send-carbide"`)
+		}
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+	})
+}
+
+// defaultToken is the -token default.
+func defaultToken() string {
+	return os.Getenv("SEND_CARBIDE_TOKEN")
+}
+
+// newAPIRequest is a request to the daemon API with the -token.
+func newAPIRequest(method, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+	}
+	return req, nil
+}
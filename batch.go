@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var queueURL string
+var queuePriority int
+var queueAfter string
+var queueHold bool
+var queueTTL time.Duration
+var queueTags string
+
+var errNoFilesMatched = errors.New("no files matched")
+
+// isRemoteSource reports whether source is fetched rather than read from
+// the local file system.
+func isRemoteSource(source string) bool {
+	for _, prefix := range []string{"http://", "https://", s3Prefix, gcsPrefix} {
+		if strings.HasPrefix(source, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandSources turns glob patterns and directories into the files they
+// name, sorted so that the send order is deterministic. Directories
+// contribute their gcode files but are not searched recursively.
+func expandSources(args []string) ([]string, bool, error) {
+	var sources []string
+	expanded := false
+	for _, arg := range args {
+		if arg == "-" || isRemoteSource(arg) {
+			sources = append(sources, arg)
+			continue
+		}
+		if strings.ContainsAny(arg, "*?[") && !fileExists(arg) {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, false, err
+			}
+			if len(matches) == 0 {
+				zap.L().Error("no files match pattern", zap.String("pattern", arg))
+				return nil, false, fmt.Errorf("%w %q", errNoFilesMatched, arg)
+			}
+			sort.Strings(matches)
+			sources = append(sources, matches...)
+			expanded = true
+			continue
+		}
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			entries, err := ioutil.ReadDir(arg)
+			if err != nil {
+				return nil, false, err
+			}
+			var files []string
+			for _, entry := range entries {
+				if !entry.IsDir() && isGcodeName(entry.Name()) {
+					files = append(files, filepath.Join(arg, entry.Name()))
+				}
+			}
+			if len(files) == 0 {
+				zap.L().Error("no gcode files in directory", zap.String("directory", arg))
+				return nil, false, fmt.Errorf("%w in %s", errNoFilesMatched, arg)
+			}
+			sort.Strings(files)
+			sources = append(sources, files...)
+			expanded = true
+			continue
+		}
+		sources = append(sources, arg)
+	}
+	return sources, expanded || len(sources) > 1, nil
+}
+
+// batchResult is the outcome of one file of a batch.
+type batchResult struct {
+	source string
+	detail string
+	err    error
+}
+
+// runBatch sends or queues each file in order and prints a result per file.
+// A failed file doesn't stop the rest.
+func runBatch(sources []string) error {
+	var sender Sender
+	if queueURL == "" {
+		var err error
+		if sender, err = openSender(backend); err != nil {
+			zap.L().Error("failed to set up backend", zap.String("backend", backend), zap.Error(err))
+			return err
+		}
+		defer sender.Close()
+	}
+	var results []batchResult
+	// Each file is prepared while the one before it is sent, so the next
+	// send starts right after
+	var next <-chan *preparedFile
+	if queueURL == "" && len(sources) > 0 {
+		next = prepareAhead(sources[0])
+	}
+	for i, source := range sources {
+		zap.L().Info("sending file", zap.String("file", source), zap.Int("number", i+1), zap.Int("files", len(sources)))
+		result := batchResult{source: source}
+		if queueURL != "" {
+			result.detail, result.err = queueFile(source)
+		} else {
+			prepared := <-next
+			if i+1 < len(sources) {
+				next = prepareAhead(sources[i+1])
+			}
+			result.detail, result.err = sendPrepared(sender, source, prepared)
+		}
+		results = append(results, result)
+	}
+	failed := 0
+	w := tabwriter.NewWriter(resultOutput(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tRESULT\tDETAIL")
+	for _, result := range results {
+		status := "ok"
+		if result.err != nil {
+			status = result.err.Error()
+			failed++
+		} else if queueURL != "" {
+			status = "queued"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.source, status, result.detail)
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(sources))
+	}
+	return nil
+}
+
+func sendFile(sender Sender, source string) (string, error) {
+	return sendPrepared(sender, source, prepareFile(source))
+}
+
+// preparedFile is a file of a batch opened and made ready to send, or why
+// it couldn't be.
+type preparedFile struct {
+	input *jobInput
+	// done is called once the file was sent
+	done func()
+	err  error
+}
+
+// prepareFile opens a file and applies the profile, -reorder and -optimize
+// to it. An input of unknown size is spooled for the carbide protocol, so
+// all the reading and changing is done before it is sent.
+func prepareFile(source string) *preparedFile {
+	input, err := openInput(source)
+	if err != nil {
+		return &preparedFile{err: err}
+	}
+	p := &preparedFile{input: input, done: func() {}}
+	profile, hasProfile, err := activeProfile()
+	if err != nil {
+		input.Close()
+		return &preparedFile{err: err}
+	}
+	pauseFlags(&profile)
+	switch {
+	case rawSend:
+		zap.L().Debug("sending the file raw, the profile's changes are not applied", zap.String("file", input.name))
+	case hasProfile:
+		applyProfile(input, profile)
+	default:
+		applyPauses(input, profile)
+	}
+	if reorderRapids {
+		var reorderProfile *machineProfile
+		if hasProfile {
+			reorderProfile = &profile
+		}
+		if _, err := applyReorder(input, reorderProfile); err != nil {
+			input.Close()
+			return &preparedFile{err: err}
+		}
+	}
+	if optimizeMoves {
+		p.done = applyOptimizer(input).report
+	}
+	readMetadata(input)
+	if backend == "carbide" {
+		if err := spoolInput(input); err != nil {
+			return &preparedFile{err: err}
+		}
+	}
+	return p
+}
+
+// prepareAhead prepares a file in the background, while the one before it
+// is sent.
+func prepareAhead(source string) <-chan *preparedFile {
+	prepared := make(chan *preparedFile, 1)
+	go func() {
+		prepared <- prepareFile(source)
+	}()
+	return prepared
+}
+
+// sendPrepared sends a prepared file and records it in the history.
+func sendPrepared(sender Sender, source string, p *preparedFile) (string, error) {
+	if p.err != nil {
+		return "", p.err
+	}
+	input := p.input
+	defer func() {
+		input.Close()
+	}()
+	defer p.done()
+	if err := confirmLargeJob(input); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	err := sender.Send(input.name, input, input.size)
+	recordSend(machineName, sender.Target(), source, input, err)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s in %v", formatByteSize(input.size), time.Since(start).Round(time.Millisecond)), nil
+}
+
+// queueFile submits a file to the job queue of a send-carbide daemon and
+// returns the job ID.
+func queueFile(source string) (string, error) {
+	input, err := openInput(source)
+	if err != nil {
+		return "", err
+	}
+	defer input.Close()
+	return queueInput(input)
+}
+
+// queueInput submits an open job to the job queue of a send-carbide daemon
+// and returns the job ID.
+func queueInput(input *jobInput) (string, error) {
+	query := url.Values{"name": {filepath.Base(input.name)}}
+	// Without a machine, the daemon routes the job by its name and tags
+	if machineName != "" {
+		query.Set("machine", machineName)
+	}
+	if queueTags != "" {
+		query.Set("tag", queueTags)
+	}
+	if queuePriority != 0 {
+		query.Set("priority", strconv.Itoa(queuePriority))
+	}
+	if queueAfter != "" {
+		// Times of day are meant on this computer's clock
+		after, err := parseStartTime(queueAfter, time.Now())
+		if err != nil {
+			return "", err
+		}
+		query.Set("after", after.Format(time.RFC3339))
+	}
+	if queueHold {
+		query.Set("hold", "true")
+	}
+	if queueTTL > 0 {
+		query.Set("ttl", queueTTL.String())
+	}
+	endpoint := strings.TrimSuffix(queueURL, "/") + "/jobs?" + query.Encode()
+	req, err := newAPIRequest(http.MethodPost, endpoint, input)
+	if err != nil {
+		return "", err
+	}
+	if input.size >= 0 {
+		req.ContentLength = input.size
+	}
+	resp, err := inputClient.Do(req)
+	if err != nil {
+		zap.L().Error("failed to submit job", zap.String("queue", queueURL), zap.Error(err))
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		var apiErr apiError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return "", fmt.Errorf("queue rejected job: %s %s", resp.Status, apiErr.Error)
+	}
+	var j job
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		return "", err
+	}
+	return "job " + j.ID, nil
+}
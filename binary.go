@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+var errBinaryInput = errors.New("the file is not text, refusing to send it (use -allow-binary to send it anyway)")
+
+// allowBinary sends inputs that look binary instead of refusing them.
+var allowBinary bool
+
+// binarySniffSize is how much of the job is looked at to tell binary from
+// text. Gcode writers don't put control characters anywhere, so the start
+// is telling.
+const binarySniffSize = 8 << 10
+
+// checkBinary refuses inputs with NUL bytes or control characters besides
+// the whitespace of text files, such as images, archives in formats that
+// aren't unpacked, or a wrong file picked by a pattern, instead of
+// streaming them to the machine. It runs after transcodeInput, so UTF-16
+// jobs, which are full of NUL bytes, have been converted by then.
+func checkBinary(in *jobInput) (*jobInput, error) {
+	r := bufio.NewReaderSize(in, binarySniffSize)
+	head, _ := r.Peek(binarySniffSize)
+	checked := &jobInput{ReadCloser: &multiCloser{Reader: r, closers: []io.Closer{in}}, name: in.name, size: in.size, path: in.path}
+	offset := binaryOffset(head)
+	if offset < 0 {
+		return checked, nil
+	}
+	line := bytes.Count(head[:offset], []byte{'\n'}) + 1
+	if allowBinary {
+		zap.L().Warn("the file is not text, sending it anyway", zap.String("file", in.name), zap.Int("offset", offset), zap.Int("line", line))
+		return checked, nil
+	}
+	checked.Close()
+	zap.L().Error("the file is not text, check that it is the gcode exported for the job", zap.String("file", in.name), zap.Int("offset", offset), zap.Int("line", line), zap.String("byte", fmt.Sprintf("%#02x", head[offset])))
+	return nil, fmt.Errorf("%w: %s has byte %#02x at offset %d (line %d)", errBinaryInput, in.name, head[offset], offset, line)
+}
+
+// binaryOffset returns the offset of the first byte in b that doesn't
+// belong in a text file, or -1. Tabs, line ends, form feeds and the DOS end
+// of file marker some old tools append are text.
+func binaryOffset(b []byte) int {
+	for i, c := range b {
+		switch {
+		case c == '\t', c == '\n', c == '\v', c == '\f', c == '\r', c == 0x1a:
+		case c < ' ', c == 0x7f:
+			return i
+		}
+	}
+	return -1
+}
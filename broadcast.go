@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// broadcastResult is the outcome of sending the file to one machine.
+type broadcastResult struct {
+	machine  string
+	target   string
+	err      error
+	duration time.Duration
+}
+
+// runBroadcast sends the input file to several machines in parallel and
+// prints a summary. Every machine is looked up before anything is sent so
+// that a typo does not leave the fleet half started.
+func runBroadcast(names []string, input *jobInput) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	senders := make([]*carbideSender, len(names))
+	for i, name := range names {
+		m, err := cfg.machine(name)
+		if err != nil {
+			zap.L().Error("Could not find machine in config", zap.String("machine", name), zap.String("config", configPath))
+			return err
+		}
+		if senders[i], err = newCarbideSenderFor(m.addresses()); err != nil {
+			zap.L().Error("failed to resolve machine", zap.String("machine", name), zap.Error(err))
+			return err
+		}
+	}
+	// Every machine reads its own copy, so remote inputs are fetched once
+	path, err := localCopy(input)
+	if err != nil {
+		return err
+	}
+	zap.L().Info("broadcasting gcode file", zap.String("file", inputFile), zap.Strings("machines", names))
+	results := make([]broadcastResult, len(names))
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = broadcastTo(names[i], senders[i], path, input)
+		}(i)
+	}
+	wg.Wait()
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MACHINE\tADDRESS\tRESULT\tTIME")
+	for _, result := range results {
+		status := "ok"
+		if result.err != nil {
+			status = result.err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.machine, result.target, status, result.duration.Round(time.Millisecond))
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d machines failed", failed, len(names))
+	}
+	return nil
+}
+
+func broadcastTo(name string, sender *carbideSender, path string, input *jobInput) broadcastResult {
+	log := zap.L().With(zap.String("machine", name))
+	start := time.Now()
+	result := broadcastResult{machine: name}
+	f, err := os.Open(path)
+	if err == nil {
+		log.Info("sending")
+		err = sender.Send(input.name, f, input.size)
+		f.Close()
+	}
+	result.duration = time.Since(start)
+	result.target = sender.Target()
+	result.err = err
+	if err != nil {
+		log.Error("send failed", zap.Error(err))
+	} else {
+		log.Info("sent", zap.Duration("duration", result.duration))
+	}
+	recordSend(name, result.target, inputFile, input, err)
+	return result
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var errProjectFile = errors.New("Carbide Create project files cannot be sent, export the toolpaths as gcode first")
+
+// sqliteHeader starts the .c2d files of current Carbide Create versions,
+// older versions wrote JSON.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// checkProjectFile refuses Carbide Create projects, which hold the design
+// but not the gcode, instead of streaming them to the machine. It looks at
+// the extension and the content, since projects are easily renamed.
+func checkProjectFile(in *jobInput) (*jobInput, error) {
+	r := bufio.NewReader(in)
+	head, _ := r.Peek(512)
+	isProject := strings.EqualFold(filepath.Ext(in.name), ".c2d") ||
+		bytes.HasPrefix(head, sqliteHeader) ||
+		looksLikeC2DJSON(head)
+	if !isProject {
+		return &jobInput{ReadCloser: &multiCloser{Reader: r, closers: []io.Closer{in}}, name: in.name, size: in.size, path: in.path}, nil
+	}
+	in.Close()
+	if companions := companionGcode(in.name); len(companions) > 0 {
+		zap.L().Error("this is a Carbide Create project, send its exported gcode instead", zap.String("file", in.name), zap.Strings("gcode", companions))
+		return nil, fmt.Errorf("%w: found %s", errProjectFile, strings.Join(companions, ", "))
+	}
+	zap.L().Error("this is a Carbide Create project, export the toolpaths as gcode in Carbide Create and send that file", zap.String("file", in.name))
+	return nil, errProjectFile
+}
+
+func looksLikeC2DJSON(head []byte) bool {
+	trimmed := bytes.TrimSpace(head)
+	if !bytes.HasPrefix(trimmed, []byte("{")) {
+		return false
+	}
+	for _, key := range []string{`"toolpaths"`, `"TOOLPATH_OBJECTS"`, `"GRID_STEP"`, `"version_major"`, `"DOCUMENT_MAT`} {
+		if bytes.Contains(head, []byte(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// companionGcode lists gcode files exported next to a local project, which
+// share its base name.
+func companionGcode(project string) []string {
+	if _, err := os.Stat(project); err != nil {
+		return nil
+	}
+	base := strings.TrimSuffix(project, filepath.Ext(project))
+	var found []string
+	for _, ext := range gcodeExtensions {
+		if ext == ".txt" {
+			continue
+		}
+		for _, candidate := range []string{base + ext, base + strings.ToUpper(ext)} {
+			if candidate == project {
+				continue
+			}
+			if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+				found = append(found, candidate)
+				break
+			}
+		}
+	}
+	return found
+}
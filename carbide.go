@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+var waitTimeout time.Duration
+var pollInterval time.Duration
+var allowedStates string
+var heartbeatInterval time.Duration
+var maxRate byteSize
+var chunkSize byteSize
+var chunkTimeout time.Duration
+var ackTimeout time.Duration
+var stallTimeout time.Duration
+
+// carbideSender sends jobs to Carbide Motion's remote access port.
+type carbideSender struct {
+	dialers   []*dialer
+	addresses string
+	connected *dialer
+	phases    *sendPhases
+	// keep leaves the connection open for the next send, like -keep-open
+	keep bool
+	// states are the machine states that permit sending, -allow-state
+	// when empty
+	states string
+	// lines counts the lines of the last send the connection took
+	lines *lineWriter
+}
+
+func newCarbideSender(cfg backendConfig) (Sender, error) {
+	c, err := newCarbideSenderFor(cfg.addresses)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newCarbideSenderFor creates a sender for an explicit list of addresses.
+func newCarbideSenderFor(addresses []string) (*carbideSender, error) {
+	dialers, err := dialersFor(addresses)
+	if err != nil {
+		return nil, err
+	}
+	return &carbideSender{dialers: dialers, addresses: strings.Join(addresses, ",")}, nil
+}
+
+// Target is the address that accepted the job, or the configured list
+// before a connection was made.
+func (c *carbideSender) Target() string {
+	if c.connected != nil {
+		return c.connected.String()
+	}
+	return c.addresses
+}
+
+func (c *carbideSender) Close() error {
+	return nil
+}
+
+// SentLines is how many lines of the last send were written to the
+// connection, -1 when it failed before the file. Carbide Motion doesn't
+// acknowledge lines, so some of them may still have been in the socket
+// buffers when it failed.
+func (c *carbideSender) SentLines() (int64, bool) {
+	if c.lines == nil {
+		return -1, false
+	}
+	return c.lines.lines, false
+}
+
+// Phases is how long the steps of the last send took, or nil before one
+// connected.
+func (c *carbideSender) Phases() *sendPhases {
+	return c.phases
+}
+
+func (c *carbideSender) Send(name string, input io.Reader, size int64) (err error) {
+	targets := make([]string, len(c.dialers))
+	for i, d := range c.dialers {
+		targets[i] = d.String()
+	}
+	c.lines = nil
+	lock, err := lockMachine(targets)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	states := c.states
+	if states == "" {
+		states = allowedStates
+	}
+	conn, r, state, d := reuseConnection(c.dialers, states)
+	if conn == nil {
+		if conn, r, state, d, err = connectReady(c.dialers, states); err != nil {
+			return err
+		}
+	}
+	c.connected = d
+	defer func() {
+		releaseConnection(conn, r, d, c.keep || keepOpen, err)
+		saveTrace(conn, err)
+	}()
+	if err := checkReceiverSpace(conn, r, d, size); err != nil {
+		return err
+	}
+	phases := &sendPhases{Dial: d.dialTime.Seconds(), Handshake: d.handshakeTime.Seconds()}
+	c.phases = phases
+	start := time.Now()
+	// lap returns the seconds since the previous phase ended
+	lap := func() float64 {
+		now := time.Now()
+		elapsed := now.Sub(start).Seconds()
+		start = now
+		return elapsed
+	}
+	// Write header
+	header := framing.Header(name, size)
+	c.lines = &lineWriter{w: carbide.NewStallWriter(conn, stallTimeout, len(header)), header: int64(len(header)), size: size}
+	w := bufio.NewWriterSize(c.lines, int(writeBufferSize))
+	zap.L().Debug("sending header", zap.String("header", header))
+	if _, err := w.Write([]byte(header)); err != nil {
+		zap.L().Error("failed sending header", zap.Error(err))
+		return &carbide.ConnectionError{Address: d.String(), Op: "send header to", Err: err}
+	}
+	emitEvent(sendEvent{Event: eventHeaderSent, Name: name, Size: size})
+	// Write GCode
+	zap.L().Debug("sending gcode", zap.Int64("size", size))
+	out := newProgressEvents(w, size)
+	if maxRate > 0 {
+		zap.L().Debug("limiting send rate", zap.String("rate", maxRate.String()+"/s"))
+		out = newRateLimitedWriter(out, int64(maxRate))
+	}
+	body, release := jobBody(input, size)
+	defer release()
+	verify := negotiateVerify(d.caps)
+	sum := crc32.NewIEEE()
+	if verify {
+		body = io.TeeReader(body, sum)
+	}
+	var n int64
+	chunked := chunkSize > 0
+	if chunked && !d.caps.Supports(carbide.FeatureChunks) {
+		zap.L().Warn("receiver does not announce chunk acks, sending the file in one piece", zap.String("address", d.String()), zap.Stringer("features", d.caps))
+		chunked = false
+	}
+	if chunked {
+		n, err = sendChunked(conn, out, w, r, body, size, int64(chunkSize), chunkTimeout)
+	} else {
+		n, err = io.Copy(out, body)
+	}
+	if err != nil {
+		zap.L().Error("failed sending file over connection", zap.Error(err), zap.Int64("size", size))
+		return &carbide.ConnectionError{Address: d.String(), Op: "send file to", Err: err}
+	}
+	zap.L().Debug("sent gcode", zap.Int64("size", n))
+	phases.Transfer = lap()
+	// Sent termination signal
+	if err := w.WriteByte(framing.End()); err != nil {
+		zap.L().Error("failed sending termination signal", zap.Error(err))
+		return &carbide.ConnectionError{Address: d.String(), Op: "send file to", Err: err}
+	}
+	// Flush connection
+	zap.L().Debug("flushing")
+	if err := w.Flush(); err != nil {
+		zap.L().Error("failed flushing connection", zap.Error(err))
+		return &carbide.ConnectionError{Address: d.String(), Op: "send file to", Err: err}
+	}
+	phases.Flush = lap()
+	emitEvent(sendEvent{Event: eventFlushed, Bytes: n})
+	// Wait for ACK
+	err = waitAck(conn, r, d, state)
+	phases.Ack = lap()
+	if err != nil {
+		return err
+	}
+	emitEvent(sendEvent{Event: eventAcked, Seconds: phases.Ack})
+	if verify {
+		err = verifyTransfer(conn, r, n, sum.Sum32())
+		phases.Verify = lap()
+	}
+	zap.L().Info("send phases", zap.Stringer("phases", phases))
+	return err
+}
+
+// negotiateVerify reports whether to verify the transfer: when -verify asks
+// for it and the receiver may support it, or whenever the receiver
+// announces that it does.
+func negotiateVerify(caps carbide.Capabilities) bool {
+	if caps.Has(carbide.FeatureVerify) {
+		return true
+	}
+	if verifySend && !caps.Supports(carbide.FeatureVerify) {
+		zap.L().Warn("receiver does not announce verification, the transfer is not verified", zap.Stringer("features", caps))
+		return false
+	}
+	return verifySend
+}
+
+// waitAck waits up to -ack-timeout for the machine to acknowledge the file.
+// When it doesn't, the error tells a receiver that is still busy with the
+// file (connection open) from one that went away (connection closed).
+func waitAck(conn net.Conn, r *bufio.Reader, d *dialer, state carbide.State) error {
+	start := time.Now()
+	if ackTimeout > 0 {
+		conn.SetReadDeadline(start.Add(ackTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	stopHeartbeat := startHeartbeat(conn, heartbeatInterval)
+	msg, err := readMessage(r)
+	stopHeartbeat()
+	waited := time.Since(start).Round(time.Millisecond)
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		zap.L().Error("timed out waiting for ack, the connection is still open so the machine may still be processing the file",
+			zap.Duration("waited", waited), zap.Stringer("last_state", state))
+		return fmt.Errorf("%w after %v: connection still open, nothing received, last state %q", carbide.ErrAckTimeout, waited, state)
+	case err != nil:
+		zap.L().Error("connection lost while waiting for ack, the receiver closed it or crashed",
+			zap.Duration("waited", waited), zap.Stringer("last_state", state), zap.Error(err))
+		err = &carbide.ConnectionError{Address: d.String(), Op: "wait for ack from", Err: err}
+		return fmt.Errorf("%w: connection closed after %v, last state %q", err, waited, state)
+	case carbide.ParseReceiverError(msg) != nil:
+		rerr := carbide.ParseReceiverError(msg)
+		zap.L().Error("receiver rejected the file instead of acknowledging it", zap.String("reason", string(rerr.Reason)), zap.String("message", msg),
+			zap.String("suggestion", rerr.Suggestion()), zap.Duration("waited", waited), zap.Stringer("last_state", state))
+		return fmt.Errorf("%w, last state %q", rerr, state)
+	case carbide.ParseMachineError(msg) != nil:
+		merr := carbide.ParseMachineError(msg)
+		zap.L().Error("machine reported a failure instead of the ack", zap.String("cause", merr.Cause()), zap.String("suggestion", merr.Suggestion()),
+			zap.Duration("waited", waited), zap.Stringer("last_state", state))
+		return fmt.Errorf("%w, last state %q", merr, state)
+	case msg != framing.AckMessage():
+		zap.L().Error("did not receive ack", zap.String("message", msg), zap.Duration("waited", waited), zap.Stringer("last_state", state))
+		err = &carbide.ProtocolError{Reason: "did not receive ack", Message: msg}
+		return fmt.Errorf("%w, last state %q", err, state)
+	}
+	zap.L().Debug("received ack", zap.Duration("waited", waited))
+	return nil
+}
+
+// connectReady dials the machine addresses in order and returns the first
+// connection that is ready to receive, in one of states. When waiting is
+// enabled it keeps polling until a machine reports an allowed state or the
+// wait timeout expires.
+func connectReady(dialers []*dialer, states string) (net.Conn, *bufio.Reader, carbide.State, *dialer, error) {
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		var state carbide.State
+		var err error
+		for _, d := range dialers {
+			var conn net.Conn
+			var r *bufio.Reader
+			conn, r, state, err = dialState(d)
+			if err == nil {
+				if isAllowedState(state, states) {
+					return conn, r, state, d, nil
+				}
+				conn.Close()
+				zap.L().Debug("machine not ready", zap.String("address", d.String()), zap.Stringer("state", state))
+				err = fmt.Errorf("%w: %s is %s", carbide.ErrNotReady, d, state)
+				saveTrace(conn, err)
+			}
+		}
+		if waitTimeout <= 0 {
+			if errors.Is(err, carbide.ErrNotReady) {
+				zap.L().Error("cannot start in current state", zap.Stringer("state", state), zap.String("allowed", states))
+			}
+			return nil, nil, "", nil, err
+		}
+		if time.Now().Add(pollInterval).After(deadline) {
+			zap.L().Error("timed out waiting for machine to become ready", zap.Stringer("state", state), zap.Duration("wait", waitTimeout))
+			return nil, nil, "", nil, err
+		}
+		zap.L().Info("machine not ready, waiting", zap.Stringer("state", state), zap.Duration("retry_in", pollInterval))
+		time.Sleep(pollInterval)
+	}
+}
+
+// isAllowedState reports whether the machine may receive a file while in
+// state, one of the comma separated states.
+func isAllowedState(state carbide.State, states string) bool {
+	return state.In(carbide.ParseStates(states))
+}
+
+// dialState connects to the machine and reads its initial state message.
+func dialState(d *dialer) (net.Conn, *bufio.Reader, carbide.State, error) {
+	zap.L().Debug("connecting", zap.String("address", d.String()))
+	start := time.Now()
+	conn, err := d.dial()
+	d.dialTime = time.Since(start)
+	if err != nil {
+		zap.L().Error("failed to connect to server", zap.String("address", d.String()), zap.Error(err))
+		return nil, nil, "", &carbide.ConnectionError{Address: d.String(), Op: "connect to", Err: err}
+	}
+	conn = newTracedConn(conn, d.String())
+	r := newConnReader(conn)
+	zap.L().Debug("connected")
+	emitEvent(sendEvent{Event: eventConnected, Target: d.String()})
+	// A receiver that accepts but never announces its state must not block
+	// failover to the next address.
+	if connectTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	}
+	start = time.Now()
+	msg, err := readMessage(r)
+	var state carbide.State
+	if err == nil {
+		state, err = parseState(msg)
+	}
+	d.handshakeTime = time.Since(start)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		if !errors.Is(err, carbide.ErrProtocol) && !errors.Is(err, carbide.ErrMachine) {
+			err = &carbide.ConnectionError{Address: d.String(), Op: "read state from", Err: err}
+		}
+		return nil, nil, "", err
+	}
+	d.caps = carbide.ParseCapabilities(msg)
+	zap.L().Debug("received state", zap.Stringer("state", state), zap.String("version", d.caps.Version), zap.Stringer("features", d.caps))
+	emitEvent(sendEvent{Event: eventState, Target: d.String(), State: state})
+	return conn, r, state, nil
+}
+
+const abortRequest = "ABORT\n"
+const pauseRequest = "PAUSE\n"
+const resumeRequest = "RESUME\n"
+const homeRequest = "HOME\n"
+const estopRequest = "ESTOP\n"
+
+// requestFeatures are the features receivers announce for requests, which
+// aren't sent to receivers that announce features without them.
+var requestFeatures = map[string]string{abortRequest: carbide.FeatureAbort}
+
+// State connects to the machine and returns the state it reports.
+func (c *carbideSender) State() (carbide.State, error) {
+	conn, _, state, d, err := dialAny(c.dialers)
+	if err != nil {
+		return "", err
+	}
+	c.connected = d
+	conn.Close()
+	return state, nil
+}
+
+// Abort asks the receiver to discard the file it is receiving or has
+// queued. Receivers that support it answer ABORT_ACK.
+func (c *carbideSender) Abort() error {
+	_, err := c.request(abortRequest, "ABORT_ACK")
+	return err
+}
+
+// EStop asks the receiver to halt the machine at once. Receivers that
+// support it answer ESTOP_ACK once the controller has stopped.
+func (c *carbideSender) EStop() error {
+	_, err := c.request(estopRequest, "ESTOP_ACK")
+	return err
+}
+
+// Pause asks the receiver to hold the running job.
+func (c *carbideSender) Pause() error {
+	_, err := c.request(pauseRequest, "PAUSE_ACK")
+	return err
+}
+
+// Resume asks the receiver to continue a held job.
+func (c *carbideSender) Resume() error {
+	_, err := c.request(resumeRequest, "RESUME_ACK")
+	return err
+}
+
+// Home asks the receiver to run the homing cycle. It answers HOME_ACK once
+// the cycle has finished, so the answer may take as long as -timeout.
+func (c *carbideSender) Home() error {
+	_, err := c.request(homeRequest, "HOME_ACK")
+	return err
+}
+
+// request sends a control message on a new connection and waits for the
+// expected answer, returning whatever the machine added after it. Receivers
+// without the request ignore it or hang up, which is reported as
+// errUnsupported.
+func (c *carbideSender) request(message, answer string) (string, error) {
+	conn, r, state, d, err := dialAny(c.dialers)
+	if err != nil {
+		return "", err
+	}
+	c.connected = d
+	defer conn.Close()
+	request := strings.TrimSpace(message)
+	if feature, ok := requestFeatures[message]; ok && !d.caps.Supports(feature) {
+		zap.L().Error("receiver does not announce the request", zap.String("request", request), zap.Stringer("features", d.caps))
+		return "", fmt.Errorf("%w by the receiver at %s: %s", errUnsupported, d, request)
+	}
+	zap.L().Debug("sending request", zap.String("request", request), zap.Stringer("state", state))
+	if _, err := conn.Write(framed(message)); err != nil {
+		zap.L().Error("failed sending request", zap.String("request", request), zap.Error(err))
+		return "", &carbide.ConnectionError{Address: d.String(), Op: "send request to", Err: err}
+	}
+	if controlTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(controlTimeout))
+	}
+	msg, err := readMessage(r)
+	var netErr net.Error
+	switch {
+	case err == io.EOF || (errors.As(err, &netErr) && netErr.Timeout()):
+		zap.L().Error("receiver did not answer, it probably does not support the request", zap.String("request", request), zap.String("address", d.String()))
+		return "", fmt.Errorf("%w by the receiver at %s: %s", errUnsupported, d, request)
+	case err != nil:
+		return "", &carbide.ConnectionError{Address: d.String(), Op: "wait for answer from", Err: err}
+	case carbide.ParseMachineError(msg) != nil:
+		merr := carbide.ParseMachineError(msg)
+		zap.L().Error("machine refused the request", zap.String("request", request), zap.String("cause", merr.Cause()), zap.String("suggestion", merr.Suggestion()))
+		return "", merr
+	case msg != answer && !strings.HasPrefix(msg, answer+" "):
+		zap.L().Error("machine refused the request", zap.String("request", request), zap.String("answer", msg))
+		return "", fmt.Errorf("%w: %s", errRequestRefused, msg)
+	}
+	zap.L().Debug("request acknowledged", zap.String("request", request), zap.String("answer", msg))
+	return strings.TrimSpace(strings.TrimPrefix(msg, answer)), nil
+}
+
+// Override asks the receiver to change an override, as "OVERRIDE FEED +10"
+// or "OVERRIDE RAPID 50". Receivers that support it answer "OVERRIDE_ACK"
+// followed by the feed, rapid and spindle levels.
+func (c *carbideSender) Override(change overrideChange) (overrides, error) {
+	value := strconv.Itoa(change.percent)
+	if change.relative {
+		value = fmt.Sprintf("%+d", change.percent)
+	}
+	levels, err := c.request("OVERRIDE "+strings.ToUpper(change.kind)+" "+value+"\n", "OVERRIDE_ACK")
+	if err != nil {
+		return overrides{}, err
+	}
+	o, err := parseOverrideLevels(levels)
+	if err != nil {
+		zap.L().Error("invalid override answer", zap.String("answer", levels))
+		return overrides{}, &carbide.ProtocolError{Reason: "invalid override levels", Message: levels}
+	}
+	return o, nil
+}
+
+// Gcode asks the receiver to run a single line of gcode. Receivers that
+// support it answer "MDI_ACK" followed by the controller's response.
+func (c *carbideSender) Gcode(line string) (string, error) {
+	return c.request("MDI "+line+"\n", "MDI_ACK")
+}
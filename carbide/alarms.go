@@ -0,0 +1,148 @@
+package carbide
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrMachine means the controller reported an error or an alarm instead of
+// doing what was asked.
+var ErrMachine = errors.New("machine reported a failure")
+
+// MachineError is an error or alarm reported by the controller, either
+// forwarded by Carbide Motion as "ERROR: ..." and "ALARM: ..." messages or
+// straight from GRBL as "error:20" and "ALARM:1". It matches ErrMachine.
+type MachineError struct {
+	// Alarm is true for alarms, which lock the machine until they are
+	// cleared, and false for errors, which only reject a command.
+	Alarm bool
+	// Code is the GRBL code, or 0 when the message has none.
+	Code int
+	// Text is what the controller said besides the code.
+	Text string
+}
+
+type machineCode struct {
+	cause      string
+	suggestion string
+}
+
+// grblAlarms are the GRBL 1.1 alarm codes.
+var grblAlarms = map[int]machineCode{
+	1:  {"hard limit triggered", "the machine position is likely lost; check what hit the limit switch, then unlock and home again"},
+	2:  {"motion target exceeds machine travel", "the job goes past the soft limits; check the work offset and the size of the job, then unlock"},
+	3:  {"reset while in motion", "steps may have been lost; home again before continuing"},
+	4:  {"probe was already triggered before probing", "check the probe wiring and that the probe is not touching, use the probe continuity test"},
+	5:  {"probe did not touch within the programmed travel", "move the tool closer to the probe, or check the probe clip is attached"},
+	6:  {"homing cycle was reset", "run the homing cycle again"},
+	7:  {"safety door opened while homing", "close the door and home again"},
+	8:  {"homing failed to clear the limit switch when pulling off", "check the limit switch wiring, or increase the homing pull-off ($27)"},
+	9:  {"homing could not find the limit switch", "check the limit switches and their wiring, then home again"},
+	10: {"homing could not find the second limit switch to square the gantry", "check the limit switches of both sides of the gantry"},
+}
+
+// grblErrors are the GRBL 1.1 error codes.
+var grblErrors = map[int]machineCode{
+	1:  {"expected a command letter", "check the gcode for stray characters"},
+	2:  {"bad number format", "check the gcode for a malformed or missing value"},
+	3:  {"invalid $ command", ""},
+	4:  {"negative value where a positive one is expected", ""},
+	5:  {"homing is not enabled", "enable homing ($22=1) if the machine has limit switches"},
+	7:  {"settings could not be read and were reset to defaults", "check the machine settings before running a job"},
+	8:  {"$ command only valid when idle", "wait for the job to finish or stop it first"},
+	9:  {"gcode locked out during alarm or jog", "clear the alarm by homing or unlocking ($X) first"},
+	10: {"soft limits need homing to be enabled", ""},
+	11: {"line too long", "check the post-processor, lines must be shorter than 80 characters"},
+	13: {"safety door open", "close the door and resume"},
+	15: {"jog target exceeds machine travel", ""},
+	16: {"invalid jog command", ""},
+	20: {"unsupported or invalid gcode command", "check the post-processor matches the machine"},
+	21: {"more than one command of the same modal group in a block", "check the post-processor matches the machine"},
+	22: {"feed rate not set", "add an F word before the first feed move"},
+	23: {"command needs an integer value", ""},
+	24: {"two commands in a block need the axis words", ""},
+	25: {"repeated word in a block", ""},
+	26: {"command needs axis words but none were given", ""},
+	27: {"line number out of range", ""},
+	28: {"command is missing a required P or L value", ""},
+	29: {"unsupported work coordinate system", "use G54 to G59"},
+	30: {"G53 needs G0 or G1 motion", ""},
+	31: {"axis words while motion is cancelled with G80", ""},
+	32: {"arc without axis words in the selected plane", ""},
+	33: {"invalid motion target", "check the arc or probe move targets"},
+	34: {"arc radius error", "check the post-processor's arc output, or disable arcs in the CAM"},
+	35: {"arc missing its IJK offset in the selected plane", ""},
+	36: {"unused words in a block", "check the post-processor matches the machine"},
+	37: {"tool length offset on an axis other than Z", ""},
+	38: {"tool number too large", ""},
+}
+
+func (e *MachineError) code() machineCode {
+	if e.Alarm {
+		return grblAlarms[e.Code]
+	}
+	return grblErrors[e.Code]
+}
+
+// Cause is a description of the failure, from the code when it is known or
+// the text the controller sent otherwise.
+func (e *MachineError) Cause() string {
+	if cause := e.code().cause; cause != "" {
+		return cause
+	}
+	return e.Text
+}
+
+// Suggestion is what to do about the failure, or empty when there is no
+// advice for it.
+func (e *MachineError) Suggestion() string {
+	return e.code().suggestion
+}
+
+func (e *MachineError) Error() string {
+	kind := "error"
+	if e.Alarm {
+		kind = "alarm"
+	}
+	if e.Code != 0 {
+		kind = fmt.Sprintf("%s %d", kind, e.Code)
+	}
+	if cause := e.Cause(); cause != "" {
+		return kind + ": " + cause
+	}
+	return kind
+}
+
+func (e *MachineError) Is(target error) bool {
+	return target == ErrMachine
+}
+
+// ParseMachineError parses an error or alarm message from the controller.
+// It returns nil for any other message.
+func ParseMachineError(msg string) *MachineError {
+	msg = strings.TrimSpace(msg)
+	i := strings.IndexByte(msg, ':')
+	if i < 0 {
+		return nil
+	}
+	e := &MachineError{}
+	switch strings.ToUpper(msg[:i]) {
+	case "ALARM":
+		e.Alarm = true
+	case "ERROR":
+	default:
+		return nil
+	}
+	text := strings.TrimSpace(msg[i+1:])
+	fields := strings.Fields(text)
+	if len(fields) > 0 {
+		if code, err := strconv.Atoi(fields[0]); err == nil {
+			e.Code = code
+			text = strings.TrimSpace(strings.TrimPrefix(text, fields[0]))
+		}
+	}
+	e.Text = text
+	return e
+}
@@ -0,0 +1,86 @@
+package carbide
+
+import "strings"
+
+// Optional protocol features a receiver may announce.
+const (
+	// FeatureVerify is the VERIFY exchange after the ack
+	FeatureVerify = "verify"
+	// FeatureChunks is acknowledging each chunk of a chunked send
+	FeatureChunks = "chunks"
+	// FeatureAbort is the ABORT request
+	FeatureAbort = "abort"
+	// FeatureInfo is the INFO request
+	FeatureInfo = "info"
+	// FeatureSession is taking further files on the connection after an
+	// ack, and answering the STATE request between them
+	FeatureSession = "session"
+)
+
+// Capabilities are what a receiver announces about itself after the state
+// in its first message, as key=value tokens like the INFO answer:
+//
+//	STATE: init version=1.2 features=verify,chunks,abort,info
+//
+// Carbide Motion announces nothing, so what it supports is unknown and
+// has to be tried.
+type Capabilities struct {
+	// Announced is whether the receiver listed its features, even none.
+	Announced bool
+	Version   string
+	Features  []string
+}
+
+// ParseCapabilities reads the capabilities from a state message. Messages
+// without them return the zero Capabilities.
+func ParseCapabilities(statusLine string) Capabilities {
+	var c Capabilities
+	i := strings.IndexByte(statusLine, ':')
+	if i < 0 {
+		return c
+	}
+	for _, token := range strings.Fields(statusLine[i+1:]) {
+		parts := strings.SplitN(token, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.ToLower(parts[0]) {
+		case "version":
+			c.Version = parts[1]
+		case "features":
+			c.Announced = true
+			for _, feature := range strings.Split(parts[1], ",") {
+				if feature = strings.ToLower(strings.TrimSpace(feature)); feature != "" {
+					c.Features = append(c.Features, feature)
+				}
+			}
+		}
+	}
+	return c
+}
+
+// Has reports whether the receiver announced feature.
+func (c Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Supports reports whether feature is worth trying: the receiver announced
+// it, or announced nothing.
+func (c Capabilities) Supports(feature string) bool {
+	return !c.Announced || c.Has(feature)
+}
+
+func (c Capabilities) String() string {
+	if !c.Announced {
+		return "unknown"
+	}
+	if len(c.Features) == 0 {
+		return "none"
+	}
+	return strings.Join(c.Features, ",")
+}
@@ -0,0 +1,270 @@
+package carbide
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Port is Carbide Motion's remote access port.
+const Port = "6280"
+
+// DefaultAllowedStates are the states a Client sends in when
+// AllowedStates is empty.
+var DefaultAllowedStates = []State{StateInit}
+
+// streamMemoryLimit is how much of an input of unknown size SendStream
+// keeps in memory before spooling it to a temporary file.
+const streamMemoryLimit = 1 << 20
+
+// Client sends jobs to a machine's remote access port. The zero value is
+// not usable, Address must be set.
+type Client struct {
+	// Address is the machine's host, with Port when it has no port.
+	Address string
+	// AllowedStates are the machine states a job may be sent in,
+	// DefaultAllowedStates when empty.
+	AllowedStates []State
+	// Messages configures how the machine's messages are read. Its
+	// Logger is Logger when not set.
+	Messages MessageReader
+	// Framing is how files are announced and acknowledged, Carbide
+	// Motion's when zero.
+	Framing Framing
+	// Strict only accepts state messages exactly as Carbide Motion sends
+	// them, see ParseStateStrict, and fails on overlong messages.
+	Strict bool
+	// StallTimeout is how long the machine may take no bytes of a file
+	// before the send fails with a StallError, DefaultStallTimeout when
+	// zero and never when negative.
+	StallTimeout time.Duration
+	Logger       Logger
+}
+
+// NewClient returns a client for the machine at address.
+func NewClient(address string) *Client {
+	return &Client{Address: address}
+}
+
+func (c *Client) target() string {
+	if _, _, err := net.SplitHostPort(c.Address); err == nil {
+		return c.Address
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(c.Address, "["), "]")
+	return net.JoinHostPort(host, Port)
+}
+
+func (c *Client) log() Logger {
+	return orNop(c.Logger)
+}
+
+func (c *Client) readMessage(r *bufio.Reader) (string, error) {
+	m := c.Messages
+	if m.Logger == nil {
+		m.Logger = c.log()
+	}
+	m.Strict = m.Strict || c.Strict
+	if m.Terminator == 0 {
+		m.Terminator = c.Framing.Terminator
+	}
+	return m.Read(r)
+}
+
+func (c *Client) parseState(msg string) (State, error) {
+	if c.Strict {
+		return c.Framing.ParseStateStrict(msg)
+	}
+	return c.Framing.ParseState(msg)
+}
+
+func (c *Client) allowed(state State) bool {
+	if len(c.AllowedStates) == 0 {
+		return state.In(DefaultAllowedStates)
+	}
+	return state.In(c.AllowedStates)
+}
+
+// aLongTimeAgo is a deadline in the past, which interrupts blocked reads
+// and writes.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watch applies the deadline of ctx to conn, and interrupts the reads and
+// writes on conn when ctx is cancelled, until stop is called.
+func watch(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// failed wraps a failure of op on the connection, or the error of ctx
+// when it was cancelled or its deadline passed, which is what made op
+// fail.
+func (c *Client) failed(ctx context.Context, op string, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s %s: %w", op, c.target(), ctx.Err())
+	}
+	return &ConnectionError{Address: c.target(), Op: op, Err: err}
+}
+
+// connect dials the machine and reads the state and capabilities it
+// announces. The connection is watched for ctx until stop is called.
+func (c *Client) connect(ctx context.Context, o *options) (conn net.Conn, r *bufio.Reader, state State, caps Capabilities, stop func(), err error) {
+	address := c.target()
+	c.log().Debug("connecting", "address", address)
+	var d net.Dialer
+	conn, err = d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, nil, StateUnknown, caps, nil, c.failed(ctx, "connect to", err)
+	}
+	stop = watch(ctx, conn)
+	r = bufio.NewReader(conn)
+	msg, err := c.readMessage(r)
+	if err == nil {
+		state, err = c.parseState(msg)
+	} else {
+		err = c.failed(ctx, "read state from", err)
+	}
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, nil, StateUnknown, caps, nil, err
+	}
+	caps = ParseCapabilities(msg)
+	c.log().Debug("received state", "address", address, "state", state, "features", caps.String())
+	o.reportState(state)
+	return conn, r, state, caps, stop, nil
+}
+
+// State connects to the machine and returns the state it reports.
+func (c *Client) State(ctx context.Context, opts ...Option) (State, error) {
+	conn, _, state, _, stop, err := c.connect(ctx, collectOptions(opts))
+	if err != nil {
+		return StateUnknown, err
+	}
+	stop()
+	conn.Close()
+	return state, nil
+}
+
+// SendReader sends size bytes of gcode read from r as a job called name,
+// and waits for the machine to acknowledge it. It fails with ErrNotReady
+// when the machine isn't in one of the allowed states, and does not read r
+// then.
+//
+// Cancelling ctx, or its deadline passing, stops the send wherever it is,
+// connecting, writing or waiting for the ack, and returns the error of
+// ctx. A deadline therefore also bounds how long the machine may take to
+// acknowledge the file.
+func (c *Client) SendReader(ctx context.Context, r io.Reader, name string, size int64, opts ...Option) error {
+	o := collectOptions(opts)
+	conn, br, state, _, stop, err := c.connect(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer stop()
+	return c.send(ctx, conn, br, state, r, name, size, o)
+}
+
+// send sends a file on a connection to a machine in state, and waits for
+// the ack.
+func (c *Client) send(ctx context.Context, conn net.Conn, br *bufio.Reader, state State, r io.Reader, name string, size int64, o *options) error {
+	address := c.target()
+	if !c.allowed(state) {
+		return fmt.Errorf("%w: %s is %s", ErrNotReady, address, state)
+	}
+	header := c.Framing.Header(name, size)
+	stall := c.StallTimeout
+	if stall == 0 {
+		stall = DefaultStallTimeout
+	}
+	sw := NewStallWriter(conn, stall, len(header))
+	sw.Deadline, _ = ctx.Deadline()
+	sw.Context = ctx
+	w := bufio.NewWriter(sw)
+	c.log().Debug("sending header", "header", header)
+	if _, err := w.WriteString(header); err != nil {
+		return c.failed(ctx, "send header to", err)
+	}
+	var out io.Writer = w
+	if o.progress != nil {
+		out = &progressWriter{w: w, total: size, f: o.progress}
+	}
+	n, err := io.Copy(out, io.LimitReader(r, size))
+	if err != nil {
+		return c.failed(ctx, "send file to", err)
+	}
+	if n < size {
+		// The header promised size bytes, the machine would wait for
+		// the rest.
+		return fmt.Errorf("input of %s ended after %d of %d bytes", name, n, size)
+	}
+	if err := w.WriteByte(c.Framing.End()); err != nil {
+		return c.failed(ctx, "send file to", err)
+	}
+	if err := w.Flush(); err != nil {
+		return c.failed(ctx, "send file to", err)
+	}
+	c.log().Debug("sent gcode", "size", n)
+	msg, err := c.readMessage(br)
+	if err != nil {
+		return c.failed(ctx, "wait for ack from", err)
+	}
+	if rerr := ParseReceiverError(msg); rerr != nil {
+		return rerr
+	}
+	if merr := ParseMachineError(msg); merr != nil {
+		return merr
+	}
+	if msg != c.Framing.AckMessage() {
+		return &ProtocolError{Reason: "did not receive ack", Message: msg}
+	}
+	c.log().Debug("received ack", "address", address)
+	return nil
+}
+
+// SendStream sends gcode of unknown size, read from r to the end, as a job
+// called name. The header announces the size before the file, so the
+// input is buffered first: in memory up to 1 MiB, in a temporary file
+// beyond that.
+func (c *Client) SendStream(ctx context.Context, r io.Reader, name string, opts ...Option) error {
+	var head bytes.Buffer
+	n, err := io.CopyN(&head, r, streamMemoryLimit+1)
+	if err == io.EOF {
+		return c.SendReader(ctx, &head, name, n, opts...)
+	}
+	if err != nil {
+		return fmt.Errorf("read %s: %w", name, err)
+	}
+	spool, err := ioutil.TempFile("", "send-carbide-*.nc")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, io.MultiReader(&head, r))
+	if err != nil {
+		return fmt.Errorf("spool %s: %w", name, err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	c.log().Debug("spooled input of unknown size", "path", spool.Name(), "size", size)
+	return c.SendReader(ctx, spool, name, size, opts...)
+}
@@ -0,0 +1,25 @@
+package carbide
+
+import "testing"
+
+func TestClientTarget(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"cnc.local", "cnc.local:6280"},
+		{"cnc.local:7000", "cnc.local:7000"},
+		{"192.168.1.20", "192.168.1.20:6280"},
+		{"::1", "[::1]:6280"},
+		{"[::1]", "[::1]:6280"},
+		{"[::1]:7000", "[::1]:7000"},
+		{"2001:db8::20", "[2001:db8::20]:6280"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:6280"},
+		{"[fe80::1%eth0]:7000", "[fe80::1%eth0]:7000"},
+	}
+	for _, tt := range tests {
+		if got := NewClient(tt.address).target(); got != tt.want {
+			t.Errorf("target() of %q = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
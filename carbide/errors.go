@@ -0,0 +1,92 @@
+// Package carbide defines what programs driving send-carbide, or embedding
+// its client, can rely on when talking to Carbide Motion's remote access
+// port.
+package carbide
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors of the client. They are returned wrapped with context, so test for
+// them with errors.Is.
+var (
+	// ErrNotReady means the machine is in a state that doesn't permit
+	// sending.
+	ErrNotReady = errors.New("machine not ready")
+	// ErrAckTimeout means the machine didn't acknowledge a file in time
+	// while the connection stayed open.
+	ErrAckTimeout = errors.New("timed out waiting for ack")
+	// ErrProtocol means the machine sent something the protocol doesn't
+	// allow.
+	ErrProtocol = errors.New("protocol error")
+	// ErrOversizedMessage means a message was longer than the limit of a
+	// strict MessageReader.
+	// It is also an ErrProtocol.
+	ErrOversizedMessage = fmt.Errorf("%w: oversized message", ErrProtocol)
+	// ErrConnection means the machine could not be reached or the
+	// connection failed while talking to it.
+	ErrConnection = errors.New("connection failed")
+	// ErrMismatch means the machine acknowledged a file but its copy is
+	// not what was sent.
+	ErrMismatch = errors.New("machine's copy differs from what was sent")
+)
+
+// ConnectionError is a failure to reach a machine or to talk to it. It
+// matches ErrConnection and unwraps to the network error.
+type ConnectionError struct {
+	Address string
+	Op      string
+	Err     error
+}
+
+func (e *ConnectionError) Error() string {
+	if e.Address == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Address, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConnectionError) Is(target error) bool {
+	return target == ErrConnection
+}
+
+// ProtocolError is a message from the machine that doesn't fit the
+// protocol. It matches ErrProtocol.
+type ProtocolError struct {
+	Reason  string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %q", e.Reason, e.Message)
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+// MismatchError is a verified transfer whose copy on the machine differs
+// from what was sent. It matches ErrMismatch. The checksums are CRC-32
+// (IEEE) and are 0 when the machine only reported its byte count.
+type MismatchError struct {
+	SentBytes     int64
+	SentCRC       uint32
+	ReceivedBytes int64
+	ReceivedCRC   uint32
+}
+
+func (e *MismatchError) Error() string {
+	if e.SentBytes != e.ReceivedBytes {
+		return fmt.Sprintf("%v: sent %d bytes, machine has %d", ErrMismatch, e.SentBytes, e.ReceivedBytes)
+	}
+	return fmt.Sprintf("%v: sent CRC-32 %08x, machine has %08x", ErrMismatch, e.SentCRC, e.ReceivedCRC)
+}
+
+func (e *MismatchError) Is(target error) bool {
+	return target == ErrMismatch
+}
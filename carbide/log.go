@@ -0,0 +1,60 @@
+package carbide
+
+import "go.uber.org/zap"
+
+// Logger receives what the client logs. Fields are given as alternating
+// keys and values, as in Debug("connected", "address", addr), so any
+// structured logger can be adapted to it.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// NopLogger discards everything. It is what the client logs to when no
+// Logger is given.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// ZapLogger logs to l, without touching zap's global logger. A nil l
+// discards everything.
+func ZapLogger(l *zap.Logger) Logger {
+	if l == nil {
+		return NopLogger
+	}
+	return zapLogger{l.WithOptions(zap.AddCallerSkip(1)).Sugar()}
+}
+
+type zapLogger struct {
+	s *zap.SugaredLogger
+}
+
+func (l zapLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.s.Debugw(msg, keysAndValues...)
+}
+
+func (l zapLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.s.Infow(msg, keysAndValues...)
+}
+
+func (l zapLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.s.Warnw(msg, keysAndValues...)
+}
+
+func (l zapLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.s.Errorw(msg, keysAndValues...)
+}
+
+func orNop(l Logger) Logger {
+	if l == nil {
+		return NopLogger
+	}
+	return l
+}
@@ -0,0 +1,54 @@
+package carbide
+
+import "io"
+
+// Option changes how a single send or state query is made.
+type Option func(*options)
+
+type options struct {
+	progress    func(sent, total int64)
+	stateChange func(state State)
+}
+
+func collectOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithProgress calls f as the file is written, with the bytes written so
+// far and the size of the file, ending with sent equal to total. It is
+// called from the goroutine making the call, so slow work in f slows the
+// send.
+func WithProgress(f func(sent, total int64)) Option {
+	return func(o *options) { o.progress = f }
+}
+
+// WithStateChange calls f with each state the machine reports, starting
+// with the one it announces when connected.
+func WithStateChange(f func(state State)) Option {
+	return func(o *options) { o.stateChange = f }
+}
+
+func (o *options) reportState(state State) {
+	if o.stateChange != nil {
+		o.stateChange(state)
+	}
+}
+
+// progressWriter reports the bytes written through it.
+type progressWriter struct {
+	w     io.Writer
+	sent  int64
+	total int64
+	f     func(sent, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.sent += int64(n)
+	p.f(p.sent, p.total)
+	return n, err
+}
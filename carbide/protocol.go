@@ -0,0 +1,275 @@
+package carbide
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Terminator ends every message of the protocol, and the file that follows
+// a GCODE header.
+const Terminator = '\n'
+
+// HeaderKey starts the header announcing a file.
+const HeaderKey = "GCODE:"
+
+// AckMessage is what the machine answers once it has received a file.
+const AckMessage = "GCODE_ACK"
+
+// DefaultHeaderFormat is the layout of Carbide Motion's header, see
+// Framing.HeaderFormat.
+const DefaultHeaderFormat = "{key} {name}:{size}"
+
+// Framing is how messages end and how files are announced and
+// acknowledged. Forks of Carbide Motion and compatible receivers may
+// differ from it here; zero fields are Carbide Motion's.
+type Framing struct {
+	// Terminator ends messages and files, '\n' when 0.
+	Terminator byte
+	// HeaderKey starts the header announcing a file, "GCODE:" when
+	// empty.
+	HeaderKey string
+	// Ack is the answer to a file, "GCODE_ACK" when empty.
+	Ack string
+	// HeaderFormat lays out the header, with {key}, {name} and {size}
+	// standing for the header key, the file name and its size in bytes,
+	// DefaultHeaderFormat when empty. The terminator follows it.
+	HeaderFormat string
+	// StateKey is the key before the colon of state messages, and the
+	// request for one, "STATE" when empty.
+	StateKey string
+}
+
+// End is the byte that ends messages and files.
+func (f Framing) End() byte {
+	if f.Terminator == 0 {
+		return Terminator
+	}
+	return f.Terminator
+}
+
+// Key is the key that starts the header announcing a file.
+func (f Framing) Key() string {
+	if f.HeaderKey == "" {
+		return HeaderKey
+	}
+	return f.HeaderKey
+}
+
+// Format is the layout of the header announcing a file.
+func (f Framing) Format() string {
+	if f.HeaderFormat == "" {
+		return DefaultHeaderFormat
+	}
+	return f.HeaderFormat
+}
+
+// Header announces a file of size bytes to the machine.
+func (f Framing) Header(name string, size int64) string {
+	header := strings.NewReplacer("{key}", f.Key(), "{name}", name, "{size}", strconv.FormatInt(size, 10)).Replace(f.Format())
+	return header + string(f.End())
+}
+
+// ParseHeader reads the name and size of the file a header announces,
+// without its terminator. ok is false for any other message.
+func (f Framing) ParseHeader(msg string) (name string, size int64, ok bool) {
+	pattern := strings.NewReplacer(`\{key\}`, regexp.QuoteMeta(f.Key()), `\{name\}`, `(?P<name>.*)`, `\{size\}`, `(?P<size>[0-9]+)`).
+		Replace(regexp.QuoteMeta(f.Format()))
+	re, err := regexp.Compile("^" + pattern + "$")
+	if err != nil {
+		return "", 0, false
+	}
+	match := re.FindStringSubmatch(strings.TrimSpace(msg))
+	if match == nil {
+		return "", 0, false
+	}
+	for i, group := range re.SubexpNames() {
+		switch group {
+		case "name":
+			name = strings.TrimSpace(match[i])
+		case "size":
+			if size, err = strconv.ParseInt(match[i], 10, 64); err != nil {
+				return "", 0, false
+			}
+		}
+	}
+	return name, size, true
+}
+
+// AckMessage is what the machine answers once it has received a file.
+func (f Framing) AckMessage() string {
+	if f.Ack == "" {
+		return AckMessage
+	}
+	return f.Ack
+}
+
+// StateRequest asks a receiver with FeatureSession for its state, and is
+// the key of the state messages it answers with.
+func (f Framing) StateRequest() string {
+	if f.StateKey == "" {
+		return stateKey
+	}
+	return f.StateKey
+}
+
+// Header announces a file of size bytes to Carbide Motion.
+func Header(name string, size int64) string {
+	return Framing{}.Header(name, size)
+}
+
+// DefaultMaxMessageSize is the longest message a MessageReader accepts
+// when MaxSize is not set.
+const DefaultMaxMessageSize = 16 << 10
+
+// MessageReader reads the machine's messages, one per line.
+type MessageReader struct {
+	// MaxSize is the longest message kept, DefaultMaxMessageSize when 0.
+	// Longer messages are read to their end and truncated to MaxSize with
+	// a warning, so a verbose receiver doesn't fail the session.
+	MaxSize int
+	// Retries is how many empty messages are skipped before one is
+	// returned as it is.
+	Retries int
+	// Terminator ends messages, '\n' when 0.
+	Terminator byte
+	// Strict fails on messages longer than MaxSize with
+	// ErrOversizedMessage instead of truncating them.
+	Strict bool
+	Logger Logger
+}
+
+// Read reads the next message from r, without its terminator. A message
+// is read up to its terminator however many reads it takes, bounded by the
+// read deadline of the connection, and whatever follows it stays buffered
+// in r for the next call. Read the whole connection through the same r.
+func (m *MessageReader) Read(r *bufio.Reader) (string, error) {
+	log := orNop(m.Logger)
+	maxSize := m.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	retries := m.Retries
+	for {
+		line, dropped, err := readLine(r, Framing{Terminator: m.Terminator}.End(), maxSize)
+		if err != nil {
+			log.Error("failed to read message", "error", err)
+			return "", err
+		}
+		if len(line) == 0 && retries > 0 {
+			log.Debug("skipping empty message")
+			retries--
+			continue
+		}
+		if dropped > 0 && m.Strict {
+			log.Error("failed to read message", "error", ErrOversizedMessage, "limit", maxSize)
+			return "", ErrOversizedMessage
+		}
+		if dropped > 0 {
+			log.Warn("message from the machine is too long, truncated it", "limit", maxSize, "length", len(line)+dropped, "kept", string(line))
+		}
+		msg, err := ParseMessage(line)
+		if err != nil {
+			log.Error("failed to read message", "error", err)
+		}
+		return msg, err
+	}
+}
+
+// readLine reads up to the next terminator, keeping the first maxSize
+// bytes and counting the ones dropped after them. A connection that ends
+// in the middle of a message is a *ProtocolError.
+func readLine(r *bufio.Reader, terminator byte, maxSize int) (line []byte, dropped int, err error) {
+	for {
+		chunk, err := r.ReadSlice(terminator)
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+		if keep := maxSize - len(line); len(chunk) > keep {
+			dropped += len(chunk) - keep
+			chunk = chunk[:keep]
+		}
+		line = append(line, chunk...)
+		switch {
+		case err == nil:
+			return line, dropped, nil
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && (len(line) > 0 || dropped > 0):
+			return nil, 0, &ProtocolError{Reason: "message without terminator", Message: string(line)}
+		default:
+			return nil, 0, err
+		}
+	}
+}
+
+// ParseMessage checks a message taken from the connection and returns it
+// as text. A carriage return before the terminator is dropped, since
+// receivers on Windows may end lines with both. NUL bytes and other control
+// characters besides tabs are a *ProtocolError: they are line noise or a
+// receiver speaking something else, and would otherwise end up in states
+// and logs.
+func ParseMessage(line []byte) (string, error) {
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	for _, c := range line {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return "", &ProtocolError{Reason: "control character in message", Message: string(line)}
+		}
+	}
+	return string(line), nil
+}
+
+// stateKey starts state messages.
+const stateKey = "STATE"
+
+// StateRequest asks a receiver with FeatureSession for its state between
+// the files of a session. It answers with a state message.
+const StateRequest = stateKey
+
+// ParseState parses a "STATE: <state>" message, tolerating what receivers
+// vary in: the case of the key, space around the colon and the state, a
+// trailing carriage return, and further tokens after the state, such as a
+// version. An error or alarm from the controller in its place is returned
+// as a *MachineError, anything else as a *ProtocolError.
+func ParseState(statusLine string) (State, error) {
+	return Framing{}.ParseState(statusLine)
+}
+
+// ParseState parses a state message like the package's ParseState, with
+// the framing's state key.
+func (f Framing) ParseState(statusLine string) (State, error) {
+	if merr := ParseMachineError(statusLine); merr != nil {
+		return StateUnknown, merr
+	}
+	i := strings.IndexByte(statusLine, ':')
+	if i < 0 || !strings.EqualFold(strings.TrimSpace(statusLine[:i]), f.StateRequest()) {
+		return StateUnknown, &ProtocolError{Reason: "invalid status message", Message: statusLine}
+	}
+	fields := strings.Fields(statusLine[i+1:])
+	if len(fields) == 0 {
+		return StateUnknown, &ProtocolError{Reason: "status message without a state", Message: statusLine}
+	}
+	return ParseStateName(fields[0]), nil
+}
+
+// ParseStateStrict parses a state message that is exactly
+// "STATE: <state>", with the key in any case, as Carbide Motion sends it.
+func ParseStateStrict(statusLine string) (State, error) {
+	return Framing{}.ParseStateStrict(statusLine)
+}
+
+// ParseStateStrict parses a state message like the package's
+// ParseStateStrict, with the framing's state key.
+func (f Framing) ParseStateStrict(statusLine string) (State, error) {
+	if merr := ParseMachineError(statusLine); merr != nil {
+		return StateUnknown, merr
+	}
+	tokens := strings.Split(statusLine, " ")
+	if len(tokens) != 2 || !strings.EqualFold(tokens[0], f.StateRequest()+":") || tokens[1] == "" {
+		return StateUnknown, &ProtocolError{Reason: "invalid status message", Message: statusLine}
+	}
+	return ParseStateName(tokens[1]), nil
+}
@@ -0,0 +1,260 @@
+package carbide
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{name: "state", line: "STATE: init", want: "STATE: init"},
+		{name: "empty", line: "", want: ""},
+		{name: "carriage return", line: "GCODE_ACK\r", want: "GCODE_ACK"},
+		{name: "only a carriage return", line: "\r", want: ""},
+		{name: "one carriage return dropped", line: "GCODE_ACK\r\r", wantErr: true},
+		{name: "tab", line: "STATE:\tidle", want: "STATE:\tidle"},
+		{name: "utf-8", line: "ERROR: fichier refusé", want: "ERROR: fichier refusé"},
+		{name: "embedded nul", line: "STATE: in\x00it", wantErr: true},
+		{name: "leading nul", line: "\x00STATE: init", wantErr: true},
+		{name: "only nuls", line: "\x00\x00\x00", wantErr: true},
+		{name: "escape sequence", line: "\x1b[2JSTATE: init", wantErr: true},
+		{name: "delete", line: "STATE: init\x7f", wantErr: true},
+		{name: "carriage return inside", line: "STATE:\rinit", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMessage([]byte(tt.line))
+			if tt.wantErr {
+				var perr *ProtocolError
+				if !errors.As(err, &perr) || !errors.Is(err, ErrProtocol) {
+					t.Fatalf("ParseMessage(%q) = %q, %v, want a ProtocolError", tt.line, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ParseMessage(%q) = %q, %v, want %q", tt.line, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageReaderRead(t *testing.T) {
+	tests := []struct {
+		name   string
+		reader MessageReader
+		input  string
+		// oneByte feeds the input a byte per read, as a slow link does
+		oneByte bool
+		want    []string
+		// wantErr is what the read after the messages fails with
+		wantErr error
+	}{
+		{name: "banner", input: "STATE: init\n", want: []string{"STATE: init"}, wantErr: io.EOF},
+		{name: "banner in pieces", input: "STATE: init\nGCODE_ACK\n", oneByte: true, want: []string{"STATE: init", "GCODE_ACK"}, wantErr: io.EOF},
+		{name: "crlf", input: "STATE: init\r\nGCODE_ACK\r\n", want: []string{"STATE: init", "GCODE_ACK"}, wantErr: io.EOF},
+		{name: "missing terminator", input: "STATE: ini", wantErr: ErrProtocol},
+		{name: "missing terminator after a message", input: "STATE: init\nGCODE_A", want: []string{"STATE: init"}, wantErr: ErrProtocol},
+		{name: "nothing", input: "", wantErr: io.EOF},
+		{name: "embedded nul", input: "STATE: \x00init\n", wantErr: ErrProtocol},
+		{name: "empty message", input: "\n", want: []string{""}, wantErr: io.EOF},
+		{name: "empty messages skipped", reader: MessageReader{Retries: 2}, input: "\n\nSTATE: idle\n", want: []string{"STATE: idle"}, wantErr: io.EOF},
+		{name: "more empty messages than retries", reader: MessageReader{Retries: 1}, input: "\n\nSTATE: idle\n", want: []string{"", "STATE: idle"}, wantErr: io.EOF},
+		{name: "terminator", reader: MessageReader{Terminator: ';'}, input: "STATE: init;GCODE_ACK;", want: []string{"STATE: init", "GCODE_ACK"}, wantErr: io.EOF},
+		{name: "overlong truncated", reader: MessageReader{MaxSize: 8}, input: "STATE: running job\nGCODE_ACK\n", want: []string{"STATE: r", "GCODE_AC"}, wantErr: io.EOF},
+		{name: "overlong past the buffer", reader: MessageReader{MaxSize: 16}, input: strings.Repeat("x", 10000) + "\nGCODE_ACK\n",
+			want: []string{strings.Repeat("x", 16), "GCODE_ACK"}, wantErr: io.EOF},
+		{name: "overlong strict", reader: MessageReader{MaxSize: 8, Strict: true}, input: "STATE: running\n", wantErr: ErrOversizedMessage},
+		{name: "overlong missing terminator", reader: MessageReader{MaxSize: 8}, input: strings.Repeat("x", 100), wantErr: ErrProtocol},
+		{name: "default limit", input: strings.Repeat("y", DefaultMaxMessageSize+1) + "\n", want: []string{strings.Repeat("y", DefaultMaxMessageSize)}, wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in io.Reader = strings.NewReader(tt.input)
+			if tt.oneByte {
+				in = iotest.OneByteReader(in)
+			}
+			r := bufio.NewReaderSize(in, 16)
+			for _, want := range tt.want {
+				got, err := tt.reader.Read(r)
+				if err != nil || got != want {
+					t.Fatalf("Read() = %q, %v, want %q", got, err, want)
+				}
+			}
+			if got, err := tt.reader.Read(r); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Read() = %q, %v, want %v", got, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseState(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		want   State
+		strict State
+		// wantErr is a *MachineError or *ProtocolError, for both parsers
+		wantErr interface{}
+		// strictErr is whether only ParseStateStrict fails
+		strictErr bool
+	}{
+		{name: "carbide motion", msg: "STATE: init", want: StateInit, strict: StateInit},
+		{name: "lower case key", msg: "state: idle", want: StateIdle, strict: StateIdle},
+		{name: "upper case state", msg: "STATE: RUNNING", want: StateRunning, strict: StateRunning},
+		{name: "no space", msg: "STATE:init", want: StateInit, strictErr: true},
+		{name: "space around the colon", msg: "STATE : init", want: StateInit, strictErr: true},
+		{name: "version after the state", msg: "STATE: init v2.1", want: StateInit, strictErr: true},
+		{name: "tab", msg: "STATE:\tidle", want: StateIdle, strictErr: true},
+		{name: "two spaces", msg: "STATE:  idle", want: StateIdle, strictErr: true},
+		{name: "empty", msg: "", wantErr: &ProtocolError{}},
+		{name: "key only", msg: "STATE", wantErr: &ProtocolError{}},
+		{name: "no state", msg: "STATE:", wantErr: &ProtocolError{}},
+		{name: "blank state", msg: "STATE:   ", wantErr: &ProtocolError{}},
+		{name: "other key", msg: "STATUS: init", wantErr: &ProtocolError{}},
+		{name: "ack instead", msg: "GCODE_ACK", wantErr: &ProtocolError{}},
+		{name: "greeting", msg: "Welcome to Carbide Motion", wantErr: &ProtocolError{}},
+		{name: "colon first", msg: ": init", wantErr: &ProtocolError{}},
+		{name: "alarm", msg: "ALARM:9 homing fail", wantErr: &MachineError{}},
+		{name: "error", msg: "error: 20", wantErr: &MachineError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, p := range []struct {
+				name   string
+				parse  func(string) (State, error)
+				want   State
+				failed bool
+			}{
+				{"ParseState", ParseState, tt.want, false},
+				{"ParseStateStrict", ParseStateStrict, tt.strict, tt.strictErr},
+			} {
+				got, err := p.parse(tt.msg)
+				switch {
+				case tt.wantErr != nil:
+					if !sameErrorType(err, tt.wantErr) {
+						t.Errorf("%s(%q) = %q, %v, want a %T", p.name, tt.msg, got, err, tt.wantErr)
+					}
+				case p.failed:
+					if !errors.Is(err, ErrProtocol) {
+						t.Errorf("%s(%q) = %q, %v, want a ProtocolError", p.name, tt.msg, got, err)
+					}
+				case err != nil || got != p.want:
+					t.Errorf("%s(%q) = %q, %v, want %q", p.name, tt.msg, got, err, p.want)
+				}
+			}
+		})
+	}
+}
+
+func sameErrorType(err error, want interface{}) bool {
+	switch want.(type) {
+	case *MachineError:
+		var merr *MachineError
+		return errors.As(err, &merr)
+	case *ProtocolError:
+		var perr *ProtocolError
+		return errors.As(err, &perr)
+	}
+	return false
+}
+
+func TestFramingParseState(t *testing.T) {
+	f := Framing{StateKey: "STATUS"}
+	if got, err := f.ParseState("status: idle"); err != nil || got != StateIdle {
+		t.Errorf("ParseState() = %q, %v, want idle", got, err)
+	}
+	if _, err := f.ParseState("STATE: idle"); !errors.Is(err, ErrProtocol) {
+		t.Errorf("ParseState() of the default key = %v, want a ProtocolError", err)
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, seed := range []string{"STATE: init", "GCODE_ACK\r", "", "\r", "STATE: in\x00it", "\x1b[2J", "ERROR: refusé\t1"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		msg, err := ParseMessage(line)
+		if err != nil {
+			if !errors.Is(err, ErrProtocol) {
+				t.Fatalf("ParseMessage(%q) failed with %v, not a ProtocolError", line, err)
+			}
+			return
+		}
+		if len(msg) > len(line) {
+			t.Fatalf("ParseMessage(%q) = %q, longer than the line", line, msg)
+		}
+		for _, c := range []byte(msg) {
+			if (c < ' ' && c != '\t') || c == 0x7f {
+				t.Fatalf("ParseMessage(%q) = %q, with control character %q", line, msg, c)
+			}
+		}
+	})
+}
+
+func FuzzParseState(f *testing.F) {
+	for _, seed := range []string{"STATE: init", "state:idle", "STATE : running v2", "STATE:", "ALARM:9 homing", "error: 20", "GCODE_ACK", ":", ""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, msg string) {
+		for name, parse := range map[string]func(string) (State, error){"ParseState": ParseState, "ParseStateStrict": ParseStateStrict} {
+			state, err := parse(msg)
+			if err != nil {
+				var merr *MachineError
+				if !errors.As(err, &merr) && !errors.Is(err, ErrProtocol) {
+					t.Fatalf("%s(%q) failed with %v, neither a MachineError nor a ProtocolError", name, msg, err)
+				}
+				if state != StateUnknown {
+					t.Fatalf("%s(%q) = %q with error %v, want no state", name, msg, state, err)
+				}
+				continue
+			}
+			if state == StateUnknown || state != ParseStateName(string(state)) || strings.ContainsAny(string(state), " \t\r\n") {
+				t.Fatalf("%s(%q) = %q, not a normalized state name", name, msg, state)
+			}
+		}
+	})
+}
+
+// FuzzMessageReader feeds arbitrary bytes to a MessageReader, which must
+// end every message or fail, and never return one longer than its limit.
+func FuzzMessageReader(f *testing.F) {
+	for _, seed := range []string{"STATE: init\nGCODE_ACK\n", "STATE: in", "\n\n\nSTATE: idle\r\n", strings.Repeat("x", 100) + "\n", "\x00\n"} {
+		f.Add([]byte(seed), uint8(8), false)
+	}
+	f.Fuzz(func(t *testing.T, input []byte, maxSize uint8, strict bool) {
+		m := MessageReader{MaxSize: int(maxSize), Strict: strict, Retries: 1}
+		limit := m.MaxSize
+		if limit <= 0 {
+			limit = DefaultMaxMessageSize
+		}
+		r := bufio.NewReaderSize(iotest.HalfReader(strings.NewReader(string(input))), 16)
+		for i := 0; i <= len(input); i++ {
+			msg, err := m.Read(r)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				if !errors.Is(err, ErrProtocol) {
+					t.Fatalf("Read() failed with %v, not a protocol error", err)
+				}
+				if errors.Is(err, ErrOversizedMessage) && !strict {
+					t.Fatalf("Read() failed with %v, not strict", err)
+				}
+				continue
+			}
+			if len(msg) > limit {
+				t.Fatalf("Read() = %d bytes, past the limit of %d", len(msg), limit)
+			}
+		}
+		t.Fatalf("Read() returned more messages than there are bytes of input")
+	})
+}
@@ -0,0 +1,130 @@
+package carbide
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrRejected means the receiver answered a file with a refusal instead of
+// the ack.
+var ErrRejected = errors.New("receiver rejected the file")
+
+// ErrRefusedSize means the receiver has no room for a file of its size,
+// whether it refused it or said so before it was sent.
+var ErrRefusedSize = errors.New("receiver refused the size of the file")
+
+// Rejection is why a receiver refused a file.
+type Rejection string
+
+// Rejections a ReceiverError is classified into.
+const (
+	// RejectBusy is a receiver busy with another job. It also matches
+	// ErrNotReady, as trying again later may work.
+	RejectBusy Rejection = "busy"
+	// RejectSizeMismatch is a file of another size than the header
+	// announced.
+	RejectSizeMismatch Rejection = "size mismatch"
+	// RejectTooLarge is a file larger than the receiver has room for. It
+	// also matches ErrRefusedSize.
+	RejectTooLarge Rejection = "too large"
+	// RejectUnsupported is a receiver that doesn't support what was
+	// asked, such as a chunked send.
+	RejectUnsupported Rejection = "unsupported"
+	// RejectRefused is a file refused for any other reason, such as its
+	// size or name.
+	RejectRefused Rejection = "rejected"
+)
+
+// rejectionWords are words of refusals that tell why, by the reason they
+// tell, most specific first. Controllers don't use them in their errors.
+var rejectionWords = []struct {
+	reason Rejection
+	words  []string
+}{
+	{RejectSizeMismatch, []string{"mismatch", "not terminated", "truncated", "incomplete", "too many bytes", "too few bytes"}},
+	{RejectTooLarge, []string{"too large", "too big", "no space", "no room", "disk full", "out of space", "insufficient space", "file size limit"}},
+	{RejectUnsupported, []string{"unsupported", "not supported", "not implemented", "unknown request", "unknown command"}},
+	{RejectBusy, []string{"busy", "in use", "another job", "queue full", "try again"}},
+}
+
+// rejectionSuggestions are what to do about each kind of refusal.
+var rejectionSuggestions = map[Rejection]string{
+	RejectBusy:         "wait for the machine to finish its current job, or retry until it is ready",
+	RejectSizeMismatch: "the receiver got another number of bytes than announced; make sure the file doesn't change while it is sent and send it again",
+	RejectTooLarge:     "the receiver has no room for the file; free space on the CNC PC, or send the job in smaller parts, such as one per tool",
+	RejectUnsupported:  "the receiver doesn't support what the send asked for; send without the extension, such as chunks, or update the receiver",
+	RejectRefused:      "the receiver refused the file; check its screen or log for why, such as the file being too large for it",
+}
+
+// ReceiverError is a refusal of a file by the receiver, as opposed to an
+// error of the controller behind it. It matches ErrRejected, ErrNotReady
+// when the receiver is busy and ErrRefusedSize when the file is too large.
+type ReceiverError struct {
+	Reason Rejection
+	// Message is what the receiver answered.
+	Message string
+}
+
+func (e *ReceiverError) Error() string {
+	switch e.Reason {
+	case RejectRefused:
+		return "receiver rejected the file: " + e.Message
+	case RejectTooLarge:
+		return ErrRefusedSize.Error() + ": " + e.Message
+	}
+	return "receiver rejected the file (" + string(e.Reason) + "): " + e.Message
+}
+
+// Suggestion is what to do about the refusal.
+func (e *ReceiverError) Suggestion() string {
+	return rejectionSuggestions[e.Reason]
+}
+
+func (e *ReceiverError) Is(target error) bool {
+	return target == ErrRejected || (target == ErrNotReady && e.Reason == RejectBusy) || (target == ErrRefusedSize && e.Reason == RejectTooLarge)
+}
+
+// ParseReceiverError classifies an answer to a file that isn't the ack: a
+// NACK, BUSY or REJECT keyword with an optional reason, as in
+// "GCODE_NACK size mismatch" or "BUSY", or an error whose text tells the
+// reason, as in "ERROR: file not terminated". Errors of the controller,
+// with a GRBL code or a text that doesn't tell, are left to
+// ParseMachineError, and anything else returns nil.
+func ParseReceiverError(msg string) *ReceiverError {
+	msg = strings.TrimSpace(msg)
+	fields := strings.Fields(strings.Replace(msg, ":", " ", 1))
+	if len(fields) == 0 {
+		return nil
+	}
+	keyword := strings.ToUpper(fields[0])
+	reason := strings.ToLower(strings.Join(fields[1:], " "))
+	switch {
+	case keyword == "BUSY" || strings.HasSuffix(keyword, "_BUSY"):
+		return &ReceiverError{Reason: RejectBusy, Message: msg}
+	case keyword == "NACK" || strings.HasSuffix(keyword, "_NACK") || keyword == "REJECT" || strings.HasSuffix(keyword, "_REJECT") || keyword == "REJECTED":
+		e := &ReceiverError{Reason: RejectRefused, Message: msg}
+		if r, ok := classifyRejection(reason); ok {
+			e.Reason = r
+		}
+		return e
+	case keyword == "ERROR":
+		if merr := ParseMachineError(msg); merr == nil || merr.Code != 0 {
+			return nil
+		}
+		if r, ok := classifyRejection(reason); ok {
+			return &ReceiverError{Reason: r, Message: msg}
+		}
+	}
+	return nil
+}
+
+func classifyRejection(reason string) (Rejection, bool) {
+	for _, r := range rejectionWords {
+		for _, word := range r.words {
+			if strings.Contains(reason, word) {
+				return r.reason, true
+			}
+		}
+	}
+	return "", false
+}
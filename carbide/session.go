@@ -0,0 +1,122 @@
+package carbide
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Session sends several files over one connection, skipping the dial and
+// the state announcement for all but the first, which adds up when jobs are
+// sent in quick succession. Only receivers announcing FeatureSession take
+// more than one file per connection; for any other, including Carbide
+// Motion, each Send connects anew, so a Session works with every receiver.
+//
+// A Session is not safe for concurrent use.
+type Session struct {
+	client *Client
+	conn   net.Conn
+	r      *bufio.Reader
+	state  State
+	caps   Capabilities
+}
+
+// Open connects to the machine and returns a session with it. ctx bounds
+// the connecting only.
+func (c *Client) Open(ctx context.Context, opts ...Option) (*Session, error) {
+	s := &Session{client: c}
+	if err := s.connect(ctx, collectOptions(opts)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) connect(ctx context.Context, o *options) error {
+	conn, r, state, caps, stop, err := s.client.connect(ctx, o)
+	if err != nil {
+		return err
+	}
+	stop()
+	conn.SetDeadline(time.Time{})
+	s.conn, s.r, s.state, s.caps = conn, r, state, caps
+	return nil
+}
+
+// State is the last state the machine reported in the session.
+func (s *Session) State() State {
+	return s.state
+}
+
+// Capabilities are what the receiver announced when the session connected.
+func (s *Session) Capabilities() Capabilities {
+	return s.caps
+}
+
+// Send sends size bytes of gcode read from r as a job called name, like
+// Client.SendReader. On a connection that already took a file it first
+// asks the machine for its state, so a machine still busy with the last job
+// fails with ErrNotReady as it would on a new connection.
+func (s *Session) Send(ctx context.Context, r io.Reader, name string, size int64, opts ...Option) error {
+	o := collectOptions(opts)
+	if s.conn == nil {
+		if err := s.connect(ctx, o); err != nil {
+			return err
+		}
+	} else if err := s.refresh(ctx, o); err != nil {
+		// The receiver went away in between, which is worth one new
+		// connection
+		s.client.log().Debug("session connection lost, reconnecting", "address", s.client.target(), "error", err)
+		s.Close()
+		if err := s.connect(ctx, o); err != nil {
+			return err
+		}
+	}
+	stop := watch(ctx, s.conn)
+	err := s.client.send(ctx, s.conn, s.r, s.state, r, name, size, o)
+	stop()
+	switch {
+	case errors.Is(err, ErrNotReady) && s.caps.Has(FeatureSession):
+		// Nothing was sent, the connection can take the next try
+	case err != nil || !s.caps.Has(FeatureSession):
+		s.Close()
+		return err
+	}
+	s.conn.SetDeadline(time.Time{})
+	return err
+}
+
+// refresh asks the receiver for its state on the open connection.
+func (s *Session) refresh(ctx context.Context, o *options) error {
+	stop := watch(ctx, s.conn)
+	defer stop()
+	defer s.conn.SetDeadline(time.Time{})
+	request := append([]byte(s.client.Framing.StateRequest()), s.client.Framing.End())
+	if _, err := s.conn.Write(request); err != nil {
+		return s.client.failed(ctx, "ask state of", err)
+	}
+	msg, err := s.client.readMessage(s.r)
+	if err != nil {
+		return s.client.failed(ctx, "read state from", err)
+	}
+	state, err := s.client.parseState(msg)
+	if err != nil {
+		return err
+	}
+	s.client.log().Debug("received state", "address", s.client.target(), "state", state)
+	o.reportState(state)
+	s.state = state
+	return nil
+}
+
+// Close closes the connection of the session.
+func (s *Session) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.r = nil, nil
+	return err
+}
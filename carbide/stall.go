@@ -0,0 +1,128 @@
+package carbide
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultStallTimeout is how long a receiver may take no bytes of a file
+// before the send fails, when a Client has no StallTimeout.
+const DefaultStallTimeout = 30 * time.Second
+
+// ErrStalled means the receiver stopped taking the file, with the socket
+// buffer full, for longer than the stall timeout.
+var ErrStalled = errors.New("receiver stalled")
+
+// StallError is a send the receiver stopped taking bytes of. It matches
+// ErrStalled, and is returned in a ConnectionError, so it matches
+// ErrConnection too.
+type StallError struct {
+	// Offset is how many bytes of the file were written to the
+	// connection, including those still in the socket buffers, 0 when it
+	// stalled on the header
+	Offset  int64
+	Timeout time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("%v: no bytes taken for %v, at byte %d of the file", ErrStalled, e.Timeout, e.Offset)
+}
+
+func (e *StallError) Is(target error) bool {
+	return target == ErrStalled
+}
+
+// StallWriter writes to a connection with a deadline on every write, so a
+// receiver that stops reading fails the send instead of blocking it on a
+// full socket buffer for ever. A write that times out having made progress
+// is carried on; one that made none for Timeout fails with a StallError.
+// Once Context is done, writes fail with its error, and the deadline that
+// interrupted them is left in place.
+type StallWriter struct {
+	Conn    net.Conn
+	Timeout time.Duration
+	// Offset is where in the file the next byte written is, negative by
+	// the length of the header while it is written
+	Offset int64
+	// Deadline is the write deadline Conn is left with between writes,
+	// zero for none
+	Deadline time.Time
+	// Context stops the writes when it is done, nil for never
+	Context context.Context
+}
+
+// NewStallWriter returns a StallWriter for a file sent after a header of
+// headerSize bytes. A timeout of 0 or less never fails a write.
+func NewStallWriter(conn net.Conn, timeout time.Duration, headerSize int) *StallWriter {
+	return &StallWriter{Conn: conn, Timeout: timeout, Offset: -int64(headerSize)}
+}
+
+func (s *StallWriter) Write(b []byte) (int, error) {
+	if s.Timeout <= 0 {
+		n, err := s.Conn.Write(b)
+		s.Offset += int64(n)
+		return n, err
+	}
+	defer s.restoreDeadline()
+	written := 0
+	for written < len(b) {
+		if err := s.done(); err != nil {
+			return written, err
+		}
+		deadline := time.Now().Add(s.Timeout)
+		if !s.Deadline.IsZero() && s.Deadline.Before(deadline) {
+			deadline = s.Deadline
+		}
+		s.Conn.SetWriteDeadline(deadline)
+		// Checked again, as setting the deadline may have undone the one
+		// in the past that a cancellation interrupts the write with
+		if err := s.done(); err != nil {
+			return written, err
+		}
+		n, err := s.Conn.Write(b[written:])
+		written += n
+		s.Offset += int64(n)
+		if err == nil {
+			continue
+		}
+		if err := s.done(); err != nil {
+			return written, err
+		}
+		var ne net.Error
+		// Past the deadline of the whole send is not a stall
+		if !errors.As(err, &ne) || !ne.Timeout() || (!s.Deadline.IsZero() && deadline.Equal(s.Deadline)) {
+			return written, err
+		}
+		if n == 0 {
+			offset := s.Offset
+			if offset < 0 {
+				offset = 0
+			}
+			return written, &StallError{Offset: offset, Timeout: s.Timeout}
+		}
+	}
+	return written, nil
+}
+
+// restoreDeadline leaves Conn with Deadline after a write, unless Context
+// is done, checking it again after setting the deadline for the same
+// reason as Write.
+func (s *StallWriter) restoreDeadline() {
+	if s.done() == nil {
+		s.Conn.SetWriteDeadline(s.Deadline)
+		s.done()
+	}
+}
+
+// done returns the error of Context once it is done, leaving the deadline
+// of Conn in the past for the writes and reads after it.
+func (s *StallWriter) done() error {
+	if s.Context == nil || s.Context.Err() == nil {
+		return nil
+	}
+	s.Conn.SetWriteDeadline(aLongTimeAgo)
+	return s.Context.Err()
+}
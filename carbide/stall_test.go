@@ -0,0 +1,128 @@
+package carbide
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowFile is gcode read 4 KiB at a time from somewhere slow, so most of
+// a send is spent between writes rather than in them.
+type slowFile struct{}
+
+func (slowFile) Read(b []byte) (int, error) {
+	time.Sleep(20 * time.Millisecond)
+	if len(b) > 4096 {
+		b = b[:4096]
+	}
+	for i := range b {
+		b[i] = 'G'
+	}
+	return len(b), nil
+}
+
+// receiver accepts one connection, announces the init state and takes
+// whatever is sent, never acknowledging it. It returns the address it
+// listens on, and the count of bytes it took once the connection closed.
+func receiver(t *testing.T) (address string, received <-chan int64) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	count := make(chan int64, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			count <- 0
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "STATE: init\n")
+		n, _ := io.Copy(ioutil.Discard, conn)
+		count <- n
+	}()
+	return ln.Addr().String(), count
+}
+
+// TestSendReaderCancelledMidStream cancels a send between two writes of
+// the file, which must stop it there rather than at the ack.
+func TestSendReaderCancelledMidStream(t *testing.T) {
+	address, received := receiver(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	const size = 400000
+	start := time.Now()
+	err := NewClient(address).SendReader(ctx, slowFile{}, "big.nc", size)
+	elapsed := time.Since(start)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendReader() = %v, want context.Canceled", err)
+	}
+	if !strings.Contains(err.Error(), "send file to") {
+		t.Errorf("SendReader() = %v, want it to stop while sending the file", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("SendReader() took %v to stop after being cancelled at 100ms", elapsed)
+	}
+	if n := <-received; n >= size {
+		t.Errorf("receiver took %d bytes, want the send stopped before the end of the file", n)
+	}
+}
+
+// stallConn is a connection whose writes never make progress, timing out
+// at the write deadline.
+type stallConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+func (c *stallConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Until(c.deadline))
+	return 0, &net.OpError{Op: "write", Net: "tcp", Err: timeoutError{}}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestStallWriterStalls(t *testing.T) {
+	sw := NewStallWriter(&stallConn{}, 20*time.Millisecond, 10)
+	sw.Offset = 100
+	_, err := sw.Write([]byte("G0 X1\n"))
+	var stall *StallError
+	if !errors.As(err, &stall) || !errors.Is(err, ErrStalled) {
+		t.Fatalf("Write() = %v, want a StallError", err)
+	}
+	if stall.Offset != 100 {
+		t.Errorf("StallError.Offset = %d, want 100", stall.Offset)
+	}
+}
+
+func TestStallWriterCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	conn := &stallConn{}
+	sw := NewStallWriter(conn, time.Second, 0)
+	sw.Context = ctx
+	if _, err := sw.Write([]byte("G0 X1\n")); err != context.Canceled {
+		t.Fatalf("Write() = %v, want context.Canceled", err)
+	}
+	if !conn.deadline.Before(time.Now()) {
+		t.Errorf("write deadline left at %v, want it in the past", conn.deadline)
+	}
+}
@@ -0,0 +1,86 @@
+package carbide
+
+import "strings"
+
+// State is a machine state, as reported by Carbide Motion in its STATE
+// messages. Receivers may report states besides the ones defined here,
+// which keep their lowercase name.
+type State string
+
+// States the machine reports, and the ones the client uses for machines it
+// can't tell the state of.
+const (
+	StateInit    State = "init"
+	StateIdle    State = "idle"
+	StateRunning State = "running"
+	StatePaused  State = "paused"
+	StateHold    State = "hold"
+	StateHoming  State = "homing"
+	StateBusy    State = "busy"
+	StateAlarm   State = "alarm"
+	StateError   State = "error"
+	StateFault   State = "fault"
+	// StateDisconnected is a machine that could not be reached
+	StateDisconnected State = "disconnected"
+	// StateUnknown is a machine whose state could not be read
+	StateUnknown State = "unknown"
+)
+
+// ParseStateName returns the state called name, in any case and with
+// surrounding space. An empty name is StateUnknown.
+func ParseStateName(name string) State {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return StateUnknown
+	}
+	return State(name)
+}
+
+// ParseStates parses a comma separated list of state names, skipping
+// empty ones.
+func ParseStates(list string) []State {
+	var states []State
+	for _, name := range strings.Split(list, ",") {
+		if strings.TrimSpace(name) != "" {
+			states = append(states, ParseStateName(name))
+		}
+	}
+	return states
+}
+
+func (s State) String() string {
+	return string(s)
+}
+
+// Ready reports whether the machine is at rest.
+func (s State) Ready() bool {
+	return s == StateInit || s == StateIdle
+}
+
+// Busy reports whether the machine is running, holding or homing.
+func (s State) Busy() bool {
+	switch s {
+	case StateRunning, StatePaused, StateHold, StateHoming, StateBusy:
+		return true
+	}
+	return false
+}
+
+// Faulted reports whether the machine is in an alarm or error state.
+func (s State) Faulted() bool {
+	switch s {
+	case StateAlarm, StateError, StateFault:
+		return true
+	}
+	return false
+}
+
+// In reports whether s is one of states.
+func (s State) In(states []State) bool {
+	for _, state := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var checkpointMode string
+
+// checkpointInterval is how often the progress of a streamed job is saved.
+const checkpointInterval = 5 * time.Second
+
+// checkpoint is how far a job streamed to GRBL got. Lines are of the job as
+// it is streamed, after -start-line, -start-at and the profile, so they
+// only apply to the same file sent the same way.
+type checkpoint struct {
+	File      string    `json:"file"`
+	SHA256    string    `json:"sha256"`
+	Machine   string    `json:"machine,omitempty"`
+	Target    string    `json:"target"`
+	Profile   string    `json:"profile,omitempty"`
+	StartLine int       `json:"start_line,omitempty"`
+	StartAt   string    `json:"start_at,omitempty"`
+	Line      int       `json:"line"`
+	Time      time.Time `json:"time"`
+}
+
+// sameJob reports whether c is for the job other describes.
+func (c checkpoint) sameJob(other checkpoint) bool {
+	return c.SHA256 == other.SHA256 && c.Target == other.Target && c.Profile == other.Profile &&
+		c.StartLine == other.StartLine && c.StartAt == other.StartAt
+}
+
+var unsafePathCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// checkpointPath returns where the checkpoint of a target is kept, next to
+// the config file.
+func checkpointPath(target string) string {
+	if configPath == "" {
+		return ""
+	}
+	name := strings.Trim(unsafePathCharacters.ReplaceAllString(target, "_"), "_")
+	return filepath.Join(filepath.Dir(configPath), "checkpoints", name+".json")
+}
+
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// save writes the checkpoint through a temporary file, so a crash while
+// writing leaves the previous one.
+func (c checkpoint) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkpointer saves the progress of a job as GRBL acknowledges its lines.
+type checkpointer struct {
+	path  string
+	cp    checkpoint
+	saved time.Time
+	// resumed is the start of a job resumed from an earlier checkpoint,
+	// whose lines are counted from where the first run started
+	resumed *startReader
+}
+
+// ack records that GRBL acknowledged a line, saving it every
+// checkpointInterval.
+func (c *checkpointer) ack(line int) {
+	if c.resumed != nil {
+		line = c.resumed.originalLine(line)
+	}
+	c.cp.Line = line
+	if time.Since(c.saved) < checkpointInterval {
+		return
+	}
+	c.save()
+}
+
+func (c *checkpointer) save() {
+	c.cp.Time = time.Now()
+	c.saved = c.cp.Time
+	if err := c.cp.save(c.path); err != nil {
+		zap.L().Warn("failed to save checkpoint", zap.String("path", c.path), zap.Error(err))
+	}
+}
+
+// finish saves where a failed job stopped, or removes the checkpoint of a
+// job that was sent in full.
+func (c *checkpointer) finish(err error) {
+	if err == nil {
+		if removeErr := os.Remove(c.path); removeErr != nil && !os.IsNotExist(removeErr) {
+			zap.L().Warn("failed to remove checkpoint", zap.String("path", c.path), zap.Error(removeErr))
+		}
+		return
+	}
+	c.save()
+	zap.L().Info("saved checkpoint", zap.String("path", c.path), zap.Int("line", c.cp.Line))
+}
+
+// startCheckpoint sets up checkpoints for a job streamed to GRBL from a
+// local file, and resumes from an earlier checkpoint of the same job when
+// -checkpoint says so or the user agrees. It returns nil when the job is
+// not checkpointed.
+func startCheckpoint(input *jobInput, sha string) *checkpointer {
+	path := checkpointPath(serialPort)
+	if path == "" {
+		return nil
+	}
+	c := &checkpointer{path: path, cp: checkpoint{
+		File:      inputFile,
+		SHA256:    sha,
+		Machine:   machineName,
+		Target:    serialPort,
+		Profile:   profileName,
+		StartLine: startLine,
+		StartAt:   startAt,
+	}}
+	previous, err := loadCheckpoint(path)
+	if err != nil {
+		zap.L().Warn("ignoring unreadable checkpoint", zap.String("path", path), zap.Error(err))
+	}
+	switch {
+	case previous == nil:
+	case !previous.sameJob(c.cp):
+		zap.L().Info("ignoring the checkpoint of another job", zap.String("path", path), zap.String("file", previous.File))
+	case checkpointMode == "restart":
+		zap.L().Info("starting over despite a checkpoint", zap.String("path", path), zap.Int("line", previous.Line))
+	case checkpointMode == "resume" || askResume(previous):
+		c.resumed = applyStart(input, previous.Line+1, 0)
+		c.cp.Line = previous.Line
+		zap.L().Info("resuming from checkpoint", zap.String("path", path), zap.Int("line", previous.Line+1))
+	}
+	return c
+}
+
+// askResume asks on the terminal whether to resume from a checkpoint. Off
+// a terminal the job starts over.
+func askResume(previous *checkpoint) bool {
+	if !isTerminal(os.Stdin) {
+		zap.L().Warn("a checkpoint of this job exists, starting over; pass -checkpoint resume to resume from it",
+			zap.String("file", previous.File), zap.Int("line", previous.Line))
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "%s stopped after line %d on %s at %s. Resume from line %d? [Y/n] ", previous.File, previous.Line,
+		previous.Target, previous.Time.Local().Format("2006-01-02 15:04"), previous.Line+1)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "" || answer == "y" || answer == "yes"
+}
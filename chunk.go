@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// chunkAckKeyword prefixes interim acknowledgements from receivers that
+// support chunked transfers. The message carries the total number of payload
+// bytes received so far, e.g. "GCODE_CHUNK_ACK 65536".
+const chunkAckKeyword = "GCODE_CHUNK_ACK"
+
+var errChunkAck = errors.New("chunk was not acknowledged")
+
+// sendChunked copies input to out in chunkSize pieces, flushing after each
+// one and waiting for the receiver to confirm how many bytes it has. This
+// detects a failing receiver early instead of only at the final ack.
+func sendChunked(conn net.Conn, out io.Writer, w *bufio.Writer, r *bufio.Reader, input io.Reader, total, chunkSize int64, timeout time.Duration) (int64, error) {
+	var sent int64
+	for {
+		n, err := io.CopyN(out, input, chunkSize)
+		sent += n
+		if n > 0 {
+			if err := w.Flush(); err != nil {
+				zap.L().Error("failed flushing chunk", zap.Error(err), zap.Int64("offset", sent))
+				return sent, err
+			}
+			if err := waitChunkAck(conn, r, sent, timeout); err != nil {
+				return sent, err
+			}
+			zap.L().Info("chunk acknowledged", zap.Int64("sent", sent), zap.Int64("total", total), zap.Float64("percent", 100*float64(sent)/float64(total)))
+		}
+		if err == io.EOF {
+			return sent, nil
+		} else if err != nil {
+			zap.L().Error("failed sending chunk", zap.Error(err), zap.Int64("offset", sent))
+			return sent, err
+		}
+	}
+}
+
+// waitChunkAck reads the interim acknowledgement for the first sent bytes.
+func waitChunkAck(conn net.Conn, r *bufio.Reader, sent int64, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	msg, err := readMessage(r)
+	if err != nil {
+		return err
+	}
+	if rerr := carbide.ParseReceiverError(msg); rerr != nil {
+		zap.L().Error("receiver rejected the chunk", zap.String("reason", string(rerr.Reason)), zap.String("message", msg), zap.Int64("offset", sent))
+		return rerr
+	}
+	tokens := strings.Fields(msg)
+	if len(tokens) != 2 || tokens[0] != chunkAckKeyword {
+		zap.L().Error("unexpected chunk response", zap.String("message", msg), zap.Int64("offset", sent))
+		return errChunkAck
+	}
+	received, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil || received != sent {
+		zap.L().Error("receiver reported a different byte count", zap.String("message", msg), zap.Int64("sent", sent))
+		return errChunkAck
+	}
+	return nil
+}
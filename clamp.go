@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// speedClamp lowers the feeds and spindle speeds of a job to the limits of
+// a profile, for machines where a job from another one must not run faster
+// than they can.
+type speedClamp struct {
+	// maxFeed is in mm/min, 0 for no limit like maxRPM
+	maxFeed float64
+	maxRPM  float64
+	metric  bool
+	// warned is whether the first clamp was logged, which is enough
+	warnedFeed, warnedRPM bool
+}
+
+func newSpeedClamp(profile machineProfile) *speedClamp {
+	return &speedClamp{maxFeed: profile.MaxFeed, maxRPM: profile.MaxRPM, metric: true}
+}
+
+// filter is the preprocessor.
+func (c *speedClamp) filter(line string) (string, bool) {
+	if code := cleanGcodeLine(line); strings.ContainsAny(code, "Gg") {
+		if words, err := parseWords(code); err == nil {
+			for _, w := range words {
+				switch {
+				case w.letter == 'G' && w.value == 20:
+					c.metric = false
+				case w.letter == 'G' && w.value == 21:
+					c.metric = true
+				}
+			}
+		}
+	}
+	if !strings.ContainsAny(line, "FfSs") {
+		return line, true
+	}
+	var b strings.Builder
+	comment := byte(0)
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case comment == '(' && ch == ')':
+			comment = 0
+		case comment != 0:
+		case ch == '(' || ch == ';':
+			comment = ch
+		case ch == 'F' || ch == 'f' || ch == 'S' || ch == 's':
+			j := i + 1
+			for j < len(line) && (line[j] == '.' || line[j] == '-' || line[j] == '+' || (line[j] >= '0' && line[j] <= '9')) {
+				j++
+			}
+			value, err := strconv.ParseFloat(line[i+1:j], 64)
+			if err != nil {
+				break
+			}
+			if limit := c.limit(ch &^ 0x20); limit > 0 && value > limit {
+				c.warn(ch&^0x20, value, limit)
+				b.WriteByte(ch)
+				b.WriteString(strconv.FormatFloat(limit, 'f', -1, 64))
+				i = j - 1
+				continue
+			}
+		}
+		b.WriteByte(ch)
+	}
+	return b.String(), true
+}
+
+// limit is the highest value of an F or S word, in the job's units.
+func (c *speedClamp) limit(letter byte) float64 {
+	if letter == 'S' {
+		return c.maxRPM
+	}
+	if !c.metric {
+		// Rounded down to stay under the limit
+		return float64(int64(c.maxFeed/25.4*1000)) / 1000
+	}
+	return c.maxFeed
+}
+
+func (c *speedClamp) warn(letter byte, value, limit float64) {
+	switch {
+	case letter == 'F' && !c.warnedFeed:
+		c.warnedFeed = true
+		zap.L().Warn("lowering feed rates to the profile's max_feed", zap.Float64("feed", value), zap.Float64("max_feed", limit))
+	case letter == 'S' && !c.warnedRPM:
+		c.warnedRPM = true
+		zap.L().Warn("lowering spindle speeds to the profile's max_rpm", zap.Float64("speed", value), zap.Float64("max_rpm", limit))
+	}
+}
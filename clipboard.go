@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var clipboardInput bool
+
+var errEmptyClipboard = errors.New("the clipboard holds no text")
+
+var errNoClipboardTool = errors.New("no clipboard tool found, install wl-clipboard, xclip or xsel")
+
+// clipboardCommands print the text on the clipboard, in the order they are
+// tried. Linux has no clipboard of its own, so the tools of Wayland and X11
+// are tried in turn.
+func clipboardCommands() [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{{"pbpaste"}}
+	case "windows":
+		// Get-Clipboard would be written in the console's code page
+		return [][]string{{"powershell", "-NoProfile", "-Command",
+			"[Console]::OutputEncoding = [Text.Encoding]::UTF8; [Console]::Out.Write((Get-Clipboard -Raw))"}}
+	}
+	return [][]string{
+		{"wl-paste", "--no-newline", "--type", "text/plain"},
+		{"xclip", "-selection", "clipboard", "-out"},
+		{"xsel", "--clipboard", "--output"},
+	}
+}
+
+// openClipboard returns the text on the clipboard as a job, for snippets
+// pasted from a generator. It goes through the same checks as files.
+func openClipboard() (*jobInput, error) {
+	var text []byte
+	err := errNoClipboardTool
+	for _, command := range clipboardCommands() {
+		if _, lookErr := exec.LookPath(command[0]); lookErr != nil {
+			continue
+		}
+		text, err = exec.Command(command[0], command[1:]...).Output()
+		if err == nil {
+			break
+		}
+		zap.L().Debug("could not read the clipboard", zap.String("command", strings.Join(command, " ")), zap.Error(err))
+	}
+	if err != nil {
+		zap.L().Error("could not read the clipboard", zap.Error(err))
+		return nil, err
+	}
+	if len(bytes.TrimSpace(text)) == 0 {
+		zap.L().Error("the clipboard is empty, copy the gcode first")
+		return nil, errEmptyClipboard
+	}
+	// Snippets are often copied without the line end of their last line,
+	// which the controller would not run
+	if !bytes.HasSuffix(text, []byte{'\n'}) {
+		text = append(text, '\n')
+	}
+	zap.L().Debug("read the clipboard", zap.Int("size", len(text)))
+	in := &jobInput{ReadCloser: ioutil.NopCloser(bytes.NewReader(text)), name: "clipboard.nc", size: int64(len(text))}
+	if in, err = transcodeInput(in); err != nil {
+		return nil, err
+	}
+	return checkBinary(in)
+}
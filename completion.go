@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// completeCommand is the hidden command the completion scripts call to
+// get candidates for the word being completed.
+const completeCommand = "__complete"
+
+// The completion commands look at the other commands, so they are added at
+// init time to avoid an initialization cycle.
+func init() {
+	commands = append(commands,
+		command{name: "completion", usage: "print a shell completion script for bash, zsh, fish or powershell", run: runCompletion},
+		command{name: completeCommand, run: runComplete, hidden: true},
+	)
+}
+
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// commandFlags returns the flags of a command, those shared by all commands
+// and the ones register adds.
+func commandFlags(name string, register func(fs *flag.FlagSet)) (flags []*flag.Flag) {
+	fs := newFlagSet(name)
+	if register != nil {
+		register(fs)
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, f)
+	})
+	return flags
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func configMachineNames() []string {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for name := range cfg.Machines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// completions returns the candidates for the last of words, which are the
+// arguments typed so far. No candidates lets the shell complete file names.
+func completions(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current := words[len(words)-1]
+	previous := words[:len(words)-1]
+	name, register := "send", sendFlags
+	if len(previous) > 0 {
+		for _, cmd := range commands {
+			if cmd.name == previous[0] {
+				name, register = cmd.name, cmd.flags
+				previous = previous[1:]
+				break
+			}
+		}
+		if words[0] == "completion" {
+			return completionShells
+		}
+		if words[0] == "daemon" && len(previous) > 0 {
+			switch previous[0] {
+			case "install":
+				name, register = "daemon install", daemonInstallFlags
+			case "uninstall":
+				name, register = "daemon uninstall", daemonUninstallFlags
+			}
+		}
+	}
+	flags := commandFlags(name, register)
+	// Complete the value of the previous flag
+	if len(previous) > 0 && strings.HasPrefix(previous[len(previous)-1], "-") {
+		name := strings.TrimLeft(previous[len(previous)-1], "-")
+		for _, f := range flags {
+			if f.Name != name || isBoolFlag(f) || strings.Contains(name, "=") {
+				continue
+			}
+			switch name {
+			case "machine":
+				return configMachineNames()
+			case "backend":
+				return strings.Split(backendNames(), ", ")
+			case "log-format":
+				return []string{"auto", "text", "json"}
+			}
+			return nil
+		}
+	}
+	var candidates []string
+	if strings.HasPrefix(current, "-") {
+		for _, f := range flags {
+			candidates = append(candidates, "-"+f.Name)
+		}
+		return candidates
+	}
+	if len(words) == 1 {
+		for _, cmd := range commands {
+			if !cmd.hidden {
+				candidates = append(candidates, cmd.name)
+			}
+		}
+	} else if words[0] == "daemon" && len(words) == 2 {
+		candidates = []string{"install", "uninstall"}
+	} else if words[0] == "queue" && len(words) == 2 {
+		candidates = []string{"list", "inspect", "cancel", "hold", "release", "move"}
+	}
+	return candidates
+}
+
+func runComplete(args []string) error {
+	current := ""
+	if len(args) > 0 {
+		current = args[len(args)-1]
+	}
+	for _, candidate := range completions(args) {
+		if strings.HasPrefix(candidate, current) {
+			fmt.Println(candidate)
+		}
+	}
+	return nil
+}
+
+func runCompletion(args []string) error {
+	fs := newFlagSet("completion")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected one of " + strings.Join(completionShells, ", "))
+	}
+	script, ok := completionScripts[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q, expected one of %s", fs.Arg(0), strings.Join(completionShells, ", "))
+	}
+	_, err := fmt.Fprint(os.Stdout, strings.Replace(script, "__COMMAND__", completeCommand, -1))
+	return err
+}
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for send-carbide, load with: source <(send-carbide completion bash)
+_send_carbide() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	COMPREPLY=($(compgen -W "$(send-carbide __COMMAND__ "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)" -- "$cur"))
+}
+complete -o default -F _send_carbide send-carbide
+`,
+	"zsh": `#compdef send-carbide
+# zsh completion for send-carbide, load with: source <(send-carbide completion zsh)
+_send_carbide() {
+	local -a candidates
+	candidates=("${(@f)$(send-carbide __COMMAND__ "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	if [[ -n "${candidates[1]}" ]]; then
+		compadd -a candidates
+	else
+		_files
+	fi
+}
+compdef _send_carbide send-carbide
+`,
+	"fish": `# fish completion for send-carbide, load with: send-carbide completion fish | source
+function __send_carbide_complete
+	set -l words (commandline -opc) (commandline -ct)
+	send-carbide __COMMAND__ $words[2..-1] 2>/dev/null
+end
+complete -c send-carbide -a '(__send_carbide_complete)'
+`,
+	"powershell": `# PowerShell completion for send-carbide, load with:
+# send-carbide completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName send-carbide, send-carbide.exe -ScriptBlock {
+	param($wordToComplete, $commandAst, $cursorPosition)
+	$words = @($commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { $_.ToString() })
+	if ($wordToComplete -eq '') { $words += '' }
+	& send-carbide __COMMAND__ @words 2>$null | ForEach-Object {
+		[System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+	}
+}
+`,
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// config is the optional YAML configuration file. It lets users refer to
+// machines by name instead of remembering their addresses.
+type config struct {
+	Machines map[string]machineConfig  `yaml:"machines"`
+	Logging  loggingConfig             `yaml:"logging"`
+	Warmup   warmupConfig              `yaml:"warmup"`
+	Probe    probeConfig               `yaml:"probe"`
+	Profiles map[string]machineProfile `yaml:"profiles"`
+	Daemon   daemonConfig              `yaml:"daemon"`
+	Protocol protocolConfig            `yaml:"protocol"`
+	Storage  storageConfig             `yaml:"storage"`
+	// Notifications announces sends and jobs on the channels of their
+	// routes.
+	Notifications notificationsConfig `yaml:"notifications"`
+	// ConfirmAbove is the size of a job, like 50MiB, above which sending
+	// it needs confirming or -force, 0 to never ask.
+	ConfirmAbove string `yaml:"confirm_above"`
+}
+
+type machineConfig struct {
+	// Address may be a comma separated list, which is tried in order along
+	// with Addresses.
+	Address   string   `yaml:"address"`
+	Addresses []string `yaml:"addresses"`
+	// Warmup replaces the top level warm-up for this machine.
+	Warmup *warmupConfig `yaml:"warmup"`
+	// Profile is the name of the machine's profile, used unless -profile
+	// is given.
+	Profile string `yaml:"profile"`
+	// Probe replaces settings of the top level probe for this machine.
+	Probe *probeConfig `yaml:"probe"`
+}
+
+// addresses returns every configured address of the machine in order.
+func (m machineConfig) addresses() []string {
+	addresses := splitAddresses(m.Address)
+	for _, address := range m.Addresses {
+		addresses = append(addresses, splitAddresses(address)...)
+	}
+	return addresses
+}
+
+var configPath string
+var machineName string
+
+// defaultConfigPath returns the config file location, honoring the
+// SEND_CARBIDE_CONFIG environment variable.
+func defaultConfigPath() string {
+	if path := os.Getenv("SEND_CARBIDE_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "send-carbide", "config.yaml")
+}
+
+// loadConfig reads the config file. A missing file is not an error and
+// results in an empty config.
+func loadConfig() (*config, error) {
+	cfg := &config{}
+	if configPath == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		zap.L().Error("failed to read config file", zap.String("path", configPath), zap.Error(err))
+		return nil, err
+	}
+	cfg, problems := checkConfig(data, false)
+	if len(problems) > 0 {
+		err := &configError{problems: problems}
+		zap.L().Error("invalid config file", zap.String("path", configPath), zap.Int("problems", len(problems)))
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// machine looks up a named machine in the config.
+func (c *config) machine(name string) (machineConfig, error) {
+	m, ok := c.Machines[name]
+	if !ok {
+		return machineConfig{}, fmt.Errorf("unknown machine %q", name)
+	}
+	return m, nil
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+var errInvalidConfig = errors.New("invalid config file")
+
+// checkingConfig keeps initLogger from exiting on an invalid config file,
+// for config check to report it.
+var checkingConfig bool
+
+// configProblem is something wrong with the config file, or with file,
+// at the line and column of the value, and the path of keys leading to it.
+type configProblem struct {
+	file         string
+	line, column int
+	path         string
+	message      string
+}
+
+func (p configProblem) String() string {
+	location := p.file
+	if location == "" {
+		location = configPath
+	}
+	switch {
+	case p.column > 0:
+		location = fmt.Sprintf("%s:%d:%d", location, p.line, p.column)
+	case p.line > 0:
+		// The yaml parser only says the line of a syntax error
+		location = fmt.Sprintf("%s:%d", location, p.line)
+	}
+	if p.path == "" {
+		return location + ": " + p.message
+	}
+	return location + ": " + p.path + ": " + p.message
+}
+
+// configError is an invalid config file. It matches errInvalidConfig.
+type configError struct {
+	problems []configProblem
+}
+
+func (e *configError) Error() string {
+	lines := make([]string, len(e.problems))
+	for i, p := range e.problems {
+		lines[i] = p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *configError) Is(target error) bool {
+	return target == errInvalidConfig
+}
+
+// yamlLinePattern finds the line of the errors of the yaml parser.
+var yamlLinePattern = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// configChecker checks a config file against the fields of config, then
+// what the values mean, remembering where each value is for the problems.
+type configChecker struct {
+	// file is checked when it isn't the config file
+	file     string
+	nodes    map[string]*yaml.Node
+	problems []configProblem
+	// resolve looks up the addresses of the machines too, which config
+	// check does but starting a command doesn't
+	resolve bool
+}
+
+// checkConfig parses a config file and returns it along with everything
+// wrong with it, in the order of the file, so a typo in a profile doesn't
+// go unnoticed until a job runs past the travel.
+func checkConfig(data []byte, resolve bool) (*config, []configProblem) {
+	c := &configChecker{nodes: map[string]*yaml.Node{}, resolve: resolve}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, []configProblem{yamlProblem("", err)}
+	}
+	cfg := &config{}
+	if len(root.Content) == 0 {
+		return cfg, nil
+	}
+	c.check(root.Content[0], reflect.TypeOf(config{}), "")
+	if len(c.problems) > 0 {
+		return nil, c.problems
+	}
+	if err := root.Decode(cfg); err != nil {
+		return nil, []configProblem{{message: err.Error()}}
+	}
+	c.checkValues(cfg)
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		return c.problems[i].line < c.problems[j].line
+	})
+	return cfg, c.problems
+}
+
+// yamlProblem is the syntax error of the yaml parser in file.
+func yamlProblem(file string, err error) configProblem {
+	p := configProblem{file: file, message: strings.TrimPrefix(err.Error(), "yaml: ")}
+	if m := yamlLinePattern.FindStringSubmatch(err.Error()); m != nil {
+		p.line, _ = strconv.Atoi(m[1])
+		p.message = strings.TrimPrefix(err.Error(), m[0])
+	}
+	return p
+}
+
+func (c *configChecker) add(path string, format string, args ...interface{}) {
+	p := configProblem{file: c.file, path: path, message: fmt.Sprintf(format, args...)}
+	// A missing value is reported on the closest one that is there
+	for key := path; ; key = parentPath(key) {
+		if n := c.nodes[key]; n != nil {
+			p.line, p.column = n.Line, n.Column
+			break
+		}
+		if key == "" {
+			break
+		}
+	}
+	c.problems = append(c.problems, p)
+}
+
+// parentPath is the path of the mapping or list a value is in.
+func parentPath(path string) string {
+	if i := strings.LastIndexAny(path, ".["); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// check compares a node with the Go type it is decoded into.
+func (c *configChecker) check(n *yaml.Node, t reflect.Type, path string) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	c.nodes[path] = n
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			c.add(path, "expected a mapping of %s", strings.Join(yamlFields(t), ", "))
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			field, ok := yamlField(t, key)
+			if !ok {
+				c.nodes[joinPath(path, key)] = n.Content[i]
+				c.add(joinPath(path, key), "unknown field, expected one of %s", strings.Join(yamlFields(t), ", "))
+				continue
+			}
+			c.check(n.Content[i+1], field.Type, joinPath(path, key))
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			c.add(path, "expected a mapping of names")
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			c.check(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value))
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			c.add(path, "expected a list")
+			return
+		}
+		for i, item := range n.Content {
+			c.check(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.String:
+		if n.Kind != yaml.ScalarNode {
+			c.add(path, "expected a string")
+		}
+	case reflect.Bool:
+		if _, err := strconv.ParseBool(n.Value); n.Kind != yaml.ScalarNode || (n.Tag != "!!bool" && err != nil) {
+			c.add(path, "expected true or false, not %q", n.Value)
+		}
+	case reflect.Int, reflect.Int64:
+		if n.Kind != yaml.ScalarNode || n.Tag != "!!int" {
+			c.add(path, "expected a whole number, not %q", n.Value)
+		}
+	case reflect.Float64:
+		if n.Kind != yaml.ScalarNode || (n.Tag != "!!int" && n.Tag != "!!float") {
+			c.add(path, "expected a number, not %q", n.Value)
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// yamlField finds the field of a struct with the yaml key.
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); strings.Split(f.Tag.Get("yaml"), ",")[0] == key {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// yamlFields are the keys of a struct.
+func yamlFields(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		if key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; key != "" && key != "-" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// checkValues checks what the values of a config with the right fields
+// mean: that the machines have addresses and existing profiles, and the
+// profiles limits a machine can have.
+func (c *configChecker) checkValues(cfg *config) {
+	for _, name := range sortedKeys(cfg.Profiles) {
+		path := "profiles." + name
+		p := cfg.Profiles[name]
+		if _, err := lookupProfile(cfg, name); err != nil {
+			key := path + ".base"
+			if strings.Contains(err.Error(), "preprocessor") {
+				key = path + ".preprocessors"
+			}
+			c.add(key, "%v", err)
+		}
+		for axis, travel := range map[string]float64{"x": p.Travel.X, "y": p.Travel.Y, "z": p.Travel.Z} {
+			if travel < 0 {
+				c.add(path+".travel."+axis, "travel must not be negative")
+			}
+		}
+		for key, value := range map[string]float64{"max_feed": p.MaxFeed, "max_rpm": p.MaxRPM, "spindle_dwell": p.SpindleDwell, "pause_below": p.PauseBelow} {
+			if value < 0 {
+				c.add(path+"."+key, "must not be negative")
+			}
+		}
+		if p.Clamp && p.MaxFeed == 0 && p.MaxRPM == 0 && p.Base == "" {
+			c.add(path+".clamp", "clamps nothing without a max_feed or max_rpm")
+		}
+		for i, state := range p.AllowStates {
+			if strings.TrimSpace(state) == "" {
+				c.add(fmt.Sprintf("%s.allow_states[%d]", path, i), "empty state")
+			}
+		}
+	}
+	for _, name := range sortedKeys(cfg.Machines) {
+		path := "machines." + name
+		m := cfg.Machines[name]
+		if len(m.addresses()) == 0 {
+			c.add(path, "no address or addresses")
+		}
+		if _, err := dialersFor(m.addresses()); c.resolve && len(m.addresses()) > 0 && err != nil {
+			c.add(path+".address", "%v", err)
+		}
+		if m.Profile != "" {
+			if _, err := lookupProfile(cfg, m.Profile); err != nil {
+				c.add(path+".profile", "%v", err)
+			}
+		}
+		if m.Warmup != nil {
+			c.checkWarmup(path+".warmup", *m.Warmup)
+		}
+	}
+	c.checkWarmup("warmup", cfg.Warmup)
+	if cfg.ConfirmAbove != "" {
+		if _, err := parseByteSize(cfg.ConfirmAbove); err != nil {
+			c.add("confirm_above", "%v", err)
+		}
+	}
+	if _, err := cfg.Protocol.framing(); err != nil {
+		c.add("protocol", "%v", err)
+	}
+	for key, location := range map[string]string{"history": cfg.Storage.History, "artifacts": cfg.Storage.Artifacts} {
+		if err := checkStorage(location); err != nil {
+			c.add("storage."+key, "%v", err)
+		}
+	}
+	for _, name := range sortedKeys(cfg.Notifications.Channels) {
+		if _, err := newNotifier(cfg.Notifications.Channels[name]); err != nil {
+			c.add("notifications.channels."+name, "%v", err)
+		}
+	}
+	for i, route := range cfg.Notifications.Routes {
+		if err := cfg.Notifications.checkRoute(route); err != nil {
+			c.add(fmt.Sprintf("notifications.routes[%d]", i), "%v", err)
+		}
+	}
+	switch strings.ToLower(cfg.Logging.Sink) {
+	case "", "syslog", "journald", "journal":
+	default:
+		c.add("logging.sink", "unknown log sink %q, use syslog or journald", cfg.Logging.Sink)
+	}
+	seen := map[string]bool{}
+	for i, l := range cfg.Daemon.Listeners {
+		path := fmt.Sprintf("daemon.listeners[%d]", i)
+		switch {
+		case l.Address == "":
+			c.add(path, "no address")
+		case seen[l.Address]:
+			c.add(path+".address", "%s is listened on twice", l.Address)
+		}
+		seen[l.Address] = true
+	}
+	for i, route := range cfg.Daemon.Routes {
+		if err := route.check(cfg); err != nil {
+			c.add(fmt.Sprintf("daemon.routes[%d]", i), "%v", err)
+		}
+	}
+	users := map[string]bool{"anonymous": true}
+	for _, l := range cfg.Daemon.Listeners {
+		for user := range l.Users {
+			users[user] = true
+		}
+		for _, token := range l.Tokens {
+			users[tokenIdentity(token)] = true
+		}
+	}
+	for _, name := range sortedKeys(cfg.Daemon.Roles) {
+		path := "daemon.roles." + name
+		role := cfg.Daemon.Roles[name]
+		for i, member := range role.Members {
+			if !users[member] {
+				c.add(fmt.Sprintf("%s.members[%d]", path, i), "%q is no user or token of the listeners", member)
+			}
+		}
+		for i, machine := range role.Machines {
+			if _, ok := cfg.Machines[machine]; !ok && machine != "*" {
+				c.add(fmt.Sprintf("%s.machines[%d]", path, i), "unknown machine %q", machine)
+			}
+		}
+	}
+}
+
+func (c *configChecker) checkWarmup(path string, w warmupConfig) {
+	for key, value := range map[string]float64{"from": float64(w.From), "to": float64(w.To), "minutes": w.Minutes, "steps": float64(w.Steps)} {
+		if value < 0 {
+			c.add(path+"."+key, "must not be negative")
+		}
+	}
+	if w.From > 0 && w.To > 0 && w.To < w.From {
+		c.add(path+".to", "is below from")
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configTemplate is what config init writes, with the settings most
+// configs need commented.
+const configTemplate = `# send-carbide config, see https://github.com/bobcob7/send-carbide#configuration
+# Check it with: send-carbide config check
+
+machines:
+  {{machine}}:
+    address: {{address}}
+    # The profile's travel and limits are checked before every send
+    profile: {{profile}}
+
+# profiles:
+#   {{machine}}:
+#     base: {{profile}}
+#     max_feed: 4000
+#     preamble: ["G21", "G90"]
+#     preprocessors: [strip-comments]
+#     clamp: true
+
+# Jobs larger than this need confirming or -force, 0 to never ask
+# confirm_above: 50MiB
+`
+
+// runConfig checks the config file, or writes a new one.
+var configForce bool
+
+func configFlags(fs *flag.FlagSet) {
+	fs.StringVar(&profileName, "profile", "shapeoko3", "with init, the profile of the machine")
+	fs.BoolVar(&configForce, "force", false, "with init, overwrite an existing config file")
+}
+
+func runConfig(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("config")
+	configFlags(fs)
+	checkingConfig = true
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) != 1 {
+		fs.PrintDefaults()
+		zap.L().Error("use config check or config init", zap.Strings("args", positional))
+		return errors.New("config needs check or init")
+	}
+	switch positional[0] {
+	case "check":
+		return runConfigCheck()
+	case "init":
+		return runConfigInit(fs, configForce)
+	}
+	fs.PrintDefaults()
+	zap.L().Error("unknown config command, use check or init", zap.String("command", positional[0]))
+	return fmt.Errorf("unknown config command %q", positional[0])
+}
+
+func runConfigCheck() error {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		zap.L().Error("failed to read config file", zap.String("path", configPath), zap.Error(err))
+		return err
+	}
+	cfg, problems := checkConfig(data, true)
+	if len(problems) > 0 {
+		return printProblems(os.Stdout, problems)
+	}
+	fmt.Printf("%s is valid: %d machines, %d profiles\n", configPath, len(cfg.Machines), len(cfg.Profiles))
+	return nil
+}
+
+// printProblems writes each problem on a line and returns them as the
+// error.
+func printProblems(w io.Writer, problems []configProblem) error {
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+	return &configError{problems: problems}
+}
+
+func runConfigInit(fs *flag.FlagSet, force bool) error {
+	if !flagGiven(fs, "address") {
+		fs.PrintDefaults()
+		zap.L().Error("config init needs the -address of the machine")
+		return errors.New("config init needs the -address of the machine")
+	}
+	if fileExists(configPath) && !force {
+		zap.L().Error("config file exists, pass -force to overwrite it", zap.String("path", configPath))
+		return fmt.Errorf("%s exists", configPath)
+	}
+	if _, ok := builtinProfiles[profileName]; !ok {
+		zap.L().Error("not a built-in profile", zap.String("profile", profileName), zap.Strings("profiles", sortedKeys(builtinProfiles)))
+		return fmt.Errorf("unknown profile %q", profileName)
+	}
+	machine := machineName
+	if machine == "" {
+		machine = "shop"
+	}
+	data := strings.NewReplacer("{{machine}}", machine, "{{address}}", serverAddress, "{{profile}}", profileName).Replace(configTemplate)
+	if _, problems := checkConfig([]byte(data), false); len(problems) > 0 {
+		return &configError{problems: problems}
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0o755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(configPath, []byte(data), 0o644); err != nil {
+		zap.L().Error("failed to write config file", zap.String("path", configPath), zap.Error(err))
+		return err
+	}
+	fmt.Printf("wrote %s with machine %s at %s\n", configPath, machine, serverAddress)
+	return nil
+}
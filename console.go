@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// consoleStateInterval is how often the console refreshes the machine state
+// in its prompt.
+const consoleStateInterval = 2 * time.Second
+
+// consoleHistoryLines is how many entered lines the console keeps.
+const consoleHistoryLines = 1000
+
+const consoleHelp = `Lines are run as gcode. Tool commands start with a colon:
+  :status        show the machine state
+  :send <file>   send a gcode file as a job
+  :abort         discard the job on the machine
+  :estop         halt the machine at once
+  :pause         hold the running job
+  :resume        continue a held job
+  :home          run the homing cycle
+  :override <feed|rapid|spindle> <change>
+                 change an override, e.g. :override feed +10%
+  :history       show entered lines
+  :help          show this help
+  :quit          leave the console
+`
+
+// console is an interactive session with one machine.
+type console struct {
+	c      controller
+	editor *lineEditor
+	// mu serialises requests to the machine between the prompt and the
+	// state poller.
+	mu    sync.Mutex
+	state carbide.State
+}
+
+func consoleHistoryPath() string {
+	if configPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configPath), "console_history")
+}
+
+// loadConsoleHistory reads the lines entered in earlier sessions.
+func loadConsoleHistory() []string {
+	path := consoleHistoryPath()
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			zap.L().Warn("failed to read console history", zap.String("path", path), zap.Error(err))
+		}
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > consoleHistoryLines {
+		lines = lines[len(lines)-consoleHistoryLines:]
+	}
+	return lines
+}
+
+// appendConsoleHistory records an entered line. Failures are logged and
+// otherwise ignored.
+func appendConsoleHistory(line string) {
+	path := consoleHistoryPath()
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		zap.L().Warn("failed to create console history directory", zap.String("path", path), zap.Error(err))
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		zap.L().Warn("failed to open console history", zap.String("path", path), zap.Error(err))
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+func consoleFlags(fs *flag.FlagSet) {
+	controlFlags(fs, 30*time.Second)
+	fs.StringVar(&allowedStates, "allow-state", "init", "comma separated list of machine states that permit sending")
+}
+
+func runConsole(args []string) error {
+	fs := newFlagSet("console")
+	consoleFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	c, err := openController()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer c.Close()
+	s := &console{c: c}
+	s.state, err = c.State()
+	if err != nil {
+		return err
+	}
+	s.editor = newLineEditor(os.Stdin, os.Stdout, loadConsoleHistory())
+	defer s.editor.Close()
+	refresh := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.pollState(refresh, stop)
+	if isTerminal(os.Stdin) {
+		s.editor.printf("connected to %s, type :help for commands\n", c.Target())
+	}
+	for {
+		line, err := s.editor.readLine(s.prompt, refresh)
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		appendConsoleHistory(line)
+		if line == ":quit" || line == ":exit" {
+			return nil
+		}
+		if err := s.run(line); err != nil {
+			s.editor.printf("%s %v\n", paint(colorRed, "error:"), err)
+			printSuggestion(s.editor.out, err)
+		}
+	}
+}
+
+// prompt shows the target and the last known machine state.
+func (s *console) prompt() string {
+	s.mu.Lock()
+	state := s.state
+	s.mu.Unlock()
+	color := colorGreen
+	switch stateExitCode(state) {
+	case statusExitBusy:
+		color = colorYellow
+	case statusExitFault, statusExitUnknown:
+		color = colorRed
+	}
+	return fmt.Sprintf("%s [%s]> ", s.c.Target(), paint(color, state.String()))
+}
+
+// pollState keeps the state in the prompt current and redraws the prompt
+// when it changes.
+func (s *console) pollState(refresh chan<- struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(consoleStateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		state, err := s.c.State()
+		if err != nil {
+			state = carbide.StateUnknown
+		}
+		changed := state != s.state
+		s.state = state
+		s.mu.Unlock()
+		if changed {
+			select {
+			case refresh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// run runs an entered line, either a tool command or a line of gcode.
+func (s *console) run(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.HasPrefix(line, ":") {
+		response, err := s.c.Gcode(line)
+		if err != nil {
+			return err
+		}
+		s.editor.printf("%s\n", response)
+		return s.updateState()
+	}
+	fields := strings.Fields(line[1:])
+	if len(fields) == 0 {
+		return errors.New("missing command, type :help for commands")
+	}
+	switch name := fields[0]; name {
+	case "help":
+		s.editor.printf("%s", consoleHelp)
+	case "history":
+		for i, entry := range s.editor.history {
+			s.editor.printf("%5d  %s\n", i+1, entry)
+		}
+	case "status":
+		if err := s.updateState(); err != nil {
+			return err
+		}
+		s.editor.printf("%s is %s\n", s.c.Target(), s.state)
+	case "send":
+		if len(fields) != 2 {
+			return errors.New("usage: :send <file>")
+		}
+		summary, err := sendFile(s.c, fields[1])
+		if err != nil {
+			return err
+		}
+		s.editor.printf("sent %s (%s) to %s\n", fields[1], summary, s.c.Target())
+		return s.updateState()
+	case "abort":
+		if err := s.c.Abort(); err != nil {
+			return err
+		}
+		s.editor.printf("aborted the job on %s\n", s.c.Target())
+		return s.updateState()
+	case "estop":
+		if err := s.c.EStop(); err != nil {
+			return err
+		}
+		s.editor.printf("stopped %s, home the machine before running again\n", s.c.Target())
+		return s.updateState()
+	case "override":
+		if len(fields) != 3 {
+			return errors.New("usage: :override <feed|rapid|spindle> <change>")
+		}
+		change, err := parseOverrideChange(fields[1], fields[2])
+		if err != nil {
+			return err
+		}
+		levels, err := s.c.Override(change)
+		if err != nil {
+			return err
+		}
+		s.editor.printf("%s\n", levels)
+	case "pause", "resume", "home":
+		before, after, err := changeState(s.c, name)
+		if after != "" {
+			s.state = after
+		}
+		if err != nil {
+			return err
+		}
+		s.editor.printf("%s -> %s\n", before, after)
+	default:
+		return fmt.Errorf("unknown command :%s, type :help for commands", name)
+	}
+	return nil
+}
+
+// updateState refreshes the state shown in the prompt. The caller holds mu.
+func (s *console) updateState() error {
+	state, err := s.c.State()
+	if err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+var errUnsupported = errors.New("not supported")
+var errRequestRefused = errors.New("machine refused the request")
+var errUnexpectedState = errors.New("machine is not in the expected state")
+
+var controlTimeout time.Duration
+
+// statePollInterval is how often a command checks whether the machine has
+// reached the state it should be in.
+const statePollInterval = 250 * time.Millisecond
+
+// controller is implemented by backends that can run commands on the
+// machine besides sending jobs. Commands the receiver doesn't understand
+// fail with errUnsupported.
+type controller interface {
+	Sender
+	// State reports the current machine state.
+	State() (carbide.State, error)
+	// Abort discards the job the machine is receiving or has queued.
+	Abort() error
+	// EStop halts the machine at once.
+	EStop() error
+	// Pause holds the running job and Resume continues it.
+	Pause() error
+	Resume() error
+	// Home runs the homing cycle and returns once it has finished.
+	Home() error
+	// Gcode runs a single line of gcode and returns the controller's
+	// response.
+	Gcode(line string) (string, error)
+	// Override changes the feed, rapid or spindle override and returns
+	// the levels afterwards.
+	Override(change overrideChange) (overrides, error)
+}
+
+// openController sets up the -backend for a machine command.
+func openController() (controller, error) {
+	// The file backend has no machine to control
+	if backend == "file" {
+		zap.L().Error("backend cannot control the machine", zap.String("backend", backend))
+		return nil, fmt.Errorf("%w by the %s backend", errUnsupported, backend)
+	}
+	sender, err := newSender(backend)
+	if err != nil {
+		zap.L().Error("failed to set up backend", zap.String("backend", backend), zap.Error(err))
+		return nil, err
+	}
+	c, ok := sender.(controller)
+	if !ok {
+		sender.Close()
+		zap.L().Error("backend cannot control the machine", zap.String("backend", backend))
+		return nil, fmt.Errorf("%w by the %s backend", errUnsupported, backend)
+	}
+	return c, nil
+}
+
+// controlFlags adds the flags of a machine command that waits up to timeout
+// for the machine by default.
+func controlFlags(fs *flag.FlagSet, timeout time.Duration) {
+	addBackendFlags(fs)
+	fs.DurationVar(&controlTimeout, "timeout", timeout, "how long to wait for the machine to answer")
+}
+
+func abortFlags(fs *flag.FlagSet) { controlFlags(fs, 5*time.Second) }
+func estopFlags(fs *flag.FlagSet) { controlFlags(fs, 2*time.Second) }
+func zeroFlags(fs *flag.FlagSet)  { controlFlags(fs, 5*time.Second) }
+func mdiFlags(fs *flag.FlagSet)   { controlFlags(fs, 30*time.Second) }
+
+// wcsCoordinates are the -x, -y and -z of set-wcs.
+var wcsCoordinates [3]string
+
+func setWCSFlags(fs *flag.FlagSet) {
+	controlFlags(fs, 5*time.Second)
+	for i, axis := range []string{"x", "y", "z"} {
+		fs.StringVar(&wcsCoordinates[i], axis, "", "make the current "+strings.ToUpper(axis)+" position this coordinate")
+	}
+}
+
+func runAbort(args []string) error {
+	fs := newFlagSet("abort")
+	abortFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	c, err := openController()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer c.Close()
+	if err := c.Abort(); err != nil {
+		return err
+	}
+	zap.L().Info("aborted job", zap.String("target", c.Target()))
+	fmt.Printf("aborted the job on %s\n", c.Target())
+	return nil
+}
+
+// runEStop halts the machine without checking its state first, so it is as
+// quick as it can be.
+func runEStop(args []string) error {
+	fs := newFlagSet("estop")
+	estopFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	c, err := openController()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer c.Close()
+	if err := c.EStop(); err != nil {
+		zap.L().Error("emergency stop failed, stop the machine by hand", zap.String("target", c.Target()), zap.Error(err))
+		return err
+	}
+	zap.L().Info("emergency stop", zap.String("target", c.Target()))
+	fmt.Printf("stopped %s, home the machine before running again\n", c.Target())
+	return nil
+}
+
+// stateChange is a command that moves the machine from one of the from
+// states to one of the to states.
+type stateChange struct {
+	timeout time.Duration
+	from    []carbide.State
+	to      []carbide.State
+	do      func(controller) error
+}
+
+var stateChanges = map[string]stateChange{
+	"pause": {5 * time.Second, []carbide.State{carbide.StateRunning},
+		[]carbide.State{carbide.StatePaused, carbide.StateHold}, controller.Pause},
+	"resume": {5 * time.Second, []carbide.State{carbide.StatePaused, carbide.StateHold},
+		[]carbide.State{carbide.StateRunning, carbide.StateIdle}, controller.Resume},
+	"home": {2 * time.Minute, []carbide.State{carbide.StateInit, carbide.StateIdle, carbide.StateAlarm},
+		[]carbide.State{carbide.StateInit, carbide.StateIdle}, controller.Home},
+}
+
+func runPause(args []string) error {
+	return runStateChange("pause", args)
+}
+
+func runResume(args []string) error {
+	return runStateChange("resume", args)
+}
+
+func runHome(args []string) error {
+	return runStateChange("home", args)
+}
+
+// stateChangeFlags returns the flags of the named state change command.
+func stateChangeFlags(name string) func(fs *flag.FlagSet) {
+	return func(fs *flag.FlagSet) {
+		controlFlags(fs, stateChanges[name].timeout)
+	}
+}
+
+func runStateChange(name string, args []string) error {
+	fs := newFlagSet(name)
+	stateChangeFlags(name)(fs)
+	fs.Parse(args)
+	initLogger()
+	c, err := openController()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer c.Close()
+	before, after, err := changeState(c, name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s -> %s on %s\n", before, after, c.Target())
+	return nil
+}
+
+// changeState runs the named state change and checks the state before and
+// after. It returns both states.
+func changeState(c controller, name string) (carbide.State, carbide.State, error) {
+	change := stateChanges[name]
+	before, err := c.State()
+	if err != nil {
+		return carbide.StateUnknown, carbide.StateUnknown, err
+	}
+	if !before.In(change.from) {
+		zap.L().Error("machine is not in a state to "+name, zap.Stringer("state", before), zap.Any("expected", change.from))
+		return before, carbide.StateUnknown, fmt.Errorf("%w: cannot %s while %s", errUnexpectedState, name, before)
+	}
+	if err := change.do(c); err != nil {
+		return before, carbide.StateUnknown, err
+	}
+	after, err := waitState(c, change.to)
+	if err != nil {
+		return before, after, err
+	}
+	zap.L().Info("changed machine state", zap.String("command", name), zap.Stringer("before", before), zap.Stringer("after", after))
+	return before, after, nil
+}
+
+// waitState polls the machine until it reports one of states, for at most
+// -timeout, and returns the last state seen.
+func waitState(c controller, states []carbide.State) (carbide.State, error) {
+	deadline := time.Now().Add(controlTimeout)
+	for {
+		state, err := c.State()
+		if err != nil {
+			return carbide.StateUnknown, err
+		}
+		if state.In(states) {
+			return state, nil
+		}
+		if time.Now().After(deadline) {
+			zap.L().Error("machine did not reach the expected state", zap.Stringer("state", state), zap.Any("expected", states))
+			return state, fmt.Errorf("%w: still %s after %v", errUnexpectedState, state, controlTimeout)
+		}
+		time.Sleep(statePollInterval)
+	}
+}
+
+// wcsNumbers maps work coordinate systems to their G10 P number.
+var wcsNumbers = map[string]int{"G54": 1, "G55": 2, "G56": 3, "G57": 4, "G58": 5, "G59": 6}
+
+// leadingArgs splits off the arguments before the first flag, so commands
+// read naturally as "zero x -machine shop". Negative numbers like "-10%"
+// are arguments, not flags.
+func leadingArgs(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") && !(len(arg) > 1 && arg[1] >= '0' && arg[1] <= '9') {
+			return args[:i], args[i:]
+		}
+	}
+	return args, nil
+}
+
+func runZero(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("zero")
+	zeroFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	axes := strings.ToUpper(strings.Join(append(positional, fs.Args()...), ""))
+	if axes == "ALL" {
+		axes = "XYZ"
+	}
+	if axes == "" || strings.Trim(axes, "XYZ") != "" {
+		fs.PrintDefaults()
+		zap.L().Error("invalid axes, use x, y, z, a combination like xy, or all", zap.String("axes", axes))
+		return fmt.Errorf("invalid axes %q", axes)
+	}
+	// P0 is the work coordinate system in use
+	line := "G10 L20 P0"
+	for _, axis := range "XYZ" {
+		if strings.ContainsRune(axes, axis) {
+			line += " " + string(axis) + "0"
+		}
+	}
+	return runWorkOffset(fs, line)
+}
+
+func runSetWCS(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("set-wcs")
+	setWCSFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) != 1 {
+		fs.PrintDefaults()
+		zap.L().Error("set-wcs needs one work coordinate system, G54 to G59", zap.Strings("args", positional))
+		return errors.New("set-wcs needs one work coordinate system")
+	}
+	wcs := strings.ToUpper(positional[0])
+	number, ok := wcsNumbers[wcs]
+	if !ok {
+		fs.PrintDefaults()
+		zap.L().Error("invalid work coordinate system, use G54 to G59", zap.String("wcs", positional[0]))
+		return fmt.Errorf("invalid work coordinate system %q", positional[0])
+	}
+	line := fmt.Sprintf("G10 L20 P%d", number)
+	for i, axis := range []string{"X", "Y", "Z"} {
+		if wcsCoordinates[i] == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(wcsCoordinates[i], 64)
+		if err != nil {
+			zap.L().Error("invalid coordinate", zap.String("axis", axis), zap.String("value", wcsCoordinates[i]))
+			return fmt.Errorf("invalid -%s %q", strings.ToLower(axis), wcsCoordinates[i])
+		}
+		line += " " + axis + strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	if line == fmt.Sprintf("G10 L20 P%d", number) {
+		fs.PrintDefaults()
+		zap.L().Error("set-wcs needs at least one of -x, -y and -z")
+		return errors.New("set-wcs needs at least one of -x, -y and -z")
+	}
+	return runWorkOffset(fs, line)
+}
+
+// runWorkOffset runs a G10 line that changes a work offset, once the
+// machine is at rest.
+func runWorkOffset(fs *flag.FlagSet, line string) error {
+	c, err := openController()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer c.Close()
+	state, err := c.State()
+	if err != nil {
+		return err
+	}
+	if !state.Ready() {
+		zap.L().Error("machine must be at rest to change work offsets", zap.Stringer("state", state))
+		return fmt.Errorf("%w: cannot change work offsets while %s", errUnexpectedState, state)
+	}
+	if _, err := c.Gcode(line); err != nil {
+		return err
+	}
+	zap.L().Info("set work offset", zap.String("gcode", line), zap.String("target", c.Target()))
+	fmt.Printf("%s on %s\n", line, c.Target())
+	return nil
+}
+
+func runMDI(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("mdi")
+	mdiFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	line := strings.TrimSpace(strings.Join(append(positional, fs.Args()...), " "))
+	if line == "" || strings.ContainsAny(line, "\r\n") {
+		fs.PrintDefaults()
+		zap.L().Error("mdi needs a single line of gcode, e.g. mdi \"G0 X0 Y0\"")
+		return errors.New("mdi needs a single line of gcode")
+	}
+	c, err := openController()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer c.Close()
+	state, err := c.State()
+	if err != nil {
+		return err
+	}
+	if stateExitCode(state) == statusExitBusy {
+		zap.L().Error("machine is busy with a job", zap.Stringer("state", state))
+		return fmt.Errorf("%w: cannot run gcode while %s", errUnexpectedState, state)
+	}
+	response, err := c.Gcode(line)
+	if err != nil {
+		return err
+	}
+	fmt.Println(response)
+	return nil
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type jobStatus string
+
+const (
+	jobQueued  jobStatus = "queued"
+	jobSending jobStatus = "sending"
+	jobDone    jobStatus = "done"
+	jobFailed  jobStatus = "failed"
+	// jobCancelled jobs were pulled from the queue before they were sent
+	jobCancelled jobStatus = "cancelled"
+	// jobExpired jobs sat queued past their TTL and were never sent
+	jobExpired jobStatus = "expired"
+)
+
+var errUnknownJob = errors.New("unknown job")
+
+var errJobNotQueued = errors.New("job is no longer queued")
+
+// job is a gcode file submitted to the daemon for a machine.
+type job struct {
+	ID        string     `json:"id"`
+	Machine   string     `json:"machine"`
+	Name      string     `json:"name"`
+	Size      int64      `json:"size"`
+	Status    jobStatus  `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	// Priority orders the queued jobs of a machine, higher first, then in
+	// submission order
+	Priority int `json:"priority,omitempty"`
+	// NotBefore is the earliest time the job may start
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	// Held jobs stay queued until they are released
+	Held bool `json:"held,omitempty"`
+	// ExpiresAt is when the job expires if it is still queued, its TTL
+	// after it was submitted or, when it was scheduled, after it may start
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Tags were given with the job, to route it to a machine
+	Tags []string `json:"tags,omitempty"`
+	// Metadata is what the comments at the start of the job say about it
+	Metadata *jobMetadata `json:"metadata,omitempty"`
+	// SubmittedBy is who submitted the job, see clientIdentity
+	SubmittedBy string `json:"submitted_by,omitempty"`
+	// Phases are how long the steps of sending the job took
+	Phases *sendPhases `json:"phases,omitempty"`
+	// EstimatedSeconds is how long the job should run on the machine, and
+	// RuntimeSeconds how long it ran once it was sent, when the machine
+	// was seen running it and back in init
+	EstimatedSeconds float64 `json:"estimated_seconds,omitempty"`
+	RuntimeSeconds   float64 `json:"runtime_seconds,omitempty"`
+	// SHA256 names the copy of the job kept in the artifacts once it was
+	// sent
+	SHA256 string `json:"sha256,omitempty"`
+	// Findings are the problems the preflight found in the job on a model
+	// of its machine
+	Findings []simulationFinding `json:"findings,omitempty"`
+	path     string
+	// preflighted is closed once the preflight ran, nil before it started,
+	// and estimated is its estimate before the machine's past runs
+	// corrected it
+	preflighted chan struct{}
+	estimated   float64
+}
+
+// jobQueue holds the jobs of every machine in submission order. Each machine
+// has a wake channel its worker blocks on while its queue is empty, and the
+// preflight blocks on checks while every job was checked.
+type jobQueue struct {
+	mu     sync.Mutex
+	jobs   map[string]*job
+	order  []*job
+	wake   map[string]chan struct{}
+	checks chan struct{}
+}
+
+func newJobQueue(machines []string) *jobQueue {
+	q := &jobQueue{
+		jobs:   make(map[string]*job),
+		wake:   make(map[string]chan struct{}, len(machines)),
+		checks: make(chan struct{}, 1),
+	}
+	for _, name := range machines {
+		q.wake[name] = make(chan struct{}, 1)
+	}
+	return q
+}
+
+func newJobID() string {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// add queues a job and wakes its machine worker and the preflight.
+func (q *jobQueue) add(j *job) {
+	q.mu.Lock()
+	q.jobs[j.ID] = j
+	q.order = append(q.order, j)
+	wake := q.wake[j.Machine]
+	q.mu.Unlock()
+	for _, c := range []chan struct{}{wake, q.checks} {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next blocks until machine has a job that may start and returns the one
+// with the highest priority, or returns nil once stop is closed. Held jobs
+// and jobs scheduled for later are skipped.
+func (q *jobQueue) next(machine string, stop <-chan struct{}) *job {
+	for {
+		best, soonest := q.pick(machine)
+		q.mu.Lock()
+		wake := q.wake[machine]
+		q.mu.Unlock()
+		if best != nil {
+			return best
+		}
+		// Wake up for the first scheduled job too
+		var timer *time.Timer
+		var scheduled <-chan time.Time
+		if !soonest.IsZero() {
+			timer = time.NewTimer(time.Until(soonest))
+			scheduled = timer.C
+		}
+		select {
+		case <-wake:
+		case <-scheduled:
+		case <-stop:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+	}
+}
+
+// pick returns the queued job of machine that should start now, or nil and
+// the time the first scheduled job may start.
+func (q *jobQueue) pick(machine string) (best *job, soonest time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for _, j := range q.order {
+		if j.Machine != machine || j.Status != jobQueued || j.Held || j.expired(now) {
+			continue
+		}
+		if j.NotBefore != nil && now.Before(*j.NotBefore) {
+			if soonest.IsZero() || j.NotBefore.Before(soonest) {
+				soonest = *j.NotBefore
+			}
+			continue
+		}
+		if best == nil || j.Priority > best.Priority {
+			best = j
+		}
+	}
+	return best, soonest
+}
+
+// unchecked starts the preflight of the queued job that should be checked
+// next, the one of highest priority in submission order, and returns it.
+// It returns nil when every job was checked.
+func (q *jobQueue) unchecked() *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next *job
+	for _, j := range q.order {
+		if j.Status != jobQueued || j.preflighted != nil {
+			continue
+		}
+		if next == nil || j.Priority > next.Priority {
+			next = j
+		}
+	}
+	if next != nil {
+		next.preflighted = make(chan struct{})
+	}
+	return next
+}
+
+// check starts the preflight of a job unless it was started already.
+// start is whether it was, and done is closed once the preflight ran.
+func (q *jobQueue) check(j *job) (done <-chan struct{}, start bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j.preflighted != nil {
+		return j.preflighted, false
+	}
+	j.preflighted = make(chan struct{})
+	return j.preflighted, true
+}
+
+// queued applies fn to a job that is still queued while holding the
+// queue lock, and returns a copy of it. Its machine worker is woken in
+// case fn made the job startable.
+func (q *jobQueue) queued(id string, fn func(j *job)) (job, error) {
+	q.mu.Lock()
+	j, ok := q.jobs[id]
+	if !ok {
+		q.mu.Unlock()
+		return job{}, errUnknownJob
+	}
+	if j.Status != jobQueued {
+		q.mu.Unlock()
+		return *j, errJobNotQueued
+	}
+	fn(j)
+	copied := *j
+	wake := q.wake[j.Machine]
+	q.mu.Unlock()
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return copied, nil
+}
+
+// hold holds a queued job, or releases it.
+func (q *jobQueue) hold(id string, held bool) (job, error) {
+	return q.queued(id, func(j *job) {
+		j.Held = held
+		if !held && j.Error == interruptedReason {
+			j.Error = ""
+		}
+	})
+}
+
+// cancel pulls a queued job from the queue.
+func (q *jobQueue) cancel(id string) (job, error) {
+	return q.queued(id, func(j *job) {
+		now := time.Now()
+		j.Status = jobCancelled
+		j.Finished = &now
+	})
+}
+
+// prioritize sets the priority of a queued job: a number, or "top" or
+// "bottom" to run it before or after the other queued jobs of its machine.
+func (q *jobQueue) prioritize(id string, priority string) (job, error) {
+	var parseErr error
+	j, err := q.queued(id, func(j *job) {
+		switch priority {
+		case "top", "bottom":
+			first := true
+			for _, other := range q.order {
+				if other == j || other.Machine != j.Machine || other.Status != jobQueued {
+					continue
+				}
+				if priority == "top" && (first || other.Priority >= j.Priority) {
+					j.Priority = other.Priority + 1
+				} else if priority == "bottom" && (first || other.Priority <= j.Priority) {
+					j.Priority = other.Priority - 1
+				}
+				first = false
+			}
+		default:
+			n, err := strconv.Atoi(priority)
+			if err != nil {
+				parseErr = fmt.Errorf("invalid priority %q, use a number, top or bottom", priority)
+				return
+			}
+			j.Priority = n
+		}
+	})
+	if parseErr != nil {
+		return j, parseErr
+	}
+	return j, err
+}
+
+// claim marks a job as being sent, unless it was cancelled or held since
+// it was picked.
+func (q *jobQueue) claim(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	if j.Status != jobQueued || j.Held || j.expired(now) {
+		return false
+	}
+	j.Status = jobSending
+	j.Started = &now
+	return true
+}
+
+// expire marks the queued jobs past their TTL expired and returns copies of
+// them.
+func (q *jobQueue) expire(now time.Time) []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var expired []job
+	for _, j := range q.order {
+		if j.Status == jobQueued && j.expired(now) {
+			j.Status = jobExpired
+			j.Finished = &now
+			expired = append(expired, *j)
+		}
+	}
+	return expired
+}
+
+// update applies fn to a job while holding the queue lock.
+func (q *jobQueue) update(j *job, fn func(j *job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fn(j)
+}
+
+// get returns a copy of a job.
+func (q *jobQueue) get(id string) (job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, errUnknownJob
+	}
+	return *j, nil
+}
+
+// list returns copies of all jobs in submission order.
+func (q *jobQueue) list() []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]job, 0, len(q.order))
+	for _, j := range q.order {
+		jobs = append(jobs, *j)
+	}
+	return jobs
+}
+
+// daemon dispatches queued jobs to the machines from the config file.
+type daemon struct {
+	cfg       *config
+	queue     *jobQueue
+	spool     string
+	listeners []listenerConfig
+	limiter   *requestLimiter
+	metrics   *phaseMetrics
+	audit     *auditLog
+	// maxUpload is the largest job accepted, 0 for no limit
+	maxUpload int64
+	// basePath is the path the API and upload page are served under
+	basePath string
+	events   *eventHub
+	// artifacts keeps the jobs sent, nil to not keep them
+	artifacts *artifactStore
+	// jobTTL is how long jobs may stay queued by default, 0 for ever
+	jobTTL time.Duration
+	// shutdownTimeout is how long a shutdown waits for the jobs being
+	// sent, 0 for as long as they take
+	shutdownTimeout time.Duration
+	// busy holds a token of each machine while a job is sent to it
+	busy map[string]chan struct{}
+	// stop is closed when the daemon shuts down
+	stop    <-chan struct{}
+	workers sync.WaitGroup
+}
+
+func (d *daemon) machineNames() []string {
+	names := make([]string, 0, len(d.cfg.Machines))
+	for name := range d.cfg.Machines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runMachine is the worker of one machine. It sends the machine's jobs one
+// at a time, each only once the machine reports an allowed state, and keeps
+// going when a job fails. A job that is already being sent is finished
+// before the worker honors stop.
+func (d *daemon) runMachine(name string, stop <-chan struct{}) {
+	defer d.workers.Done()
+	m := d.cfg.Machines[name]
+	for {
+		j := d.queue.next(name, stop)
+		if j == nil {
+			return
+		}
+		if !d.waitReady(name, m, stop) {
+			return
+		}
+		// Jobs may have been held, released or submitted while waiting
+		if j, _ = d.queue.pick(name); j == nil {
+			continue
+		}
+		d.dispatch(j, m)
+	}
+}
+
+// waitReady polls the machine until it can accept a job, in the states its
+// profile allows. It returns false if stop is closed first.
+func (d *daemon) waitReady(name string, m machineConfig, stop <-chan struct{}) bool {
+	states := d.allowedStates(m)
+	logged := false
+	for {
+		dialers, err := dialersFor(m.addresses())
+		if err == nil {
+			state, err := pooledState(dialers)
+			d.events.machineState(name, state, err)
+			if err == nil {
+				if isAllowedState(state, states) {
+					return true
+				}
+				if !logged {
+					zap.L().Info("waiting for machine to become ready", zap.String("machine", name), zap.Stringer("state", state))
+					logged = true
+				}
+			}
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// allowedStates are the states the machine may be sent a job in: the
+// allow_states of its profile, or -allow-state when it has none.
+func (d *daemon) allowedStates(m machineConfig) string {
+	if m.Profile != "" {
+		if profile, err := lookupProfile(d.cfg, m.Profile); err == nil && len(profile.AllowStates) > 0 {
+			return strings.Join(profile.AllowStates, ",")
+		}
+	}
+	return allowedStates
+}
+
+func (d *daemon) dispatch(j *job, m machineConfig) {
+	busy := d.busy[j.Machine]
+	busy <- struct{}{}
+	defer func() { <-busy }()
+	if !d.queue.claim(j) {
+		return
+	}
+	if started, err := d.queue.get(j.ID); err == nil {
+		d.events.jobEvent(daemonEventStarted, started)
+	}
+	zap.L().Info("dispatching job", zap.String("job", j.ID), zap.String("machine", j.Machine), zap.String("name", j.Name))
+	estimated := d.estimate(j)
+	phases, err := d.send(j, m)
+	d.metrics.record(j.Machine, phases, err)
+	finished := time.Now()
+	hash, artifact := d.artifacts.keep(j.path)
+	d.queue.update(j, func(j *job) {
+		j.Finished = &finished
+		j.Phases = phases
+		j.SHA256 = hash
+		if err != nil {
+			j.Status = jobFailed
+			j.Error = err.Error()
+		} else {
+			j.Status = jobDone
+		}
+	})
+	result, event := "ok", daemonEventDone
+	if err != nil {
+		result, event = err.Error(), daemonEventFailed
+	}
+	if finished, getErr := d.queue.get(j.ID); getErr == nil {
+		d.events.jobEvent(event, finished)
+	}
+	d.audit.record(auditEntry{Client: j.SubmittedBy, Action: "send", Job: j.ID, Machine: j.Machine, Name: j.Name, Result: result})
+	if err != nil {
+		zap.L().Error("job failed", zap.String("job", j.ID), zap.String("machine", j.Machine), zap.Error(err))
+	} else {
+		zap.L().Info("job done", zap.String("job", j.ID), zap.String("machine", j.Machine))
+		os.Remove(j.path)
+		if estimated > 0 {
+			d.workers.Add(1)
+			go d.trackRun(j, m, estimated)
+		}
+	}
+	appendHistory(historyEntry{
+		Time:     finished,
+		Kind:     historyKindSend,
+		Machine:  j.Machine,
+		Address:  m.Address,
+		File:     j.Name,
+		Size:     j.Size,
+		Result:   result,
+		Metadata: j.Metadata,
+		Job:      j.ID,
+		SHA256:   hash,
+		Artifact: artifact,
+	})
+}
+
+func (d *daemon) send(j *job, m machineConfig) (*sendPhases, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sender, err := newCarbideSenderFor(m.addresses())
+	if err != nil {
+		return nil, err
+	}
+	defer sender.Close()
+	sender.keep = true
+	sender.states = d.allowedStates(m)
+	err = sender.Send(j.Name, f, j.Size)
+	return sender.Phases(), err
+}
+
+// serve runs the API and machine workers until stop is closed, then stops
+// accepting jobs and waits for in-flight transfers to complete.
+func (d *daemon) serve(stop <-chan struct{}) error {
+	d.stop = stop
+	for _, name := range d.machineNames() {
+		d.workers.Add(1)
+		go d.runMachine(name, stop)
+		d.workers.Add(1)
+		go d.watchMachine(name, stop)
+	}
+	if d.artifacts != nil {
+		d.workers.Add(1)
+		go d.pruneArtifacts(stop)
+	}
+	d.workers.Add(1)
+	go d.expireJobs(stop)
+	d.workers.Add(1)
+	go d.preflightJobs(stop)
+	handler := d.handler()
+	rpc := d.newGRPCServer()
+	var servers []*http.Server
+	serveErr := make(chan error, len(d.listeners))
+	for _, l := range d.listeners {
+		l := l
+		authenticate := func(next http.Handler) http.Handler { return d.limiter.limit(l.authenticate(next, d.audit)) }
+		api := basePath(d.basePath, d.limiter.limit(cors(l.authenticate(handler, d.audit))))
+		server := &http.Server{Addr: l.Address, Handler: serveGRPC(rpc, authenticate, api)}
+		servers = append(servers, server)
+		go func() {
+			serveErr <- server.ListenAndServe()
+		}()
+		zap.L().Info("daemon listening", zap.String("listen", l.Address), zap.Bool("auth", !l.open()), zap.Strings("machines", d.machineNames()))
+	}
+	var err error
+	select {
+	case err = <-serveErr:
+		zap.L().Error("daemon stopped", zap.Error(err))
+	case <-stop:
+		zap.L().Info("shutting down, waiting for in-flight jobs")
+	}
+	d.events.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+			zap.L().Warn("failed to stop API cleanly", zap.String("listen", server.Addr), zap.Error(shutdownErr))
+		}
+	}
+	if err != nil {
+		d.saveQueue()
+		return err
+	}
+	d.waitWorkers()
+	d.saveQueue()
+	zap.L().Info("daemon stopped")
+	return nil
+}
+
+var daemonListen, daemonSpool string
+var daemonRateLimit int
+var daemonMaxUpload byteSize
+var daemonBasePath, daemonOrigins, daemonProxies string
+var daemonAuditFile string
+var daemonArtifacts string
+var daemonArtifactRetention time.Duration
+var daemonArtifactLimit byteSize
+var daemonJobTTL time.Duration
+var daemonShutdownTimeout time.Duration
+
+func daemonFlags(fs *flag.FlagSet) {
+	daemonMaxUpload = 512 << 20
+	fs.StringVar(&daemonListen, "listen", "", "address for the HTTP API to listen on (default: the daemon listeners of the config file, or 127.0.0.1:6281)")
+	fs.StringVar(&daemonSpool, "spool", "", "directory for submitted files (default: spool next to the config file)")
+	fs.StringVar(&allowedStates, "allow-state", "init", "comma separated list of machine states that permit sending")
+	fs.DurationVar(&pollInterval, "poll-interval", 5*time.Second, "how often to check the state of machines with queued jobs")
+	fs.DurationVar(&ackTimeout, "ack-timeout", 10*time.Minute, "how long to wait for a machine to acknowledge a job, 0 waits forever")
+	fs.DurationVar(&lockWait, "lock-wait", 30*time.Minute, "how long a job waits for a manual send to the same machine to finish")
+	fs.IntVar(&daemonRateLimit, "rate-limit", 600, "requests a minute each client address may make to the API, 0 for no limit")
+	fs.Var(&daemonMaxUpload, "max-upload", "largest job accepted, 0 for no limit")
+	fs.StringVar(&daemonBasePath, "base-path", "", "serve the API and upload page under this path, like /cnc, for a reverse proxy that passes it on")
+	fs.StringVar(&daemonOrigins, "cors-origin", "", "comma separated web origins allowed to call the API from a browser, like https://shop.example.com, or * for any")
+	fs.StringVar(&daemonAuditFile, "audit-log", "", "append who submitted, changed and sent which jobs to this file, off to not keep one (default: audit.jsonl next to the config file)")
+	fs.StringVar(&daemonArtifacts, "artifacts", "", "keep a copy of every job sent in this directory or database URL, named by its SHA-256, so it can be sent again as it ran (default: storage.artifacts of the config file, or keep none)")
+	fs.DurationVar(&daemonArtifactRetention, "artifact-retention", 30*24*time.Hour, "how long a kept job is kept after it was last sent, 0 for ever")
+	fs.Var(&daemonArtifactLimit, "artifact-limit", "most the kept jobs may take together, the least recently sent are removed past it, 0 for no limit")
+	fs.DurationVar(&daemonJobTTL, "job-ttl", 0, "expire jobs still queued this long after they were submitted or scheduled to start, so a forgotten job doesn't start unattended days later, 0 for never; a submission may pass its own ttl")
+	fs.DurationVar(&daemonShutdownTimeout, "shutdown-timeout", 10*time.Minute, "on SIGTERM, how long to wait for the jobs being sent before saving them held and exiting, 0 waits for as long as they take")
+	fs.StringVar(&daemonProxies, "trusted-proxy", "127.0.0.1,::1", "comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is trusted")
+}
+
+func runDaemon(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "install":
+			return runDaemonInstall(args[1:])
+		case "uninstall":
+			return runDaemonUninstall(args[1:])
+		}
+	}
+	fs := newFlagSet("daemon")
+	daemonFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	proxyNets, err := parseTrustedProxies(daemonProxies)
+	if err != nil {
+		fs.PrintDefaults()
+		zap.L().Error("invalid -trusted-proxy", zap.Error(err))
+		return err
+	}
+	trustedProxies = proxyNets
+	corsOrigins = splitAddresses(daemonOrigins)
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if len(cfg.Machines) == 0 {
+		zap.L().Error("no machines configured", zap.String("config", configPath))
+		return errors.New("no machines configured")
+	}
+	if daemonSpool == "" {
+		daemonSpool = filepath.Join(filepath.Dir(configPath), "spool")
+	}
+	if err := os.MkdirAll(daemonSpool, 0o755); err != nil {
+		zap.L().Error("failed to create spool directory", zap.String("spool", daemonSpool), zap.Error(err))
+		return err
+	}
+	listeners := cfg.Daemon.Listeners
+	if len(listeners) == 0 {
+		if daemonListen == "" {
+			daemonListen = "127.0.0.1:6281"
+		}
+		listeners = []listenerConfig{{Address: daemonListen}}
+	} else if daemonListen != "" {
+		zap.L().Error("-listen can't be used with daemon listeners in the config file", zap.String("config", configPath))
+		return errors.New("-listen can't be used with daemon listeners in the config file")
+	}
+	if daemonAuditFile == "" {
+		daemonAuditFile = auditPath()
+	}
+	audit, err := openAuditLog(daemonAuditFile)
+	if err != nil {
+		zap.L().Error("failed to open audit log", zap.String("path", daemonAuditFile), zap.Error(err))
+		return err
+	}
+	defer audit.Close()
+	if !flagGiven(fs, "artifacts") {
+		daemonArtifacts = storagePath(storage.Artifacts)
+	}
+	artifacts, err := openArtifactStore(daemonArtifacts, daemonArtifactRetention, int64(daemonArtifactLimit))
+	if err != nil {
+		zap.L().Error("failed to open artifact storage", zap.String("artifacts", redactLocation(daemonArtifacts)), zap.Error(err))
+		return err
+	}
+	d := &daemon{cfg: cfg, spool: daemonSpool, listeners: listeners, limiter: newRequestLimiter(daemonRateLimit), metrics: newPhaseMetrics(), audit: audit,
+		maxUpload: int64(daemonMaxUpload), basePath: daemonBasePath, artifacts: artifacts, jobTTL: daemonJobTTL,
+		shutdownTimeout: daemonShutdownTimeout}
+	d.queue = newJobQueue(d.machineNames())
+	d.events = newEventHub()
+	d.busy = make(map[string]chan struct{}, len(cfg.Machines))
+	for name := range cfg.Machines {
+		d.busy[name] = make(chan struct{}, 1)
+	}
+	if err := d.restoreQueue(); err != nil {
+		return err
+	}
+	if handled, err := runUnderServiceManager(d.serve); handled {
+		return err
+	}
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		zap.L().Info("received signal", zap.String("signal", sig.String()))
+		close(stop)
+	}()
+	return d.serve(stop)
+}
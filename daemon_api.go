@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type machineStatus struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Queued  int    `json:"queued"`
+	// Permitted is whether the client may send to the machine
+	Permitted bool `json:"permitted"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// requestError is a request the API refuses, with the HTTP status it is
+// answered with. The gRPC API answers it with the matching code.
+type requestError struct {
+	status int
+	msg    string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func refuse(status int, format string, args ...interface{}) error {
+	return &requestError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// writeRequestError answers a request that failed with err, with the
+// status of a requestError and 500 Internal Server Error for any other.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var rerr *requestError
+	if errors.As(err, &rerr) {
+		writeError(w, rerr.status, "%s", rerr.msg)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "%v", err)
+}
+
+// handler returns the daemon's HTTP API:
+//
+//	POST /jobs?machine=<name>&name=<file>  submit a job, body is the gcode,
+//	                                      optionally with &priority=<n>,
+//	                                      &after=<time>, &hold=true and
+//	                                      &ttl=<duration>
+//	GET  /jobs                            list jobs
+//	GET  /jobs/<id>                       inspect a job
+//	DELETE /jobs/<id>                     cancel a queued job
+//	POST /jobs/<id>/hold                  keep a queued job from starting
+//	POST /jobs/<id>/release               let a held job start
+//	POST /jobs/<id>/priority?priority=<n> reorder a queued job, n is a
+//	                                      number, top or bottom
+//	GET  /machines                        list machines and queue lengths
+//	GET  /events[?machine=<name>]         stream machine state changes and
+//	                                      job events as server-sent events
+//	GET  /artifacts/<sha256>              the kept copy of a sent job
+//	POST /preflight?machine=<name>        check a job on a model of the
+//	                                      machine without queueing it
+//	GET  /metrics                         send counts and phase times in
+//	                                      the Prometheus text format
+//	GET  /healthz                         whether the daemon is up
+//	GET  /readyz[?machine=<name>]         whether the machines answer
+//	GET  /                                the upload page
+//
+// The listeners answer the same requests over gRPC too, see serveGRPC.
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", d.handleMetrics)
+	mux.HandleFunc("/healthz", d.handleHealth)
+	mux.HandleFunc("/readyz", d.handleReady)
+	mux.HandleFunc("/", uploadPage)
+	mux.HandleFunc("/preflight", d.preflight)
+	mux.HandleFunc("/jobs", d.handleJobs)
+	mux.HandleFunc("/jobs/", d.handleJob)
+	mux.HandleFunc("/machines", d.handleMachines)
+	mux.HandleFunc("/events", d.handleEvents)
+	mux.HandleFunc("/artifacts/", d.handleArtifact)
+	return mux
+}
+
+func (d *daemon) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, d.queue.list())
+	case http.MethodPost:
+		d.submit(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+func (d *daemon) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	action := ""
+	if i := strings.IndexByte(id, '/'); i >= 0 {
+		id, action = id[:i], id[i+1:]
+	}
+	if action == "cancel" {
+		// Cancelling is DELETE /jobs/<id>
+		writeError(w, http.StatusNotFound, "unknown action %q", action)
+		return
+	}
+	method := http.MethodPost
+	if action == "" {
+		method = http.MethodGet
+		if r.Method == http.MethodDelete {
+			method = http.MethodDelete
+		}
+	}
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	var j job
+	var err error
+	if r.Method == http.MethodGet {
+		if j, err = d.queue.get(id); err != nil {
+			err = refuse(http.StatusNotFound, "%v %q", err, id)
+		}
+	} else {
+		if action == "" {
+			action = "cancel"
+		}
+		j, err = d.changeJob(r, id, action, r.URL.Query().Get("priority"))
+	}
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+// changeJob cancels, holds, releases or reorders a job by action, for the
+// client of r when it may, and records it in the audit log.
+func (d *daemon) changeJob(r *http.Request, id, action, priority string) (job, error) {
+	// Unknown jobs are answered below, like to those who may change them
+	if j, err := d.queue.get(id); err == nil {
+		if err := d.allowed(r, d.cfg.Daemon.permissions(clientIdentity(r)).change(clientIdentity(r), j),
+			auditEntry{Action: action, Job: id, Machine: j.Machine, Name: j.Name}); err != nil {
+			return job{}, err
+		}
+	}
+	var j job
+	var err error
+	switch action {
+	case "cancel":
+		if j, err = d.queue.cancel(id); err == nil {
+			d.events.jobEvent(daemonEventCancelled, j)
+			os.Remove(j.path)
+			zap.L().Info("job cancelled", zap.String("job", id), zap.String("machine", j.Machine))
+		}
+	case "hold", "release":
+		if j, err = d.queue.hold(id, action == "hold"); err == nil {
+			event := daemonEventHeld
+			if action == "release" {
+				event = daemonEventReleased
+			}
+			d.events.jobEvent(event, j)
+			zap.L().Info("job "+action+"d", zap.String("job", id), zap.String("machine", j.Machine))
+		}
+	case "priority":
+		if j, err = d.queue.prioritize(id, priority); err == nil {
+			d.events.jobEvent(daemonEventReordered, j)
+			zap.L().Info("job reordered", zap.String("job", id), zap.String("machine", j.Machine), zap.Int("priority", j.Priority))
+		}
+	default:
+		return job{}, refuse(http.StatusNotFound, "unknown action %q", action)
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	d.audit.request(r, auditEntry{Action: action, Job: id, Machine: j.Machine, Name: j.Name, Result: result})
+	switch {
+	case errors.Is(err, errUnknownJob):
+		return j, refuse(http.StatusNotFound, "%v %q", err, id)
+	case errors.Is(err, errJobNotQueued):
+		return j, refuse(http.StatusConflict, "%v: %s is %s", err, id, j.Status)
+	case err != nil:
+		return j, refuse(http.StatusBadRequest, "%v", err)
+	}
+	return j, nil
+}
+
+func (d *daemon) handleMachines(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.machineStatuses(r))
+}
+
+// machineStatuses returns the machines, as the client of r sees them.
+func (d *daemon) machineStatuses(r *http.Request) []machineStatus {
+	queued := map[string]int{}
+	for _, j := range d.queue.list() {
+		if j.Status == jobQueued {
+			queued[j.Machine]++
+		}
+	}
+	p := d.cfg.Daemon.permissions(clientIdentity(r))
+	var machines []machineStatus
+	for _, name := range d.machineNames() {
+		m := d.cfg.Machines[name]
+		machines = append(machines, machineStatus{Name: name, Address: strings.Join(m.addresses(), ","), Queued: queued[name], Permitted: p.send(name)})
+	}
+	return machines
+}
+
+// submit spools the request body and queues it for the requested machine.
+func (d *daemon) submit(w http.ResponseWriter, r *http.Request) {
+	if d.tooLarge(w, r.ContentLength) {
+		return
+	}
+	j, err := d.enqueue(r, r.URL.Query(), r.Body)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, j)
+}
+
+// enqueue spools body and queues it for the client of r, as query says:
+// the machine, name, tags and schedule of a submission to POST /jobs.
+func (d *daemon) enqueue(r *http.Request, query url.Values, body io.Reader) (job, error) {
+	select {
+	case <-d.stop:
+		return job{}, refuse(http.StatusServiceUnavailable, "the daemon is shutting down")
+	default:
+	}
+	tags := parseTags(query)
+	machine := query.Get("machine")
+	if machine == "" && len(d.cfg.Daemon.Routes) > 0 {
+		routed, route, err := d.route(filepath.Base(query.Get("name")), tags, d.cfg.Daemon.permissions(clientIdentity(r)).send)
+		if err != nil {
+			return job{}, refuse(http.StatusBadRequest, "%v", err)
+		}
+		zap.L().Debug("routed job", zap.String("name", query.Get("name")), zap.Strings("tags", tags), zap.String("route", route.String()), zap.String("machine", routed))
+		machine = routed
+	}
+	if machine == "" {
+		return job{}, refuse(http.StatusBadRequest, "no machine given, and the daemon has no routes to pick one")
+	}
+	if _, ok := d.cfg.Machines[machine]; !ok {
+		return job{}, refuse(http.StatusBadRequest, "unknown machine %q", machine)
+	}
+	if err := d.allowed(r, d.cfg.Daemon.permissions(clientIdentity(r)).send(machine), auditEntry{Action: "submit", Machine: machine, Name: query.Get("name")}); err != nil {
+		return job{}, err
+	}
+	priority, notBefore, held, err := parseSchedule(query)
+	if err != nil {
+		return job{}, refuse(http.StatusBadRequest, "%v", err)
+	}
+	ttl := d.jobTTL
+	if value := query.Get("ttl"); value != "" {
+		if ttl, err = time.ParseDuration(value); err != nil || ttl < 0 {
+			return job{}, refuse(http.StatusBadRequest, "invalid ttl %q, use a duration like 12h, or 0 to never expire", value)
+		}
+	}
+	if d.maxUpload > 0 {
+		body = io.LimitReader(body, d.maxUpload+1)
+	}
+	id := newJobID()
+	name := filepath.Base(query.Get("name"))
+	if name == "." || name == "/" {
+		name = "job-" + id + ".nc"
+	}
+	path := filepath.Join(d.spool, id+".nc")
+	f, err := os.Create(path)
+	if err != nil {
+		zap.L().Error("failed to create spool file", zap.String("path", path), zap.Error(err))
+		return job{}, refuse(http.StatusInternalServerError, "failed to spool job")
+	}
+	size, err := io.Copy(f, body)
+	f.Close()
+	if err != nil {
+		os.Remove(path)
+		return job{}, refuse(http.StatusBadRequest, "failed to read job: %v", err)
+	}
+	if err := d.checkSize(size); err != nil {
+		os.Remove(path)
+		return job{}, err
+	}
+	if size == 0 {
+		os.Remove(path)
+		return job{}, refuse(http.StatusBadRequest, "empty job")
+	}
+	// The comments at the start are read before a preamble comes before them
+	metadata := fileMetadata(path)
+	if size, err = d.applyMachineProfile(path, d.cfg.Machines[machine]); err != nil {
+		os.Remove(path)
+		zap.L().Error("failed to apply machine profile", zap.String("path", path), zap.String("machine", machine), zap.Error(err))
+		return job{}, refuse(http.StatusInternalServerError, "failed to apply the profile of machine %q", machine)
+	}
+	j := &job{
+		ID:          id,
+		Machine:     machine,
+		Name:        name,
+		Size:        size,
+		Status:      jobQueued,
+		Submitted:   time.Now(),
+		Priority:    priority,
+		NotBefore:   notBefore,
+		Held:        held,
+		Tags:        tags,
+		Metadata:    metadata,
+		SubmittedBy: clientIdentity(r),
+		path:        path,
+	}
+	if ttl > 0 {
+		expires := j.Submitted.Add(ttl)
+		if notBefore != nil && notBefore.After(j.Submitted) {
+			expires = notBefore.Add(ttl)
+		}
+		j.ExpiresAt = &expires
+	}
+	d.queue.add(j)
+	if submitted, err := d.queue.get(id); err == nil {
+		d.events.jobEvent(daemonEventSubmitted, submitted)
+	}
+	d.audit.request(r, auditEntry{Action: "submit", Job: id, Machine: machine, Name: name, Result: "ok"})
+	zap.L().Info("job submitted", zap.String("job", id), zap.String("machine", machine), zap.String("name", name), zap.Int64("size", size),
+		zap.Int("priority", priority), zap.Bool("held", held))
+	return *j, nil
+}
+
+// applyMachineProfile rewrites the job spooled at path with the profile of
+// the machine, once, so the preflight checks the program the machine gets.
+// It returns the size of the job as it is sent.
+func (d *daemon) applyMachineProfile(path string, m machineConfig) (int64, error) {
+	if m.Profile == "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	profile, err := lookupProfile(d.cfg, m.Profile)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	input := &jobInput{ReadCloser: f, name: filepath.Base(path), size: -1, path: path}
+	applyProfile(input, profile)
+	defer input.Close()
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(out, input)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return size, nil
+}
+
+// parseSchedule parses the priority, start time and hold of a submission.
+func parseSchedule(query url.Values) (priority int, notBefore *time.Time, held bool, err error) {
+	if value := query.Get("priority"); value != "" {
+		if priority, err = strconv.Atoi(value); err != nil {
+			return 0, nil, false, fmt.Errorf("invalid priority %q", value)
+		}
+	}
+	if value := query.Get("after"); value != "" {
+		t, err := parseStartTime(value, time.Now())
+		if err != nil {
+			return 0, nil, false, err
+		}
+		notBefore = &t
+	}
+	if value := query.Get("hold"); value != "" {
+		if held, err = strconv.ParseBool(value); err != nil {
+			return 0, nil, false, fmt.Errorf("invalid hold %q", value)
+		}
+	}
+	return priority, notBefore, held, nil
+}
+
+// uploadBody returns the body of an upload, cut off past -max-upload. A
+// request that says it is larger is answered 413 Request Entity Too Large
+// without reading it.
+func (d *daemon) uploadBody(w http.ResponseWriter, r *http.Request) (io.Reader, bool) {
+	if d.maxUpload <= 0 {
+		return r.Body, true
+	}
+	if d.tooLarge(w, r.ContentLength) {
+		return nil, false
+	}
+	return io.LimitReader(r.Body, d.maxUpload+1), true
+}
+
+// tooLarge answers 413 Request Entity Too Large when size is past
+// -max-upload.
+func (d *daemon) tooLarge(w http.ResponseWriter, size int64) bool {
+	if err := d.checkSize(size); err != nil {
+		writeRequestError(w, err)
+		return true
+	}
+	return false
+}
+
+// checkSize refuses a job of size bytes when it is past -max-upload.
+func (d *daemon) checkSize(size int64) error {
+	if d.maxUpload <= 0 || size <= d.maxUpload {
+		return nil
+	}
+	return refuse(http.StatusRequestEntityTooLarge, "job is larger than the limit of %s", formatByteSize(d.maxUpload))
+}
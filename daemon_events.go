@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// Events of the daemon's /events stream. A job event carries the job as it
+// is after the change.
+const (
+	daemonEventState     = "state"
+	daemonEventSubmitted = "submitted"
+	daemonEventCancelled = "cancelled"
+	daemonEventHeld      = "held"
+	daemonEventReleased  = "released"
+	daemonEventReordered = "reordered"
+	daemonEventStarted   = "started"
+	daemonEventDone      = "done"
+	daemonEventFailed    = "failed"
+	daemonEventExpired   = "expired"
+	// daemonEventChecked is a queued job the preflight checked and
+	// estimated
+	daemonEventChecked = "checked"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// it is dropped, so a stalled dashboard doesn't hold up the queue.
+const subscriberBuffer = 64
+
+// keepaliveInterval is how often a comment is written to an idle stream,
+// so proxies don't close it.
+const keepaliveInterval = 30 * time.Second
+
+// daemonEvent is an event of the /events stream.
+type daemonEvent struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Machine string    `json:"machine"`
+	// State is what the machine answered, empty when it couldn't be
+	// reached and Error says why
+	State carbide.State `json:"state,omitempty"`
+	Error string        `json:"error,omitempty"`
+	Job   *job          `json:"job,omitempty"`
+}
+
+// eventHub passes the events of the daemon on to its subscribers. It
+// remembers the last state of each machine, which a new subscriber gets
+// first.
+type eventHub struct {
+	mu          sync.Mutex
+	id          int64
+	states      map[string]daemonEvent
+	subscribers map[chan daemonEvent]bool
+	closed      chan struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{states: make(map[string]daemonEvent), subscribers: make(map[chan daemonEvent]bool), closed: make(chan struct{})}
+}
+
+// publish sends an event to every subscriber, dropping those that fell too
+// far behind.
+func (h *eventHub) publish(e daemonEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.id++
+	e.ID, e.Time = h.id, time.Now()
+	if e.Event == daemonEventState {
+		h.states[e.Machine] = e
+	}
+	for events := range h.subscribers {
+		select {
+		case events <- e:
+		default:
+			zap.L().Warn("dropping event subscriber that fell behind", zap.Int("buffer", subscriberBuffer))
+			delete(h.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// machineState publishes the state of a machine when it changed since it
+// was last seen.
+func (h *eventHub) machineState(machine string, state carbide.State, err error) {
+	e := daemonEvent{Event: daemonEventState, Machine: machine, State: state}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	h.mu.Lock()
+	last, seen := h.states[machine]
+	h.mu.Unlock()
+	if seen && last.State == e.State && last.Error == e.Error {
+		return
+	}
+	h.publish(e)
+}
+
+// jobEvent publishes a change of a job, and notifies the channels routed
+// the event.
+func (h *eventHub) jobEvent(event string, j job) {
+	h.publish(daemonEvent{Event: event, Machine: j.Machine, Job: &j})
+	notifications.dispatch(jobNotification(event, &j))
+}
+
+// subscribe returns a channel of the events from now on, after the last
+// known state of every machine. It is closed when the subscriber falls
+// behind or the daemon shuts down.
+func (h *eventHub) subscribe() chan daemonEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := make(chan daemonEvent, subscriberBuffer+len(h.states))
+	for _, e := range h.states {
+		events <- e
+	}
+	select {
+	case <-h.closed:
+		close(events)
+	default:
+		h.subscribers[events] = true
+	}
+	return events
+}
+
+func (h *eventHub) unsubscribe(events chan daemonEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[events] {
+		delete(h.subscribers, events)
+		close(events)
+	}
+}
+
+// watching is whether anyone is subscribed.
+func (h *eventHub) watching() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers) > 0
+}
+
+// close ends every stream, so shutting down doesn't wait for them.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	close(h.closed)
+	for events := range h.subscribers {
+		delete(h.subscribers, events)
+		close(events)
+	}
+}
+
+// watchMachine checks the state of a machine every -poll-interval while
+// anyone is subscribed to the events, so state changes are streamed when
+// no job waits for it too. It leaves the machine alone while a job is
+// being sent to it.
+func (d *daemon) watchMachine(name string, stop <-chan struct{}) {
+	defer d.workers.Done()
+	busy := d.busy[name]
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if !d.events.watching() {
+			continue
+		}
+		select {
+		case busy <- struct{}{}:
+		default:
+			continue
+		}
+		dialers, err := dialersFor(d.cfg.Machines[name].addresses())
+		var state carbide.State
+		if err == nil {
+			state, err = pooledState(dialers)
+		}
+		<-busy
+		d.events.machineState(name, state, err)
+	}
+}
+
+// handleEvents streams machine state changes and job events as server-sent
+// events, of every machine or of the ?machine= ones:
+//
+//	event: started
+//	id: 12
+//	data: {"id":12,"time":"...","event":"started","machine":"shop","job":{...}}
+func (d *daemon) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	machines := map[string]bool{}
+	for _, name := range splitAddresses(r.URL.Query().Get("machine")) {
+		if _, ok := d.cfg.Machines[name]; !ok {
+			writeError(w, http.StatusNotFound, "unknown machine %q", name)
+			return
+		}
+		machines[name] = true
+	}
+	events := d.events.subscribe()
+	defer d.events.unsubscribe(events)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	zap.L().Debug("event subscriber connected", zap.String("remote", clientAddress(r)), zap.String("machine", strings.Join(splitAddresses(r.URL.Query().Get("machine")), ",")))
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if len(machines) > 0 && !machines[e.Machine] {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", e.Event, e.ID, data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			zap.L().Debug("event subscriber disconnected", zap.String("remote", clientAddress(r)))
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/daemonpb"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer is the daemon's gRPC API, daemonpb.Daemon. It is served on
+// the listeners of the HTTP API, behind the same authentication and rate
+// limit, and answers server reflection so clients can be generated from
+// it. Its methods do what the HTTP API's requests do, as the client of
+// the HTTP request carrying the call.
+type grpcServer struct {
+	daemonpb.UnimplementedDaemonServer
+	d *daemon
+}
+
+// newGRPCServer returns the gRPC server of the daemon.
+func (d *daemon) newGRPCServer() *grpc.Server {
+	s := grpc.NewServer()
+	daemonpb.RegisterDaemonServer(s, &grpcServer{d: d})
+	reflection.Register(s)
+	return s
+}
+
+type grpcRequestKey struct{}
+
+// serveGRPC passes the gRPC calls among the requests to rpc, with the
+// request in their context so the methods know who made them, and the
+// others to api. Calls come as HTTP/2 without TLS, which h2c handles.
+func serveGRPC(rpc *grpc.Server, authenticate func(http.Handler) http.Handler, api http.Handler) http.Handler {
+	calls := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rpc.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), grpcRequestKey{}, r)))
+	}))
+	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			calls.ServeHTTP(w, r)
+			return
+		}
+		api.ServeHTTP(w, r)
+	}), &http2.Server{})
+}
+
+// grpcRequest returns the HTTP request carrying a gRPC call.
+func grpcRequest(ctx context.Context) *http.Request {
+	if r, ok := ctx.Value(grpcRequestKey{}).(*http.Request); ok {
+		return r
+	}
+	// Not served by serveGRPC, which the client can't tell apart from an
+	// anonymous request
+	r, _ := http.NewRequest(http.MethodPost, "/", nil)
+	return r.WithContext(ctx)
+}
+
+// grpcStatusCodes are the codes of the HTTP statuses of requestErrors.
+var grpcStatusCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+}
+
+// grpcError is err as a gRPC status.
+func grpcError(err error) error {
+	var rerr *requestError
+	if !errors.As(err, &rerr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code, ok := grpcStatusCodes[rerr.status]
+	if !ok {
+		code = codes.Internal
+	}
+	return status.Error(code, rerr.msg)
+}
+
+func (s *grpcServer) SubmitJob(stream daemonpb.Daemon_SubmitJobServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	sub := first.GetSubmission()
+	if sub == nil {
+		return status.Error(codes.InvalidArgument, "the first message has no submission")
+	}
+	query := url.Values{}
+	for key, value := range map[string]string{"machine": sub.Machine, "name": sub.Name, "after": sub.After, "ttl": sub.Ttl} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	for _, tag := range sub.Tags {
+		query.Add("tag", tag)
+	}
+	if sub.Priority != 0 {
+		query.Set("priority", strconv.Itoa(int(sub.Priority)))
+	}
+	if sub.Hold {
+		query.Set("hold", "true")
+	}
+	j, err := s.d.enqueue(grpcRequest(stream.Context()), query, &submissionReader{stream: stream, data: first.Data})
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(jobMessage(j))
+}
+
+// submissionReader reads the file of a SubmitJob call from its messages,
+// to io.EOF once the client closed its side of the stream.
+type submissionReader struct {
+	stream daemonpb.Daemon_SubmitJobServer
+	data   []byte
+}
+
+func (r *submissionReader) Read(b []byte) (int, error) {
+	for len(r.data) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.data = msg.Data
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (s *grpcServer) ListJobs(ctx context.Context, _ *daemonpb.ListJobsRequest) (*daemonpb.ListJobsResponse, error) {
+	resp := &daemonpb.ListJobsResponse{}
+	for _, j := range s.d.queue.list() {
+		resp.Jobs = append(resp.Jobs, jobMessage(j))
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) GetJob(ctx context.Context, req *daemonpb.JobRequest) (*daemonpb.Job, error) {
+	j, err := s.d.queue.get(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "%v %q", err, req.Id)
+	}
+	return jobMessage(j), nil
+}
+
+func (s *grpcServer) CancelJob(ctx context.Context, req *daemonpb.JobRequest) (*daemonpb.Job, error) {
+	return s.change(ctx, req.Id, "cancel", "")
+}
+
+func (s *grpcServer) HoldJob(ctx context.Context, req *daemonpb.JobRequest) (*daemonpb.Job, error) {
+	return s.change(ctx, req.Id, "hold", "")
+}
+
+func (s *grpcServer) ReleaseJob(ctx context.Context, req *daemonpb.JobRequest) (*daemonpb.Job, error) {
+	return s.change(ctx, req.Id, "release", "")
+}
+
+func (s *grpcServer) PrioritizeJob(ctx context.Context, req *daemonpb.PrioritizeJobRequest) (*daemonpb.Job, error) {
+	return s.change(ctx, req.Id, "priority", req.Priority)
+}
+
+func (s *grpcServer) change(ctx context.Context, id, action, priority string) (*daemonpb.Job, error) {
+	j, err := s.d.changeJob(grpcRequest(ctx), id, action, priority)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return jobMessage(j), nil
+}
+
+func (s *grpcServer) ListMachines(ctx context.Context, _ *daemonpb.ListMachinesRequest) (*daemonpb.ListMachinesResponse, error) {
+	resp := &daemonpb.ListMachinesResponse{}
+	for _, m := range s.d.machineStatuses(grpcRequest(ctx)) {
+		resp.Machines = append(resp.Machines, &daemonpb.Machine{Name: m.Name, Address: m.Address, Queued: int32(m.Queued), Permitted: m.Permitted})
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) WatchEvents(req *daemonpb.WatchEventsRequest, stream daemonpb.Daemon_WatchEventsServer) error {
+	machines := map[string]bool{}
+	for _, name := range req.Machines {
+		if _, ok := s.d.cfg.Machines[name]; !ok {
+			return status.Errorf(codes.NotFound, "unknown machine %q", name)
+		}
+		machines[name] = true
+	}
+	events := s.d.events.subscribe()
+	defer s.d.events.unsubscribe(events)
+	r := grpcRequest(stream.Context())
+	zap.L().Debug("event subscriber connected", zap.String("remote", clientAddress(r)), zap.Strings("machine", req.Machines), zap.String("api", "grpc"))
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if len(machines) > 0 && !machines[e.Machine] {
+				continue
+			}
+			if err := stream.Send(eventMessage(e)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			zap.L().Debug("event subscriber disconnected", zap.String("remote", clientAddress(r)), zap.String("api", "grpc"))
+			return nil
+		}
+	}
+}
+
+func timestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+// jobMessage is a job as the gRPC API returns it.
+func jobMessage(j job) *daemonpb.Job {
+	msg := &daemonpb.Job{
+		Id:               j.ID,
+		Machine:          j.Machine,
+		Name:             j.Name,
+		Size:             j.Size,
+		Status:           string(j.Status),
+		Error:            j.Error,
+		Submitted:        timestamppb.New(j.Submitted),
+		Started:          timestamp(j.Started),
+		Finished:         timestamp(j.Finished),
+		Priority:         int32(j.Priority),
+		NotBefore:        timestamp(j.NotBefore),
+		Held:             j.Held,
+		ExpiresAt:        timestamp(j.ExpiresAt),
+		Tags:             j.Tags,
+		SubmittedBy:      j.SubmittedBy,
+		EstimatedSeconds: j.EstimatedSeconds,
+		RuntimeSeconds:   j.RuntimeSeconds,
+		Sha256:           j.SHA256,
+	}
+	if m := j.Metadata; m != nil {
+		msg.Metadata = &daemonpb.JobMetadata{Name: m.Name, Stock: m.Stock, Tools: m.Tools, Generator: m.Generator, Date: m.Date}
+	}
+	if p := j.Phases; p != nil {
+		msg.Phases = &daemonpb.SendPhases{Dial: p.Dial, Handshake: p.Handshake, Transfer: p.Transfer, Flush: p.Flush, Ack: p.Ack, Verify: p.Verify}
+	}
+	for _, f := range j.Findings {
+		msg.Findings = append(msg.Findings, &daemonpb.Finding{Line: int32(f.Line), Kind: f.Kind, Message: f.Message})
+	}
+	return msg
+}
+
+// eventMessage is an event as the gRPC API streams it.
+func eventMessage(e daemonEvent) *daemonpb.Event {
+	msg := &daemonpb.Event{Id: e.ID, Time: timestamppb.New(e.Time), Event: e.Event, Machine: e.Machine, State: string(e.State), Error: e.Error}
+	if e.Job != nil {
+		msg.Job = jobMessage(*e.Job)
+	}
+	return msg
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyMachineProfile(t *testing.T) {
+	d := &daemon{cfg: &config{Profiles: map[string]machineProfile{
+		"shop": {MaxFeed: 1000, Clamp: true, Preamble: []string{"G21"}, Footer: []string{"M5"}},
+	}}}
+	tests := []struct {
+		name    string
+		machine machineConfig
+		want    string
+	}{
+		{"no profile", machineConfig{}, "G1 X10 F3000\n"},
+		{"profile", machineConfig{Profile: "shop"}, "G21\nG1 X10 F1000\nM5\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "job.nc")
+			if err := ioutil.WriteFile(path, []byte("G1 X10 F3000\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			size, err := d.applyMachineProfile(path, tt.machine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want || size != int64(len(data)) {
+				t.Errorf("spooled %q of size %d, want %q", data, size, tt.want)
+			}
+			// The preflight checks the clamped feed the machine is sent
+			if tt.machine.Profile == "" {
+				return
+			}
+			profile := d.cfg.Profiles[tt.machine.Profile]
+			if findings, _ := preflightFile(path, &profile); len(findings) > 0 {
+				t.Errorf("preflight found %+v in the rewritten job", findings)
+			}
+		})
+	}
+}
+
+func TestDaemonAllowedStates(t *testing.T) {
+	saved := allowedStates
+	defer func() { allowedStates = saved }()
+	allowedStates = "init"
+	d := &daemon{cfg: &config{Profiles: map[string]machineProfile{
+		"idle": {AllowStates: []string{"init", "idle"}},
+		"none": {MaxFeed: 1000},
+	}}}
+	tests := []struct {
+		profile string
+		want    string
+	}{
+		{"", "init"},
+		{"idle", "init,idle"},
+		{"none", "init"},
+	}
+	for _, tt := range tests {
+		if got := d.allowedStates(machineConfig{Profile: tt.profile}); got != tt.want {
+			t.Errorf("allowedStates with profile %q = %q, want %q", tt.profile, got, tt.want)
+		}
+	}
+}
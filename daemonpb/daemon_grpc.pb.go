@@ -0,0 +1,493 @@
+// The gRPC interface of the send-carbide daemon. It offers what the HTTP
+// API does, on the same listeners with the same tokens and users, for shop
+// software that would rather generate a client than call the JSON API.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: daemon.proto
+
+package daemonpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Daemon_SubmitJob_FullMethodName     = "/sendcarbide.v1.Daemon/SubmitJob"
+	Daemon_ListJobs_FullMethodName      = "/sendcarbide.v1.Daemon/ListJobs"
+	Daemon_GetJob_FullMethodName        = "/sendcarbide.v1.Daemon/GetJob"
+	Daemon_CancelJob_FullMethodName     = "/sendcarbide.v1.Daemon/CancelJob"
+	Daemon_HoldJob_FullMethodName       = "/sendcarbide.v1.Daemon/HoldJob"
+	Daemon_ReleaseJob_FullMethodName    = "/sendcarbide.v1.Daemon/ReleaseJob"
+	Daemon_PrioritizeJob_FullMethodName = "/sendcarbide.v1.Daemon/PrioritizeJob"
+	Daemon_ListMachines_FullMethodName  = "/sendcarbide.v1.Daemon/ListMachines"
+	Daemon_WatchEvents_FullMethodName   = "/sendcarbide.v1.Daemon/WatchEvents"
+)
+
+// DaemonClient is the client API for Daemon service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DaemonClient interface {
+	// SubmitJob queues a file. The first message carries the submission and
+	// may hold the start of the file, the ones after it the rest of it.
+	SubmitJob(ctx context.Context, opts ...grpc.CallOption) (Daemon_SubmitJobClient, error)
+	// ListJobs returns every job, in submission order.
+	ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error)
+	// GetJob returns a job.
+	GetJob(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (*Job, error)
+	// CancelJob pulls a queued job from the queue.
+	CancelJob(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (*Job, error)
+	// HoldJob keeps a queued job from starting.
+	HoldJob(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (*Job, error)
+	// ReleaseJob lets a held job start.
+	ReleaseJob(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (*Job, error)
+	// PrioritizeJob reorders a queued job.
+	PrioritizeJob(ctx context.Context, in *PrioritizeJobRequest, opts ...grpc.CallOption) (*Job, error)
+	// ListMachines returns the machines and how many jobs they have queued.
+	ListMachines(ctx context.Context, in *ListMachinesRequest, opts ...grpc.CallOption) (*ListMachinesResponse, error)
+	// WatchEvents streams the state changes of the machines and the events
+	// of the jobs, starting with the last known state of every machine.
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (Daemon_WatchEventsClient, error)
+}
+
+type daemonClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDaemonClient(cc grpc.ClientConnInterface) DaemonClient {
+	return &daemonClient{cc}
+}
+
+func (c *daemonClient) SubmitJob(ctx context.Context, opts ...grpc.CallOption) (Daemon_SubmitJobClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Daemon_ServiceDesc.Streams[0], Daemon_SubmitJob_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &daemonSubmitJobClient{stream}
+	return x, nil
+}
+
+type Daemon_SubmitJobClient interface {
+	Send(*SubmitJobRequest) error
+	CloseAndRecv() (*Job, error)
+	grpc.ClientStream
+}
+
+type daemonSubmitJobClient struct {
+	grpc.ClientStream
+}
+
+func (x *daemonSubmitJobClient) Send(m *SubmitJobRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *daemonSubmitJobClient) CloseAndRecv() (*Job, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Job)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *daemonClient) ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error) {
+	out := new(ListJobsResponse)
+	err := c.cc.Invoke(ctx, Daemon_ListJobs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) GetJob(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, Daemon_GetJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) CancelJob(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, Daemon_CancelJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) HoldJob(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, Daemon_HoldJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) ReleaseJob(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, Daemon_ReleaseJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) PrioritizeJob(ctx context.Context, in *PrioritizeJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, Daemon_PrioritizeJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) ListMachines(ctx context.Context, in *ListMachinesRequest, opts ...grpc.CallOption) (*ListMachinesResponse, error) {
+	out := new(ListMachinesResponse)
+	err := c.cc.Invoke(ctx, Daemon_ListMachines_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *daemonClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (Daemon_WatchEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Daemon_ServiceDesc.Streams[1], Daemon_WatchEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &daemonWatchEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Daemon_WatchEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type daemonWatchEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *daemonWatchEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DaemonServer is the server API for Daemon service.
+// All implementations must embed UnimplementedDaemonServer
+// for forward compatibility
+type DaemonServer interface {
+	// SubmitJob queues a file. The first message carries the submission and
+	// may hold the start of the file, the ones after it the rest of it.
+	SubmitJob(Daemon_SubmitJobServer) error
+	// ListJobs returns every job, in submission order.
+	ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error)
+	// GetJob returns a job.
+	GetJob(context.Context, *JobRequest) (*Job, error)
+	// CancelJob pulls a queued job from the queue.
+	CancelJob(context.Context, *JobRequest) (*Job, error)
+	// HoldJob keeps a queued job from starting.
+	HoldJob(context.Context, *JobRequest) (*Job, error)
+	// ReleaseJob lets a held job start.
+	ReleaseJob(context.Context, *JobRequest) (*Job, error)
+	// PrioritizeJob reorders a queued job.
+	PrioritizeJob(context.Context, *PrioritizeJobRequest) (*Job, error)
+	// ListMachines returns the machines and how many jobs they have queued.
+	ListMachines(context.Context, *ListMachinesRequest) (*ListMachinesResponse, error)
+	// WatchEvents streams the state changes of the machines and the events
+	// of the jobs, starting with the last known state of every machine.
+	WatchEvents(*WatchEventsRequest, Daemon_WatchEventsServer) error
+	mustEmbedUnimplementedDaemonServer()
+}
+
+// UnimplementedDaemonServer must be embedded to have forward compatible implementations.
+type UnimplementedDaemonServer struct {
+}
+
+func (UnimplementedDaemonServer) SubmitJob(Daemon_SubmitJobServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubmitJob not implemented")
+}
+func (UnimplementedDaemonServer) ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListJobs not implemented")
+}
+func (UnimplementedDaemonServer) GetJob(context.Context, *JobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetJob not implemented")
+}
+func (UnimplementedDaemonServer) CancelJob(context.Context, *JobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelJob not implemented")
+}
+func (UnimplementedDaemonServer) HoldJob(context.Context, *JobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HoldJob not implemented")
+}
+func (UnimplementedDaemonServer) ReleaseJob(context.Context, *JobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseJob not implemented")
+}
+func (UnimplementedDaemonServer) PrioritizeJob(context.Context, *PrioritizeJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PrioritizeJob not implemented")
+}
+func (UnimplementedDaemonServer) ListMachines(context.Context, *ListMachinesRequest) (*ListMachinesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMachines not implemented")
+}
+func (UnimplementedDaemonServer) WatchEvents(*WatchEventsRequest, Daemon_WatchEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedDaemonServer) mustEmbedUnimplementedDaemonServer() {}
+
+// UnsafeDaemonServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DaemonServer will
+// result in compilation errors.
+type UnsafeDaemonServer interface {
+	mustEmbedUnimplementedDaemonServer()
+}
+
+func RegisterDaemonServer(s grpc.ServiceRegistrar, srv DaemonServer) {
+	s.RegisterService(&Daemon_ServiceDesc, srv)
+}
+
+func _Daemon_SubmitJob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DaemonServer).SubmitJob(&daemonSubmitJobServer{stream})
+}
+
+type Daemon_SubmitJobServer interface {
+	SendAndClose(*Job) error
+	Recv() (*SubmitJobRequest, error)
+	grpc.ServerStream
+}
+
+type daemonSubmitJobServer struct {
+	grpc.ServerStream
+}
+
+func (x *daemonSubmitJobServer) SendAndClose(m *Job) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *daemonSubmitJobServer) Recv() (*SubmitJobRequest, error) {
+	m := new(SubmitJobRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Daemon_ListJobs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListJobsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).ListJobs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_ListJobs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).ListJobs(ctx, req.(*ListJobsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_GetJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).GetJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_GetJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).GetJob(ctx, req.(*JobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_CancelJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).CancelJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_CancelJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).CancelJob(ctx, req.(*JobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_HoldJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).HoldJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_HoldJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).HoldJob(ctx, req.(*JobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_ReleaseJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).ReleaseJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_ReleaseJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).ReleaseJob(ctx, req.(*JobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_PrioritizeJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PrioritizeJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).PrioritizeJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_PrioritizeJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).PrioritizeJob(ctx, req.(*PrioritizeJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_ListMachines_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListMachinesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DaemonServer).ListMachines(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Daemon_ListMachines_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DaemonServer).ListMachines(ctx, req.(*ListMachinesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Daemon_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DaemonServer).WatchEvents(m, &daemonWatchEventsServer{stream})
+}
+
+type Daemon_WatchEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type daemonWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *daemonWatchEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Daemon_ServiceDesc is the grpc.ServiceDesc for Daemon service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Daemon_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sendcarbide.v1.Daemon",
+	HandlerType: (*DaemonServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListJobs",
+			Handler:    _Daemon_ListJobs_Handler,
+		},
+		{
+			MethodName: "GetJob",
+			Handler:    _Daemon_GetJob_Handler,
+		},
+		{
+			MethodName: "CancelJob",
+			Handler:    _Daemon_CancelJob_Handler,
+		},
+		{
+			MethodName: "HoldJob",
+			Handler:    _Daemon_HoldJob_Handler,
+		},
+		{
+			MethodName: "ReleaseJob",
+			Handler:    _Daemon_ReleaseJob_Handler,
+		},
+		{
+			MethodName: "PrioritizeJob",
+			Handler:    _Daemon_PrioritizeJob_Handler,
+		},
+		{
+			MethodName: "ListMachines",
+			Handler:    _Daemon_ListMachines_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SubmitJob",
+			Handler:       _Daemon_SubmitJob_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _Daemon_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "daemon.proto",
+}
@@ -0,0 +1,7 @@
+// Package daemonpb is the gRPC client and server code of the send-carbide
+// daemon's API, generated from daemon.proto. Shop software can import it,
+// or generate a client in its own language from daemon.proto or from the
+// server's reflection.
+package daemonpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative daemon.proto
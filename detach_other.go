@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly,!windows
+
+package main
+
+import "syscall"
+
+// Other platforms start processes as they are.
+func detachedProcess() *syscall.SysProcAttr {
+	return nil
+}
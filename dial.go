@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+var connectTimeout time.Duration
+var bindAddress string
+
+// dialer opens connections to the machine over the transport selected by the
+// address: plain TCP for host names and IPs, WebSocket for ws:// and wss://.
+type dialer struct {
+	target string
+	dial   func() (net.Conn, error)
+	// dialTime and handshakeTime are how long the last connection took to
+	// open and to announce the machine state
+	dialTime      time.Duration
+	handshakeTime time.Duration
+	// caps is what the receiver announced on the last connection
+	caps carbide.Capabilities
+}
+
+func (d *dialer) String() string {
+	return d.target
+}
+
+var errNoAddress = errors.New("no usable machine address")
+var errSeveralMachines = errors.New("only send accepts several machines")
+
+// addressFlag collects machine addresses or names from repeated flags and
+// comma separated lists. The first use replaces the default.
+type addressFlag struct {
+	value *string
+	set   bool
+}
+
+func (f *addressFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f *addressFlag) Set(s string) error {
+	if !f.set {
+		*f.value = s
+		f.set = true
+		return nil
+	}
+	*f.value += "," + s
+	return nil
+}
+
+// splitAddresses splits a comma separated address list.
+func splitAddresses(list string) []string {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// resolveDialers returns a dialer for each machine address, in the order
+// they should be tried.
+func resolveDialers() ([]*dialer, error) {
+	addresses, err := machineAddresses()
+	if err != nil {
+		return nil, err
+	}
+	return dialersFor(addresses)
+}
+
+// machineAddresses returns the addresses of the -address flag, or of the
+// -machine from the config file when one is given.
+func machineAddresses() ([]string, error) {
+	if machineName != "" {
+		if len(splitAddresses(machineName)) > 1 {
+			return nil, errSeveralMachines
+		}
+		cfg, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		m, err := cfg.machine(machineName)
+		if err != nil {
+			zap.L().Error("Could not find machine in config", zap.String("machine", machineName), zap.String("config", configPath))
+			return nil, err
+		}
+		serverAddress = strings.Join(m.addresses(), ",")
+	}
+	return splitAddresses(serverAddress), nil
+}
+
+// dialersFor returns a dialer for each of addresses, skipping those that
+// fail to resolve so long as at least one remains.
+func dialersFor(addresses []string) ([]*dialer, error) {
+	var dialers []*dialer
+	var lastErr error = errNoAddress
+	for _, address := range expandSRV(addresses) {
+		d, err := resolveDialer(address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		dialers = append(dialers, d)
+	}
+	if len(dialers) == 0 {
+		return nil, lastErr
+	}
+	return dialers, nil
+}
+
+// srvPrefix marks addresses to be looked up as _carbide._tcp SRV records.
+const srvPrefix = "srv:"
+
+// expandSRV replaces every "srv:<domain>" address with the targets of the
+// _carbide._tcp.<domain> SRV record, ordered by priority and weight.
+func expandSRV(addresses []string) []string {
+	var expanded []string
+	for _, address := range addresses {
+		if !strings.HasPrefix(address, srvPrefix) {
+			expanded = append(expanded, address)
+			continue
+		}
+		domain := strings.TrimPrefix(address, srvPrefix)
+		_, records, err := net.LookupSRV("carbide", "tcp", domain)
+		if err != nil {
+			zap.L().Error("failed to look up SRV record", zap.String("domain", domain), zap.Error(err))
+			continue
+		}
+		for _, record := range records {
+			target := strings.TrimSuffix(record.Target, ".")
+			zap.L().Debug("found SRV target", zap.String("target", target), zap.Uint16("port", record.Port))
+			expanded = append(expanded, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+		}
+	}
+	return expanded
+}
+
+// resolveDialer validates a single machine address and returns a dialer
+// for it.
+func resolveDialer(serverAddress string) (*dialer, error) {
+	if strings.HasPrefix(serverAddress, "ws://") || strings.HasPrefix(serverAddress, "wss://") {
+		u, err := url.Parse(serverAddress)
+		if err != nil {
+			zap.L().Error("Could not parse websocket address", zap.String("address", serverAddress), zap.Error(err))
+			return nil, err
+		}
+		return &dialer{target: u.String(), dial: func() (net.Conn, error) {
+			return dialWebSocket(u)
+		}}, nil
+	}
+	address := machineHostPort(serverAddress)
+	if proxyAddress != "" || sshGateway != "" {
+		// Leave name resolution to the proxy or gateway, the machine may
+		// only be resolvable on the remote network.
+		return &dialer{target: address, dial: func() (net.Conn, error) {
+			return dialTCP(address)
+		}}, nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		zap.L().Error("Could not resolve input address", zap.String("address", serverAddress))
+		return nil, err
+	}
+	return &dialer{target: addr.String(), dial: func() (net.Conn, error) {
+		return dialTCP(addr.String())
+	}}, nil
+}
+
+// machineHostPort joins the machine address with the Carbide Motion port.
+// Addresses may already carry a port ("host:1234", "[::1]:1234"), and IPv6
+// literals may be bare, bracketed or carry a zone ("fe80::1%en0").
+func machineHostPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	return net.JoinHostPort(host, carbidePort)
+}
+
+// dialAny connects to the first reachable machine address and reads its
+// state.
+func dialAny(dialers []*dialer) (net.Conn, *bufio.Reader, carbide.State, *dialer, error) {
+	var lastErr error = errNoAddress
+	for _, d := range dialers {
+		conn, r, state, err := dialState(d)
+		if err == nil {
+			return conn, r, state, d, nil
+		}
+		lastErr = err
+	}
+	return nil, nil, "", nil, lastErr
+}
+
+// bindLocalAddr resolves -bind, which is either a local IP address or an
+// interface name, to the local address for a connection to remote. For an
+// interface the first address of the same IP family as remote is used.
+func bindLocalAddr(remote string) (net.Addr, error) {
+	if ip := net.ParseIP(bindAddress); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	iface, err := net.InterfaceByName(bindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -bind %q: not an IP address or interface", bindAddress)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	wantIPv4 := true
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			wantIPv4 = false
+		}
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != wantIPv4 {
+			continue
+		}
+		return &net.TCPAddr{IP: ipNet.IP}, nil
+	}
+	return nil, fmt.Errorf("interface %s has no usable address", bindAddress)
+}
+
+// netDialer returns the dialer for a TCP connection to remote.
+func netDialer(remote string) (*net.Dialer, error) {
+	d := &net.Dialer{Timeout: connectTimeout, KeepAlive: keepAlive}
+	if bindAddress != "" {
+		local, err := bindLocalAddr(remote)
+		if err != nil {
+			zap.L().Error("failed to resolve bind address", zap.String("bind", bindAddress), zap.Error(err))
+			return nil, err
+		}
+		zap.L().Debug("binding local address", zap.String("local", local.String()))
+		d.LocalAddr = local
+	}
+	return d, nil
+}
+
+func dialTCP(address string) (net.Conn, error) {
+	if sshGateway != "" {
+		return dialSSH(address)
+	}
+	if proxyAddress != "" {
+		host, _, _ := net.SplitHostPort(address)
+		if !bypassProxy(host) {
+			return dialProxy(address)
+		}
+	}
+	d, err := netDialer(address)
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial("tcp", address)
+}
+
+func dialTLS(address, serverName string) (net.Conn, error) {
+	conn, err := dialTCP(address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMachineHostPort(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"cnc.local", "cnc.local:6280"},
+		{"cnc.local:7000", "cnc.local:7000"},
+		{"192.168.1.20", "192.168.1.20:6280"},
+		{"192.168.1.20:7000", "192.168.1.20:7000"},
+		// Bare IPv6 literals can't carry a port, every colon is the address
+		{"::1", "[::1]:6280"},
+		{"2001:db8::20", "[2001:db8::20]:6280"},
+		{"2001:db8::1:7000", "[2001:db8::1:7000]:6280"},
+		{"[::1]", "[::1]:6280"},
+		{"[2001:db8::20]", "[2001:db8::20]:6280"},
+		{"[::1]:7000", "[::1]:7000"},
+		{"[2001:db8::20]:6280", "[2001:db8::20]:6280"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:6280"},
+		{"[fe80::1%eth0]", "[fe80::1%eth0]:6280"},
+		{"[fe80::1%eth0]:7000", "[fe80::1%eth0]:7000"},
+		{"::ffff:192.168.1.20", "[::ffff:192.168.1.20]:6280"},
+	}
+	for _, tt := range tests {
+		if got := machineHostPort(tt.address); got != tt.want {
+			t.Errorf("machineHostPort(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+		host, port, err := net.SplitHostPort(machineHostPort(tt.address))
+		if err != nil || host == "" || port == "" {
+			t.Errorf("machineHostPort(%q) doesn't split into a host and port: %v", tt.address, err)
+		}
+	}
+}
+
+func TestResolveDialerIPv6(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"::1", "[::1]:6280"},
+		{"[::1]", "[::1]:6280"},
+		{"[::1]:7000", "[::1]:7000"},
+		{"2001:db8::20", "[2001:db8::20]:6280"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:6280"},
+		{"[fe80::1%eth0]:7000", "[fe80::1%eth0]:7000"},
+		{"127.0.0.1", "127.0.0.1:6280"},
+	}
+	for _, tt := range tests {
+		d, err := resolveDialer(tt.address)
+		if err != nil {
+			t.Errorf("resolveDialer(%q) failed: %v", tt.address, err)
+			continue
+		}
+		if d.String() != tt.want {
+			t.Errorf("resolveDialer(%q) targets %q, want %q", tt.address, d.String(), tt.want)
+		}
+	}
+}
+
+func TestDialersForIPv6List(t *testing.T) {
+	dialers, err := dialersFor(splitAddresses("[::1]:7000, 2001:db8::20,127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range dialers {
+		got = append(got, d.String())
+	}
+	want := []string{"[::1]:7000", "[2001:db8::20]:6280", "127.0.0.1:6280"}
+	if len(got) != len(want) {
+		t.Fatalf("dialersFor() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("dialersFor() = %q, want %q", got, want)
+			break
+		}
+	}
+}
+
+// TestDialIPv6Loopback connects to a listener on ::1, given the ways an
+// address may be written, where the host has IPv6.
+func TestDialIPv6Loopback(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	for _, address := range []string{"[::1]:" + port, "[0:0:0:0:0:0:0:1]:" + port} {
+		d, err := resolveDialer(address)
+		if err != nil {
+			t.Errorf("resolveDialer(%q) failed: %v", address, err)
+			continue
+		}
+		conn, err := d.dial()
+		if err != nil {
+			t.Errorf("dial %q failed: %v", address, err)
+			continue
+		}
+		conn.Close()
+	}
+}
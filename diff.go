@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var errJobsDiffer = errors.New("the jobs differ")
+
+// diffMaxEdits is how many commands may differ before diff gives up on
+// lining the jobs up and only compares their summaries, since the work
+// grows with the square of the edits.
+const diffMaxEdits = 2000
+
+// diffShown is how many changed commands are printed before they are only
+// counted.
+const diffShown = 200
+
+// gcodeCommand is a line of a job as the machine sees it: without comments,
+// line numbers and spacing, and with its numbers in one form, so that
+// "N10 G01 X1.50 (edge)" and "G1X1.5" are the same.
+type gcodeCommand struct {
+	text string
+	// line is where it is in the file
+	line int
+}
+
+func canonicalCommand(line string) string {
+	code := strings.TrimSpace(cleanGcodeLine(line))
+	if code == "" || code == "%" {
+		return ""
+	}
+	words, err := parseWords(code)
+	if err != nil {
+		// Compare what can't be parsed as it is, but for case and spacing
+		return strings.ToUpper(strings.Join(strings.Fields(code), ""))
+	}
+	parts := make([]string, 0, len(words))
+	for _, w := range words {
+		if w.letter == 'N' {
+			continue
+		}
+		parts = append(parts, string(w.letter)+strconv.FormatFloat(w.value, 'f', -1, 64))
+	}
+	return strings.Join(parts, " ")
+}
+
+// jobDigest is what diff compares of a job besides its commands.
+type jobDigest struct {
+	File     string               `json:"file"`
+	Commands int                  `json:"commands"`
+	Feeds    []float64            `json:"feeds"`
+	Tools    []string             `json:"tools"`
+	Extent   map[string]axisRange `json:"extent"`
+	Toolpath toolpathStats        `json:"toolpath"`
+}
+
+// readJob reads the commands of a job and runs them on a simulator to
+// measure it.
+func readJob(path string) ([]gcodeCommand, jobDigest, error) {
+	input, err := openInput(path)
+	if err != nil {
+		return nil, jobDigest{}, err
+	}
+	defer input.Close()
+	readMetadata(input)
+	s := newSimulator(nil, nil, 0)
+	s.measureOnly = true
+	var commands []gcodeCommand
+	feeds := map[float64]bool{}
+	tools := map[string]bool{}
+	reader := bufio.NewReader(input)
+	for number := 1; ; number++ {
+		line, err := reader.ReadString('\n')
+		if text := canonicalCommand(line); text != "" {
+			commands = append(commands, gcodeCommand{text: text, line: number})
+			s.step(line)
+			if s.feed > 0 {
+				feeds[s.feed] = true
+			}
+			if s.tool > 0 {
+				tools["T"+strconv.Itoa(s.tool)] = true
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			zap.L().Error("failed to read job", zap.String("file", input.name), zap.Error(err))
+			return nil, jobDigest{}, err
+		}
+	}
+	report := s.result(input.name)
+	digest := jobDigest{File: input.name, Commands: len(commands), Extent: report.Extent, Toolpath: report.Toolpath, Feeds: []float64{}, Tools: []string{}}
+	for feed := range feeds {
+		digest.Feeds = append(digest.Feeds, feed)
+	}
+	sort.Float64s(digest.Feeds)
+	// The tools CAM lists name what the T words only number
+	if m := input.metadata; m != nil {
+		for _, tool := range m.Tools {
+			tools[tool] = true
+		}
+	}
+	for tool := range tools {
+		digest.Tools = append(digest.Tools, tool)
+	}
+	sort.Strings(digest.Tools)
+	return commands, digest, nil
+}
+
+// diffEdit is a command kept, removed from the old job or added in the new
+// one.
+type diffEdit struct {
+	kind     byte
+	old, new int
+}
+
+// diffCommands lines the old and new commands up with the fewest edits, by
+// Myers' algorithm. It gives up past diffMaxEdits.
+func diffCommands(a, b []gcodeCommand) ([]diffEdit, bool) {
+	var edits []diffEdit
+	// Regenerated jobs mostly change in the middle, and the ends that stay
+	// the same need no search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix].text == b[prefix].text {
+		edits = append(edits, diffEdit{kind: '=', old: prefix, new: prefix})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix].text == b[len(b)-1-suffix].text {
+		suffix++
+	}
+	middle, ok := myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if !ok {
+		return nil, false
+	}
+	for _, e := range middle {
+		edits = append(edits, diffEdit{kind: e.kind, old: e.old + prefix, new: e.new + prefix})
+	}
+	for i := suffix; i > 0; i-- {
+		edits = append(edits, diffEdit{kind: '=', old: len(a) - i, new: len(b) - i})
+	}
+	return edits, true
+}
+
+func myersDiff(a, b []gcodeCommand) ([]diffEdit, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil, true
+	}
+	// v holds the furthest x reached on every diagonal k = x-y, and trace
+	// keeps the diagonals -d to d of it after every round d
+	v := make([]int, 2*max+2)
+	offset := max + 1
+	var trace [][]int
+	rounds := -1
+	for d := 0; d <= max && rounds < 0; d++ {
+		if d > diffMaxEdits {
+			return nil, false
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x].text == b[y].text {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				rounds = d
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+	// Walk back from the end through the rounds
+	var edits []diffEdit
+	x, y := n, m
+	for d := rounds; d > 0; d-- {
+		previous := trace[d-1]
+		at := func(k int) int { return previous[k+d-1] }
+		k := x - y
+		var from int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			from = k + 1
+		} else {
+			from = k - 1
+		}
+		fromX := at(from)
+		fromY := fromX - from
+		for x > fromX && y > fromY {
+			x--
+			y--
+			edits = append(edits, diffEdit{kind: '=', old: x, new: y})
+		}
+		if x == fromX {
+			y--
+			edits = append(edits, diffEdit{kind: '+', old: x, new: y})
+		} else {
+			x--
+			edits = append(edits, diffEdit{kind: '-', old: x, new: y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		edits = append(edits, diffEdit{kind: '=', old: x, new: y})
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits, true
+}
+
+// diffReport is what diff prints.
+type diffReport struct {
+	Old jobDigest `json:"old"`
+	New jobDigest `json:"new"`
+	// Aligned is false when too much changed to line the commands up, and
+	// the counts below are left out
+	Aligned   bool `json:"aligned"`
+	Unchanged int  `json:"unchanged,omitempty"`
+	Removed   int  `json:"removed,omitempty"`
+	Added     int  `json:"added,omitempty"`
+}
+
+func (r diffReport) same() bool {
+	return r.Aligned && r.Removed == 0 && r.Added == 0
+}
+
+// setChange lists what is only in old and only in new.
+func setChange(old, new []string) (removed, added []string) {
+	in := func(list []string, s string) bool {
+		for _, item := range list {
+			if item == s {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range old {
+		if !in(new, s) {
+			removed = append(removed, s)
+		}
+	}
+	for _, s := range new {
+		if !in(old, s) {
+			added = append(added, s)
+		}
+	}
+	return removed, added
+}
+
+func formatFeeds(feeds []float64) []string {
+	text := make([]string, len(feeds))
+	for i, feed := range feeds {
+		text[i] = strconv.FormatFloat(feed, 'f', -1, 64)
+	}
+	return text
+}
+
+// printChange prints a line of the summary, for what changed or, when
+// nothing did, what it is.
+func printChange(label string, old, new []string, unit string) {
+	removed, added := setChange(old, new)
+	if len(removed) == 0 && len(added) == 0 {
+		if len(old) > 0 {
+			fmt.Printf("%s the same, %s%s\n", label, strings.Join(old, ", "), unit)
+		}
+		return
+	}
+	var parts []string
+	if len(removed) > 0 {
+		parts = append(parts, paint(colorRed, "removed "+strings.Join(removed, ", ")+unit))
+	}
+	if len(added) > 0 {
+		parts = append(parts, paint(colorGreen, "added "+strings.Join(added, ", ")+unit))
+	}
+	fmt.Printf("%s %s\n", label, strings.Join(parts, ", "))
+}
+
+func formatExtent(extent map[string]axisRange) string {
+	var parts []string
+	for _, name := range axisNames {
+		if r, ok := extent[name]; ok {
+			parts = append(parts, fmt.Sprintf("%s %s to %s", name, formatMM(r.Min), formatMM(r.Max)))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ") + " mm"
+}
+
+func (r diffReport) print() {
+	switch {
+	case !r.Aligned:
+		fmt.Printf("%s -> %s: more than %d commands differ, only the summaries are compared\n", r.Old.File, r.New.File, diffMaxEdits)
+	case r.same():
+		fmt.Printf("%s -> %s: the same %d commands\n", r.Old.File, r.New.File, r.Unchanged)
+	default:
+		fmt.Printf("%s -> %s: %d commands the same, %d removed, %d added\n", r.Old.File, r.New.File, r.Unchanged, r.Removed, r.Added)
+	}
+	printChange("Feeds:", formatFeeds(r.Old.Feeds), formatFeeds(r.New.Feeds), " mm/min")
+	printChange("Tools:", r.Old.Tools, r.New.Tools, "")
+	if old, new := formatExtent(r.Old.Extent), formatExtent(r.New.Extent); old == new {
+		fmt.Printf("Extent: the same, %s\n", old)
+	} else {
+		fmt.Printf("Extent: %s -> %s\n", old, new)
+	}
+	if old, new := r.Old.Toolpath.String(), r.New.Toolpath.String(); old == new {
+		fmt.Printf("Toolpath: the same, %s\n", old)
+	} else {
+		fmt.Printf("Toolpath: %s -> %s\n", old, new)
+	}
+}
+
+// printEdits prints the changed commands in runs, with the lines they are
+// on in the old and new files.
+func printEdits(edits []diffEdit, a, b []gcodeCommand) {
+	shown, changed := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].kind == '=' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(edits) && edits[j].kind != '=' {
+			j++
+		}
+		oldLine, newLine := 0, 0
+		if e := edits[i]; e.old < len(a) {
+			oldLine = a[e.old].line
+		} else if len(a) > 0 {
+			oldLine = a[len(a)-1].line + 1
+		}
+		if e := edits[i]; e.new < len(b) {
+			newLine = b[e.new].line
+		} else if len(b) > 0 {
+			newLine = b[len(b)-1].line + 1
+		}
+		if shown < diffShown {
+			fmt.Println(paint(colorDim, fmt.Sprintf("@@ old line %d, new line %d @@", oldLine, newLine)))
+		}
+		for ; i < j; i++ {
+			changed++
+			if shown == diffShown {
+				continue
+			}
+			shown++
+			if e := edits[i]; e.kind == '-' {
+				fmt.Println(paint(colorRed, "- "+a[e.old].text))
+			} else {
+				fmt.Println(paint(colorGreen, "+ "+b[e.new].text))
+			}
+		}
+	}
+	if changed > shown {
+		fmt.Printf("... and %d more changed commands\n", changed-shown)
+	}
+}
+
+var diffSummaryOnly, diffJSON bool
+
+func diffFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&diffSummaryOnly, "summary", false, "only print the summary, not the changed commands")
+	fs.BoolVar(&diffJSON, "json", false, "print the summary as JSON")
+}
+
+func runDiff(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("diff")
+	diffFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) != 2 {
+		fs.PrintDefaults()
+		zap.L().Error("diff needs the old and the new gcode file", zap.Strings("args", positional))
+		return errors.New("diff needs the old and the new gcode file")
+	}
+	a, oldDigest, err := readJob(positional[0])
+	if err != nil {
+		return err
+	}
+	b, newDigest, err := readJob(positional[1])
+	if err != nil {
+		return err
+	}
+	report := diffReport{Old: oldDigest, New: newDigest}
+	edits, aligned := diffCommands(a, b)
+	report.Aligned = aligned
+	for _, e := range edits {
+		switch e.kind {
+		case '=':
+			report.Unchanged++
+		case '-':
+			report.Removed++
+		case '+':
+			report.Added++
+		}
+	}
+	if diffJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		if !diffSummaryOnly {
+			printEdits(edits, a, b)
+		}
+		report.print()
+	}
+	if !report.same() {
+		return errJobsDiffer
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// maxScanHosts bounds the size of a subnet scan so a typo like /8 does not
+// start probing millions of addresses.
+const maxScanHosts = 4096
+
+type discovered struct {
+	Address string        `json:"address"`
+	State   carbide.State `json:"state"`
+	Latency time.Duration `json:"latency_ns"`
+}
+
+// subnetList collects -scan flags.
+type subnetList []string
+
+func (s *subnetList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *subnetList) Set(value string) error {
+	*s = append(*s, splitAddresses(value)...)
+	return nil
+}
+
+// subnetHosts lists the host addresses of an IPv4 subnet, excluding the
+// network and broadcast addresses.
+func subnetHosts(cidr string) ([]net.IP, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	base := ipNet.IP.To4()
+	if base == nil {
+		return nil, fmt.Errorf("%s: only IPv4 subnets can be scanned", cidr)
+	}
+	ones, bits := ipNet.Mask.Size()
+	size := 1 << uint(bits-ones)
+	if size > maxScanHosts {
+		return nil, fmt.Errorf("%s: subnet too large to scan (%d addresses, limit %d)", cidr, size, maxScanHosts)
+	}
+	start := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	var hosts []net.IP
+	for i := 0; i < size; i++ {
+		if size > 2 && (i == 0 || i == size-1) {
+			continue
+		}
+		n := start + uint32(i)
+		hosts = append(hosts, net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)))
+	}
+	return hosts, nil
+}
+
+// localSubnets returns the IPv4 subnets of the host's non-loopback
+// interfaces, used when no -scan is given.
+func localSubnets() []string {
+	var subnets []string
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		ones, _ := ipNet.Mask.Size()
+		if ones < 22 {
+			// Only scan the /24 around our own address on large networks
+			ipNet = &net.IPNet{IP: ipNet.IP.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		}
+		subnets = append(subnets, (&net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}).String())
+	}
+	return subnets
+}
+
+// probe checks whether a Carbide Motion receiver answers at address.
+func probe(address string, timeout time.Duration) (discovered, error) {
+	start := time.Now()
+	d, err := netDialer(address)
+	if err != nil {
+		return discovered{}, err
+	}
+	d.Timeout = timeout
+	conn, err := d.Dial("tcp", address)
+	if err != nil {
+		return discovered{}, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	state, err := getState(newConnReader(conn))
+	if err != nil {
+		return discovered{}, err
+	}
+	return discovered{Address: address, State: state, Latency: time.Since(start)}, nil
+}
+
+var discoverSubnets subnetList
+var discoverConcurrency int
+var discoverRate int
+var discoverTimeout time.Duration
+var discoverJSON bool
+
+func discoverFlags(fs *flag.FlagSet) {
+	fs.Var(&discoverSubnets, "scan", "IPv4 subnet to probe, e.g. 192.168.1.0/24 (repeatable, defaults to the local subnets)")
+	fs.IntVar(&discoverConcurrency, "concurrency", 64, "maximum number of probes in flight")
+	fs.IntVar(&discoverRate, "rate", 200, "maximum number of probes started per second")
+	fs.DurationVar(&discoverTimeout, "timeout", 750*time.Millisecond, "how long to wait for each host")
+	fs.BoolVar(&discoverJSON, "json", false, "print the responders as JSON")
+}
+
+func runDiscover(args []string) error {
+	fs := newFlagSet("discover")
+	discoverFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	if len(discoverSubnets) == 0 {
+		discoverSubnets = localSubnets()
+		if len(discoverSubnets) == 0 {
+			fs.PrintDefaults()
+			return errors.New("no local subnets found, use -scan")
+		}
+	}
+	var hosts []net.IP
+	for _, subnet := range discoverSubnets {
+		ips, err := subnetHosts(subnet)
+		if err != nil {
+			zap.L().Error("invalid subnet", zap.String("subnet", subnet), zap.Error(err))
+			return err
+		}
+		hosts = append(hosts, ips...)
+	}
+	zap.L().Info("scanning", zap.Strings("subnets", discoverSubnets), zap.Int("hosts", len(hosts)))
+	// Start at most rate probes per second with at most concurrency in flight
+	var mu sync.Mutex
+	var found []discovered
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, discoverConcurrency)
+	ticker := time.NewTicker(time.Second / time.Duration(discoverRate))
+	defer ticker.Stop()
+	for _, host := range hosts {
+		<-ticker.C
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result, err := probe(address, discoverTimeout)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			found = append(found, result)
+			mu.Unlock()
+		}(net.JoinHostPort(host.String(), carbidePort))
+	}
+	wg.Wait()
+	sort.Slice(found, func(i, j int) bool {
+		a, _, _ := net.SplitHostPort(found[i].Address)
+		b, _, _ := net.SplitHostPort(found[j].Address)
+		return bytes.Compare(net.ParseIP(a).To16(), net.ParseIP(b).To16()) < 0
+	})
+	if discoverJSON {
+		return json.NewEncoder(os.Stdout).Encode(found)
+	}
+	for _, result := range found {
+		fmt.Printf("%-22s %-10s %v\n", result.Address, result.State, result.Latency.Round(time.Millisecond))
+	}
+	zap.L().Info("scan complete", zap.Int("responders", len(found)))
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+var errDoctorFailed = errors.New("doctor found problems")
+
+// clockSkewLimit is how far the clock of the receiver may be off from this
+// computer's before doctor warns, past the round trip of asking it.
+const clockSkewLimit = 5 * time.Second
+
+// Results of a doctor check.
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// doctorCheck is the result of one of the checks of doctor.
+type doctorCheck struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// doctorReport collects the checks in the order they ran.
+type doctorReport struct {
+	// Version is what version prints, with the platform
+	Version string        `json:"version"`
+	Checks  []doctorCheck `json:"checks"`
+}
+
+func (r *doctorReport) add(check, status, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, doctorCheck{Check: check, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// failed is how many checks failed.
+func (r *doctorReport) failed() int {
+	failed := 0
+	for _, c := range r.Checks {
+		if c.Status == checkFail {
+			failed++
+		}
+	}
+	return failed
+}
+
+// runDoctor checks what a send needs, from the config file to the state
+// handshake of the machine, and prints a pass or fail line for each, to ask
+// for first when something doesn't work.
+var doctorJSON bool
+
+func doctorFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&doctorJSON, "json", false, "print the report as JSON")
+}
+
+func runDoctor(args []string) error {
+	fs := newFlagSet("doctor")
+	doctorFlags(fs)
+	// doctor reports an invalid config file rather than stopping at it
+	checkingConfig = true
+	fs.Parse(args)
+	initLogger()
+	report := &doctorReport{Version: buildVersion().String()}
+	cfg := doctorConfig(report)
+	addresses := doctorAddresses(report, cfg)
+	dialers := doctorDNS(report, addresses)
+	reachable := doctorTCP(report, dialers)
+	doctorState(report, reachable)
+	doctorPermissions(report, cfg)
+	doctorStorage(report, cfg)
+	if doctorJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printDoctor(report)
+	}
+	if failed := report.failed(); failed > 0 {
+		zap.L().Error("doctor found problems", zap.Int("failed", failed))
+		return errDoctorFailed
+	}
+	return nil
+}
+
+func printDoctor(report *doctorReport) {
+	colors := map[string]string{checkPass: colorGreen, checkWarn: colorYellow, checkFail: colorRed, checkSkip: colorDim}
+	fmt.Println(report.Version)
+	for _, c := range report.Checks {
+		status := fmt.Sprintf("%-4s", strings.ToUpper(c.Status))
+		fmt.Printf("%s  %-11s %s\n", paint(colors[c.Status], status), c.Check, c.Detail)
+	}
+}
+
+// doctorConfig checks the config file and returns it. An invalid one is
+// read as far as it goes, to check the machine anyway.
+func doctorConfig(report *doctorReport) *config {
+	if configPath == "" {
+		report.add("config", checkSkip, "no config directory, pass -config")
+		return &config{}
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		report.add("config", checkPass, "%s doesn't exist, using the defaults", configPath)
+		return &config{}
+	} else if err != nil {
+		report.add("config", checkFail, "%v", err)
+		return &config{}
+	}
+	cfg, problems := checkConfig(data, false)
+	if len(problems) > 0 {
+		report.add("config", checkFail, "%d problems, the first: %s (run config check for all)", len(problems), problems[0])
+		cfg = &config{}
+		yaml.Unmarshal(data, cfg)
+		return cfg
+	}
+	report.add("config", checkPass, "%s is valid: %d machines, %d profiles", configPath, len(cfg.Machines), len(cfg.Profiles))
+	return cfg
+}
+
+// doctorAddresses are the addresses of the -machine, or -address.
+func doctorAddresses(report *doctorReport, cfg *config) []string {
+	if machineName == "" {
+		return splitAddresses(serverAddress)
+	}
+	m, err := cfg.machine(machineName)
+	if err != nil {
+		report.add("machine", checkFail, "%v in %s", err, configPath)
+		return nil
+	}
+	report.add("machine", checkPass, "%s is at %s", machineName, strings.Join(m.addresses(), ", "))
+	return m.addresses()
+}
+
+// doctorDNS looks up every address and returns a dialer for those that
+// resolve.
+func doctorDNS(report *doctorReport, addresses []string) []*dialer {
+	if len(addresses) == 0 {
+		report.add("dns", checkSkip, "no machine address")
+		return nil
+	}
+	var dialers []*dialer
+	for _, address := range expandSRV(addresses) {
+		switch {
+		case strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://"):
+			report.add("dns", checkSkip, "%s is looked up by the WebSocket dial", address)
+		case proxyAddress != "" || sshGateway != "":
+			report.add("dns", checkSkip, "%s is looked up by the proxy or gateway", address)
+		default:
+			host, _, _ := net.SplitHostPort(machineHostPort(address))
+			ips, err := net.LookupHost(host)
+			if err != nil {
+				report.add("dns", checkFail, "%s: %v", address, err)
+				continue
+			}
+			if net.ParseIP(host) == nil {
+				report.add("dns", checkPass, "%s is %s", host, strings.Join(ips, ", "))
+			} else {
+				report.add("dns", checkSkip, "%s is an IP address", host)
+			}
+		}
+		if d, err := resolveDialer(address); err == nil {
+			dialers = append(dialers, d)
+		}
+	}
+	if len(dialers) == 0 && strings.HasPrefix(addresses[0], srvPrefix) {
+		report.add("dns", checkFail, "no _carbide._tcp SRV targets for %s", strings.Join(addresses, ", "))
+	}
+	return dialers
+}
+
+// doctorTCP connects to every address and returns those that take the
+// connection.
+func doctorTCP(report *doctorReport, dialers []*dialer) []*dialer {
+	if len(dialers) == 0 {
+		report.add("tcp", checkSkip, "no address resolved")
+		return nil
+	}
+	var reachable []*dialer
+	for _, d := range dialers {
+		start := time.Now()
+		conn, err := d.dial()
+		if err != nil {
+			report.add("tcp", checkFail, "%s: %v", d, err)
+			if hint := connectionHint(&carbide.ConnectionError{Address: d.String(), Op: "connect to", Err: err}); hint != "" {
+				report.add("firewall", checkWarn, "%s", hint)
+			}
+			continue
+		}
+		conn.Close()
+		report.add("tcp", checkPass, "%s connects in %v", d, time.Since(start).Round(time.Millisecond))
+		reachable = append(reachable, d)
+	}
+	return reachable
+}
+
+// doctorState reads the state the machine announces, and compares the
+// time of a receiver that identifies itself with this computer's.
+func doctorState(report *doctorReport, dialers []*dialer) {
+	if len(dialers) == 0 {
+		report.add("state", checkSkip, "no address reachable")
+		report.add("clock", checkSkip, "no address reachable")
+		return
+	}
+	conn, r, state, d, err := dialAny(dialers)
+	if err != nil {
+		report.add("state", checkFail, "%v", err)
+		report.add("clock", checkSkip, "no state handshake")
+		return
+	}
+	defer conn.Close()
+	detail := fmt.Sprintf("%s is %s", d, state)
+	if d.caps.Version != "" {
+		detail += ", receiver " + d.caps.Version
+	}
+	if d.caps.Announced {
+		detail += ", features " + d.caps.String()
+	}
+	status := checkPass
+	switch state {
+	case carbide.StateAlarm, carbide.StateError, carbide.StateFault:
+		status, detail = checkWarn, detail+", clear it before sending"
+	}
+	report.add("state", status, "%s, answered in %v", detail, d.handshakeTime.Round(time.Millisecond))
+	if !d.caps.Supports(carbide.FeatureInfo) {
+		report.add("clock", checkSkip, "the receiver doesn't identify itself")
+		return
+	}
+	start := time.Now()
+	info, err := queryInfo(conn, r, connectTimeout)
+	roundTrip := time.Since(start)
+	if err != nil {
+		report.add("clock", checkSkip, "the receiver didn't identify itself: %v", err)
+		return
+	}
+	remote, err := time.Parse(time.RFC3339, info["time"])
+	if err != nil {
+		report.add("clock", checkSkip, "the receiver doesn't say its time")
+		return
+	}
+	skew := time.Until(remote.Add(roundTrip / 2)).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > clockSkewLimit+roundTrip {
+		report.add("clock", checkWarn, "the receiver's clock is %v off, times of day in schedules and the history won't match", skew)
+		return
+	}
+	report.add("clock", checkPass, "the receiver's clock is within %v", clockSkewLimit)
+}
+
+// doctorPermissions checks that the files send-carbide writes can be
+// written, and that a config file with tokens isn't readable by others.
+func doctorPermissions(report *doctorReport, cfg *config) {
+	if path := historyPath(); path != "" && !isDatabase(path) {
+		if err := writableDir(filepath.Dir(path)); err != nil {
+			report.add("permissions", checkFail, "the history can't be written: %v", err)
+		} else {
+			report.add("permissions", checkPass, "the history can be written to %s", path)
+		}
+	}
+	if logFile != "" {
+		if err := writableDir(filepath.Dir(logFile)); err != nil {
+			report.add("permissions", checkFail, "the -log-file can't be written: %v", err)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	secrets := false
+	for _, l := range cfg.Daemon.Listeners {
+		secrets = secrets || !l.open()
+	}
+	if info, err := os.Stat(configPath); err == nil && secrets && info.Mode().Perm()&0o077 != 0 {
+		report.add("permissions", checkWarn, "%s has tokens and is readable by others (%v), chmod 600 it", configPath, info.Mode().Perm())
+	}
+}
+
+// doctorStorage connects to the databases of the storage.
+func doctorStorage(report *doctorReport, cfg *config) {
+	for _, s := range []struct{ name, location string }{{"history", cfg.Storage.History}, {"artifacts", cfg.Storage.Artifacts}} {
+		if !isDatabase(s.location) {
+			continue
+		}
+		db, err := openSQLStore(s.location)
+		if err == nil {
+			err = db.ping()
+		}
+		if err != nil {
+			report.add("storage", checkFail, "the %s database %s: %v", s.name, redactLocation(s.location), err)
+			continue
+		}
+		report.add("storage", checkPass, "the %s database %s is reachable", s.name, redactLocation(s.location))
+	}
+}
+
+// writableDir checks that files can be created in dir, or in the closest
+// directory above it that exists, where send-carbide would create it.
+func writableDir(dir string) error {
+	for {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	f, err := ioutil.TempFile(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
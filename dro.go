@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+var droMode bool
+var droJSONStream bool
+
+// droInterval is how often GRBL is asked for its position while a job runs.
+const droInterval = 200 * time.Millisecond
+
+// droReading is the position of the machine at one moment of a job.
+type droReading struct {
+	Time  time.Time     `json:"time"`
+	State carbide.State `json:"state"`
+	X     float64       `json:"x"`
+	Y     float64       `json:"y"`
+	Z     float64       `json:"z"`
+	// Coordinates is "work" once the work offset is known, "machine"
+	// before that.
+	Coordinates string `json:"coordinates"`
+	// Line is the last line of the file the controller accepted.
+	Line int `json:"line"`
+}
+
+// droView shows the readings of a job, as a line redrawn in place on a
+// terminal, one line per reading elsewhere, or as JSON lines.
+type droView struct {
+	out      io.Writer
+	json     bool
+	live     bool
+	wco      [3]float64
+	knownWCO bool
+	drawn    bool
+}
+
+func newDROView(out *os.File, jsonStream bool) *droView {
+	return &droView{out: out, json: jsonStream, live: isTerminal(out)}
+}
+
+func parseAxes(text string) ([3]float64, bool) {
+	var axes [3]float64
+	values := strings.Split(text, ",")
+	if len(values) < len(axes) {
+		return axes, false
+	}
+	for i := range axes {
+		var err error
+		if axes[i], err = strconv.ParseFloat(values[i], 64); err != nil {
+			return axes, false
+		}
+	}
+	return axes, true
+}
+
+// reading turns the fields of a GRBL status report into a reading. GRBL
+// reports either the machine or the work position, and the work offset
+// only every few reports, so the last offset is kept.
+func (v *droView) reading(fields []string, line int) droReading {
+	r := droReading{Time: time.Now(), State: reportState(fields), Coordinates: "machine", Line: line}
+	var position [3]float64
+	var work bool
+	for _, field := range fields[1:] {
+		switch {
+		case strings.HasPrefix(field, "WCO:"):
+			v.wco, v.knownWCO = parseAxes(strings.TrimPrefix(field, "WCO:"))
+		case strings.HasPrefix(field, "MPos:"):
+			position, _ = parseAxes(strings.TrimPrefix(field, "MPos:"))
+		case strings.HasPrefix(field, "WPos:"):
+			position, _ = parseAxes(strings.TrimPrefix(field, "WPos:"))
+			work = true
+		}
+	}
+	if !work && v.knownWCO {
+		for i := range position {
+			position[i] -= v.wco[i]
+		}
+		work = true
+	}
+	if work {
+		r.Coordinates = "work"
+	}
+	r.X, r.Y, r.Z = position[0], position[1], position[2]
+	return r
+}
+
+// report shows the reading of a status report.
+func (v *droView) report(fields []string, line int) {
+	r := v.reading(fields, line)
+	if v.json {
+		if err := json.NewEncoder(v.out).Encode(r); err != nil {
+			zap.L().Warn("failed to write position", zap.Error(err))
+		}
+		return
+	}
+	prefix := ""
+	if r.Coordinates == "machine" {
+		prefix = "M"
+	}
+	text := fmt.Sprintf("%-8s %sX %9.3f  %sY %9.3f  %sZ %9.3f  line %d", r.State, prefix, r.X, prefix, r.Y, prefix, r.Z, r.Line)
+	if !v.live {
+		fmt.Fprintln(v.out, text)
+		return
+	}
+	fmt.Fprint(v.out, "\r\033[K"+text)
+	v.drawn = true
+}
+
+// clear ends the line drawn on the terminal.
+func (v *droView) clear() {
+	if v.drawn {
+		fmt.Fprintln(v.out)
+		v.drawn = false
+	}
+}
+
+// sendWithDRO streams the job while asking GRBL for its position, and keeps
+// showing it until the machine has finished the moves it buffered.
+func (s *serialSender) sendWithDRO(input io.Reader) (int, error) {
+	view := newDROView(resultOutput(), droJSONStream)
+	defer view.clear()
+	s.grbl.onReport = view.report
+	defer func() {
+		s.grbl.onReport = nil
+	}()
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		ticker := time.NewTicker(droInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// A realtime command, so it may be written between lines
+				if _, err := s.port.Write([]byte{'?'}); err != nil {
+					zap.L().Debug("failed asking for status", zap.Error(err))
+				}
+			}
+		}
+	}()
+	lines, err := s.grbl.stream(input)
+	close(stop)
+	<-polled
+	if err != nil {
+		return lines, err
+	}
+	for {
+		fields, err := s.grbl.report()
+		if err != nil {
+			return lines, err
+		}
+		view.report(fields, s.grbl.acked)
+		if stateExitCode(reportState(fields)) != statusExitBusy {
+			return lines, nil
+		}
+		time.Sleep(droInterval)
+	}
+}
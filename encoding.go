@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// inputEncoding is the text encoding of the job, or auto to detect it.
+var inputEncoding = "auto"
+
+// inputEncodings are the -encoding values besides auto.
+var inputEncodings = []string{"utf-8", "utf-16le", "utf-16be", "latin1"}
+
+// encodingSniffSize is how much of the job is looked at to tell its
+// encoding.
+const encodingSniffSize = 4 << 10
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// detectEncoding guesses the encoding of a job from its start. Byte order
+// marks decide; without one, text with a NUL in most of its odd or even
+// bytes and hardly any of the others is UTF-16, and text that isn't valid
+// UTF-8 is taken to be Latin-1, or rather its Windows superset, which is
+// what Windows tools write.
+func detectEncoding(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xfe}):
+		return "utf-16le"
+	case bytes.HasPrefix(head, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	case bytes.HasPrefix(head, utf8BOM):
+		return "utf-8"
+	}
+	var even, odd int
+	for i, c := range head {
+		if c != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			even++
+		} else {
+			odd++
+		}
+	}
+	pairs := len(head) / 2
+	switch {
+	case pairs > 0 && odd > pairs/2 && even < pairs/10:
+		return "utf-16le"
+	case pairs > 0 && even > pairs/2 && odd < pairs/10:
+		return "utf-16be"
+	}
+	// Binary files aren't Latin-1 either, they are left for checkBinary
+	// to refuse. The sniffed bytes may end in the middle of a character.
+	if binaryOffset(head) < 0 && !utf8.Valid(trimPartialRune(head)) {
+		return "latin1"
+	}
+	return "utf-8"
+}
+
+// trimPartialRune drops an incomplete UTF-8 sequence from the end of b.
+func trimPartialRune(b []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return b[:len(b)-i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// transcodeInput converts jobs saved as UTF-16 or Latin-1, as some Windows
+// CAM tools do, to UTF-8 in a temporary file, so the size announced to the
+// machine is the size of what is sent. A UTF-8 byte order mark is dropped.
+// Other jobs are passed through untouched.
+func transcodeInput(in *jobInput) (*jobInput, error) {
+	r := bufio.NewReaderSize(in, encodingSniffSize)
+	head, _ := r.Peek(encodingSniffSize)
+	encoding := inputEncoding
+	if encoding == "auto" {
+		encoding = detectEncoding(head)
+	}
+	sniffed := &jobInput{ReadCloser: &multiCloser{Reader: r, closers: []io.Closer{in}}, name: in.name, size: in.size, path: in.path}
+	var decode func(*bufio.Reader, *bufio.Writer) (transcodeStats, error)
+	switch encoding {
+	case "utf-8":
+		if !bytes.HasPrefix(head, utf8BOM) {
+			return sniffed, nil
+		}
+		zap.L().Debug("dropping the UTF-8 byte order mark", zap.String("file", in.name))
+		r.Discard(len(utf8BOM))
+		if sniffed.size >= 0 {
+			sniffed.size -= int64(len(utf8BOM))
+		}
+		sniffed.path = ""
+		return sniffed, nil
+	case "utf-16le":
+		decode = func(r *bufio.Reader, w *bufio.Writer) (transcodeStats, error) {
+			return decodeUTF16(r, w, func(b []byte) uint16 { return uint16(b[0]) | uint16(b[1])<<8 })
+		}
+	case "utf-16be":
+		decode = func(r *bufio.Reader, w *bufio.Writer) (transcodeStats, error) {
+			return decodeUTF16(r, w, func(b []byte) uint16 { return uint16(b[0])<<8 | uint16(b[1]) })
+		}
+	case "latin1":
+		decode = decodeLatin1
+	default:
+		sniffed.Close()
+		return nil, fmt.Errorf("unknown encoding %q, use auto or one of %v", encoding, inputEncodings)
+	}
+	defer sniffed.Close()
+	zap.L().Info("transcoding the job to UTF-8", zap.String("file", in.name), zap.String("encoding", encoding))
+	tmp, err := ioutil.TempFile("", "send-carbide-*.nc")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(tmp)
+	stats, err := decode(r, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	var size int64
+	if err == nil {
+		size, err = tmp.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		zap.L().Error("Could not transcode input file", zap.String("file", in.name), zap.String("encoding", encoding), zap.Error(err))
+		return nil, err
+	}
+	if stats.replaced > 0 {
+		zap.L().Warn("the job has characters that could not be decoded, they were replaced with U+FFFD",
+			zap.String("file", in.name), zap.String("encoding", encoding), zap.Int("count", stats.replaced), zap.Int("first_line", stats.firstReplacedLine))
+	}
+	if stats.nonASCII > 0 {
+		zap.L().Warn("the job has characters outside ASCII, which the controller may reject outside comments",
+			zap.String("file", in.name), zap.Int("count", stats.nonASCII), zap.Int("first_line", stats.firstNonASCIILine))
+	}
+	return &jobInput{ReadCloser: &tempFile{tmp}, name: in.name, size: size, path: tmp.Name()}, nil
+}
+
+// transcodeStats counts the characters of a job worth warning about.
+type transcodeStats struct {
+	line              int
+	replaced          int
+	firstReplacedLine int
+	nonASCII          int
+	firstNonASCIILine int
+}
+
+func (s *transcodeStats) write(w *bufio.Writer, r rune) {
+	switch {
+	case r == '\n':
+		s.line++
+	case r == utf8.RuneError:
+		if s.replaced == 0 {
+			s.firstReplacedLine = s.line + 1
+		}
+		s.replaced++
+	case r >= utf8.RuneSelf:
+		if s.nonASCII == 0 {
+			s.firstNonASCIILine = s.line + 1
+		}
+		s.nonASCII++
+	}
+	w.WriteRune(r)
+}
+
+func decodeUTF16(r *bufio.Reader, w *bufio.Writer, word func([]byte) uint16) (transcodeStats, error) {
+	var stats transcodeStats
+	unit := make([]byte, 2)
+	first := true
+	// high is a leading surrogate waiting for its pair
+	var high uint16
+	for {
+		if _, err := io.ReadFull(r, unit); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			stats.write(w, utf8.RuneError)
+			break
+		} else if err != nil {
+			return stats, err
+		}
+		u := word(unit)
+		if first {
+			first = false
+			if u == 0xfeff {
+				continue
+			}
+		}
+		switch {
+		case high != 0 && utf16.IsSurrogate(rune(u)) && u >= 0xdc00:
+			stats.write(w, utf16.DecodeRune(rune(high), rune(u)))
+			high = 0
+			continue
+		case high != 0:
+			stats.write(w, utf8.RuneError)
+			high = 0
+		}
+		switch {
+		case u >= 0xd800 && u < 0xdc00:
+			high = u
+		case utf16.IsSurrogate(rune(u)):
+			stats.write(w, utf8.RuneError)
+		default:
+			stats.write(w, rune(u))
+		}
+	}
+	if high != 0 {
+		stats.write(w, utf8.RuneError)
+	}
+	return stats, nil
+}
+
+// windows1252 maps the bytes 0x80 to 0x9f that Windows-1252 uses for
+// printable characters where Latin-1 has control codes. The 0 entries are
+// undefined.
+var windows1252 = [32]rune{
+	0x20ac, 0, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021, 0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017d, 0,
+	0, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014, 0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0, 0x017e, 0x0178,
+}
+
+func decodeLatin1(r *bufio.Reader, w *bufio.Writer) (transcodeStats, error) {
+	var stats transcodeStats
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return stats, nil
+		} else if err != nil {
+			return stats, err
+		}
+		switch {
+		case c >= 0x80 && c < 0xa0 && windows1252[c-0x80] != 0:
+			stats.write(w, windows1252[c-0x80])
+		case c >= 0x80 && c < 0xa0:
+			stats.write(w, utf8.RuneError)
+		default:
+			stats.write(w, rune(c))
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+)
+
+var eventsMode bool
+
+// eventInterval is how often progress events are written during a
+// transfer.
+const eventInterval = 250 * time.Millisecond
+
+// sendEvent is a line of -events output.
+type sendEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Target is the address connected to
+	Target string        `json:"target,omitempty"`
+	State  carbide.State `json:"state,omitempty"`
+	// Name and Size are of the job announced in the header
+	Name string `json:"name,omitempty"`
+	Size int64  `json:"size,omitempty"`
+	// Bytes of Size were written so far
+	Bytes int64 `json:"bytes,omitempty"`
+	// Seconds is how long the machine took to acknowledge the job
+	Seconds float64 `json:"seconds,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Events of a send, in the order they happen.
+const (
+	eventConnected  = "connected"
+	eventState      = "state"
+	eventHeaderSent = "header-sent"
+	eventProgress   = "progress"
+	eventFlushed    = "flushed"
+	eventAcked      = "acked"
+	eventError      = "error"
+)
+
+var eventsMu sync.Mutex
+
+// emitEvent writes an event as a line of JSON when -events is set.
+func emitEvent(e sendEvent) {
+	if !eventsMode {
+		return
+	}
+	e.Time = time.Now()
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	json.NewEncoder(resultOutput()).Encode(e)
+}
+
+// progressEvents writes progress events as a job is written to w.
+type progressEvents struct {
+	w       io.Writer
+	size    int64
+	n       int64
+	emitted time.Time
+}
+
+func newProgressEvents(w io.Writer, size int64) io.Writer {
+	if !eventsMode {
+		return w
+	}
+	return &progressEvents{w: w, size: size, emitted: time.Now()}
+}
+
+func (p *progressEvents) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	if p.n == p.size || time.Since(p.emitted) >= eventInterval {
+		p.emitted = time.Now()
+		emitEvent(sendEvent{Event: eventProgress, Bytes: p.n, Size: p.size})
+	}
+	return n, err
+}
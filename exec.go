@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var execCommand string
+
+// commandOutput is the stdout of a generator command. Closing it waits for
+// the command, so a failing generator fails the job.
+type commandOutput struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	closed bool
+	err    error
+}
+
+func (c *commandOutput) Close() error {
+	if c.closed {
+		return c.err
+	}
+	c.closed = true
+	c.ReadCloser.Close()
+	if c.err = c.cmd.Wait(); c.err != nil {
+		zap.L().Error("generator command failed", zap.String("command", strings.Join(c.cmd.Args, " ")), zap.Error(c.err))
+	}
+	return c.err
+}
+
+// openExec runs command through the shell and returns its output as a job
+// of unknown size. Its stderr is passed through.
+func openExec(command string) (*jobInput, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		zap.L().Error("failed to start generator command", zap.String("command", command), zap.Error(err))
+		return nil, err
+	}
+	name := "exec.nc"
+	if fields := strings.Fields(command); len(fields) > 0 {
+		name = strings.TrimSuffix(filepath.Base(fields[len(fields)-1]), filepath.Ext(fields[len(fields)-1])) + ".nc"
+	}
+	return &jobInput{ReadCloser: &commandOutput{ReadCloser: stdout, cmd: cmd}, name: name, size: -1}, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// expiryInterval is how often the daemon looks for jobs past their TTL. A
+// job is never sent once it expired, this only bounds how late it is
+// reported.
+const expiryInterval = time.Minute
+
+// expired reports whether the job is past its TTL at now.
+func (j *job) expired(now time.Time) bool {
+	return j.ExpiresAt != nil && !now.Before(*j.ExpiresAt)
+}
+
+// expireJobs pulls the jobs past their TTL from the queue, and tells the
+// event stream and the audit log about them, until stop is closed.
+func (d *daemon) expireJobs(stop <-chan struct{}) {
+	defer d.workers.Done()
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		for _, j := range d.queue.expire(time.Now()) {
+			zap.L().Warn("job expired before it was sent", zap.String("job", j.ID), zap.String("machine", j.Machine), zap.String("name", j.Name),
+				zap.Time("submitted", j.Submitted), zap.Time("expires", *j.ExpiresAt))
+			os.Remove(j.path)
+			d.events.jobEvent(daemonEventExpired, j)
+			d.audit.record(auditEntry{Client: j.SubmittedBy, Action: "expire", Job: j.ID, Machine: j.Machine, Name: j.Name, Result: "ok"})
+		}
+	}
+}
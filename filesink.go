@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+var outputPath string
+
+// fileSender writes jobs to a local file (or stdout for "-") instead of a
+// machine, which is handy for checking exactly what would be transmitted.
+type fileSender struct {
+	path string
+	out  io.WriteCloser
+}
+
+func newFileSender(cfg backendConfig) (Sender, error) {
+	if cfg.outputPath == "-" {
+		return &fileSender{path: cfg.outputPath, out: os.Stdout}, nil
+	}
+	f, err := os.Create(cfg.outputPath)
+	if err != nil {
+		zap.L().Error("failed to create output file", zap.String("output", cfg.outputPath), zap.Error(err))
+		return nil, err
+	}
+	return &fileSender{path: cfg.outputPath, out: f}, nil
+}
+
+func (f *fileSender) Target() string {
+	return f.path
+}
+
+func (f *fileSender) Close() error {
+	if f.out == os.Stdout {
+		return nil
+	}
+	return f.out.Close()
+}
+
+func (f *fileSender) Send(name string, input io.Reader, size int64) error {
+	n, err := io.Copy(f.out, input)
+	if err != nil {
+		zap.L().Error("failed writing output file", zap.String("output", f.path), zap.Error(err))
+		return err
+	}
+	zap.L().Debug("wrote gcode", zap.Int64("size", n))
+	return nil
+}
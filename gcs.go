@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const gcsPrefix = "gs://"
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_only"
+const gcsMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+var errNoGoogleCredentials = errors.New("no Google credentials found")
+
+// googleCredentials is a service account key or the application default
+// credentials written by gcloud.
+type googleCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func googleCredentialsFile() string {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gcloud", "application_default_credentials.json")
+}
+
+// googleAccessToken follows the application default credentials chain: an
+// explicit token, a credentials file, then the metadata server of a GCE
+// instance.
+func googleAccessToken() (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	if data, err := ioutil.ReadFile(googleCredentialsFile()); err == nil {
+		var creds googleCredentials
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return "", err
+		}
+		switch creds.Type {
+		case "service_account":
+			return serviceAccountToken(creds)
+		case "authorized_user":
+			return exchangeToken("https://oauth2.googleapis.com/token", url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {creds.ClientID},
+				"client_secret": {creds.ClientSecret},
+				"refresh_token": {creds.RefreshToken},
+			})
+		default:
+			return "", fmt.Errorf("unsupported Google credentials type %q", creds.Type)
+		}
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	req, _ := http.NewRequest(http.MethodGet, gcsMetadataToken, nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errNoGoogleCredentials
+	}
+	defer resp.Body.Close()
+	return decodeToken(resp)
+}
+
+// serviceAccountToken exchanges a signed JWT for an access token.
+func serviceAccountToken(creds googleCredentials) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("service account private key is not RSA")
+	}
+	tokenURI := creds.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcsScope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return exchangeToken(tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+}
+
+func exchangeToken(tokenURI string, form url.Values) (string, error) {
+	resp, err := inputClient.PostForm(tokenURI, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return decodeToken(resp)
+}
+
+func decodeToken(resp *http.Response) (string, error) {
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// openGCS streams an object from gs://bucket/object. Without credentials
+// only public objects can be read.
+func openGCS(source string) (*jobInput, error) {
+	location := strings.TrimPrefix(source, gcsPrefix)
+	i := strings.Index(location, "/")
+	if i <= 0 || i == len(location)-1 {
+		return nil, fmt.Errorf("invalid GCS location %q, expected gs://bucket/object", source)
+	}
+	bucket, object := location[:i], location[i+1:]
+	endpoint := os.Getenv("STORAGE_EMULATOR_HOST")
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	} else if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", endpoint, url.PathEscape(bucket), url.PathEscape(object)), nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := googleAccessToken()
+	if err == nil {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if err != errNoGoogleCredentials {
+		zap.L().Error("Could not get Google credentials", zap.String("source", source), zap.Error(err))
+		return nil, err
+	} else {
+		zap.L().Warn("no Google credentials found, trying anonymous access", zap.String("source", source))
+	}
+	return openHTTP(req, source, path.Base(object))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// grblRxBufferSize is the size of GRBL's serial receive buffer. The
+// character counting protocol keeps at most this many bytes in flight.
+const grblRxBufferSize = 128
+
+var errGRBLTimeout = errors.New("timed out waiting for grbl")
+
+// grblError is an error or alarm reported by GRBL for a line.
+type grblError struct {
+	line     int
+	text     string
+	response string
+}
+
+func (e *grblError) Error() string {
+	if merr := carbide.ParseMachineError(e.response); merr != nil {
+		return fmt.Sprintf("grbl rejected line %d %q: %v", e.line, e.text, merr)
+	}
+	return fmt.Sprintf("grbl rejected line %d %q: %s", e.line, e.text, e.response)
+}
+
+// Unwrap returns the error or alarm as a carbide.MachineError.
+func (e *grblError) Unwrap() error {
+	if merr := carbide.ParseMachineError(e.response); merr != nil {
+		return merr
+	}
+	return nil
+}
+
+// grblStreamer drives a GRBL controller over a serial port.
+type grblStreamer struct {
+	port      io.ReadWriter
+	responses chan string
+	readErr   chan error
+	timeout   time.Duration
+	// onReport, when set, is called with the fields of each status report
+	// that arrives while streaming and the last line GRBL acknowledged.
+	onReport func(fields []string, line int)
+	// acked is the number of the last line of the input GRBL acknowledged.
+	acked int
+	// onAck, when set, is called with the number of each line GRBL
+	// acknowledges while streaming.
+	onAck func(line int)
+}
+
+func newGRBLStreamer(port io.ReadWriter, timeout time.Duration) *grblStreamer {
+	g := &grblStreamer{
+		port:      port,
+		responses: make(chan string, 64),
+		readErr:   make(chan error, 1),
+		timeout:   timeout,
+	}
+	go g.readLoop()
+	return g
+}
+
+func (g *grblStreamer) readLoop() {
+	scanner := bufio.NewScanner(g.port)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			g.responses <- line
+		}
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	g.readErr <- err
+}
+
+// next returns the next response from GRBL.
+func (g *grblStreamer) next() (string, error) {
+	return g.nextWithin(g.timeout)
+}
+
+// nextWithin returns the next response from GRBL, waiting at most timeout.
+func (g *grblStreamer) nextWithin(timeout time.Duration) (string, error) {
+	select {
+	case line := <-g.responses:
+		zap.L().Debug("grbl response", zap.String("response", line))
+		return line, nil
+	case err := <-g.readErr:
+		return "", err
+	case <-time.After(timeout):
+		return "", errGRBLTimeout
+	}
+}
+
+// waitBanner waits for the startup banner GRBL prints after the port is
+// opened and the controller resets.
+func (g *grblStreamer) waitBanner() (string, error) {
+	for {
+		line, err := g.next()
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(line, "Grbl") {
+			return line, nil
+		}
+	}
+}
+
+// cleanGcodeLine strips comments and whitespace so less of GRBL's small
+// receive buffer is wasted.
+func cleanGcodeLine(line string) string {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	for {
+		start := strings.IndexByte(line, '(')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(line[start:], ')')
+		if end < 0 {
+			line = line[:start]
+			break
+		}
+		line = line[:start] + line[start+end+1:]
+	}
+	return strings.TrimSpace(line)
+}
+
+// stream sends every line of input, keeping GRBL's receive buffer as full
+// as possible without overflowing it. It returns the number of lines sent.
+func (g *grblStreamer) stream(input io.Reader) (int, error) {
+	type pending struct {
+		number int
+		text   string
+	}
+	var inFlight []pending
+	buffered := 0
+	g.acked = 0
+	// waitOne consumes the response to the oldest in-flight line. GRBL holds
+	// the ok back for as long as a dwell, an M0 pause or a move the planner
+	// waits on takes, so a quiet GRBL is asked for a status report instead
+	// of given up on, and only one that doesn't answer that is stuck.
+	waitOne := func() error {
+		polled := false
+		for {
+			response, err := g.next()
+			if errors.Is(err, errGRBLTimeout) && !polled {
+				if _, err := g.port.Write([]byte{'?'}); err != nil {
+					return err
+				}
+				polled = true
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			polled = false
+			if response == "ok" {
+				break
+			}
+			if strings.HasPrefix(response, "error:") || strings.HasPrefix(response, "ALARM:") {
+				return &grblError{line: inFlight[0].number, text: inFlight[0].text, response: response}
+			}
+			if strings.HasPrefix(response, "<") && g.onReport != nil {
+				g.onReport(reportFields(response), g.acked)
+			}
+			// Status reports, feedback messages and settings output do not
+			// acknowledge a line.
+		}
+		g.acked = inFlight[0].number
+		if g.onAck != nil {
+			g.onAck(g.acked)
+		}
+		buffered -= len(inFlight[0].text) + 1
+		inFlight = inFlight[1:]
+		return nil
+	}
+	scanner := bufio.NewScanner(input)
+	lineNumber := 0
+	sent := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := cleanGcodeLine(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if len(line)+1 > grblRxBufferSize {
+			return sent, fmt.Errorf("line %d is longer than the grbl receive buffer", lineNumber)
+		}
+		for buffered+len(line)+1 > grblRxBufferSize {
+			if err := waitOne(); err != nil {
+				return sent, err
+			}
+		}
+		if _, err := io.WriteString(g.port, line+"\n"); err != nil {
+			return sent, err
+		}
+		inFlight = append(inFlight, pending{number: lineNumber, text: line})
+		buffered += len(line) + 1
+		sent++
+	}
+	if err := scanner.Err(); err != nil {
+		return sent, err
+	}
+	for len(inFlight) > 0 {
+		if err := waitOne(); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// grblStates maps GRBL's status report states to the names Carbide Motion
+// reports, so both backends are checked against the same states.
+var grblStates = map[string]carbide.State{
+	"Idle": carbide.StateIdle,
+	"Run":  carbide.StateRunning,
+	"Hold": carbide.StateHold,
+	"Jog":  carbide.StateRunning,
+	"Home": carbide.StateHoming,
+}
+
+// report asks GRBL for a status report and returns its fields.
+func (g *grblStreamer) report() ([]string, error) {
+	if _, err := g.port.Write([]byte{'?'}); err != nil {
+		return nil, err
+	}
+	for {
+		response, err := g.next()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(response, "<") {
+			return reportFields(response), nil
+		}
+	}
+}
+
+// reportFields splits a status report like
+// <Hold:0|MPos:0.000,0.000,0.000|FS:0,0> into its fields.
+func reportFields(report string) []string {
+	return strings.Split(strings.Trim(report, "<>"), "|")
+}
+
+// status asks GRBL for a status report and returns its state.
+func (g *grblStreamer) status() (carbide.State, error) {
+	fields, err := g.report()
+	if err != nil {
+		return carbide.StateUnknown, err
+	}
+	return reportState(fields), nil
+}
+
+// reportState returns the state of a status report.
+func reportState(fields []string) carbide.State {
+	state := fields[0]
+	if i := strings.IndexByte(state, ':'); i >= 0 {
+		state = state[:i]
+	}
+	if mapped, ok := grblStates[state]; ok {
+		return mapped
+	}
+	return carbide.ParseStateName(state)
+}
+
+// grblOverrideReports is how many status reports to wait for the override
+// levels. GRBL includes them right after a change and otherwise only in
+// every tenth to twentieth report.
+const grblOverrideReports = 20
+
+// overrides asks GRBL for status reports until one has the override levels.
+func (g *grblStreamer) overrides() (overrides, error) {
+	for i := 0; i < grblOverrideReports; i++ {
+		fields, err := g.report()
+		if err != nil {
+			return overrides{}, err
+		}
+		for _, field := range fields {
+			if strings.HasPrefix(field, "Ov:") {
+				return parseOverrideLevels(strings.TrimPrefix(field, "Ov:"))
+			}
+		}
+	}
+	return overrides{}, errors.New("grbl did not report override levels")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGRBL acknowledges each line after delay, like GRBL running a dwell,
+// and answers status requests when it isn't stuck.
+type fakeGRBL struct {
+	r     *io.PipeReader
+	w     *io.PipeWriter
+	delay time.Duration
+	stuck bool
+}
+
+func newFakeGRBL(delay time.Duration, stuck bool) *fakeGRBL {
+	r, w := io.Pipe()
+	return &fakeGRBL{r: r, w: w, delay: delay, stuck: stuck}
+}
+
+func (f *fakeGRBL) Read(b []byte) (int, error) {
+	return f.r.Read(b)
+}
+
+func (f *fakeGRBL) Write(b []byte) (int, error) {
+	for _, c := range b {
+		switch {
+		case c == '?' && !f.stuck:
+			go f.w.Write([]byte("<Run|MPos:0.000,0.000,0.000|FS:0,0>\n"))
+		case c == '\n' && !f.stuck:
+			go func() {
+				time.Sleep(f.delay)
+				f.w.Write([]byte("ok\n"))
+			}()
+		}
+	}
+	return len(b), nil
+}
+
+func TestGRBLStreamWaitsForHeldOk(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		stuck   bool
+		wantErr error
+	}{
+		{"quick ok", 0, false, nil},
+		// A G4 dwell, an M0 pause or a full planner hold the ok back much
+		// longer than the response timeout
+		{"held ok", 500 * time.Millisecond, false, nil},
+		{"stuck", 0, true, errGRBLTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := newFakeGRBL(tt.delay, tt.stuck)
+			defer port.w.Close()
+			g := newGRBLStreamer(port, 50*time.Millisecond)
+			var reports int
+			g.onReport = func([]string, int) { reports++ }
+			sent, err := g.stream(strings.NewReader("G1 X10 F300\nG4 P10\nM0\n"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("stream returned %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (sent != 3 || g.acked != 3) {
+				t.Errorf("sent %d lines and got %d acknowledged, want 3", sent, g.acked)
+			}
+			if tt.delay > 0 && reports == 0 {
+				t.Error("GRBL wasn't asked for its status while it held the ok back")
+			}
+		})
+	}
+}
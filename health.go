@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/bobcob7/send-carbide/carbide"
+)
+
+// healthPaths are answered without credentials, for orchestrators and
+// uptime monitors.
+var healthPaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+// machineReadiness is whether the daemon can reach a machine.
+type machineReadiness struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	// State is what the machine answered, even when it isn't one that
+	// permits sending
+	State carbide.State `json:"state,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready    bool               `json:"ready"`
+	Machines []machineReadiness `json:"machines"`
+}
+
+// handleHealth answers that the daemon is up.
+func (d *daemon) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady answers 200 OK when every machine, or the ?machine= one,
+// can be reached and answers its state, and 503 Service Unavailable
+// otherwise. A busy machine is still ready, the queue waits for it.
+func (d *daemon) handleReady(w http.ResponseWriter, r *http.Request) {
+	names := d.machineNames()
+	if machine := r.URL.Query().Get("machine"); machine != "" {
+		if _, ok := d.cfg.Machines[machine]; !ok {
+			writeError(w, http.StatusNotFound, "unknown machine %q", machine)
+			return
+		}
+		names = []string{machine}
+	}
+	result := readiness{Ready: true, Machines: make([]machineReadiness, len(names))}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			result.Machines[i] = d.checkMachine(name)
+		}(i, name)
+	}
+	wg.Wait()
+	status := http.StatusOK
+	for _, m := range result.Machines {
+		if !m.Ready {
+			result.Ready = false
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, result)
+}
+
+func (d *daemon) checkMachine(name string) machineReadiness {
+	readiness := machineReadiness{Name: name}
+	dialers, err := dialersFor(d.cfg.Machines[name].addresses())
+	if err != nil {
+		readiness.Error = err.Error()
+		return readiness
+	}
+	state, err := pooledState(dialers)
+	if err != nil {
+		readiness.Error = err.Error()
+		return readiness
+	}
+	readiness.Ready = true
+	readiness.State = state
+	return readiness
+}
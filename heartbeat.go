@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// startHeartbeat periodically writes an empty message to conn so idle NAT
+// and firewall state is kept alive while the receiver processes a large file.
+// The returned function stops the heartbeat and waits for it to finish.
+func startHeartbeat(conn net.Conn, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := conn.Write([]byte{framing.End()}); err != nil {
+					zap.L().Warn("failed sending heartbeat", zap.Error(err))
+					return
+				}
+				zap.L().Debug("sent heartbeat")
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
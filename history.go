@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// historyEntry is one line of the job history file.
+type historyEntry struct {
+	Time    time.Time         `json:"time"`
+	Kind    string            `json:"kind"`
+	Machine string            `json:"machine,omitempty"`
+	Address string            `json:"address"`
+	File    string            `json:"file,omitempty"`
+	Size    int64             `json:"size,omitempty"`
+	Result  string            `json:"result"`
+	Info    map[string]string `json:"info,omitempty"`
+	// Metadata is what the comments of a sent job say about it
+	Metadata *jobMetadata `json:"metadata,omitempty"`
+	// Job is the ID of a job the daemon sent
+	Job string `json:"job,omitempty"`
+	// SHA256 and Artifact are of the copy the daemon kept of the job,
+	// with -artifacts
+	SHA256   string `json:"sha256,omitempty"`
+	Artifact string `json:"artifact,omitempty"`
+	// EstimatedSeconds and RuntimeSeconds are how long a run was estimated
+	// to take and took, from the end of the send until the machine was
+	// back in init
+	EstimatedSeconds float64 `json:"estimated_seconds,omitempty"`
+	RuntimeSeconds   float64 `json:"runtime_seconds,omitempty"`
+}
+
+const (
+	historyKindSend = "send"
+	historyKindInfo = "info"
+	// historyKindRun is how long a job ran once it was sent, with -track-run
+	// or in the daemon
+	historyKindRun = "run"
+)
+
+// historyPath returns the job history location, storage.history of the
+// config file or history.jsonl next to it.
+func historyPath() string {
+	if storage.History != "" {
+		return storagePath(storage.History)
+	}
+	if configPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configPath), "history.jsonl")
+}
+
+// appendHistory records an entry in the job history. Failures are logged and
+// otherwise ignored since history must never block a send.
+func appendHistory(entry historyEntry) {
+	history, err := openHistory()
+	if err != nil {
+		zap.L().Warn("failed to open history", zap.String("path", redactLocation(historyPath())), zap.Error(err))
+		return
+	} else if history == nil {
+		return
+	}
+	if err := history.appendHistory(entry); err != nil {
+		zap.L().Warn("failed to write history entry", zap.String("path", redactLocation(historyPath())), zap.Error(err))
+	}
+}
+
+// readHistory returns all entries in the job history, oldest first.
+func readHistory() ([]historyEntry, error) {
+	history, err := openHistory()
+	if err != nil || history == nil {
+		return nil, err
+	}
+	return history.readHistory()
+}
+
+// lastMachineInfo returns the most recently recorded identification of the
+// machine at address, if any.
+func lastMachineInfo(address string) map[string]string {
+	entries, err := readHistory()
+	if err != nil {
+		zap.L().Debug("failed to read history", zap.Error(err))
+		return nil
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Kind == historyKindInfo && entries[i].Address == address && entries[i].Info != nil {
+			return entries[i].Info
+		}
+	}
+	return nil
+}
+
+var errNoArtifact = errors.New("no copy of the job was kept")
+
+// runHistory lists the jobs sent, or sends one of the daemon's again from
+// the copy it kept with -artifacts.
+var historyJSON, historyForce bool
+var historyLast int
+
+func historyFlags(fs *flag.FlagSet) {
+	addBackendFlags(fs)
+	fs.StringVar(&profileName, "profile", "", "with resend, machine profile to check the job against, by default the machine's profile from the config file")
+	fs.StringVar(&queueURL, "queue", "", "with resend, submit the job to the job queue of a send-carbide daemon at this URL (e.g. http://cnc-pc:6281) instead of sending it, fetching its copy from there when there is none here")
+	fs.StringVar(&apiToken, "token", defaultToken(), "token for a daemon that requires one, defaults to SEND_CARBIDE_TOKEN; pass a user and password in the URL for basic auth")
+	fs.DurationVar(&waitTimeout, "wait", 0, "with resend, wait up to this long for the machine to become ready instead of failing (e.g. 10m)")
+	fs.StringVar(&allowedStates, "allow-state", "init", "with resend, comma separated list of machine states that permit sending, by default the profile's allow_states or init")
+	fs.DurationVar(&ackTimeout, "ack-timeout", 10*time.Minute, "with resend, how long to wait for the machine to acknowledge the job, 0 waits forever")
+	fs.BoolVar(&historyForce, "force", false, "with resend, send the job even when the preflight finds problems")
+	fs.BoolVar(&historyJSON, "json", false, "print the entries as JSON")
+	fs.IntVar(&historyLast, "n", 20, "print this many of the latest sends, 0 for all")
+}
+
+func runHistory(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("history")
+	historyFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) == 0 {
+		positional = []string{"list"}
+	}
+	action, positional := positional[0], positional[1:]
+	switch {
+	case action == "list" && len(positional) == 0:
+		return listHistory(historyLast, historyJSON)
+	case action == "resend" && len(positional) == 1:
+		return resendJob(fs, positional[0], historyForce)
+	}
+	fs.PrintDefaults()
+	zap.L().Error("wrong arguments, e.g. history list or history resend <job-id>", zap.String("command", action), zap.Strings("args", positional))
+	return fmt.Errorf("unknown history command %q", strings.Join(append([]string{action}, positional...), " "))
+}
+
+// listHistory prints the last sends, of -machine when it is given.
+func listHistory(last int, jsonOutput bool) error {
+	entries, err := readHistory()
+	if err != nil {
+		zap.L().Error("failed to read history", zap.String("path", redactLocation(historyPath())), zap.Error(err))
+		return err
+	}
+	var sends []historyEntry
+	for _, entry := range entries {
+		if entry.Kind == historyKindSend && (machineName == "" || entry.Machine == machineName) {
+			sends = append(sends, entry)
+		}
+	}
+	if last > 0 && len(sends) > last {
+		sends = sends[len(sends)-last:]
+	}
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(sends)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tMACHINE\tFILE\tSIZE\tRESULT\tJOB")
+	for _, entry := range sends {
+		machine := entry.Machine
+		if machine == "" {
+			machine = entry.Address
+		}
+		job := entry.Job
+		if entry.SHA256 != "" {
+			job += " (kept)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Local().Format("2006-01-02 15:04"), machine, entry.File,
+			formatByteSize(entry.Size), entry.Result, job)
+	}
+	return w.Flush()
+}
+
+// resendJob sends a job of the daemon again from the copy it kept, to its
+// machine or the -machine one, once a preflight against that machine's
+// profile finds no problems.
+func resendJob(fs *flag.FlagSet, id string, force bool) error {
+	entries, err := readHistory()
+	if err != nil {
+		zap.L().Error("failed to read history", zap.String("path", redactLocation(historyPath())), zap.Error(err))
+		return err
+	}
+	var entry *historyEntry
+	for i := len(entries) - 1; i >= 0 && entry == nil; i-- {
+		if entries[i].Kind == historyKindSend && entries[i].Job == id {
+			entry = &entries[i]
+		}
+	}
+	if entry == nil {
+		zap.L().Error("no such job in the history", zap.String("job", id), zap.String("history", redactLocation(historyPath())))
+		return fmt.Errorf("%w %q", errUnknownJob, id)
+	}
+	if entry.SHA256 == "" {
+		zap.L().Error("the daemon kept no copy of the job, run it with -artifacts", zap.String("job", id))
+		return fmt.Errorf("%w of %s", errNoArtifact, id)
+	}
+	if !flagGiven(fs, "machine") {
+		machineName = entry.Machine
+	}
+	if err := profileStates(fs); err != nil {
+		return err
+	}
+	path, err := artifactCopy(entry)
+	if err != nil {
+		return err
+	}
+	if path != entry.Artifact {
+		defer os.Remove(path)
+	}
+	report, err := resendPreflight(path, entry.File)
+	if err != nil {
+		return err
+	}
+	if len(report.Findings) > 0 {
+		printSimulation(report)
+		if !force {
+			zap.L().Error("preflight found problems, pass -force to send anyway", zap.String("job", id), zap.String("machine", machineName), zap.Int("findings", len(report.Findings)))
+			return fmt.Errorf("%w: %d in %s", errSimulationProblems, len(report.Findings), entry.File)
+		}
+		zap.L().Warn("sending despite the preflight's problems", zap.String("job", id), zap.Int("findings", len(report.Findings)))
+	}
+	input, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	input.name = entry.File
+	if queueURL != "" {
+		detail, err := queueInput(input)
+		if err != nil {
+			zap.L().Error("failed to resend job", zap.String("job", id), zap.Error(err))
+			return err
+		}
+		fmt.Fprintf(resultOutput(), "queued job %s (%s) again for %s as %s\n", id, entry.File, machineName, detail)
+		return nil
+	}
+	sender, err := newSender(backend)
+	if err != nil {
+		zap.L().Error("failed to set up backend", zap.String("backend", backend), zap.Error(err))
+		return err
+	}
+	defer sender.Close()
+	err = sender.Send(input.name, input, input.size)
+	recordSend(machineName, sender.Target(), entry.File, input, err)
+	if err != nil {
+		zap.L().Error("failed to resend job", zap.String("job", id), zap.Error(err))
+		return err
+	}
+	fmt.Fprintf(resultOutput(), "sent job %s (%s) again to %s\n", id, entry.File, sender.Target())
+	return nil
+}
+
+// artifactCopy returns the path of the copy of a job: the daemon's, when
+// it is on this computer, or a temporary one read from storage.artifacts
+// or fetched from -queue. Either
+// must still have the content that was sent.
+func artifactCopy(entry *historyEntry) (string, error) {
+	if f, err := os.Open(entry.Artifact); err == nil {
+		hash, err := contentHash(f)
+		f.Close()
+		if err == nil && hash == entry.SHA256 {
+			return entry.Artifact, nil
+		}
+		zap.L().Warn("kept copy of the job changed, ignoring it", zap.String("artifact", entry.Artifact))
+	}
+	if store, err := openArtifactStore(storagePath(storage.Artifacts), 0, 0); err == nil && store != nil {
+		if r, err := store.open(entry.SHA256); err == nil {
+			defer r.Close()
+			return artifactTemp(entry, r, "storage")
+		}
+	}
+	if queueURL == "" {
+		zap.L().Error("the copy of the job is not on this computer, pass the daemon's -queue to fetch it", zap.String("job", entry.Job), zap.String("artifact", entry.Artifact))
+		return "", fmt.Errorf("%w of %s here", errNoArtifact, entry.Job)
+	}
+	endpoint := strings.TrimSuffix(queueURL, "/") + "/artifacts/" + entry.SHA256
+	req, err := newAPIRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := inputClient.Do(req)
+	if err != nil {
+		zap.L().Error("failed to reach the daemon", zap.String("url", endpoint), zap.Error(err))
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		zap.L().Error("daemon has no copy of the job", zap.String("job", entry.Job), zap.String("status", resp.Status), zap.String("error", apiErr.Error))
+		return "", fmt.Errorf("%w of %s: %s", errNoArtifact, entry.Job, apiErr.Error)
+	}
+	return artifactTemp(entry, resp.Body, "the daemon")
+}
+
+// artifactTemp writes the copy of a job read from where to a temporary
+// file, checking it still has the content that was sent.
+func artifactTemp(entry *historyEntry, r io.Reader, where string) (string, error) {
+	f, err := ioutil.TempFile("", "send-carbide-resend-*.nc")
+	if err != nil {
+		return "", err
+	}
+	hash, err := contentHash(io.TeeReader(r, f))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hash != entry.SHA256 {
+		err = fmt.Errorf("copy of %s from %s has SHA-256 %s, not %s", entry.Job, where, hash, entry.SHA256)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		zap.L().Error("failed to fetch the copy of the job", zap.String("job", entry.Job), zap.Error(err))
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// resendPreflight checks a job on a model of the machine it is sent to:
+// by the daemon with -queue, as its preflight does, or here against the
+// -profile or the machine's profile.
+func resendPreflight(path, name string) (simulationReport, error) {
+	if queueURL != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return simulationReport{}, err
+		}
+		defer f.Close()
+		query := url.Values{"machine": {machineName}, "name": {name}}
+		req, err := newAPIRequest(http.MethodPost, strings.TrimSuffix(queueURL, "/")+"/preflight?"+query.Encode(), f)
+		if err != nil {
+			return simulationReport{}, err
+		}
+		var report preflightReport
+		resp, err := inputClient.Do(req)
+		if err != nil {
+			zap.L().Error("failed to reach the daemon", zap.String("queue", queueURL), zap.Error(err))
+			return simulationReport{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			var apiErr apiError
+			json.NewDecoder(resp.Body).Decode(&apiErr)
+			zap.L().Error("daemon refused the preflight", zap.String("status", resp.Status), zap.String("error", apiErr.Error))
+			return simulationReport{}, errors.New(apiErr.Error)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&report)
+		return report.simulationReport, err
+	}
+	profile, hasProfile, err := activeProfile()
+	if err != nil {
+		return simulationReport{}, err
+	}
+	input, err := openInput(path)
+	if err != nil {
+		return simulationReport{}, err
+	}
+	defer input.Close()
+	input.name = name
+	var s *simulator
+	if hasProfile {
+		applyProfile(input, profile)
+		s = newSimulator(&profile, nil, preflightSpike)
+	} else {
+		zap.L().Info("no profile, the travel is not checked")
+		s = newSimulator(nil, nil, preflightSpike)
+	}
+	if err := s.run(input); err != nil {
+		zap.L().Error("failed to read job", zap.String("file", name), zap.Error(err))
+		return simulationReport{}, err
+	}
+	return s.result(name), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+const infoRequest = "INFO\n"
+
+var errInfoUnsupported = errors.New("receiver does not support identification")
+
+// queryInfo asks the receiver to identify itself. Receivers that support it
+// answer with a single "INFO: key=value key=value" line; anything else, or no
+// answer before the timeout, means the exchange is unsupported.
+func queryInfo(conn net.Conn, r *bufio.Reader, timeout time.Duration) (map[string]string, error) {
+	zap.L().Debug("requesting machine info")
+	if _, err := conn.Write(framed(infoRequest)); err != nil {
+		zap.L().Error("failed sending info request", zap.Error(err))
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	msg, err := readMessage(r)
+	if err != nil {
+		// Receivers without the exchange either ignore the request or hang up.
+		var netErr net.Error
+		if err == io.EOF || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return nil, errInfoUnsupported
+		}
+		return nil, err
+	}
+	return parseInfo(msg)
+}
+
+// parseInfo parses the fields of an INFO response line.
+func parseInfo(msg string) (map[string]string, error) {
+	tokens := strings.Fields(msg)
+	if len(tokens) == 0 || strings.ToUpper(tokens[0]) != "INFO:" {
+		zap.L().Debug("unexpected info response", zap.String("message", msg))
+		return nil, errInfoUnsupported
+	}
+	info := make(map[string]string, len(tokens)-1)
+	for _, token := range tokens[1:] {
+		parts := strings.SplitN(token, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		info[strings.ToLower(parts[0])] = parts[1]
+	}
+	return info, nil
+}
+
+var infoJSON bool
+var infoTimeout time.Duration
+
+func infoFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&infoJSON, "json", false, "print the machine info as JSON")
+	fs.DurationVar(&infoTimeout, "timeout", 3*time.Second, "how long to wait for the receiver to identify itself")
+}
+
+func runInfo(args []string) error {
+	fs := newFlagSet("info")
+	infoFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	dialers, err := resolveDialers()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	conn, r, state, d, err := dialAny(dialers)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var info map[string]string
+	err = errInfoUnsupported
+	if d.caps.Supports(carbide.FeatureInfo) {
+		info, err = queryInfo(conn, r, infoTimeout)
+	}
+	if err != nil && err != errInfoUnsupported {
+		return err
+	}
+	if info == nil {
+		info = map[string]string{}
+	}
+	info["state"] = state.String()
+	if _, ok := info["features"]; !ok && d.caps.Announced {
+		info["features"] = d.caps.String()
+	}
+	if _, ok := info["version"]; !ok && d.caps.Version != "" {
+		info["version"] = d.caps.Version
+	}
+	appendHistory(historyEntry{
+		Time:    time.Now(),
+		Kind:    historyKindInfo,
+		Machine: machineName,
+		Address: d.String(),
+		Result:  "ok",
+		Info:    info,
+	})
+	if infoJSON {
+		return json.NewEncoder(os.Stdout).Encode(info)
+	}
+	if err == errInfoUnsupported {
+		fmt.Println("identification: not supported by receiver")
+	}
+	keys := make([]string, 0, len(info))
+	for key := range info {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s: %s\n", key, info[key])
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// jobInput is an opened job with the name and size the receiver is told.
+// A size of -1 means it is only known once the input has been read, which
+// backends that stream line by line don't mind.
+type jobInput struct {
+	io.ReadCloser
+	name string
+	size int64
+	// path is a local file with the same content, if there is one
+	path string
+	// metadata is what the comments at the start of the job say about it
+	metadata *jobMetadata
+}
+
+// openInput opens a job from a local path, an http(s) URL or an object
+// storage location, unpacking it if it is compressed, refusing project
+// files that are not gcode, converting it to UTF-8 and refusing it if it
+// is not text. With -raw it is only opened.
+func openInput(source string) (*jobInput, error) {
+	in, err := openSource(source)
+	if err != nil || rawSend {
+		return in, err
+	}
+	if in, err = decompressInput(in); err != nil {
+		return nil, err
+	}
+	if in, err = checkProjectFile(in); err != nil {
+		return nil, err
+	}
+	if in, err = transcodeInput(in); err != nil {
+		return nil, err
+	}
+	return checkBinary(in)
+}
+
+func openSource(source string) (*jobInput, error) {
+	switch {
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return openURL(source)
+	case strings.HasPrefix(source, s3Prefix):
+		return openS3(source)
+	case strings.HasPrefix(source, gcsPrefix):
+		return openGCS(source)
+	}
+	if source == "-" {
+		return &jobInput{ReadCloser: ioutil.NopCloser(os.Stdin), name: "stdin.nc", size: -1}, nil
+	}
+	fileInfo, err := os.Stat(source)
+	if err != nil {
+		zap.L().Error("Could not find input file", zap.String("file", source))
+		return nil, err
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		zap.L().Error("Could not open input file", zap.String("file", source))
+		return nil, err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		// The size of a named pipe or device means nothing and it can only
+		// be read once
+		zap.L().Debug("input is not a regular file, streaming it", zap.String("file", source), zap.Stringer("mode", fileInfo.Mode()))
+		return &jobInput{ReadCloser: f, name: filepath.Base(source), size: -1}, nil
+	}
+	return &jobInput{ReadCloser: f, name: source, size: fileInfo.Size(), path: source}, nil
+}
+
+var inputClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// openURL streams a job from a web server.
+func openURL(source string) (*jobInput, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = u.Host
+	}
+	return openHTTP(req, source, name)
+}
+
+// openHTTP streams the response to req as the job. The protocol header
+// needs the size up front, so the body is downloaded to a temporary file
+// first when the server doesn't send a Content-Length, or when -wait could
+// leave the download idle long enough for the server to give up.
+func openHTTP(req *http.Request, source, name string) (*jobInput, error) {
+	resp, err := inputClient.Do(req)
+	if err != nil {
+		zap.L().Error("Could not download input file", zap.String("url", source), zap.Error(err))
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		zap.L().Error("Could not download input file", zap.String("url", source), zap.String("status", resp.Status))
+		return nil, fmt.Errorf("GET %s: %s", source, resp.Status)
+	}
+	if resp.ContentLength >= 0 && waitTimeout <= 0 {
+		return &jobInput{ReadCloser: resp.Body, name: name, size: resp.ContentLength}, nil
+	}
+	defer resp.Body.Close()
+	zap.L().Info("downloading input file", zap.String("url", source))
+	tmp, err := ioutil.TempFile("", "send-carbide-*.nc")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(tmp, resp.Body)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		zap.L().Error("Could not download input file", zap.String("url", source), zap.Error(err))
+		return nil, err
+	}
+	return &jobInput{ReadCloser: &tempFile{tmp}, name: name, size: size, path: tmp.Name()}, nil
+}
+
+// tempFile is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// localCopy returns the path of a local file with the contents of input,
+// downloading it to a temporary file that is removed with input if needed.
+func localCopy(input *jobInput) (string, error) {
+	if input.path != "" {
+		return input.path, nil
+	}
+	if err := spoolInput(input); err != nil || input.path != "" {
+		return input.path, err
+	}
+	tmp, err := ioutil.TempFile("", "send-carbide-*.nc")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, input.ReadCloser); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	input.ReadCloser.Close()
+	input.ReadCloser = &tempFile{tmp}
+	input.path = tmp.Name()
+	return tmp.Name(), nil
+}
+
+// spoolMemory is how much of an input of unknown size spoolInput keeps in
+// memory before it spools it to a temporary file instead.
+var spoolMemory = byteSize(1 << 20)
+
+// spoolInput makes sure the size of input is known, which the carbide
+// protocol announces before the file, by reading stdin, command output,
+// pipes and downloads of unknown length to their end first: into memory up
+// to -spool-memory, into a temporary file beyond that. The job is then sent
+// from the spool. Failures of a generator command surface here.
+func spoolInput(input *jobInput) error {
+	if input.size >= 0 {
+		return nil
+	}
+	var head bytes.Buffer
+	n, err := io.CopyN(&head, input.ReadCloser, int64(spoolMemory)+1)
+	if err == io.EOF {
+		if err := input.ReadCloser.Close(); err != nil {
+			return err
+		}
+		zap.L().Debug("spooled input of unknown size in memory", zap.String("file", input.name), zap.Int64("size", n))
+		input.ReadCloser = ioutil.NopCloser(&head)
+		input.size = n
+		return nil
+	}
+	if err != nil {
+		input.ReadCloser.Close()
+		return err
+	}
+	tmp, err := ioutil.TempFile("", "send-carbide-*.nc")
+	if err != nil {
+		input.ReadCloser.Close()
+		return err
+	}
+	size, err := io.Copy(tmp, io.MultiReader(&head, input.ReadCloser))
+	if closeErr := input.ReadCloser.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	zap.L().Debug("spooled input of unknown size to a temporary file", zap.String("file", input.name), zap.String("spool", tmp.Name()), zap.Int64("size", size))
+	input.ReadCloser = &tempFile{tmp}
+	input.size = size
+	input.path = tmp.Name()
+	return nil
+}
+
+// countingReader counts the bytes of an input of unknown size as it is
+// sent.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var joinFiles bool
+var joinRetract string
+var joinPause bool
+
+var errJoinPreflight = errors.New("joined files failed preflight checks")
+
+var programEndPattern = regexp.MustCompile(`(?i)^(N\d+\s*)?M0*(2|30)(\D|$)`)
+var unitsPattern = regexp.MustCompile(`(?i)G(20|21)(\D|$)`)
+
+// joinPart is what the preflight of one file found.
+type joinPart struct {
+	name        string
+	units       string
+	programEnds int
+}
+
+// joinInputs merges several files into one job. Program ends and % markers
+// of all but the last file are dropped so the machine doesn't stop early,
+// and a separator block (a safe retract and optionally an M0 pause) goes
+// between files. The result is written to a temporary file because the
+// size must be known before sending.
+func joinInputs(sources []string) (*jobInput, error) {
+	if len(sources) < 2 {
+		zap.L().Error("-join needs at least two files", zap.Strings("files", sources))
+		return nil, errJoinPreflight
+	}
+	tmp, err := ioutil.TempFile("", "send-carbide-*.nc")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*jobInput, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	w := bufio.NewWriter(tmp)
+	var parts []joinPart
+	var names []string
+	for i, source := range sources {
+		last := i == len(sources)-1
+		if i > 0 {
+			fmt.Fprintf(w, "(send-carbide: part %d of %d, %s)\n", i+1, len(sources), filepath.Base(source))
+			if joinRetract != "" {
+				fmt.Fprintln(w, joinRetract)
+			}
+			if joinPause {
+				fmt.Fprintln(w, "M0")
+			}
+		}
+		in, err := openInput(source)
+		if err != nil {
+			return fail(err)
+		}
+		part, err := copyJoinPart(w, in, last)
+		in.Close()
+		if err != nil {
+			return fail(err)
+		}
+		parts = append(parts, part)
+		names = append(names, strings.TrimSuffix(filepath.Base(in.name), filepath.Ext(in.name)))
+	}
+	if err := checkJoinedParts(parts); err != nil {
+		return fail(err)
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return &jobInput{ReadCloser: &tempFile{tmp}, name: strings.Join(names, "+") + ".nc", size: size, path: tmp.Name()}, nil
+}
+
+// copyJoinPart copies one file line by line and records what the preflight
+// needs to know about it.
+func copyJoinPart(w io.Writer, in *jobInput, last bool) (joinPart, error) {
+	part := joinPart{name: in.name}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lines := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if bytes.IndexByte(line, 0) >= 0 {
+			zap.L().Error("file is not text gcode", zap.String("file", in.name))
+			return part, fmt.Errorf("%w: %s is not text", errJoinPreflight, in.name)
+		}
+		code := cleanGcodeLine(string(line))
+		if code != "" {
+			lines++
+		}
+		if m := unitsPattern.FindStringSubmatch(code); m != nil {
+			part.units = "G" + m[1]
+		}
+		if !last && (code == "%" || programEndPattern.MatchString(code)) {
+			if code != "%" {
+				part.programEnds++
+			}
+			continue
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return part, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return part, err
+	}
+	if lines == 0 {
+		zap.L().Error("file contains no gcode", zap.String("file", in.name))
+		return part, fmt.Errorf("%w: %s is empty", errJoinPreflight, in.name)
+	}
+	if part.programEnds > 0 {
+		zap.L().Info("dropped program end from joined file", zap.String("file", in.name), zap.Int("lines", part.programEnds))
+	}
+	return part, nil
+}
+
+// checkJoinedParts fails when files were written for different units, since
+// the later ones would run scaled by 25.4.
+func checkJoinedParts(parts []joinPart) error {
+	units := ""
+	for _, part := range parts {
+		switch {
+		case part.units == "":
+			zap.L().Warn("file does not set units and inherits them from the previous one", zap.String("file", part.name))
+		case units == "":
+			units = part.units
+		case part.units != units:
+			zap.L().Error("joined files use different units", zap.String("file", part.name), zap.String("units", part.units), zap.String("expected", units))
+			return fmt.Errorf("%w: %s uses %s, earlier files use %s", errJoinPreflight, part.name, part.units, units)
+		}
+	}
+	return nil
+}
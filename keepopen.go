@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+var keepOpen bool
+
+// keptConnection is a connection left open after a send or a state check,
+// to a receiver that announced it takes further files on it.
+type keptConnection struct {
+	conn net.Conn
+	r    *bufio.Reader
+	caps carbide.Capabilities
+}
+
+// connectionPool holds the open connections by the address they are
+// connected to, one per machine. A connection is taken out while it is in
+// use, so whoever comes second dials anew.
+type connectionPool struct {
+	sync.Mutex
+	m map[string]*keptConnection
+}
+
+// keptConnections stay open until the process exits: in the daemon, for the
+// next job and state check of the machine, and with -keep-open for the next
+// file of a batch or send of watch-file.
+var keptConnections = &connectionPool{m: map[string]*keptConnection{}}
+
+// take removes an open connection to one of dialers from the pool and asks
+// the receiver for its state on it. It returns a nil conn when there was
+// none, or when it went stale in between, to connect anew.
+func (p *connectionPool) take(dialers []*dialer) (net.Conn, *bufio.Reader, carbide.State, *dialer) {
+	p.Lock()
+	var kept *keptConnection
+	var d *dialer
+	for _, d = range dialers {
+		if kept = p.m[d.String()]; kept != nil {
+			delete(p.m, d.String())
+			break
+		}
+	}
+	p.Unlock()
+	if kept == nil {
+		return nil, nil, "", nil
+	}
+	start := time.Now()
+	if connectTimeout > 0 {
+		kept.conn.SetDeadline(start.Add(connectTimeout))
+	}
+	_, err := kept.conn.Write(framed(framing.StateRequest()))
+	var msg string
+	if err == nil {
+		msg, err = readMessage(kept.r)
+	}
+	var state carbide.State
+	if err == nil {
+		state, err = parseState(msg)
+	}
+	kept.conn.SetDeadline(time.Time{})
+	if err != nil {
+		zap.L().Debug("open connection went stale, reconnecting", zap.String("address", d.String()), zap.Error(err))
+		kept.conn.Close()
+		return nil, nil, "", nil
+	}
+	d.dialTime, d.handshakeTime, d.caps = 0, time.Since(start), kept.caps
+	emitEvent(sendEvent{Event: eventState, Target: d.String(), State: state})
+	return kept.conn, kept.r, state, d
+}
+
+// put keeps a connection open for the next send, or closes it when the
+// receiver doesn't take further files on it.
+func (p *connectionPool) put(conn net.Conn, r *bufio.Reader, d *dialer) {
+	if !d.caps.Has(carbide.FeatureSession) {
+		conn.Close()
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if previous := p.m[d.String()]; previous != nil {
+		previous.conn.Close()
+	}
+	p.m[d.String()] = &keptConnection{conn: conn, r: r, caps: d.caps}
+}
+
+// reuseConnection takes an open connection to one of dialers when the
+// machine is in one of states on it. It returns a nil conn otherwise, to connect anew
+// and wait there as usual.
+func reuseConnection(dialers []*dialer, states string) (net.Conn, *bufio.Reader, carbide.State, *dialer) {
+	conn, r, state, d := keptConnections.take(dialers)
+	if conn == nil {
+		return nil, nil, "", nil
+	}
+	if !isAllowedState(state, states) {
+		zap.L().Debug("not reusing the open connection", zap.String("address", d.String()), zap.Stringer("state", state))
+		conn.Close()
+		return nil, nil, "", nil
+	}
+	zap.L().Debug("reusing the open connection", zap.String("address", d.String()), zap.Stringer("state", state))
+	return conn, r, state, d
+}
+
+// releaseConnection closes the connection of a send, or keeps it open for
+// the next one when asked to and the send succeeded.
+func releaseConnection(conn net.Conn, r *bufio.Reader, d *dialer, keep bool, err error) {
+	if keepOpen && err == nil && !d.caps.Has(carbide.FeatureSession) {
+		zap.L().Info("receiver does not announce sessions, closing the connection", zap.String("address", d.String()), zap.Stringer("features", d.caps))
+	}
+	if !keep || err != nil {
+		conn.Close()
+		return
+	}
+	keptConnections.put(conn, r, d)
+}
+
+// pooledState reports the state of the machine over its open connection,
+// connecting when there is none and keeping the new connection open when
+// the receiver takes files on it.
+func pooledState(dialers []*dialer) (carbide.State, error) {
+	conn, r, state, d := keptConnections.take(dialers)
+	if conn == nil {
+		var err error
+		if conn, r, state, d, err = dialAny(dialers); err != nil {
+			return "", err
+		}
+	}
+	keptConnections.put(conn, r, d)
+	return state, nil
+}
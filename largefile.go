@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var forceSend bool
+var confirmAbove byteSize
+
+var errLargeJob = errors.New("the job is larger than confirm_above")
+
+// defaultConfirmAbove is the size of a job above which sending it needs
+// confirming, unless the config file sets confirm_above.
+const defaultConfirmAbove = 50 << 20
+
+// assumedSendRate is the transfer rate the time to send a job is estimated
+// at without -max-rate, in bytes per second: about what Carbide Motion
+// takes in over a local network.
+const assumedSendRate = 1 << 20
+
+// confirmThreshold is the size from the flag, the config file or the
+// default, 0 when large jobs need no confirming.
+func confirmThreshold() (int64, error) {
+	if confirmAbove > 0 {
+		return int64(confirmAbove), nil
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return 0, err
+	}
+	if cfg.ConfirmAbove == "" {
+		return defaultConfirmAbove, nil
+	}
+	threshold, err := parseByteSize(cfg.ConfirmAbove)
+	if err != nil {
+		zap.L().Error("invalid confirm_above", zap.String("config", configPath), zap.Error(err))
+		return 0, err
+	}
+	return threshold, nil
+}
+
+// confirmLargeJob asks before a job larger than the threshold is sent, as
+// the receiver is busy with it for a long time and a job that wasn't meant
+// to be sent whole is easy to pick by mistake. Off a terminal it fails
+// unless -force is given.
+func confirmLargeJob(input *jobInput) error {
+	if forceSend || input.size < 0 {
+		return nil
+	}
+	threshold, err := confirmThreshold()
+	if err != nil || threshold == 0 || input.size <= threshold {
+		return err
+	}
+	rate := int64(assumedSendRate)
+	if maxRate > 0 && int64(maxRate) < rate {
+		rate = int64(maxRate)
+	}
+	estimate := time.Duration(float64(input.size) / float64(rate) * float64(time.Second)).Round(time.Second)
+	message := fmt.Sprintf("%s is %s, taking about %v to send at %s/s", filepath.Base(input.name), formatByteSize(input.size), estimate, formatByteSize(rate))
+	if !isTerminal(os.Stdin) {
+		zap.L().Error(message+"; pass -force to send it anyway", zap.String("file", input.name), zap.Int64("size", input.size), zap.Int64("confirm_above", threshold))
+		return fmt.Errorf("%w (%s > %s)", errLargeJob, formatByteSize(input.size), formatByteSize(threshold))
+	}
+	fmt.Fprintf(os.Stderr, "%s. Send it? [y/N] ", message)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return fmt.Errorf("%w, not sent", errLargeJob)
+	}
+	return nil
+}
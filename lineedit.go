@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// Keys the line editor handles.
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyBackspace = 8
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// lineEditor reads lines from a terminal with cursor movement and history.
+// When the input is not a terminal it reads plain lines.
+type lineEditor struct {
+	out     io.Writer
+	keys    chan byte
+	readErr error
+	restore func()
+	history []string
+}
+
+func newLineEditor(in *os.File, out io.Writer, history []string) *lineEditor {
+	e := &lineEditor{out: out, keys: make(chan byte, 256), history: history}
+	if isTerminal(in) {
+		restore, err := makeRaw(in)
+		if err != nil {
+			zap.L().Debug("reading plain lines", zap.Error(err))
+		} else {
+			e.restore = restore
+		}
+	}
+	go e.readKeys(in)
+	return e
+}
+
+func (e *lineEditor) readKeys(in io.Reader) {
+	buf := make([]byte, 256)
+	for {
+		n, err := in.Read(buf)
+		for _, b := range buf[:n] {
+			e.keys <- b
+		}
+		if err != nil {
+			e.readErr = err
+			close(e.keys)
+			return
+		}
+	}
+}
+
+// Close restores the terminal.
+func (e *lineEditor) Close() {
+	if e.restore != nil {
+		e.restore()
+	}
+}
+
+// printf writes a line of output above the prompt.
+func (e *lineEditor) printf(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	if e.restore != nil {
+		text = "\r\033[K" + text
+	}
+	fmt.Fprint(e.out, text)
+}
+
+// readLine shows prompt and returns the line typed, without the newline. The
+// prompt is drawn again whenever refresh fires, so it can show live
+// information. It returns io.EOF at the end of input, and errInterrupted
+// when the line is cancelled with Ctrl-C.
+func (e *lineEditor) readLine(prompt func() string, refresh <-chan struct{}) (string, error) {
+	if e.restore == nil {
+		return e.readPlainLine(prompt())
+	}
+	var line []rune
+	var pending []byte
+	pos := 0
+	browse := len(e.history)
+	var edited []rune
+	draw := func() {
+		fmt.Fprintf(e.out, "\r\033[K%s%s", prompt(), string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\033[%dD", back)
+		}
+	}
+	recall := func(i int) {
+		if browse == len(e.history) {
+			edited = append([]rune(nil), line...)
+		}
+		browse = i
+		if i == len(e.history) {
+			line = append([]rune(nil), edited...)
+		} else {
+			line = []rune(e.history[i])
+		}
+		pos = len(line)
+	}
+	draw()
+	for {
+		var key byte
+		select {
+		case <-refresh:
+			draw()
+			continue
+		case b, ok := <-e.keys:
+			if !ok {
+				fmt.Fprint(e.out, "\r\n")
+				return "", e.readErr
+			}
+			key = b
+		}
+		switch key {
+		case keyEnter, '\n':
+			fmt.Fprint(e.out, "\r\n")
+			text := string(line)
+			e.remember(text)
+			return text, nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case keyBackspace, keyDelete:
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case keyCtrlA:
+			pos = 0
+		case keyCtrlE:
+			pos = len(line)
+		case keyCtrlB:
+			if pos > 0 {
+				pos--
+			}
+		case keyCtrlF:
+			if pos < len(line) {
+				pos++
+			}
+		case keyCtrlK:
+			line = line[:pos]
+		case keyCtrlU:
+			line = line[pos:]
+			pos = 0
+		case keyCtrlL:
+			fmt.Fprint(e.out, "\033[H\033[2J")
+		case keyCtrlP:
+			if browse > 0 {
+				recall(browse - 1)
+			}
+		case keyCtrlN:
+			if browse < len(e.history) {
+				recall(browse + 1)
+			}
+		case keyEscape:
+			switch e.escapeSequence() {
+			case "[A", "OA":
+				if browse > 0 {
+					recall(browse - 1)
+				}
+			case "[B", "OB":
+				if browse < len(e.history) {
+					recall(browse + 1)
+				}
+			case "[C", "OC":
+				if pos < len(line) {
+					pos++
+				}
+			case "[D", "OD":
+				if pos > 0 {
+					pos--
+				}
+			case "[H", "OH", "[1~":
+				pos = 0
+			case "[F", "OF", "[4~":
+				pos = len(line)
+			case "[3~":
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if key < ' ' {
+				continue
+			}
+			pending = append(pending, key)
+			if !utf8.FullRune(pending) {
+				continue
+			}
+			r, _ := utf8.DecodeRune(pending)
+			pending = pending[:0]
+			line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+			pos++
+		}
+		draw()
+	}
+}
+
+// escapeSequence reads the rest of a cursor key sequence, such as "[A" for
+// up.
+func (e *lineEditor) escapeSequence() string {
+	first, ok := <-e.keys
+	if !ok || (first != '[' && first != 'O') {
+		return ""
+	}
+	seq := []byte{first}
+	for {
+		b, ok := <-e.keys
+		if !ok {
+			return ""
+		}
+		seq = append(seq, b)
+		// Sequences end with a letter or a tilde
+		if b == '~' || (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') {
+			return string(seq)
+		}
+	}
+}
+
+// readPlainLine reads a line from input that is not a terminal, or a
+// terminal that can't be switched to raw mode.
+func (e *lineEditor) readPlainLine(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	var line []byte
+	for {
+		b, ok := <-e.keys
+		if !ok {
+			if len(line) == 0 {
+				return "", e.readErr
+			}
+			break
+		}
+		if b == '\n' {
+			break
+		}
+		line = append(line, b)
+	}
+	text := string(trimCR(line))
+	e.remember(text)
+	return text, nil
+}
+
+// remember adds a line to the history unless it repeats the last one.
+func (e *lineEditor) remember(text string) {
+	if text != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != text) {
+		e.history = append(e.history, text)
+	}
+}
+
+func trimCR(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		return line[:n-1]
+	}
+	return line
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// lineReporter is a sender that knows how far into the file its last send
+// got, to say where the machine's copy ends when the send failed.
+type lineReporter interface {
+	// SentLines is the number of the last line of the file written in
+	// full, and whether the machine acknowledged it, or -1 when the send
+	// failed before the file
+	SentLines() (line int64, acked bool)
+}
+
+// lineWriter counts the lines of a file written through it to the
+// machine, between the header and the end of the file. Below the write
+// buffer, it counts what the connection took rather than what was read.
+type lineWriter struct {
+	w io.Writer
+	// header is how many bytes of header are still to be written, and size
+	// how many of the file, negative when it is unknown
+	header int64
+	size   int64
+	lines  int64
+}
+
+func (l *lineWriter) Write(b []byte) (int, error) {
+	n, err := l.w.Write(b)
+	written := b[:n]
+	if l.header > 0 {
+		skip := l.header
+		if skip > int64(len(written)) {
+			skip = int64(len(written))
+		}
+		written, l.header = written[skip:], l.header-skip
+	}
+	if l.size >= 0 {
+		if int64(len(written)) > l.size {
+			written = written[:l.size]
+		}
+		l.size -= int64(len(written))
+	}
+	l.lines += int64(bytes.Count(written, []byte{'\n'}))
+	return n, err
+}
+
+// countLines returns how many lines the file at path has, or -1 when there
+// is no such file.
+func countLines(path string) int64 {
+	if path == "" {
+		return -1
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	var lines int64
+	last := byte('\n')
+	r := bufio.NewReaderSize(f, 64<<10)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			last = buf[n-1]
+		}
+		if err != nil {
+			break
+		}
+	}
+	// A last line without a newline is a line too
+	if last != '\n' {
+		lines++
+	}
+	return lines
+}
+
+// withSentLines adds where the machine's copy of a job ends to the error
+// of a failed send, so it is printed and kept in the history with it.
+func withSentLines(err error, sender Sender, input *jobInput) error {
+	report := sentLinesReport(sender, input)
+	if report == "" {
+		return err
+	}
+	zap.L().Warn("send failed part way", zap.String("file", input.name), zap.String("lines", report))
+	return fmt.Errorf("%w; %s", err, report)
+}
+
+// sentLinesReport says where the machine's copy of a job ends after a
+// failed send, or "" when the sender can't tell.
+func sentLinesReport(sender Sender, input *jobInput) string {
+	reporter, ok := sender.(lineReporter)
+	if !ok {
+		return ""
+	}
+	line, acked := reporter.SentLines()
+	if line < 0 {
+		return ""
+	}
+	total := countLines(input.path)
+	switch {
+	case line == 0:
+		return tr("report.no-lines")
+	case acked && total > 0:
+		return tr("report.acked-of", line, total)
+	case acked:
+		return tr("report.acked", line)
+	case total > 0:
+		return tr("report.sent-of", line, total)
+	}
+	return tr("report.sent", line)
+}
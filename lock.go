@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var lockWait time.Duration
+
+var errMachineLocked = errors.New("machine is busy with another send")
+
+const lockRetryInterval = 500 * time.Millisecond
+
+// lockDir holds one lock file per machine address. It lives in the temp
+// directory so that every user and the daemon on the PC share it.
+func lockDir() string {
+	return filepath.Join(os.TempDir(), "send-carbide")
+}
+
+func lockFileName(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, address) + ".lock"
+}
+
+// machineLock is an exclusive lock on all addresses of one machine.
+type machineLock struct {
+	files []*os.File
+}
+
+func (l *machineLock) unlock() {
+	for _, f := range l.files {
+		unlockFile(f)
+		f.Close()
+	}
+	l.files = nil
+}
+
+// lockMachine locks every address so that no other invocation streams to
+// the same machine concurrently. When another process holds the lock it
+// waits up to lockWait before failing with errMachineLocked.
+func lockMachine(addresses []string) (*machineLock, error) {
+	if err := os.MkdirAll(lockDir(), 0o777); err != nil {
+		return nil, err
+	}
+	os.Chmod(lockDir(), 0o777|os.ModeSticky)
+	sorted := append([]string(nil), addresses...)
+	sort.Strings(sorted)
+	l := &machineLock{}
+	deadline := time.Now().Add(lockWait)
+	logged := false
+	for i := 0; i < len(sorted); i++ {
+		if i > 0 && sorted[i] == sorted[i-1] {
+			continue
+		}
+		path := filepath.Join(lockDir(), lockFileName(sorted[i]))
+		f, err := openLockFile(path)
+		if err != nil {
+			l.unlock()
+			return nil, err
+		}
+		for {
+			err = tryLockFile(f)
+			if err == nil {
+				break
+			}
+			if err != errMachineLocked {
+				f.Close()
+				l.unlock()
+				return nil, err
+			}
+			if !time.Now().Before(deadline) {
+				owner := lockOwner(path)
+				f.Close()
+				l.unlock()
+				zap.L().Error("machine is busy with another send", zap.String("address", sorted[i]), zap.String("owner", owner))
+				return nil, fmt.Errorf("%w (%s held by %s)", errMachineLocked, sorted[i], owner)
+			}
+			if !logged {
+				zap.L().Info("machine is busy with another send, waiting", zap.String("address", sorted[i]), zap.Duration("wait", lockWait))
+				logged = true
+			}
+			time.Sleep(lockRetryInterval)
+		}
+		l.files = append(l.files, f)
+		// Record who holds the lock for the error message of the next caller
+		if f.Truncate(0) == nil {
+			f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		}
+	}
+	return l, nil
+}
+
+func openLockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		// Lock files created by another user may not be writable
+		f, err = os.Open(path)
+	}
+	return f, err
+}
+
+func lockOwner(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+		return "another process"
+	}
+	return "pid " + strings.TrimSpace(string(data))
+}
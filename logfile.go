@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logFile string
+var logMaxSize = byteSize(10 << 20)
+var logMaxAge time.Duration
+var logMaxBackups int
+
+const logBackupTimeFormat = "20060102T150405"
+
+// rotatingFile is a log file that is rotated once it reaches maxSize.
+// Rotated files are renamed with a timestamp suffix and removed when they
+// are older than maxAge or there are more than maxBackups of them.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.prune()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		// The file couldn't be opened again when it was last rotated
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	var rotateErr error
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if rotateErr = r.rotate(); r.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+func (r *rotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// rotate renames the file to a backup and opens a new one. When either
+// fails, the file is opened again as it is, so logging goes on in it, and
+// rotating is tried again once another maxSize has been written.
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+	backup := fmt.Sprintf("%s.%s", r.path, time.Now().Format(logBackupTimeFormat))
+	for i := 1; fileExists(backup); i++ {
+		backup = fmt.Sprintf("%s.%s-%d", r.path, time.Now().Format(logBackupTimeFormat), i)
+	}
+	err := os.Rename(r.path, backup)
+	if err == nil {
+		err = r.open()
+	}
+	if err != nil {
+		if r.open() == nil {
+			r.size = 0
+		}
+		return fmt.Errorf("failed to rotate log file %s: %w", r.path, err)
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes rotated files beyond the age and count limits.
+func (r *rotatingFile) prune() {
+	backups, _ := filepath.Glob(r.path + ".*")
+	// The timestamp suffix sorts oldest first
+	sort.Strings(backups)
+	for i, backup := range backups {
+		suffix := strings.TrimPrefix(backup, r.path+".")
+		if len(suffix) < len(logBackupTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(logBackupTimeFormat, suffix[:len(logBackupTimeFormat)]); err != nil {
+			continue
+		}
+		tooMany := r.maxBackups > 0 && len(backups)-i > r.maxBackups
+		tooOld := false
+		if info, err := os.Stat(backup); err == nil && r.maxAge > 0 {
+			tooOld = time.Since(info.ModTime()) > r.maxAge
+		}
+		if tooMany || tooOld {
+			os.Remove(backup)
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFileKeepsLoggingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "send-carbide.log")
+	r, err := openRotatingFile(path, 100, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.file.Close()
+	line := bytes.Repeat([]byte("x"), 79)
+	line = append(line, '\n')
+	if _, err := r.Write(line); err != nil {
+		t.Fatal(err)
+	}
+	// Removed from under the logger, the file can't be renamed to a backup
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Write(line); n != len(line) || err == nil {
+		t.Errorf("write during a failed rotation returned %d, %v, want %d and the rotation's error", n, err, len(line))
+	}
+	short := []byte("rotated later\n")
+	if _, err := r.Write(short); err != nil {
+		t.Errorf("write after a failed rotation failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(line, short...); !bytes.Equal(data, want) {
+		t.Errorf("log file has %q, want %q", data, want)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// loggingConfig selects where logs go besides stderr and -log-file.
+type loggingConfig struct {
+	// Sink is "syslog" or "journald"; empty keeps stderr only.
+	Sink string `yaml:"sink"`
+	// Tag is the syslog tag or journal identifier, send-carbide by default.
+	Tag string `yaml:"tag"`
+	// SyslogAddress sends to a remote syslog server such as
+	// udp://loghost:514 instead of the local one.
+	SyslogAddress string `yaml:"syslog_address"`
+}
+
+const journalSocket = "/run/systemd/journal/socket"
+
+func (l loggingConfig) tag() string {
+	if l.Tag != "" {
+		return l.Tag
+	}
+	return serviceName
+}
+
+// sinkCore returns the zap core for the configured sink. replaceStderr is
+// true when stderr already ends up in the same place, as it does for a
+// systemd service logging to the journal.
+func (l loggingConfig) sinkCore(level zapcore.LevelEnabler) (core zapcore.Core, replaceStderr bool, err error) {
+	switch strings.ToLower(l.Sink) {
+	case "":
+		return nil, false, nil
+	case "syslog":
+		core, err = newSyslogCore(l, level)
+		return core, false, err
+	case "journald", "journal":
+		core, err = newJournalCore(l.tag(), level)
+		return core, os.Getenv("JOURNAL_STREAM") != "", err
+	default:
+		return nil, false, fmt.Errorf("unknown log sink %q, use syslog or journald", l.Sink)
+	}
+}
+
+// journalCore writes entries to the systemd journal using its native
+// protocol, keeping zap fields as separate journal fields.
+type journalCore struct {
+	zapcore.LevelEnabler
+	conn   *net.UnixConn
+	tag    string
+	fields []zapcore.Field
+}
+
+func newJournalCore(tag string, level zapcore.LevelEnabler) (zapcore.Core, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalCore{LevelEnabler: level, conn: conn, tag: tag}, nil
+}
+
+func (c *journalCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.fields = append(append([]zapcore.Field(nil), c.fields...), fields...)
+	return &clone
+}
+
+func (c *journalCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *journalCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range append(append([]zapcore.Field(nil), c.fields...), fields...) {
+		field.AddTo(enc)
+	}
+	var msg bytes.Buffer
+	writeJournalField(&msg, "MESSAGE", entry.Message)
+	writeJournalField(&msg, "PRIORITY", strconv.Itoa(syslogPriority(entry.Level)))
+	writeJournalField(&msg, "SYSLOG_IDENTIFIER", c.tag)
+	if entry.Caller.Defined {
+		writeJournalField(&msg, "CODE_FILE", entry.Caller.File)
+		writeJournalField(&msg, "CODE_LINE", strconv.Itoa(entry.Caller.Line))
+	}
+	if entry.Stack != "" {
+		writeJournalField(&msg, "STACKTRACE", entry.Stack)
+	}
+	keys := make([]string, 0, len(enc.Fields))
+	for key := range enc.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeJournalField(&msg, journalFieldName(key), fmt.Sprint(enc.Fields[key]))
+	}
+	_, err := c.conn.Write(msg.Bytes())
+	return err
+}
+
+func (c *journalCore) Sync() error {
+	return nil
+}
+
+// writeJournalField encodes one field, using the length prefixed form for
+// values that contain newlines.
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName converts a zap key to a valid journal field name, which
+// must be upper case letters, digits and underscores.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	return "SC_" + name
+}
+
+// syslogPriority maps zap levels to syslog severities.
+func syslogPriority(level zapcore.Level) int {
+	switch level {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	default:
+		return 2
+	}
+}
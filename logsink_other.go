@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func newSyslogCore(l loggingConfig, level zapcore.LevelEnabler) (zapcore.Core, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
@@ -1,164 +1,321 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net"
 	"os"
-	"strings"
+	"time"
 
+	"github.com/bobcob7/send-carbide/carbide"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-const terminationCharacter = '\x0a'
-const messageBufferSize = 128
+const carbidePort = carbide.Port
 
-var inputFile string
 var serverAddress string
-var verbosity bool
+var quiet bool
+var verbose bool
+var veryVerbose bool
+var keepAlive time.Duration
 
-func init() {
-	flag.BoolVar(&verbosity, "v", false, "enable verbose logs")
-	flag.StringVar(&inputFile, "file", "", "gcode file that you want to send")
-	flag.StringVar(&serverAddress, "address", "127.0.0.1", "IP address or domain for the machine runing Carbide Motion")
+// command is a subcommand of the CLI. The send command runs when no other
+// command name is given so that existing invocations keep working. flags
+// adds the command's own flags to those of newFlagSet, for run and for
+// completion, and is nil when it has none.
+type command struct {
+	name   string
+	usage  string
+	run    func(args []string) error
+	flags  func(fs *flag.FlagSet)
+	hidden bool
 }
 
-func initLogger() {
-	cfg := zap.NewDevelopmentConfig()
-	if !verbosity {
-		cfg.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
-	} else {
-		cfg.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
-	}
-	cfg.EncoderConfig = zap.NewProductionEncoderConfig()
-	logger, err := cfg.Build()
-	if err != nil {
-		panic(err)
+var commands = []command{
+	{name: "send", usage: "send a gcode file to the machine (default)", run: runSend, flags: sendFlags},
+	{name: "status", usage: "print the machine state and exit with a state specific code", run: runStatus, flags: statusFlags},
+	{name: "info", usage: "report the receiver version, model and capabilities", run: runInfo, flags: infoFlags},
+	{name: "daemon", usage: "run a job queue server that dispatches to configured machines", run: runDaemon, flags: daemonFlags},
+	{name: "queue", usage: "list, inspect, cancel, hold, release or reorder the jobs of a running daemon", run: runQueue, flags: queueFlags},
+	{name: "config", usage: "check the config file, or write a new one", run: runConfig, flags: configFlags},
+	{name: "offline", usage: "list the jobs kept by send -offline for machines that couldn't be reached, forward or drop them", run: runOffline, flags: offlineFlags},
+	{name: "history", usage: "list the jobs sent, or send one the daemon kept a copy of again", run: runHistory, flags: historyFlags},
+	{name: "discover", usage: "scan subnets for machines running Carbide Motion", run: runDiscover, flags: discoverFlags},
+	{name: "report", usage: "gather the version, config, last protocol trace and logs into a zip file to attach to an issue", run: runReport, flags: reportFlags},
+	{name: "doctor", usage: "check the config, the name, reachability, handshake and clock of the machine and local permissions", run: runDoctor, flags: doctorFlags},
+	{name: "ping", usage: "measure connect and state round-trip latency", run: runPing, flags: pingFlags},
+	{name: "abort", usage: "discard the job the machine is receiving or running", run: runAbort, flags: abortFlags},
+	{name: "estop", usage: "halt the machine at once", run: runEStop, flags: estopFlags},
+	{name: "pause", usage: "hold the running job", run: runPause, flags: stateChangeFlags("pause")},
+	{name: "resume", usage: "continue a held job", run: runResume, flags: stateChangeFlags("resume")},
+	{name: "home", usage: "run the homing cycle and wait for it to finish", run: runHome, flags: stateChangeFlags("home")},
+	{name: "zero", usage: "zero axes of the current work coordinate system", run: runZero, flags: zeroFlags},
+	{name: "set-wcs", usage: "set a work coordinate system from the current position", run: runSetWCS, flags: setWCSFlags},
+	{name: "mdi", usage: "run a single line of gcode and print the response", run: runMDI, flags: mdiFlags},
+	{name: "override", usage: "change the feed, rapid or spindle override of the running job", run: runOverride, flags: overrideFlags},
+	{name: "warmup", usage: "run the spindle warm-up from the config file", run: runWarmup, flags: warmupFlags},
+	{name: "probe", usage: "find the work offset with a corner probe block on GRBL", run: runProbe, flags: probeFlags},
+	{name: "simulate", usage: "run a job on a model of the machine and report moves past its travel, rapids into the stock and feed spikes", run: runSimulate, flags: simulateFlags},
+	{name: "mock", usage: "run a fake receiver that can inject faults, to test senders against", run: runMock, flags: mockFlags},
+	{name: "stress", usage: "send a file over and over and report the success rate, latencies and resource use", run: runStress, flags: stressFlags},
+	{name: "diff", usage: "compare two jobs command by command and summarize the changes to feeds, tools and extent", run: runDiff, flags: diffFlags},
+	{name: "reorder", usage: "put the cuts of a job in the order with the least rapid travel and report the time saved", run: runReorder, flags: reorderFlags},
+	{name: "preview", usage: "draw the toolpath of a job from above in the terminal", run: runPreview, flags: previewFlags},
+	{name: "profiles", usage: "list the built-in and configured machine profiles, or export or import one", run: runProfiles, flags: profilesFlags},
+	{name: "console", usage: "control the machine interactively from a prompt", run: runConsole, flags: consoleFlags},
+	{name: "watch-file", usage: "check a job whenever CAM rewrites it and offer to send it", run: runWatchFile, flags: watchFileFlags},
+	{name: "watch-status", usage: "print machine state changes as they arrive", run: runWatchStatus, flags: watchStatusFlags},
+	{name: "version", usage: "print the version, commit and build date", run: runVersion, flags: versionFlags},
+	{name: "self-update", usage: "download and install the latest release", run: runSelfUpdate, flags: selfUpdateFlags},
+}
+
+// flagGiven reports whether the flag was set on the command line, rather
+// than left at its default.
+func flagGiven(fs *flag.FlagSet, name string) bool {
+	given := false
+	fs.Visit(func(f *flag.Flag) {
+		given = given || f.Name == name
+	})
+	return given
+}
+
+// newFlagSet creates a flag set for a subcommand with the flags shared by all
+// commands already registered.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&quiet, "q", false, "only log errors")
+	fs.BoolVar(&verbose, "v", false, "also log progress")
+	fs.BoolVar(&veryVerbose, "vv", false, "also log debug details")
+	serverAddress = "127.0.0.1"
+	fs.Var(&addressFlag{value: &serverAddress}, "address", "IP address (v4 or v6) or domain for the machine runing Carbide Motion, optionally with a port, a ws:// or wss:// URL to tunnel over WebSocket, or srv:<domain> to look up _carbide._tcp.<domain>. Repeat or comma separate to try several addresses in order")
+	fs.DurationVar(&connectTimeout, "connect-timeout", 10*time.Second, "how long to wait for the connection to the machine")
+	fs.DurationVar(&keepAlive, "keepalive", 30*time.Second, "TCP keepalive period, negative disables keepalives")
+	fs.DurationVar(&stallTimeout, "stall-timeout", carbide.DefaultStallTimeout, "fail a send when the machine takes no bytes of the file for this long, 0 waits forever")
+	fs.StringVar(&bindAddress, "bind", "", "local IP address or interface name to send from on multi-homed hosts")
+	fs.StringVar(&proxyAddress, "proxy", defaultProxy(), "socks5://, socks5h:// or http:// proxy to reach the machine through, defaults to ALL_PROXY")
+	fs.StringVar(&sshGateway, "ssh", "", "reach the machine through an SSH tunnel to this gateway (user@host[:port]) using the system ssh client, takes precedence over -proxy")
+	fs.StringVar(&logFormat, "log-format", "auto", "stderr log format: auto (a concise summary on a terminal), text or json")
+	fs.StringVar(&logFile, "log-file", "", "also write JSON logs to this file, rotating it as it grows")
+	fs.Var(&logMaxSize, "log-max-size", "rotate the log file once it reaches this size")
+	fs.DurationVar(&logMaxAge, "log-max-age", 30*24*time.Hour, "delete rotated log files older than this, 0 keeps them")
+	fs.IntVar(&logMaxBackups, "log-max-backups", 5, "number of rotated log files to keep, 0 keeps all")
+	fs.Var(&readBufferSize, "read-buffer", "size of the buffer for reading from the machine")
+	fs.Var(&maxMessageSize, "max-message", "longest message from the machine that is kept, longer ones are truncated with a warning")
+	fs.Var(&writeBufferSize, "write-buffer", "size of the buffer for writing to the machine")
+	fs.BoolVar(&strictProtocol, "strict-protocol", false, "only accept state messages exactly as Carbide Motion sends them, and fail on messages longer than -max-message")
+	fs.IntVar(&protocolRetries, "protocol-retries", 3, "skip this many empty messages from the machine before taking one as it is")
+	fs.StringVar(&headerFormat, "header-format", "", "layout of the header announcing a file, with {key}, {name} and {size}, overriding the config's protocol (default \"{key} {name}:{size}\")")
+	fs.StringVar(&ackToken, "ack-token", "", "answer of the machine to a file, overriding the config's protocol (default GCODE_ACK)")
+	fs.StringVar(&statePrefix, "state-prefix", "", "key before the colon of state messages and the request for one, overriding the config's protocol (default STATE)")
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "path to the config file")
+	fs.StringVar(&localeName, "locale", defaultLocale(), "language of warnings and suggestions: "+localeNames()+" to follow LANG, defaults to SEND_CARBIDE_LOCALE")
+	machineName = ""
+	fs.Var(&addressFlag{value: &machineName}, "machine", "name of a machine from the config file, overrides -address. send accepts several to broadcast the file to all of them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s:\n", os.Args[0], name)
+		fs.PrintDefaults()
 	}
-	zap.ReplaceGlobals(logger)
+	return fs
 }
 
-func main() {
-	flag.Parse()
-	initLogger()
-	// Validate input address
-	addr, err := net.ResolveTCPAddr("tcp", serverAddress+":6280")
-	if err != nil {
-		flag.PrintDefaults()
-		zap.L().Fatal("Could not resolve input address", zap.String("address", serverAddress))
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		if cmd.hidden {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.usage)
 	}
-	// Validate input file
-	fileInfo, err := os.Stat(inputFile)
-	if err != nil {
-		flag.PrintDefaults()
-		zap.L().Fatal("Could not find input file", zap.String("file", inputFile))
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+// logLevel maps -q, -v and -vv to a log level. Without any of them only
+// warnings and errors are logged, the most verbose flag wins.
+func logLevel() zapcore.Level {
+	switch {
+	case veryVerbose:
+		return zapcore.DebugLevel
+	case verbose:
+		return zapcore.InfoLevel
+	case quiet:
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.WarnLevel
 	}
-	input, err := os.Open(inputFile)
-	if err != nil {
-		flag.PrintDefaults()
-		zap.L().Fatal("Could not open input file", zap.String("file", inputFile))
-	}
-	defer input.Close()
-	// Setup server connection
-	zap.L().Info("sending gcode file", zap.String("file", inputFile), zap.String("address", serverAddress))
-	zap.L().Debug("connecting", zap.String("address", addr.String()))
-	conn, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		zap.L().Error("failed to connect to server", zap.String("address", addr.String()))
-		return
-	}
-	defer conn.Close()
-	r := bufio.NewReader(conn)
-	w := bufio.NewWriter(conn)
-	zap.L().Debug("connected")
-	// Ensure that server is ready to receive
-	state, err := getState(r)
-	if err != nil {
-		return
-	}
-	zap.L().Debug("received state", zap.String("state", state))
-	if state != "init" {
-		zap.L().Error("cannot start outside of init state", zap.String("state", state))
-		return
-	}
-	// Write header
-	header := fmt.Sprintf("GCODE: %s:%d\n", inputFile, fileInfo.Size())
-	zap.L().Debug("sending header", zap.String("header", header))
-	if _, err := w.Write([]byte(header)); err != nil {
-		zap.L().Error("failed sending header", zap.Error(err))
-		return
-	}
-	// Write GCode
-	zap.L().Debug("sending gcode", zap.Int64("size", fileInfo.Size()))
-	n, err := io.Copy(w, input)
-	if err != nil {
-		zap.L().Error("failed sending file over connection", zap.Error(err), zap.Int64("size", fileInfo.Size()))
-		return
-	}
-	zap.L().Debug("sent gcode", zap.Int64("size", n))
-	// Sent termination signal
-	if err := w.WriteByte(terminationCharacter); err != nil {
-		zap.L().Error("failed sending termination signal", zap.Error(err))
-		return
-	}
-	// Flush connection
-	zap.L().Debug("flushing")
-	if err := w.Flush(); err != nil {
-		zap.L().Error("failed flushing connection", zap.Error(err))
-		return
-	}
-	// Wait for ACK
-	if msg, err := readMessage(r); err != nil {
-		return
-	} else if msg != "GCODE_ACK" {
-		zap.L().Error("did not receive ack", zap.String("message", msg))
-		return
-	}
-	zap.L().Info("done")
 }
 
-func readMessage(r io.Reader) (string, error) {
-	buffer := make([]byte, messageBufferSize)
-	outputBuffer := make([]byte, 0, messageBufferSize)
-	n, err := r.Read(buffer)
+func initLogger() {
+	if logFormat != "auto" && logFormat != "text" && logFormat != "json" {
+		fmt.Fprintf(os.Stderr, "invalid -log-format %q, use auto, text or json\n", logFormat)
+		os.Exit(2)
+	}
+	if readBufferSize < minBufferSize || writeBufferSize < minBufferSize {
+		fmt.Fprintf(os.Stderr, "-read-buffer and -write-buffer must be at least %dB\n", minBufferSize)
+		os.Exit(2)
+	}
+	if maxMessageSize <= 0 {
+		fmt.Fprintln(os.Stderr, "-max-message must be more than 0B")
+		os.Exit(2)
+	}
+	l, err := parseLocale(localeName)
 	if err != nil {
-		zap.L().Error("failed to read message", zap.Error(err))
-		return "", err
+		fmt.Fprintf(os.Stderr, "invalid -locale: %v\n", err)
+		os.Exit(2)
+	}
+	activeLocale = l
+	cfg := zap.NewDevelopmentConfig()
+	cfg.Level = zap.NewAtomicLevelAt(logLevel())
+	cfg.EncoderConfig = zap.NewProductionEncoderConfig()
+	switch {
+	case logFormat == "json":
+		cfg.Encoding = "json"
+		cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	case humanOutput(os.Stderr):
+		// People only need the message and fields, not timestamps or traces
+		cfg.EncoderConfig.TimeKey = ""
+		cfg.EncoderConfig.CallerKey = ""
+		cfg.DisableStacktrace = true
+		cfg.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		if useColor() {
+			cfg.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		}
 	}
-	for i := 0; i < n; i++ {
-		if buffer[i] == terminationCharacter {
-			zap.L().Debug("found termination character", zap.Int("index", i))
-			break
+	var cores []zapcore.Core
+	if logFile != "" {
+		f, err := openRotatingFile(logFile, int64(logMaxSize), logMaxAge, logMaxBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open log file %s: %v\n", logFile, err)
+			os.Exit(1)
 		}
-		outputBuffer = append(outputBuffer, buffer[i])
+		encoderConfig := zap.NewProductionEncoderConfig()
+		encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		cores = append(cores, zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), f, cfg.Level))
 	}
-	if len(outputBuffer) >= messageBufferSize {
-		zap.L().Error("failed to read message", zap.Error(err))
-		return "", errors.New("oversized message")
+	replaceStderr := false
+	config, err := loadConfig()
+	if errors.Is(err, errInvalidConfig) && !checkingConfig {
+		fmt.Fprintf(os.Stderr, "%v\nrun send-carbide config check after fixing it\n", err)
+		os.Exit(2)
 	}
-	return string(outputBuffer), nil
+	if err == nil {
+		storage = config.Storage
+		if framing, err = config.Protocol.withFlags().framing(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid protocol in %s or the protocol flags: %v\n", configPath, err)
+			os.Exit(2)
+		}
+		if notifications, err = config.Notifications.router(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid notifications in %s: %v\n", configPath, err)
+			os.Exit(2)
+		}
+		sink, replace, err := config.Logging.sinkCore(cfg.Level)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to set up %s logging: %v\n", config.Logging.Sink, err)
+		} else if sink != nil {
+			cores = append(cores, sink)
+			replaceStderr = replace
+		}
+	}
+	options := []zap.Option{zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		if replaceStderr {
+			return zapcore.NewTee(cores...)
+		}
+		return zapcore.NewTee(append([]zapcore.Core{core}, cores...)...)
+	})}
+	logger, err := cfg.Build(options...)
+	if err != nil {
+		panic(err)
+	}
+	zap.ReplaceGlobals(logger)
+	zap.L().Debug("starting", zap.Stringer("version", buildVersion()))
 }
 
-var errInvalidStatusMessage = errors.New("invalid status message")
+// exitError carries a specific process exit code out of a command.
+type exitError struct {
+	code int
+	err  error
+}
 
-func getState(r io.Reader) (string, error) {
-	statusLine, err := readMessage(r)
-	if err != nil {
-		return "", err
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// Exit codes of send for failures scripts may want to handle differently.
+const (
+	sendExitNotReady   = statusExitBusy
+	sendExitConnection = 5
+	sendExitAckTimeout = 6
+	sendExitProtocol   = 7
+	sendExitMachine    = 8
+	sendExitMismatch   = 9
+	sendExitRejected   = 10
+)
+
+// printSuggestion prints what to do about an error or alarm the machine,
+// or a file the receiver refused, when there is advice for it.
+func printSuggestion(out io.Writer, err error) {
+	if suggestion := localSuggestion(err); suggestion != "" {
+		fmt.Fprintf(out, "%s %s\n", paint(colorYellow, tr("label.suggestion")), suggestion)
 	}
-	// Get state
-	tokens := strings.Split(statusLine, " ")
-	if len(tokens) != 2 {
-		zap.L().Error("unexpected number of tokens", zap.String("message", statusLine))
-		return "", errInvalidStatusMessage
+}
+
+// sendExitError gives the errors of the carbide package their exit code.
+func sendExitError(err error) error {
+	var exitErr *exitError
+	if err == nil || errors.As(err, &exitErr) {
+		return err
+	}
+	switch {
+	case errors.Is(err, carbide.ErrNotReady):
+		return &exitError{code: sendExitNotReady, err: err}
+	case errors.Is(err, carbide.ErrRejected):
+		return &exitError{code: sendExitRejected, err: err}
+	case errors.Is(err, carbide.ErrAckTimeout):
+		return &exitError{code: sendExitAckTimeout, err: err}
+	case errors.Is(err, carbide.ErrMismatch):
+		return &exitError{code: sendExitMismatch, err: err}
+	case errors.Is(err, carbide.ErrMachine):
+		return &exitError{code: sendExitMachine, err: err}
+	case errors.Is(err, carbide.ErrProtocol):
+		return &exitError{code: sendExitProtocol, err: err}
+	case errors.Is(err, carbide.ErrConnection):
+		return &exitError{code: sendExitConnection, err: err}
+	}
+	return err
+}
+
+func main() {
+	args := os.Args[1:]
+	run := runSend
+	if len(args) > 0 {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			usage()
+			return
+		}
+		if args[0] == "--version" {
+			args[0] = "version"
+		}
+		for _, cmd := range commands {
+			if cmd.name == args[0] {
+				run = cmd.run
+				args = args[1:]
+				break
+			}
+		}
 	}
-	if strings.ToUpper(tokens[0]) != "STATE:" {
-		zap.L().Error("unexpected message key", zap.String("message", statusLine), zap.String("key", tokens[0]))
-		return "", errInvalidStatusMessage
+	err := run(args)
+	notifications.wait()
+	if err != nil {
+		printSuggestion(os.Stderr, err)
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
+		os.Exit(1)
 	}
-	return strings.ToLower(strings.TrimSpace(tokens[1])), nil
 }
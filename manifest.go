@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+var manifestPath string
+var manifestVars = manifestVarFlag{}
+var startStep int
+
+var errManifest = errors.New("invalid manifest")
+var errManifestStopped = errors.New("stopped before the step")
+
+// jobManifest describes a job of several steps, such as the setups of a
+// part machined from both sides, so it is run the same way every time. It
+// is read from YAML or JSON:
+//
+//	name: bracket
+//	variables:
+//	  side: top
+//	steps:
+//	  - file: facing.nc
+//	    machine: shop
+//	  - file: ${side}-contour.nc
+//	    pause: flip the part and zero Z on the new top
+//	    wait: 10m
+type jobManifest struct {
+	Name string `yaml:"name"`
+	// Variables are expanded as ${name} in the strings of the steps, -var
+	// takes precedence
+	Variables map[string]string `yaml:"variables"`
+	Steps     []manifestStep    `yaml:"steps"`
+}
+
+// manifestStep is a file sent to a machine. Empty fields are those of the
+// flags, and files are relative to the manifest.
+type manifestStep struct {
+	Name    string `yaml:"name"`
+	File    string `yaml:"file"`
+	Machine string `yaml:"machine"`
+	Profile string `yaml:"profile"`
+	// Pause is shown before the step, which waits for Enter to start
+	Pause string `yaml:"pause"`
+	// Wait is how long to wait for the machine to become ready, like -wait
+	Wait string `yaml:"wait"`
+}
+
+// manifestVarFlag collects -var name=value flags.
+type manifestVarFlag map[string]string
+
+func (f manifestVarFlag) String() string {
+	var vars []string
+	for name, value := range f {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return strings.Join(vars, ",")
+}
+
+func (f manifestVarFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%q is not name=value", s)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+// loadManifest reads a manifest and expands its variables. Unknown fields
+// and variables are errors, so a typo doesn't send the wrong file.
+func loadManifest(path string) (*jobManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		zap.L().Error("failed to read manifest", zap.String("manifest", path), zap.Error(err))
+		return nil, err
+	}
+	m := &jobManifest{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(m); err != nil {
+		zap.L().Error("failed to parse manifest", zap.String("manifest", path), zap.Error(err))
+		return nil, fmt.Errorf("%w %s: %v", errManifest, path, err)
+	}
+	if len(m.Steps) == 0 {
+		return nil, fmt.Errorf("%w %s: no steps", errManifest, path)
+	}
+	vars := map[string]string{}
+	for name, value := range m.Variables {
+		vars[name] = value
+	}
+	for name, value := range manifestVars {
+		vars[name] = value
+	}
+	var unknown []string
+	expand := func(s string) string {
+		return os.Expand(s, func(name string) string {
+			value, ok := vars[name]
+			if !ok {
+				unknown = append(unknown, name)
+			}
+			return value
+		})
+	}
+	dir := filepath.Dir(path)
+	for i := range m.Steps {
+		step := &m.Steps[i]
+		step.Name, step.File, step.Machine = expand(step.Name), expand(step.File), expand(step.Machine)
+		step.Profile, step.Pause, step.Wait = expand(step.Profile), expand(step.Pause), expand(step.Wait)
+		if step.File == "" {
+			return nil, fmt.Errorf("%w %s: step %d has no file", errManifest, path, i+1)
+		}
+		if !filepath.IsAbs(step.File) && !isRemoteSource(step.File) {
+			step.File = filepath.Join(dir, step.File)
+		}
+		if step.Wait != "" {
+			if _, err := time.ParseDuration(step.Wait); err != nil {
+				return nil, fmt.Errorf("%w %s: step %d: wait: %v", errManifest, path, i+1, err)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("%w %s: undefined variables %s", errManifest, path, strings.Join(unknown, ", "))
+	}
+	return m, nil
+}
+
+// title is how the step is called in prompts and results.
+func (s manifestStep) title() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return filepath.Base(s.File)
+}
+
+// runManifest sends the steps of a manifest in order, starting at -step,
+// and stops at the first one that fails, as the later setups depend on it.
+func runManifest(fs *flag.FlagSet, path string) error {
+	m, err := loadManifest(path)
+	if err != nil {
+		return err
+	}
+	if startStep < 1 || startStep > len(m.Steps) {
+		zap.L().Error("no such step in the manifest", zap.Int("step", startStep), zap.Int("steps", len(m.Steps)))
+		return fmt.Errorf("%w: -step %d of %d steps", errManifest, startStep, len(m.Steps))
+	}
+	name := m.Name
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	// A missing file is found before the first step is cut, not halfway
+	for i, step := range m.Steps[startStep-1:] {
+		if !isRemoteSource(step.File) && !fileExists(step.File) {
+			zap.L().Error("Could not find input file", zap.String("manifest", name), zap.Int("step", startStep+i), zap.String("file", step.File))
+			return fmt.Errorf("%w %s: step %d: no file %s", errManifest, path, startStep+i, step.File)
+		}
+	}
+	defaultMachine, defaultProfile, defaultWait, defaultStates := machineName, profileName, waitTimeout, allowedStates
+	defer func() {
+		machineName, profileName, waitTimeout, allowedStates = defaultMachine, defaultProfile, defaultWait, defaultStates
+	}()
+	out := resultOutput()
+	prompt := bufio.NewReader(os.Stdin)
+	for i := startStep - 1; i < len(m.Steps); i++ {
+		step := m.Steps[i]
+		machineName, profileName, waitTimeout, allowedStates = defaultMachine, defaultProfile, defaultWait, defaultStates
+		if step.Machine != "" {
+			machineName = step.Machine
+		}
+		if step.Profile != "" {
+			profileName = step.Profile
+		}
+		if step.Wait != "" {
+			waitTimeout, _ = time.ParseDuration(step.Wait)
+		}
+		if err := profileStates(fs); err != nil {
+			return err
+		}
+		if step.Pause != "" {
+			fmt.Fprintf(os.Stderr, "Step %d of %d: %s, then press Enter to send %s (q to stop): ", i+1, len(m.Steps), step.Pause, step.title())
+			answer, err := prompt.ReadString('\n')
+			if err != nil || strings.EqualFold(strings.TrimSpace(answer), "q") {
+				return fmt.Errorf("%w %d of %s, resume with -step %d", errManifestStopped, i+1, name, i+1)
+			}
+		}
+		zap.L().Info("sending manifest step", zap.String("manifest", name), zap.Int("step", i+1), zap.String("file", step.File), zap.String("machine", machineName))
+		sender, err := openSender(backend)
+		if err != nil {
+			zap.L().Error("failed to set up backend", zap.String("backend", backend), zap.Error(err))
+			return err
+		}
+		detail, err := sendFile(sender, step.File)
+		target := sender.Target()
+		sender.Close()
+		if err != nil {
+			zap.L().Error("manifest step failed", zap.String("manifest", name), zap.Int("step", i+1), zap.String("file", step.File), zap.Error(err))
+			return fmt.Errorf("step %d of %s (%s): %w; resume with -step %d", i+1, name, step.title(), err, i+1)
+		}
+		fmt.Fprintf(out, "sent step %d of %d: %s (%s) to %s\n", i+1, len(m.Steps), step.title(), detail, target)
+	}
+	return nil
+}
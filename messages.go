@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bobcob7/send-carbide/carbide"
+)
+
+// localeName is the -locale of the warnings and suggestions people read.
+// Logs stay in English, as do the kinds of findings and everything scripts
+// match on.
+var localeName string
+
+// activeLocale is what localeName chose, set by initLogger.
+var activeLocale = &locale{language: "en", messages: englishMessages}
+
+// locale is a language of the messages, and whether lengths and feeds are
+// in inches for it.
+type locale struct {
+	language string
+	imperial bool
+	messages map[string]string
+}
+
+// catalogs are the messages of each language. A message missing from one
+// is given in English.
+var catalogs = map[string]map[string]string{
+	"en": englishMessages,
+	"de": germanMessages,
+	"es": spanishMessages,
+}
+
+// imperialRegions are the regions of a locale that measure in inches.
+var imperialRegions = map[string]bool{"us": true, "lr": true, "mm": true}
+
+func defaultLocale() string {
+	if name := os.Getenv("SEND_CARBIDE_LOCALE"); name != "" {
+		return name
+	}
+	return "en"
+}
+
+// parseLocale reads a locale such as en, en-US, de_DE.UTF-8 or auto, which
+// follows LC_ALL, LC_MESSAGES and LANG and falls back to English for
+// languages there are no messages for.
+func parseLocale(name string) (*locale, error) {
+	auto := name == "auto"
+	if auto {
+		name = "en"
+		for _, key := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+			if value := os.Getenv(key); value != "" {
+				name = value
+				break
+			}
+		}
+	}
+	tag := strings.ToLower(name)
+	if i := strings.IndexAny(tag, ".@"); i >= 0 {
+		tag = tag[:i]
+	}
+	parts := strings.FieldsFunc(tag, func(r rune) bool { return r == '-' || r == '_' })
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("invalid locale %q", name)
+	}
+	messages, ok := catalogs[parts[0]]
+	if !ok {
+		if auto {
+			return &locale{language: "en", messages: englishMessages}, nil
+		}
+		return nil, fmt.Errorf("no messages for locale %q, use %s", name, localeNames())
+	}
+	l := &locale{language: parts[0], messages: messages}
+	if len(parts) > 1 {
+		l.imperial = imperialRegions[parts[len(parts)-1]]
+	}
+	return l, nil
+}
+
+func localeNames() string {
+	names := make([]string, 0, len(catalogs))
+	for name := range catalogs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ") + ", a region such as en-US for inches, or auto"
+}
+
+// tr formats the message with the key in the active locale.
+func tr(key string, args ...interface{}) string {
+	format, ok := activeLocale.messages[key]
+	if !ok {
+		format = englishMessages[key]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// length is a length in mm, printed in the units of the active locale.
+type length float64
+
+func (l length) String() string {
+	if activeLocale.imperial {
+		return strconv.FormatFloat(float64(l)/25.4, 'f', 4, 64) + " in"
+	}
+	return formatMM(float64(l)) + " mm"
+}
+
+// feedRate is a feed rate in mm/min, printed in the units of the active
+// locale.
+type feedRate float64
+
+func (f feedRate) String() string {
+	if activeLocale.imperial {
+		return strconv.FormatFloat(float64(f)/25.4, 'f', 1, 64) + " in/min"
+	}
+	return strconv.FormatFloat(float64(f), 'g', -1, 64) + " mm/min"
+}
+
+// localSuggestion is the suggestion of the carbide package for an error
+// in the active locale, where there is a translation of it, or what may
+// have blocked a connection that failed.
+func localSuggestion(err error) string {
+	var merr *carbide.MachineError
+	var rerr *carbide.ReceiverError
+	var cerr *carbide.ConnectionError
+	var serr *carbide.StallError
+	switch {
+	case errors.As(err, &serr):
+		return tr("suggestion.stalled")
+	case errors.As(err, &rerr):
+		if s, ok := activeLocale.messages["suggestion.reject."+string(rerr.Reason)]; ok {
+			return s
+		}
+		return rerr.Suggestion()
+	case errors.As(err, &cerr):
+		return connectionHint(cerr)
+	case errors.As(err, &merr):
+		kind := "error"
+		if merr.Alarm {
+			kind = "alarm"
+		}
+		if s, ok := activeLocale.messages[fmt.Sprintf("suggestion.%s.%d", kind, merr.Code)]; ok {
+			return s
+		}
+		return merr.Suggestion()
+	}
+	return ""
+}
+
+// englishMessages are the messages, which the other catalogs translate. The
+// suggestions for errors of the machine are the carbide package's.
+var englishMessages = map[string]string{
+	"label.warning":    "Warning:",
+	"label.suggestion": "Suggestion:",
+
+	"finding.unreadable":     "cannot read %q: %v",
+	"finding.no-motion":      "axis words without a motion mode",
+	"finding.rapid-down":     "rapid down to Z%v, below the work zero",
+	"finding.rapid-sideways": "rapid sideways at Z%v, below the work zero",
+	"finding.no-feed":        "feed move without a feed rate",
+	"finding.feed-above":     "feed of %v is above the profile's %v",
+	"finding.feed-jump":      "feed jumps from %v to %v",
+	"finding.arc-radius":     "arc radius %v is too small for its end point",
+	"finding.outside-travel": "%s%v is %v in machine coordinates, outside the travel of %v to 0",
+	"finding.spans-travel":   "the job spans %v along %s, more than the travel of %v",
+	"warning.no-units":       "no G20/G21, the job uses the machine's current units",
+	"warning.mixed-units":    "the job switches between G20 and G21",
+	"warning.no-program-end": "no program end (M2/M30)",
+	"warning.air-time":       "%.0f%% of the estimated time is spent in the air, the toolpath may be poorly optimized",
+	"warning.feed-above":     "feed rate of %v is above the profile's %v",
+	"warning.spindle-above":  "spindle speed of %g RPM is above the profile's %g",
+
+	"report.no-lines": "no full line of the file reached the machine",
+	"report.sent-of":  "sent through line %d of %d, the machine's copy ends there or before",
+	"report.sent":     "sent through line %d, the machine's copy ends there or before",
+	"report.acked-of": "GRBL acknowledged through line %d of %d",
+	"report.acked":    "GRBL acknowledged through line %d",
+
+	"suggestion.connect.no-ping":        "%s doesn't answer ping either; check the CNC PC is on and on this network, though Windows also blocks ping on public networks",
+	"suggestion.connect.refused":        "%s answers ping but nothing listens on port %s; start Carbide Motion on it and turn on remote access in its settings",
+	"suggestion.connect.blocked":        "%s answers ping but port %s doesn't, which is usually the Windows firewall of the CNC PC; allow Carbide Motion through it, or run this on the CNC PC as administrator: netsh advfirewall firewall add rule name=\"Carbide Motion\" dir=in action=allow protocol=TCP localport=%[2]s",
+	"suggestion.stalled":                "the machine stopped reading the file; check Carbide Motion isn't waiting on a dialog and its PC isn't asleep, or raise -stall-timeout for a slow link",
+	"suggestion.connect.public-network": "this computer's network %q is set to Public, on which Windows blocks local connections; if the CNC PC's is too, set it to Private under Settings > Network & Internet",
+}
@@ -0,0 +1,53 @@
+package main
+
+// germanMessages are the messages in German.
+var germanMessages = map[string]string{
+	"label.warning":    "Warnung:",
+	"label.suggestion": "Vorschlag:",
+
+	"finding.unreadable":     "%q ist nicht lesbar: %v",
+	"finding.no-motion":      "Achsenwörter ohne Bewegungsmodus",
+	"finding.rapid-down":     "Eilgang hinunter auf Z%v, unter den Werkstücknullpunkt",
+	"finding.rapid-sideways": "Eilgang seitwärts auf Z%v, unter dem Werkstücknullpunkt",
+	"finding.no-feed":        "Vorschubbewegung ohne Vorschub",
+	"finding.feed-above":     "Vorschub von %v liegt über dem Maximum des Profils von %v",
+	"finding.feed-jump":      "Vorschub springt von %v auf %v",
+	"finding.arc-radius":     "Bogenradius %v ist zu klein für seinen Endpunkt",
+	"finding.outside-travel": "%s%v liegt in Maschinenkoordinaten bei %v, außerhalb des Verfahrwegs von %v bis 0",
+	"finding.spans-travel":   "der Job erstreckt sich über %v entlang %s, mehr als der Verfahrweg von %v",
+	"warning.no-units":       "kein G20/G21, der Job verwendet die aktuellen Einheiten der Maschine",
+	"warning.mixed-units":    "der Job wechselt zwischen G20 und G21",
+	"warning.no-program-end": "kein Programmende (M2/M30)",
+	"warning.air-time":       "%.0f%% der geschätzten Zeit wird in der Luft verbracht, der Werkzeugweg ist möglicherweise schlecht optimiert",
+	"warning.feed-above":     "Vorschub von %v liegt über dem Maximum des Profils von %v",
+	"warning.spindle-above":  "Spindeldrehzahl von %g U/min liegt über dem Maximum des Profils von %g",
+
+	"suggestion.alarm.1":  "die Maschinenposition ist wahrscheinlich verloren; prüfen, was den Endschalter ausgelöst hat, dann entsperren und erneut referenzieren",
+	"suggestion.alarm.2":  "der Job geht über die Software-Endlagen hinaus; Werkstücknullpunkt und Größe des Jobs prüfen, dann entsperren",
+	"suggestion.alarm.3":  "möglicherweise wurden Schritte verloren; vor dem Fortfahren erneut referenzieren",
+	"suggestion.alarm.4":  "Verkabelung des Tasters prüfen und dass der Taster nichts berührt, den Durchgangstest des Tasters verwenden",
+	"suggestion.alarm.5":  "das Werkzeug näher an den Taster fahren oder prüfen, ob die Klemme des Tasters angeschlossen ist",
+	"suggestion.alarm.6":  "die Referenzfahrt erneut starten",
+	"suggestion.alarm.7":  "die Tür schließen und erneut referenzieren",
+	"suggestion.alarm.8":  "Verkabelung der Endschalter prüfen oder den Rückzug der Referenzfahrt ($27) erhöhen",
+	"suggestion.alarm.9":  "Endschalter und ihre Verkabelung prüfen, dann erneut referenzieren",
+	"suggestion.alarm.10": "die Endschalter beider Seiten des Portals prüfen",
+
+	"report.no-lines": "keine ganze Zeile der Datei hat die Maschine erreicht",
+	"report.sent-of":  "bis Zeile %d von %d gesendet, die Kopie der Maschine endet dort oder davor",
+	"report.sent":     "bis Zeile %d gesendet, die Kopie der Maschine endet dort oder davor",
+	"report.acked-of": "GRBL hat bis Zeile %d von %d bestätigt",
+	"report.acked":    "GRBL hat bis Zeile %d bestätigt",
+
+	"suggestion.connect.no-ping":        "%s antwortet auch nicht auf Ping; prüfen, ob der CNC-PC eingeschaltet und in diesem Netzwerk ist, wobei Windows Ping in öffentlichen Netzwerken ebenfalls blockiert",
+	"suggestion.connect.refused":        "%s antwortet auf Ping, aber auf Port %s lauscht nichts; Carbide Motion darauf starten und den Fernzugriff in seinen Einstellungen einschalten",
+	"suggestion.connect.blocked":        "%s antwortet auf Ping, Port %s aber nicht, meist wegen der Windows-Firewall des CNC-PCs; Carbide Motion durch sie zulassen oder auf dem CNC-PC als Administrator ausführen: netsh advfirewall firewall add rule name=\"Carbide Motion\" dir=in action=allow protocol=TCP localport=%[2]s",
+	"suggestion.stalled":                "die Maschine hat aufgehört, die Datei zu lesen; prüfen, dass Carbide Motion nicht auf einen Dialog wartet und sein PC nicht schläft, oder -stall-timeout für eine langsame Verbindung erhöhen",
+	"suggestion.connect.public-network": "das Netzwerk %q dieses Computers ist auf Öffentlich gestellt, wo Windows lokale Verbindungen blockiert; wenn das des CNC-PCs es auch ist, es unter Einstellungen > Netzwerk und Internet auf Privat stellen",
+
+	"suggestion.reject.busy":          "warten, bis die Maschine ihren aktuellen Job beendet hat, oder es erneut versuchen, bis sie bereit ist",
+	"suggestion.reject.size mismatch": "der Empfänger hat eine andere Anzahl Bytes erhalten als angekündigt; sicherstellen, dass sich die Datei beim Senden nicht ändert, und sie erneut senden",
+	"suggestion.reject.too large":     "der Empfänger hat keinen Platz für die Datei; auf dem CNC-PC Platz schaffen oder den Job in kleineren Teilen senden, etwa einem pro Werkzeug",
+	"suggestion.reject.unsupported":   "der Empfänger unterstützt nicht, was beim Senden verlangt wurde; ohne die Erweiterung, etwa Chunks, senden oder den Empfänger aktualisieren",
+	"suggestion.reject.rejected":      "der Empfänger hat die Datei abgelehnt; auf seinem Bildschirm oder in seinem Log nach dem Grund sehen, etwa einer zu großen Datei",
+}
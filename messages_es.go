@@ -0,0 +1,53 @@
+package main
+
+// spanishMessages are the messages in Spanish.
+var spanishMessages = map[string]string{
+	"label.warning":    "Advertencia:",
+	"label.suggestion": "Sugerencia:",
+
+	"finding.unreadable":     "no se puede leer %q: %v",
+	"finding.no-motion":      "palabras de eje sin modo de movimiento",
+	"finding.rapid-down":     "movimiento rápido hacia abajo hasta Z%v, por debajo del cero de la pieza",
+	"finding.rapid-sideways": "movimiento rápido lateral en Z%v, por debajo del cero de la pieza",
+	"finding.no-feed":        "movimiento de avance sin velocidad de avance",
+	"finding.feed-above":     "el avance de %v supera el máximo del perfil de %v",
+	"finding.feed-jump":      "el avance salta de %v a %v",
+	"finding.arc-radius":     "el radio de arco %v es demasiado pequeño para su punto final",
+	"finding.outside-travel": "%s%v está en %v en coordenadas de máquina, fuera del recorrido de %v a 0",
+	"finding.spans-travel":   "el trabajo abarca %v a lo largo de %s, más que el recorrido de %v",
+	"warning.no-units":       "sin G20/G21, el trabajo usa las unidades actuales de la máquina",
+	"warning.mixed-units":    "el trabajo cambia entre G20 y G21",
+	"warning.no-program-end": "sin fin de programa (M2/M30)",
+	"warning.air-time":       "el %.0f%% del tiempo estimado se pasa en el aire, la trayectoria puede estar mal optimizada",
+	"warning.feed-above":     "la velocidad de avance de %v supera el máximo del perfil de %v",
+	"warning.spindle-above":  "la velocidad del husillo de %g RPM supera el máximo del perfil de %g",
+
+	"suggestion.alarm.1":  "es probable que se haya perdido la posición de la máquina; compruebe qué activó el final de carrera, luego desbloquee y vuelva a hacer el homing",
+	"suggestion.alarm.2":  "el trabajo sobrepasa los límites de software; compruebe el origen de trabajo y el tamaño del trabajo, luego desbloquee",
+	"suggestion.alarm.3":  "es posible que se hayan perdido pasos; vuelva a hacer el homing antes de continuar",
+	"suggestion.alarm.4":  "compruebe el cableado de la sonda y que no esté tocando nada, use la prueba de continuidad de la sonda",
+	"suggestion.alarm.5":  "acerque la herramienta a la sonda, o compruebe que la pinza de la sonda esté conectada",
+	"suggestion.alarm.6":  "vuelva a ejecutar el ciclo de homing",
+	"suggestion.alarm.7":  "cierre la puerta y vuelva a hacer el homing",
+	"suggestion.alarm.8":  "compruebe el cableado de los finales de carrera, o aumente el retroceso del homing ($27)",
+	"suggestion.alarm.9":  "compruebe los finales de carrera y su cableado, luego vuelva a hacer el homing",
+	"suggestion.alarm.10": "compruebe los finales de carrera de ambos lados del pórtico",
+
+	"report.no-lines": "ninguna línea completa del archivo llegó a la máquina",
+	"report.sent-of":  "enviado hasta la línea %d de %d, la copia de la máquina termina ahí o antes",
+	"report.sent":     "enviado hasta la línea %d, la copia de la máquina termina ahí o antes",
+	"report.acked-of": "GRBL confirmó hasta la línea %d de %d",
+	"report.acked":    "GRBL confirmó hasta la línea %d",
+
+	"suggestion.connect.no-ping":        "%s tampoco responde al ping; compruebe que el PC de la CNC esté encendido y en esta red, aunque Windows también bloquea el ping en redes públicas",
+	"suggestion.connect.refused":        "%s responde al ping pero nada escucha en el puerto %s; inicie Carbide Motion en él y active el acceso remoto en su configuración",
+	"suggestion.connect.blocked":        "%s responde al ping pero el puerto %s no, lo que suele deberse al firewall de Windows del PC de la CNC; permita Carbide Motion en él, o ejecute en el PC de la CNC como administrador: netsh advfirewall firewall add rule name=\"Carbide Motion\" dir=in action=allow protocol=TCP localport=%[2]s",
+	"suggestion.stalled":                "la máquina dejó de leer el archivo; compruebe que Carbide Motion no espera en un diálogo y que su PC no está suspendido, o aumente -stall-timeout para un enlace lento",
+	"suggestion.connect.public-network": "la red %q de este equipo está configurada como pública, en la que Windows bloquea las conexiones locales; si la del PC de la CNC también lo está, cámbiela a privada en Configuración > Red e Internet",
+
+	"suggestion.reject.busy":          "espere a que la máquina termine su trabajo actual, o reintente hasta que esté lista",
+	"suggestion.reject.size mismatch": "el receptor recibió un número de bytes distinto del anunciado; asegúrese de que el archivo no cambie mientras se envía y envíelo de nuevo",
+	"suggestion.reject.too large":     "el receptor no tiene espacio para el archivo; libere espacio en el PC de la CNC, o envíe el trabajo en partes más pequeñas, como una por herramienta",
+	"suggestion.reject.unsupported":   "el receptor no admite lo que pidió el envío; envíe sin la extensión, como los fragmentos, o actualice el receptor",
+	"suggestion.reject.rejected":      "el receptor rechazó el archivo; revise su pantalla o su registro para saber por qué, como que el archivo sea demasiado grande",
+}
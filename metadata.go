@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// metadataPeekSize is how much of the start of a job is searched for
+// metadata comments.
+const metadataPeekSize = 64 * 1024
+
+// jobMetadata is what CAM software says about a job in the comments at its
+// start.
+type jobMetadata struct {
+	Name      string   `json:"name,omitempty"`
+	Stock     string   `json:"stock,omitempty"`
+	Tools     []string `json:"tools,omitempty"`
+	Generator string   `json:"generator,omitempty"`
+	Date      string   `json:"date,omitempty"`
+}
+
+func (m *jobMetadata) empty() bool {
+	return m.Name == "" && m.Stock == "" && len(m.Tools) == 0 && m.Generator == "" && m.Date == ""
+}
+
+// String is the metadata besides the tools on one line, like "sign, stock
+// 300 x 200 x 12.7 mm, from Carbide Create".
+func (m *jobMetadata) String() string {
+	var parts []string
+	if m.Name != "" {
+		parts = append(parts, m.Name)
+	}
+	if m.Stock != "" {
+		parts = append(parts, "stock "+m.Stock)
+	}
+	if m.Generator != "" {
+		parts = append(parts, "from "+m.Generator)
+	}
+	if m.Date != "" {
+		parts = append(parts, "posted "+m.Date)
+	}
+	return strings.Join(parts, ", ")
+}
+
+var (
+	// Carbide Create writes the design file, the stock corners and the
+	// stock block
+	stockCornerPattern = regexp.MustCompile(`(?i)^stock(min|max)\s*:\s*(-?[\d.]+)\s*mm\s*,\s*(-?[\d.]+)\s*mm\s*,\s*(-?[\d.]+)\s*mm`)
+	stockBlockPattern  = regexp.MustCompile(`(?i)^stock/block\s*,\s*([\d.]+)\s*,\s*([\d.]+)\s*,\s*([\d.]+)`)
+	// Tools are listed like "T1 D=6.35 CR=0 - flat end mill" by Fusion 360
+	// and most other posts, or "TOOL/MILL,3.18,..." by Carbide Create
+	toolCommentPattern = regexp.MustCompile(`(?i)^(T\d+\b|tool/|tool\s*\d+\b|tool\s*:)`)
+	// Other comments are "key: value" or "key = value"
+	metadataPairPattern = regexp.MustCompile(`^([A-Za-z][A-Za-z ]*?)\s*[:=]\s*(.+)$`)
+	generatorPattern    = regexp.MustCompile(`(?i)^(?:created|generated|posted|made|exported)\s+(?:by|with|using)\s+(.+)$`)
+)
+
+// metadataKeys maps the keys of "key: value" comments to the metadata they
+// set.
+var metadataKeys = map[string]string{
+	"job": "name", "job name": "name", "program": "name", "program name": "name", "name": "name", "file": "name", "project": "name",
+	"design file": "design",
+	"stock":       "stock", "stock size": "stock", "material": "stock",
+	"post": "generator", "post processor": "generator", "postprocessor": "generator", "generator": "generator", "cam": "generator", "software": "generator",
+	"date": "date", "post date": "date", "posted": "date", "posted on": "date", "created": "date", "created on": "date", "generated": "date", "generated on": "date", "time": "date",
+}
+
+// parseMetadata reads the metadata from the comments before the first
+// move of a job. Comments after it describe toolpaths, not the job.
+func parseMetadata(r io.Reader) *jobMetadata {
+	m := &jobMetadata{}
+	var stockMin, stockMax []float64
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), metadataPeekSize)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		code := cleanGcodeLine(line)
+		if code != "" && code != "%" && motionPattern.MatchString(code) {
+			break
+		}
+		for _, comment := range gcodeComments(line) {
+			if comment == "" {
+				continue
+			}
+			if match := stockCornerPattern.FindStringSubmatch(comment); match != nil {
+				if strings.EqualFold(match[1], "min") {
+					stockMin = parseFloats(match[2:])
+				} else {
+					stockMax = parseFloats(match[2:])
+				}
+			} else if !m.comment(comment) && first && m.Name == "" && !strings.ContainsAny(comment, ":=") {
+				// Fusion 360 and others start with the program name or
+				// number on its own
+				m.Name = comment
+			}
+			first = false
+		}
+	}
+	if m.Stock == "" && len(stockMin) == 3 && len(stockMax) == 3 {
+		m.Stock = formatStock([]float64{stockMax[0] - stockMin[0], stockMax[1] - stockMin[1], stockMax[2] - stockMin[2]})
+	}
+	if m.empty() {
+		return nil
+	}
+	return m
+}
+
+// comment sets the metadata a comment has, and reports whether it had
+// any.
+func (m *jobMetadata) comment(text string) bool {
+	if match := stockBlockPattern.FindStringSubmatch(text); match != nil {
+		if m.Stock == "" {
+			m.Stock = formatStock(parseFloats(match[1:]))
+		}
+		return true
+	}
+	if toolCommentPattern.MatchString(text) {
+		m.Tools = append(m.Tools, text)
+		return true
+	}
+	if match := generatorPattern.FindStringSubmatch(text); match != nil {
+		m.Generator = match[1]
+		return true
+	}
+	match := metadataPairPattern.FindStringSubmatch(text)
+	if match == nil {
+		return false
+	}
+	value := strings.TrimSpace(match[2])
+	switch metadataKeys[strings.ToLower(match[1])] {
+	case "name":
+		m.Name = value
+	case "design":
+		// Only Carbide Create names the design file
+		m.Name = strings.TrimSuffix(path.Base(strings.Replace(value, `\`, "/", -1)), ".c2d")
+		if m.Generator == "" {
+			m.Generator = "Carbide Create"
+		}
+	case "stock":
+		m.Stock = value
+	case "generator":
+		m.Generator = value
+	case "date":
+		m.Date = value
+	default:
+		return false
+	}
+	return true
+}
+
+// gcodeComments returns the text of the comments on a line, both
+// (parenthesised) and after a semicolon.
+func gcodeComments(line string) []string {
+	var comments []string
+	for {
+		start := strings.IndexByte(line, '(')
+		semicolon := strings.IndexByte(line, ';')
+		if semicolon >= 0 && (start < 0 || semicolon < start) {
+			return append(comments, strings.TrimSpace(line[semicolon+1:]))
+		}
+		if start < 0 {
+			return comments
+		}
+		end := strings.IndexByte(line[start:], ')')
+		if end < 0 {
+			return append(comments, strings.TrimSpace(line[start+1:]))
+		}
+		comments = append(comments, strings.TrimSpace(line[start+1:start+end]))
+		line = line[start+end+1:]
+	}
+}
+
+func parseFloats(fields []string) []float64 {
+	values := make([]float64, 0, len(fields))
+	for _, field := range fields {
+		v, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func formatStock(size []float64) string {
+	if len(size) != 3 {
+		return ""
+	}
+	return fmt.Sprintf("%g x %g x %g mm", size[0], size[1], size[2])
+}
+
+// readMetadata sets the metadata of the input from its comments.
+func readMetadata(input *jobInput) {
+	if input.path != "" {
+		input.metadata = fileMetadata(input.path)
+	} else {
+		input.metadata = peekMetadata(input)
+	}
+	if input.metadata != nil {
+		zap.L().Info("job metadata", zap.String("file", input.name), zap.Stringer("job", input.metadata), zap.Strings("tools", input.metadata.Tools))
+	}
+}
+
+// peekMetadata reads the metadata of a job without taking anything away
+// from what is sent.
+func peekMetadata(input *jobInput) *jobMetadata {
+	r := bufio.NewReaderSize(input.ReadCloser, metadataPeekSize)
+	input.ReadCloser = struct {
+		io.Reader
+		io.Closer
+	}{r, input.ReadCloser}
+	// A short peek is the whole job, and errors are for the send to report
+	head, _ := r.Peek(metadataPeekSize)
+	return parseMetadata(bytes.NewReader(head))
+}
+
+// fileMetadata reads the metadata of a job in a local file.
+func fileMetadata(file string) *jobMetadata {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return parseMetadata(io.LimitReader(f, metadataPeekSize))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+var mmapInput bool
+
+// jobBody returns the reader the content of a job is sent from. With -mmap
+// a local file is mapped into memory, so the gcode goes from the page cache
+// to the socket without being copied through the read buffers first. The
+// returned function releases the mapping.
+func jobBody(input io.Reader, size int64) (io.Reader, func()) {
+	in, ok := input.(*jobInput)
+	if !mmapInput || !ok || in.path == "" || size <= 0 {
+		return input, func() {}
+	}
+	data, unmap, err := mapFile(in.path, size)
+	if err != nil {
+		zap.L().Warn("failed to map input file, reading it instead", zap.String("path", in.path), zap.Error(err))
+		return input, func() {}
+	}
+	zap.L().Debug("mapped input file", zap.String("path", in.path), zap.Int64("size", size))
+	// The mapping bypasses the reader, so count what is sent here
+	if stats, ok := in.ReadCloser.(*statsReader); ok {
+		stats.scan(data)
+	}
+	return bytes.NewReader(data), unmap
+}
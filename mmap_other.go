@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import "errors"
+
+// Other platforms read the file normally.
+func mapFile(path string, size int64) ([]byte, func(), error) {
+	return nil, nil, errors.New("memory mapping is not supported on this platform")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// benchmarkFileSize is the size of the carve file the send benchmarks send,
+// large enough for the way it is read to dominate the handshake and ack.
+const benchmarkFileSize = 64 << 20
+
+// carveFile writes a file of gcode like a 3D carve's, short moves one per
+// line, of about size bytes.
+func carveFile(b *testing.B, size int) (path string, written int64) {
+	b.Helper()
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, "G1 X%.3f Y%.3f Z%.3f F1200\n", float64(i%4000)*0.05, float64(i/4000)*0.05, -float64(i%7)*0.1)
+	}
+	path = filepath.Join(b.TempDir(), "carve.nc")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	return path, int64(buf.Len())
+}
+
+// benchmarkSend sends a large file to a mock receiver on the loopback
+// interface, through the write buffer of the given size, mapping the file
+// or reading it.
+func benchmarkSend(b *testing.B, buffer byteSize, mmap bool) {
+	path, size := carveFile(b, benchmarkFileSize)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go newMockReceiver().serve(ln)
+
+	savedBuffer, savedMmap, savedStates, savedAck := writeBufferSize, mmapInput, allowedStates, ackTimeout
+	defer func() {
+		writeBufferSize, mmapInput, allowedStates, ackTimeout = savedBuffer, savedMmap, savedStates, savedAck
+	}()
+	writeBufferSize, mmapInput, allowedStates, ackTimeout = buffer, mmap, "init", time.Minute
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sender, err := newCarbideSenderFor([]string{ln.Addr().String()})
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = sender.Send("carve.nc", &jobInput{ReadCloser: f, name: "carve.nc", size: size, path: path}, size)
+		sender.Close()
+		f.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSendRead is the send before the large-file pass: the file read
+// through bufio's default 4 KiB buffer.
+func BenchmarkSendRead(b *testing.B) {
+	benchmarkSend(b, 4<<10, false)
+}
+
+// BenchmarkSendReadLargeBuffer reads the file through the default
+// -write-buffer of 256 KiB.
+func BenchmarkSendReadLargeBuffer(b *testing.B) {
+	benchmarkSend(b, 256<<10, false)
+}
+
+// BenchmarkSendMmap maps the file with -mmap, with the default
+// -write-buffer.
+func BenchmarkSendMmap(b *testing.B) {
+	benchmarkSend(b, 256<<10, true)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// mockSplitDelay is the pause between the bytes of a split message, long
+// enough for each byte to leave in a packet of its own.
+const mockSplitDelay = 2 * time.Millisecond
+
+// mockGarbageState is what a faulty mock sends instead of its state: the
+// key mangled by line noise, which a sender must reject.
+const mockGarbageState = "ST\x00ATE:\x7f ?!"
+
+var errMockDrop = errors.New("dropped the connection")
+
+// mockFaults are the failures a mock receiver injects.
+type mockFaults struct {
+	// dropAt closes the connection after this many bytes of a file, never
+	// when negative
+	dropAt int64
+	// stall is how long the mock stops reading at dropAt before it closes
+	// the connection, as a receiver that hangs with the socket buffer full
+	stall time.Duration
+	// ackDelay is how long the ack is held back once a file is in
+	ackDelay time.Duration
+	// garbageState sends mockGarbageState instead of the state
+	garbageState bool
+	// split writes every message one byte at a time
+	split bool
+	// reject is answered to files instead of the ack, when set
+	reject string
+	// connections is how many connections get the faults before the mock
+	// behaves, all of them when 0, so retries can be seen to succeed
+	connections int
+}
+
+// mockReceiver speaks the receiving side of the Carbide Motion protocol
+// without a machine behind it: it announces a state, acknowledges files and
+// answers the requests of the other commands, injecting faults if asked.
+// It uses the configured framing.
+type mockReceiver struct {
+	state carbide.State
+	// features are announced after the state, nothing is announced when
+	// empty, like Carbide Motion
+	features  string
+	chunkSize int64
+	faults    mockFaults
+	// runFor is how long the mock announces running once it acknowledged
+	// a file, as if it ran the job
+	runFor time.Duration
+	// clockSkew is how far off the time the mock identifies itself with
+	// is
+	clockSkew time.Duration
+	// free is the room the mock says it has, refusing larger files, 0
+	// for unlimited
+	free int64
+
+	mu          sync.Mutex
+	connections int
+	jobs        int
+	// received and sum describe the last file, for VERIFY
+	received int64
+	sum      uint32
+	// runningUntil is when the job the mock pretends to run ends
+	runningUntil time.Time
+}
+
+// mockVersion is the version the mock announces, that of the build.
+func mockVersion() string {
+	if v := buildVersion().Version; v != "" {
+		return v
+	}
+	return "dev"
+}
+
+func newMockReceiver() *mockReceiver {
+	return &mockReceiver{state: carbide.StateInit, faults: mockFaults{dropAt: -1}}
+}
+
+// serve accepts connections on l until it is closed.
+func (m *mockReceiver) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go m.handle(conn)
+	}
+}
+
+// faulty counts a new connection and reports whether it gets the faults.
+func (m *mockReceiver) faulty() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections++
+	return m.faults.connections == 0 || m.connections <= m.faults.connections
+}
+
+// currentState is the state announced, running while the mock pretends to
+// run a job.
+func (m *mockReceiver) currentState() carbide.State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Now().Before(m.runningUntil) {
+		return carbide.StateRunning
+	}
+	return m.state
+}
+
+func (m *mockReceiver) banner() string {
+	banner := framing.StateRequest() + ": " + m.currentState().String()
+	if m.features != "" {
+		banner += " version=" + mockVersion() + " features=" + m.features
+	}
+	return banner
+}
+
+func (m *mockReceiver) handle(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	faulty := m.faulty()
+	zap.L().Debug("mock connection", zap.String("remote", remote), zap.Bool("faults", faulty))
+	w := &mockWriter{conn: conn, split: faulty && m.faults.split}
+	banner := m.banner()
+	if faulty && m.faults.garbageState {
+		banner = mockGarbageState
+	}
+	if err := w.send(banner); err != nil {
+		return
+	}
+	r := bufio.NewReader(conn)
+	// Without a logger, senders hanging up aren't logged as failures
+	messages := carbide.MessageReader{MaxSize: int(maxMessageSize), Terminator: framing.End()}
+	for {
+		msg, err := messages.Read(r)
+		if err != nil {
+			if err != io.EOF {
+				zap.L().Debug("mock connection failed", zap.String("remote", remote), zap.Error(err))
+			}
+			return
+		}
+		request := strings.Fields(msg)
+		name, size, isHeader := framing.ParseHeader(msg)
+		switch {
+		case len(request) == 0:
+			// A heartbeat
+			continue
+		case isHeader:
+			err = m.receiveJob(r, w, name, size, faulty)
+		case strings.Contains(msg, framing.Key()):
+			err = w.send("error: invalid header")
+		case request[0] == "VERIFY":
+			m.mu.Lock()
+			err = w.send(fmt.Sprintf("VERIFY_ACK %d %08x", m.received, m.sum))
+			m.mu.Unlock()
+		case request[0] == framing.StateRequest():
+			err = w.send(framing.StateRequest() + ": " + m.currentState().String())
+		case request[0] == "INFO":
+			info := "INFO: model=send-carbide-mock version=" + mockVersion() + " time=" + time.Now().Add(m.clockSkew).UTC().Format(time.RFC3339)
+			if m.free > 0 {
+				info += fmt.Sprintf(" free=%d", m.free)
+			}
+			err = w.send(info)
+		case request[0] == "ABORT", request[0] == "PAUSE", request[0] == "RESUME", request[0] == "HOME", request[0] == "ESTOP":
+			err = w.send(request[0] + "_ACK")
+		default:
+			zap.L().Warn("mock received an unknown request", zap.String("remote", remote), zap.String("request", msg))
+			err = w.send("error: unsupported request")
+		}
+		if err != nil {
+			if err == errMockDrop {
+				zap.L().Info("mock dropped the connection", zap.String("remote", remote), zap.Int64("at", m.faults.dropAt))
+			}
+			return
+		}
+	}
+}
+
+// receiveJob reads the file of size bytes a header announced, acking its
+// chunks and then the file.
+func (m *mockReceiver) receiveJob(r *bufio.Reader, w *mockWriter, name string, size int64, faulty bool) error {
+	dropAt := int64(-1)
+	if faulty {
+		dropAt = m.faults.dropAt
+	}
+	sum := crc32.NewIEEE()
+	var received int64
+	for received < size || received == dropAt {
+		if received == dropAt {
+			time.Sleep(m.faults.stall)
+			return errMockDrop
+		}
+		n := size - received
+		if m.chunkSize > 0 && n > m.chunkSize-received%m.chunkSize {
+			n = m.chunkSize - received%m.chunkSize
+		}
+		if dropAt >= 0 && received+n > dropAt {
+			n = dropAt - received
+		}
+		copied, err := io.CopyN(sum, r, n)
+		received += copied
+		if err != nil {
+			return err
+		}
+		if m.chunkSize > 0 && received != dropAt && (received%m.chunkSize == 0 || received == size) {
+			if err := w.send(fmt.Sprintf("%s %d", chunkAckKeyword, received)); err != nil {
+				return err
+			}
+		}
+	}
+	if end, err := r.ReadByte(); err != nil {
+		return err
+	} else if end != framing.End() {
+		zap.L().Warn("mock received a file without its terminator", zap.String("file", name), zap.Int64("size", size))
+		return w.send("error: file not terminated")
+	}
+	m.mu.Lock()
+	m.jobs++
+	m.received, m.sum = received, sum.Sum32()
+	m.mu.Unlock()
+	zap.L().Info("mock received job", zap.String("file", name), zap.Int64("size", size), zap.String("crc32", fmt.Sprintf("%08x", sum.Sum32())))
+	if faulty && m.faults.ackDelay > 0 {
+		time.Sleep(m.faults.ackDelay)
+	}
+	if faulty && m.faults.reject != "" {
+		return w.send(m.faults.reject)
+	}
+	if m.free > 0 && size > m.free {
+		return w.send("GCODE_NACK too large")
+	}
+	if m.runFor > 0 {
+		m.mu.Lock()
+		m.runningUntil = time.Now().Add(m.runFor)
+		m.mu.Unlock()
+	}
+	return w.send(framing.AckMessage())
+}
+
+// mockWriter writes the messages of a mock receiver, split into single
+// bytes when asked.
+type mockWriter struct {
+	conn  net.Conn
+	split bool
+}
+
+func (w *mockWriter) send(msg string) error {
+	data := append([]byte(msg), framing.End())
+	if !w.split {
+		_, err := w.conn.Write(data)
+		return err
+	}
+	for i := range data {
+		if i > 0 {
+			time.Sleep(mockSplitDelay)
+		}
+		if _, err := w.conn.Write(data[i : i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mocked is the receiver mock runs, which most of its flags set up.
+var mocked *mockReceiver
+var mockListen, mockState string
+var mockChunkSize, mockFree byteSize
+
+func mockFlags(fs *flag.FlagSet) {
+	mocked = newMockReceiver()
+	fs.StringVar(&mockListen, "listen", net.JoinHostPort("127.0.0.1", carbidePort), "address to accept senders on")
+	fs.StringVar(&mockState, "state", "init", "machine state to announce")
+	fs.StringVar(&mocked.features, "features", "", "comma separated features to announce after the state (verify, chunks, abort, info, session), none announced when empty")
+	fs.Var(&mockChunkSize, "chunk-size", "acknowledge files in chunks of this size, as the sender's -chunk-size")
+	fs.DurationVar(&mocked.runFor, "run", 0, "announce running for this long after acknowledging a file, as if the machine ran the job")
+	fs.DurationVar(&mocked.clockSkew, "clock-skew", 0, "identify with a time this far off the real one")
+	fs.Var(&mockFree, "free", "say this much room is free in the INFO answer, and refuse larger files as too large, 0 is unlimited")
+	fs.Int64Var(&mocked.faults.dropAt, "drop-at", -1, "fault: close the connection after receiving this many bytes of a file")
+	fs.DurationVar(&mocked.faults.stall, "stall", 0, "fault: stop reading for this long at -drop-at before closing the connection")
+	fs.DurationVar(&mocked.faults.ackDelay, "ack-delay", 0, "fault: wait this long before acknowledging a file")
+	fs.BoolVar(&mocked.faults.garbageState, "garbage-state", false, "fault: send line noise instead of the state")
+	fs.StringVar(&mocked.faults.reject, "reject", "", "fault: answer files with this message instead of the ack, e.g. \"GCODE_NACK too large\" or BUSY")
+	fs.BoolVar(&mocked.faults.split, "split", false, "fault: write messages one byte at a time")
+	fs.IntVar(&mocked.faults.connections, "faulty-connections", 0, "only inject the faults into this many connections, then behave, 0 injects them into all")
+}
+
+func runMock(args []string) error {
+	fs := newFlagSet("mock")
+	mockFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	mocked.state = carbide.ParseStateName(mockState)
+	mocked.chunkSize = int64(mockChunkSize)
+	mocked.free = int64(mockFree)
+	l, err := net.Listen("tcp", mockListen)
+	if err != nil {
+		zap.L().Error("failed to listen", zap.String("listen", mockListen), zap.Error(err))
+		return err
+	}
+	zap.L().Info("mock receiver listening", zap.String("listen", l.Addr().String()), zap.Stringer("state", mocked.state), zap.String("features", mocked.features))
+	return mocked.serve(l)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+)
+
+// serveMock serves m on a free port of the loopback interface until the
+// test ends, and returns its address.
+func serveMock(t *testing.T, m *mockReceiver) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go m.serve(l)
+	return l.Addr().String()
+}
+
+// sendToMock sends data to the mock at address as one job.
+func sendToMock(t *testing.T, address string, data []byte) error {
+	t.Helper()
+	sender, err := newCarbideSenderFor([]string{address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.states = carbide.StateInit.String()
+	return sender.Send("job.nc", bytes.NewReader(data), int64(len(data)))
+}
+
+func TestCarbideSenderMockFaults(t *testing.T) {
+	savedAck, savedStall, savedConnect := ackTimeout, stallTimeout, connectTimeout
+	defer func() { ackTimeout, stallTimeout, connectTimeout = savedAck, savedStall, savedConnect }()
+	ackTimeout, stallTimeout, connectTimeout = 500*time.Millisecond, 200*time.Millisecond, time.Second
+	job := bytes.Repeat([]byte("G1 X10 Y10 F300\n"), 64)
+	tests := []struct {
+		name   string
+		faults mockFaults
+		// size is that of the job, the 1KiB one when 0
+		size int
+		// sends is how many times the job is sent, the last send
+		// returning wantErr
+		sends   int
+		wantErr error
+	}{
+		{name: "no faults", faults: mockFaults{dropAt: -1}, sends: 1},
+		{name: "drop", faults: mockFaults{dropAt: 100}, sends: 1, wantErr: carbide.ErrConnection},
+		// The mock behaves on the connection after the faulty one, as a
+		// sender retrying the job sees
+		{name: "drop then retry", faults: mockFaults{dropAt: 100, connections: 1}, sends: 2},
+		{name: "stall", faults: mockFaults{dropAt: 0, stall: 2 * time.Second}, size: 32 << 20, sends: 1, wantErr: carbide.ErrStalled},
+		{name: "ack delay", faults: mockFaults{dropAt: -1, ackDelay: 100 * time.Millisecond}, sends: 1},
+		{name: "ack held too long", faults: mockFaults{dropAt: -1, ackDelay: 2 * time.Second}, sends: 1, wantErr: carbide.ErrAckTimeout},
+		{name: "garbage state", faults: mockFaults{dropAt: -1, garbageState: true}, sends: 1, wantErr: carbide.ErrProtocol},
+		{name: "split messages", faults: mockFaults{dropAt: -1, split: true}, sends: 1},
+		{name: "reject", faults: mockFaults{dropAt: -1, reject: "GCODE_NACK busy"}, sends: 1, wantErr: carbide.ErrRejected},
+		{name: "reject then retry", faults: mockFaults{dropAt: -1, reject: "GCODE_NACK busy", connections: 1}, sends: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := job
+			if tt.size > 0 {
+				data = bytes.Repeat(job, tt.size/len(job))
+			}
+			m := newMockReceiver()
+			m.faults = tt.faults
+			address := serveMock(t, m)
+			var err error
+			for i := 0; i < tt.sends; i++ {
+				err = sendToMock(t, address, data)
+				if i < tt.sends-1 && err == nil {
+					t.Fatalf("send %d succeeded despite the faults", i+1)
+				}
+			}
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("send failed: %v", err)
+				}
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				if m.received != int64(len(data)) || m.sum != crc32.ChecksumIEEE(data) {
+					t.Errorf("mock received %d bytes with crc32 %08x, want %d with %08x", m.received, m.sum, len(data), crc32.ChecksumIEEE(data))
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("send returned %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
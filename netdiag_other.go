@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "github.com/bobcob7/send-carbide/carbide"
+
+// Only Windows has connection hints, its firewall and network profiles
+// being what commonly block the machine.
+func connectionHint(e *carbide.ConnectionError) string {
+	return ""
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"golang.org/x/sys/windows"
+)
+
+// diagnoseTimeout bounds each of the commands run to diagnose a failed
+// connection, so a slow PowerShell doesn't hold up the error.
+const diagnoseTimeout = 5 * time.Second
+
+// connectionHint works out why a connection to the machine failed, from
+// whether it answers ping, whether the port refused or dropped the
+// connection and the profile of this computer's network. On Windows the
+// firewall and public networks are the usual causes, which surface as a
+// bare timeout otherwise.
+func connectionHint(e *carbide.ConnectionError) string {
+	if e.Op != "connect to" || proxyAddress != "" || sshGateway != "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(e.Address)
+	if err != nil {
+		return ""
+	}
+	var hints []string
+	switch {
+	case !answersPing(host):
+		hints = append(hints, tr("suggestion.connect.no-ping", host))
+	case errors.Is(e.Err, windows.WSAECONNREFUSED):
+		hints = append(hints, tr("suggestion.connect.refused", host, port))
+	default:
+		hints = append(hints, tr("suggestion.connect.blocked", host, port))
+	}
+	if name := publicNetwork(); name != "" {
+		hints = append(hints, tr("suggestion.connect.public-network", name))
+	}
+	return strings.Join(hints, "; ")
+}
+
+// answersPing is whether host replies to one ping. The exit code of ping
+// is 0 for "destination host unreachable" from a router too, so only a
+// reply with its TTL counts.
+func answersPing(host string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ping", "-n", "1", "-w", "1000", host).CombinedOutput()
+	return err == nil && strings.Contains(strings.ToUpper(string(out)), "TTL=")
+}
+
+// publicNetwork is the name of a network this computer is connected to
+// with the Public profile, or empty when there is none.
+func publicNetwork() string {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+		"Get-NetConnectionProfile | Where-Object NetworkCategory -eq 'Public' | Select-Object -ExpandProperty Name").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+// webhookNotifier posts notifications as JSON to a URL.
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+func newWebhookNotifier(c notifierConfig) (notifier, error) {
+	if err := checkNotifyURL(c.URL); err != nil {
+		return nil, err
+	}
+	return &webhookNotifier{url: c.URL, headers: c.Headers}, nil
+}
+
+func (w *webhookNotifier) notify(n notification) error {
+	return postJSON(w.url, w.headers, n)
+}
+
+// slackNotifier posts notifications to a Slack incoming webhook, or a chat
+// taking the same messages, like Mattermost.
+type slackNotifier struct {
+	url string
+}
+
+func newSlackNotifier(c notifierConfig) (notifier, error) {
+	if err := checkNotifyURL(c.URL); err != nil {
+		return nil, err
+	}
+	return &slackNotifier{url: c.URL}, nil
+}
+
+func (s *slackNotifier) notify(n notification) error {
+	return postJSON(s.url, nil, map[string]string{"text": n.String()})
+}
+
+func checkNotifyURL(address string) error {
+	if address == "" {
+		return errors.New("no url")
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%s is not an http or https URL", address)
+	}
+	return nil
+}
+
+// postJSON posts v as JSON, and fails unless the answer is a success.
+func postJSON(address string, headers map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, address, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		// The path of a webhook is often its secret
+		return fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(text)))
+	}
+	return nil
+}
+
+// desktopNotifier shows notifications on the desktop of the user running
+// send-carbide, with notify-send on Linux, osascript on macOS and a balloon
+// of the notification area on Windows.
+type desktopNotifier struct{}
+
+func newDesktopNotifier(c notifierConfig) (notifier, error) {
+	return desktopNotifier{}, nil
+}
+
+func (desktopNotifier) notify(n notification) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// The texts are passed as arguments so they need no quoting
+		cmd = exec.Command("osascript", "-e", "on run argv", "-e", "display notification (item 2 of argv) with title (item 1 of argv)", "-e", "end run",
+			n.Title(), n.String())
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms; $n = New-Object System.Windows.Forms.NotifyIcon; "+
+				"$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true; "+
+				"$n.ShowBalloonTip(10000, $env:SEND_CARBIDE_TITLE, $env:SEND_CARBIDE_MESSAGE, 'Info'); Start-Sleep -Seconds 5; $n.Dispose()")
+		cmd.Env = append(os.Environ(), "SEND_CARBIDE_TITLE="+n.Title(), "SEND_CARBIDE_MESSAGE="+n.String())
+	default:
+		cmd = exec.Command("notify-send", "--app-name", serviceName, n.Title(), n.String())
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", cmd.Args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// emailNotifier mails notifications through a mail server, logging in
+// when it has a username.
+type emailNotifier struct {
+	server string
+	auth   smtp.Auth
+	from   string
+	to     []string
+}
+
+func newEmailNotifier(c notifierConfig) (notifier, error) {
+	switch {
+	case c.SMTP == "":
+		return nil, errors.New("no smtp server")
+	case c.From == "":
+		return nil, errors.New("no from address")
+	case len(c.To) == 0:
+		return nil, errors.New("no to addresses")
+	}
+	server := c.SMTP
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "25")
+	}
+	host, _, _ := net.SplitHostPort(server)
+	e := &emailNotifier{server: server, from: c.From, to: c.To}
+	if c.Username != "" {
+		e.auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	return e, nil
+}
+
+func (e *emailNotifier) notify(n notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s: %s\r\n", serviceName, n.Title())
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", n.String())
+	if n.Job != "" {
+		fmt.Fprintf(&msg, "\r\njob %s\r\n", n.Job)
+	}
+	return smtp.SendMail(e.server, e.auth, e.from, e.to, msg.Bytes())
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// notifyTimeout bounds how long a channel may take to deliver a
+// notification, and how long a command waits for them before it exits.
+const notifyTimeout = 10 * time.Second
+
+// notificationsConfig is where the events of sends and daemon jobs are
+// announced: the channels by name, and the routes saying which events go
+// to which channels.
+type notificationsConfig struct {
+	Channels map[string]notifierConfig `yaml:"channels"`
+	Routes   []notificationRoute       `yaml:"routes"`
+}
+
+// notifierConfig is a channel of the notifications. Type picks the
+// notifier, the other fields are the settings of the types using them.
+type notifierConfig struct {
+	Type string `yaml:"type"`
+	// URL is where webhook and slack post to
+	URL string `yaml:"url"`
+	// Headers are added to the requests of a webhook, like Authorization
+	Headers map[string]string `yaml:"headers"`
+	// SMTP is the host:port of the mail server of email
+	SMTP string   `yaml:"smtp"`
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+	// Broker is the mqtt:// or mqtts:// URL of an MQTT broker, and Topic
+	// what is published to, send-carbide/{machine}/{event} by default
+	Broker string `yaml:"broker"`
+	Topic  string `yaml:"topic"`
+	// Username and Password log in to the mail server or the broker
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// notificationRoute sends the events of the machines to the channels. No
+// events is every event, and no machines every machine.
+type notificationRoute struct {
+	Events   []string `yaml:"events"`
+	Machines []string `yaml:"machines"`
+	Channels []string `yaml:"channels"`
+}
+
+// notificationEvents are the events that can be routed. A send from the
+// command line is done, failed or spooled for a machine that can't be
+// reached; the others are the daemon's job events.
+var notificationEvents = []string{notifySpooled, daemonEventSubmitted, daemonEventChecked, daemonEventHeld, daemonEventReleased, daemonEventReordered,
+	daemonEventCancelled, daemonEventExpired, daemonEventStarted, daemonEventDone, daemonEventFailed}
+
+// notification is an event of a send or a job, as channels deliver it.
+type notification struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Machine string    `json:"machine,omitempty"`
+	// Name is the file sent, and Job its id when the daemon sent it
+	Name  string `json:"name,omitempty"`
+	Job   string `json:"job,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Title is the short form of the notification, for a subject or a desktop
+// notification's title.
+func (n notification) Title() string {
+	if n.Machine == "" {
+		return fmt.Sprintf("%s %s", n.Name, n.Event)
+	}
+	return fmt.Sprintf("%s on %s %s", n.Name, n.Machine, n.Event)
+}
+
+func (n notification) String() string {
+	if n.Error == "" {
+		return n.Title()
+	}
+	return n.Title() + ": " + n.Error
+}
+
+// notifier delivers notifications to one channel.
+type notifier interface {
+	notify(n notification) error
+}
+
+// notifierTypes maps the type of a channel to its constructor, which
+// checks the settings the type needs. A new channel only needs to register
+// itself here.
+var notifierTypes = map[string]func(c notifierConfig) (notifier, error){
+	"webhook": newWebhookNotifier,
+	"slack":   newSlackNotifier,
+	"desktop": newDesktopNotifier,
+	"email":   newEmailNotifier,
+	"mqtt":    newMQTTNotifier,
+}
+
+func notifierTypeNames() string {
+	names := make([]string, 0, len(notifierTypes))
+	for name := range notifierTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newNotifier creates the notifier of a channel.
+func newNotifier(c notifierConfig) (notifier, error) {
+	constructor, ok := notifierTypes[strings.ToLower(c.Type)]
+	if !ok {
+		return nil, fmt.Errorf("unknown notification type %q, expected one of %s", c.Type, notifierTypeNames())
+	}
+	return constructor(c)
+}
+
+// checkRoute returns what is wrong with a route, or nil.
+func (c notificationsConfig) checkRoute(r notificationRoute) error {
+	if len(r.Channels) == 0 {
+		return fmt.Errorf("no channels")
+	}
+	for _, name := range r.Channels {
+		if _, ok := c.Channels[name]; !ok {
+			return fmt.Errorf("unknown channel %q", name)
+		}
+	}
+	for _, event := range r.Events {
+		if !containsString(notificationEvents, event) {
+			return fmt.Errorf("unknown event %q, expected one of %s", event, strings.Join(notificationEvents, ", "))
+		}
+	}
+	return nil
+}
+
+// notifications delivers the events of this run to the configured
+// channels. It is nil without any, which notifies nothing.
+var notifications *notificationRouter
+
+// notificationRouter passes notifications on to the channels of the routes
+// they match.
+type notificationRouter struct {
+	channels map[string]notifier
+	routes   []notificationRoute
+	pending  sync.WaitGroup
+}
+
+// router sets up the channels and routes of the config, nil when there are
+// no routes.
+func (c notificationsConfig) router() (*notificationRouter, error) {
+	if len(c.Routes) == 0 {
+		return nil, nil
+	}
+	r := &notificationRouter{channels: make(map[string]notifier), routes: c.Routes}
+	for _, name := range sortedKeys(c.Channels) {
+		n, err := newNotifier(c.Channels[name])
+		if err != nil {
+			return nil, fmt.Errorf("channel %s: %w", name, err)
+		}
+		r.channels[name] = n
+	}
+	for i, route := range c.Routes {
+		if err := c.checkRoute(route); err != nil {
+			return nil, fmt.Errorf("route %d: %w", i+1, err)
+		}
+	}
+	return r, nil
+}
+
+// matches is whether the route takes the notification.
+func (r notificationRoute) matches(n notification) bool {
+	if len(r.Events) > 0 && !containsString(r.Events, n.Event) {
+		return false
+	}
+	return len(r.Machines) == 0 || containsString(r.Machines, n.Machine)
+}
+
+// dispatch delivers a notification to the channels of every route it
+// matches, once to each, in the background so neither sends nor jobs wait
+// for them. Channels that fail are logged.
+func (r *notificationRouter) dispatch(n notification) {
+	if r == nil {
+		return
+	}
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	sent := map[string]bool{}
+	for _, route := range r.routes {
+		if !route.matches(n) {
+			continue
+		}
+		for _, name := range route.Channels {
+			if sent[name] {
+				continue
+			}
+			sent[name] = true
+			r.pending.Add(1)
+			go func(name string, channel notifier) {
+				defer r.pending.Done()
+				if err := channel.notify(n); err != nil {
+					zap.L().Warn("failed to send notification", zap.String("channel", name), zap.String("event", n.Event), zap.Error(err))
+					return
+				}
+				zap.L().Debug("sent notification", zap.String("channel", name), zap.String("event", n.Event))
+			}(name, r.channels[name])
+		}
+	}
+}
+
+// wait waits for the notifications being delivered, so a command doesn't
+// exit before they are out, for at most notifyTimeout.
+func (r *notificationRouter) wait() {
+	if r == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		r.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(notifyTimeout):
+		zap.L().Warn("gave up waiting for notifications", zap.Duration("timeout", notifyTimeout))
+	}
+}
+
+// notifySend announces the outcome of a send from the command line.
+func notifySend(machine, file string, err error) {
+	n := notification{Event: daemonEventDone, Machine: machine, Name: filepath.Base(file)}
+	var offline *offlineError
+	switch {
+	case errors.As(err, &offline):
+		n.Event, n.Job, n.Error = notifySpooled, offline.job.ID, offline.err.Error()
+	case err != nil:
+		n.Event, n.Error = daemonEventFailed, err.Error()
+	}
+	notifications.dispatch(n)
+}
+
+// jobNotification is the notification of a job event of the daemon.
+func jobNotification(event string, j *job) notification {
+	return notification{Event: event, Machine: j.Machine, Name: j.Name, Job: j.ID, Error: j.Error}
+}
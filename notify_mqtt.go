@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultMQTTTopic is what notifications are published to when a channel
+// has no topic.
+const defaultMQTTTopic = "send-carbide/{machine}/{event}"
+
+// mqttNotifier publishes notifications as JSON to an MQTT broker, for home
+// automation and shop dashboards. It speaks just enough MQTT 3.1.1 to
+// publish a message at most once: a connection per notification, no
+// subscriptions and no retained state.
+type mqttNotifier struct {
+	address  string
+	tls      bool
+	topic    string
+	username string
+	password string
+}
+
+func newMQTTNotifier(c notifierConfig) (notifier, error) {
+	if c.Broker == "" {
+		return nil, errors.New("no broker")
+	}
+	u, err := url.Parse(c.Broker)
+	if err != nil {
+		return nil, err
+	}
+	m := &mqttNotifier{topic: c.Topic, username: c.Username, password: c.Password}
+	port := "1883"
+	switch u.Scheme {
+	case "mqtt", "tcp":
+	case "mqtts", "ssl", "tls":
+		m.tls, port = true, "8883"
+	default:
+		return nil, fmt.Errorf("%s is not an mqtt:// or mqtts:// URL", c.Broker)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s has no host", c.Broker)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	m.address = net.JoinHostPort(u.Hostname(), port)
+	if u.User != nil && m.username == "" {
+		m.username = u.User.Username()
+		m.password, _ = u.User.Password()
+	}
+	if m.topic == "" {
+		m.topic = defaultMQTTTopic
+	}
+	if strings.ContainsAny(m.topic, "+#") {
+		return nil, fmt.Errorf("topic %s has wildcards, which can't be published to", m.topic)
+	}
+	return m, nil
+}
+
+func (m *mqttNotifier) notify(n notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	var conn net.Conn
+	if m.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.address, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", m.address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	if _, err := conn.Write(m.connectPacket()); err != nil {
+		return err
+	}
+	if err := readConnack(bufio.NewReader(conn)); err != nil {
+		return err
+	}
+	machine := n.Machine
+	if machine == "" {
+		machine = "-"
+	}
+	topic := strings.NewReplacer("{machine}", machine, "{event}", n.Event).Replace(m.topic)
+	var publish bytes.Buffer
+	writeMQTTString(&publish, topic)
+	publish.Write(payload)
+	if _, err := conn.Write(mqttPacket(0x30, publish.Bytes())); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte{0xe0, 0})
+	return err
+}
+
+// connectPacket logs in with a clean session, so the broker keeps nothing
+// of the connection.
+func (m *mqttNotifier) connectPacket() []byte {
+	var b bytes.Buffer
+	writeMQTTString(&b, "MQTT")
+	b.WriteByte(4)
+	flags := byte(0x02)
+	if m.username != "" {
+		flags |= 0x80
+		if m.password != "" {
+			flags |= 0x40
+		}
+	}
+	b.WriteByte(flags)
+	// Keep alive, in seconds
+	binary.Write(&b, binary.BigEndian, uint16(30))
+	writeMQTTString(&b, fmt.Sprintf("%s-%d", serviceName, time.Now().UnixNano()%1e9))
+	if m.username != "" {
+		writeMQTTString(&b, m.username)
+		if m.password != "" {
+			writeMQTTString(&b, m.password)
+		}
+	}
+	return mqttPacket(0x10, b.Bytes())
+}
+
+// mqttConnectErrors are the reasons a broker refuses a connection, by their
+// return code.
+var mqttConnectErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad username or password",
+	5: "not authorized",
+}
+
+func readConnack(r *bufio.Reader) error {
+	var ack [4]byte
+	if _, err := io.ReadFull(r, ack[:]); err != nil {
+		return fmt.Errorf("read connack: %w", err)
+	}
+	if ack[0] != 0x20 || ack[1] != 2 {
+		return fmt.Errorf("expected connack, got packet %#x", ack[0])
+	}
+	if ack[3] != 0 {
+		reason, ok := mqttConnectErrors[ack[3]]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", ack[3])
+		}
+		return fmt.Errorf("broker refused the connection: %s", reason)
+	}
+	return nil
+}
+
+// mqttPacket frames the body of a packet with its type and the remaining
+// length.
+func mqttPacket(kind byte, body []byte) []byte {
+	packet := []byte{kind}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func writeMQTTString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// offlineSpool keeps jobs for machines that can't be reached and sends
+// them once the machines are online, instead of failing.
+var offlineSpool bool
+
+// offlineRetryInterval is how often forward -wait tries the machines of
+// the offline jobs.
+const offlineRetryInterval = time.Minute
+
+// notifySpooled is the notification of a job spooled for a machine that
+// can't be reached.
+const notifySpooled = "spooled"
+
+var errNoOfflineJob = errors.New("no such offline job")
+
+var errNoOfflineDir = errors.New("offline jobs are kept next to the config file, which has no location")
+
+// offlineJob is a job spooled for a machine that couldn't be reached, kept
+// as it was to be sent, with what it was sent to.
+type offlineJob struct {
+	ID      string `json:"id"`
+	Machine string `json:"machine,omitempty"`
+	// Addresses are of the machine, tried in order as send tries them
+	Addresses []string `json:"addresses"`
+	Name      string   `json:"name"`
+	File      string   `json:"file"`
+	Size      int64    `json:"size"`
+	// AllowStates are the states the machine may be sent the job in, as
+	// -allow-state or the profile said
+	AllowStates string    `json:"allow_states"`
+	Spooled     time.Time `json:"spooled"`
+	Attempts    int       `json:"attempts,omitempty"`
+	// Error is why the last forward failed when the machine could be
+	// reached. Such jobs aren't tried again until forwarded by their id.
+	Error string `json:"error,omitempty"`
+}
+
+func (j *offlineJob) target() string {
+	if j.Machine != "" {
+		return j.Machine
+	}
+	return strings.Join(j.Addresses, ",")
+}
+
+// offlineError is a send that failed because the machine couldn't be
+// reached and was spooled to be sent later. send reports it as spooled.
+type offlineError struct {
+	job *offlineJob
+	err error
+}
+
+func (e *offlineError) Error() string {
+	return fmt.Sprintf("%v; spooled as offline job %s to send once the machine is online", e.err, e.job.ID)
+}
+
+func (e *offlineError) Unwrap() error {
+	return e.err
+}
+
+// offlineDir holds the offline jobs, next to the config file.
+func offlineDir() string {
+	if configPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configPath), "offline")
+}
+
+func offlineJobPath(id string) string {
+	return filepath.Join(offlineDir(), id+".nc")
+}
+
+// machineUnreachable reports whether a send failed because no address of
+// the machine took the connection, before any of the job was sent.
+func machineUnreachable(err error) bool {
+	var cerr *carbide.ConnectionError
+	return errors.As(err, &cerr) && cerr.Op == "connect to"
+}
+
+// machineNotUp reports whether a forward failed because the machine isn't
+// up yet: it can't be reached, or isn't ready for a job while it starts.
+func machineNotUp(err error) bool {
+	return machineUnreachable(err) || errors.Is(err, carbide.ErrNotReady)
+}
+
+// spoolOffline keeps a job that failed with err because its machine
+// couldn't be reached, with -offline, and starts forwarding it in the
+// background. It returns an offlineError then, and err otherwise.
+func spoolOffline(sender Sender, file string, input *jobInput, err error) error {
+	if !offlineSpool || !machineUnreachable(err) {
+		return err
+	}
+	if input.path == "" || offlineDir() == "" {
+		zap.L().Warn("can't spool a job without a file or config file to keep it by", zap.String("file", file))
+		return err
+	}
+	j := &offlineJob{ID: newJobID(), Machine: machineName, Addresses: splitAddresses(sender.Target()), Name: input.name, File: file,
+		Size: input.size, AllowStates: allowedStates, Spooled: time.Now()}
+	if serr := j.spool(input.path); serr != nil {
+		zap.L().Error("failed to spool offline job", zap.String("file", file), zap.Error(serr))
+		return err
+	}
+	zap.L().Info("machine can't be reached, spooled job", zap.String("job", j.ID), zap.String("file", file), zap.String("machine", j.target()))
+	startForwarder()
+	return &offlineError{job: j, err: err}
+}
+
+// spool copies the file of the job to the offline jobs, then saves the job.
+func (j *offlineJob) spool(path string) error {
+	if err := os.MkdirAll(offlineDir(), 0o755); err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(offlineJobPath(j.ID))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	return j.save()
+}
+
+// save writes the job through a temporary file, so a crash while writing
+// leaves the previous one.
+func (j *offlineJob) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(offlineDir(), j.ID+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (j *offlineJob) remove() {
+	os.Remove(offlineJobPath(j.ID))
+	os.Remove(filepath.Join(offlineDir(), j.ID+".json"))
+}
+
+// offlineResult prints where a spooled job went and reports the send as
+// done, as it will be once the machine is online.
+func offlineResult(err error) error {
+	var offline *offlineError
+	if !errors.As(err, &offline) {
+		return err
+	}
+	fmt.Fprintf(resultOutput(), "%s can't be reached, spooled %s as offline job %s to send once it is online\n", offline.job.target(), offline.job.File, offline.job.ID)
+	return nil
+}
+
+// readOfflineJobs returns the offline jobs, oldest first.
+func readOfflineJobs() ([]*offlineJob, error) {
+	paths, err := filepath.Glob(filepath.Join(offlineDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*offlineJob
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var j offlineJob
+		if err := json.Unmarshal(data, &j); err != nil {
+			zap.L().Warn("skipping unreadable offline job", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		jobs = append(jobs, &j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Spooled.Before(jobs[b].Spooled) })
+	return jobs, nil
+}
+
+// startForwarder starts offline forward -wait in the background, which
+// sends the offline jobs as their machines come online. It keeps running
+// when send exits, and writes its logs next to the offline jobs.
+func startForwarder() {
+	exe, err := os.Executable()
+	var config string
+	if err == nil {
+		config, err = filepath.Abs(configPath)
+	}
+	if err == nil {
+		cmd := exec.Command(exe, "offline", "forward", "-wait", "-config", config, "-log-file", filepath.Join(filepath.Dir(config), "offline", "forward.log"))
+		cmd.SysProcAttr = detachedProcess()
+		if err = cmd.Start(); err == nil {
+			zap.L().Debug("started forwarding offline jobs", zap.Int("pid", cmd.Process.Pid))
+			cmd.Process.Release()
+			return
+		}
+	}
+	zap.L().Warn("failed to start forwarding offline jobs, run send-carbide offline forward -wait", zap.Error(err))
+}
+
+// lockForwarding waits until no other process forwards the offline jobs,
+// so each job is sent once.
+func lockForwarding() (*os.File, error) {
+	if err := os.MkdirAll(offlineDir(), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(offlineDir(), "forward.lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := tryLockFile(f)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, errMachineLocked) {
+			f.Close()
+			return nil, err
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// forwardOffline sends the offline jobs, or those of ids, to their
+// machines. With wait it tries those whose machine isn't up every interval
+// until every job was sent, skipping those that failed otherwise.
+func forwardOffline(ids []string, wait bool, interval time.Duration) error {
+	lock, err := lockForwarding()
+	if err != nil {
+		zap.L().Error("failed to lock the offline jobs", zap.String("dir", offlineDir()), zap.Error(err))
+		return err
+	}
+	defer lock.Close()
+	defer unlockFile(lock)
+	out := resultOutput()
+	for {
+		jobs, err := readOfflineJobs()
+		if err != nil {
+			zap.L().Error("failed to read offline jobs", zap.String("dir", offlineDir()), zap.Error(err))
+			return err
+		}
+		var failed error
+		waiting := 0
+		for _, j := range jobs {
+			if len(ids) > 0 && !containsString(ids, j.ID) || len(ids) == 0 && wait && j.Error != "" {
+				continue
+			}
+			err := forwardJob(j)
+			switch {
+			case err == nil:
+				fmt.Fprintf(out, "sent offline job %s (%s) to %s\n", j.ID, j.File, j.target())
+			case machineNotUp(err):
+				waiting++
+			default:
+				fmt.Fprintf(out, "offline job %s (%s) failed: %v\n", j.ID, j.File, err)
+				failed = err
+			}
+		}
+		if !wait || waiting == 0 {
+			if waiting > 0 && failed == nil {
+				fmt.Fprintf(out, "%d offline jobs wait for their machines\n", waiting)
+			}
+			return failed
+		}
+		zap.L().Debug("waiting for the machines of offline jobs", zap.Int("jobs", waiting), zap.Duration("interval", interval))
+		time.Sleep(interval)
+	}
+}
+
+// forwardJob sends an offline job, and removes it once it was sent. A job
+// whose machine isn't up stays for later without being recorded.
+func forwardJob(j *offlineJob) error {
+	sender, err := newCarbideSenderFor(j.Addresses)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(offlineJobPath(j.ID))
+	if err != nil {
+		zap.L().Error("failed to open offline job", zap.String("job", j.ID), zap.Error(err))
+		return err
+	}
+	defer f.Close()
+	input := &jobInput{ReadCloser: f, name: j.Name, size: j.Size, path: f.Name()}
+	allowedStates = j.AllowStates
+	err = sender.Send(j.Name, input, j.Size)
+	j.Attempts++
+	if machineNotUp(err) {
+		zap.L().Debug("machine of offline job isn't up yet", zap.String("job", j.ID), zap.String("machine", j.target()), zap.Error(err))
+		j.save()
+		return err
+	}
+	recordSend(j.Machine, sender.Target(), j.File, input, err)
+	if err != nil {
+		zap.L().Error("failed to forward offline job", zap.String("job", j.ID), zap.String("machine", j.target()), zap.Error(err))
+		j.Error = err.Error()
+		j.save()
+		return err
+	}
+	zap.L().Info("forwarded offline job", zap.String("job", j.ID), zap.String("machine", j.target()), zap.Duration("waited", time.Since(j.Spooled)))
+	f.Close()
+	j.remove()
+	return nil
+}
+
+// runOffline lists the offline jobs, forwards them or drops one.
+var offlineWait bool
+var offlineInterval time.Duration
+
+func offlineFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&offlineWait, "wait", false, "with forward, keep trying the machines that can't be reached until every job was sent")
+	fs.DurationVar(&offlineInterval, "interval", offlineRetryInterval, "with forward -wait, how often to try the machines")
+}
+
+func runOffline(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("offline")
+	offlineFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if offlineDir() == "" {
+		zap.L().Error("offline jobs are kept next to the config file, pass -config")
+		return errNoOfflineDir
+	}
+	if len(positional) == 0 {
+		positional = []string{"list"}
+	}
+	action, ids := positional[0], positional[1:]
+	switch action {
+	case "list":
+		jobs, err := readOfflineJobs()
+		if err != nil {
+			return err
+		}
+		printOfflineJobs(resultOutput(), jobs)
+		return nil
+	case "forward":
+		return forwardOffline(ids, offlineWait, offlineInterval)
+	case "drop":
+		if len(ids) == 0 {
+			fs.PrintDefaults()
+			zap.L().Error("drop needs the ids of the jobs to drop")
+			return fmt.Errorf("offline drop needs job ids")
+		}
+		jobs, err := readOfflineJobs()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			found := false
+			for _, j := range jobs {
+				if j.ID == id {
+					j.remove()
+					found = true
+				}
+			}
+			if !found {
+				zap.L().Error("no such offline job", zap.String("job", id))
+				return fmt.Errorf("%w %q", errNoOfflineJob, id)
+			}
+			fmt.Fprintf(resultOutput(), "dropped offline job %s\n", id)
+		}
+		return nil
+	}
+	fs.PrintDefaults()
+	zap.L().Error("unknown offline command, use list, forward or drop", zap.String("command", action))
+	return fmt.Errorf("unknown offline command %q", action)
+}
+
+func printOfflineJobs(out io.Writer, jobs []*offlineJob) {
+	if len(jobs) == 0 {
+		fmt.Fprintln(out, "no offline jobs")
+		return
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMACHINE\tFILE\tSIZE\tSPOOLED\tTRIES\tERROR")
+	for _, j := range jobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", j.ID, j.target(), j.File, formatByteSize(j.Size), j.Spooled.Local().Format("2006-01-02 15:04"), j.Attempts, j.Error)
+	}
+	w.Flush()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var optimizeMoves bool
+
+// moveOptimizer drops what a job repeats without effect: moves to where the
+// tool already is, coordinates of axes that don't move, and G0/G1, F and S
+// words the machine already has. 3D finishing passes are cut into so many
+// tiny segments that this shrinks them a lot.
+//
+// It only rewrites plain G0/G1 moves. Anything else is passed on as it is,
+// and whatever it may change about the position is forgotten, so a move is
+// only shortened when the position it repeats is certain.
+type moveOptimizer struct {
+	// motion is the mode the job last set, which its moves leave out, and
+	// sentMotion the one the machine got; feed and speed are those the
+	// machine got. They are -1 while unknown.
+	motion, sentMotion int
+	feed, speed        float64
+	// absolute is whether a G90 is known to be in effect
+	absolute bool
+	pos      [3]float64
+	known    [3]bool
+
+	lines, dropped int
+	wordsDropped   int
+	bytesIn        int64
+	bytesOut       int64
+}
+
+func newMoveOptimizer() *moveOptimizer {
+	o := &moveOptimizer{}
+	o.forget()
+	return o
+}
+
+// forget drops what is known about the state of the machine.
+func (o *moveOptimizer) forget() {
+	o.motion, o.sentMotion = -1, -1
+	o.feed, o.speed = -1, -1
+	o.known = [3]bool{}
+}
+
+// filter is the preprocessor.
+func (o *moveOptimizer) filter(line string) (string, bool) {
+	o.lines++
+	o.bytesIn += int64(len(line)) + 1
+	out, keep := o.rewrite(line)
+	if keep {
+		o.bytesOut += int64(len(out)) + 1
+	} else {
+		o.dropped++
+	}
+	return out, keep
+}
+
+func (o *moveOptimizer) rewrite(line string) (string, bool) {
+	code := strings.TrimSpace(line)
+	if code == "" || strings.ContainsAny(code, "(;%") {
+		o.track(cleanGcodeLine(code))
+		return line, true
+	}
+	words, err := parseWords(code)
+	if err != nil || !plainMove(words) {
+		o.track(code)
+		return line, true
+	}
+	motion := o.motion
+	var target [3]*float64
+	feed, speed := -1.0, -1.0
+	for i := range words {
+		switch w := &words[i]; w.letter {
+		case 'G':
+			motion = int(w.value)
+		case 'F':
+			feed = w.value
+		case 'S':
+			speed = w.value
+		default:
+			target[w.letter-'X'] = &w.value
+		}
+	}
+	if motion != 0 && motion != 1 {
+		// Arcs are left alone, like moves in a mode nobody set
+		o.track(code)
+		return line, true
+	}
+	o.motion = motion
+	var parts []string
+	for i, p := range target {
+		if p == nil {
+			continue
+		}
+		if o.absolute && o.known[i] && o.pos[i] == *p {
+			o.wordsDropped++
+			continue
+		}
+		parts = append(parts, axisNames[i]+strconv.FormatFloat(*p, 'f', -1, 64))
+		if o.absolute {
+			o.pos[i], o.known[i] = *p, true
+		} else {
+			o.known[i] = false
+		}
+	}
+	var modal []string
+	// A mode change is sent even by a line that doesn't move, since lines
+	// passed on as they are may move in it
+	if o.motion != o.sentMotion {
+		modal = append(modal, "G"+strconv.Itoa(o.motion))
+		o.sentMotion = o.motion
+	} else if hasWord(words, 'G') {
+		o.wordsDropped++
+	}
+	if feed >= 0 && feed != o.feed {
+		modal = append(modal, "F"+strconv.FormatFloat(feed, 'f', -1, 64))
+		o.feed = feed
+	} else if feed >= 0 {
+		o.wordsDropped++
+	}
+	if speed >= 0 && speed != o.speed {
+		modal = append(modal, "S"+strconv.FormatFloat(speed, 'f', -1, 64))
+		o.speed = speed
+	} else if speed >= 0 {
+		o.wordsDropped++
+	}
+	parts = append(modal, parts...)
+	if len(parts) == 0 {
+		return "", false
+	}
+	return strings.Join(parts, " "), true
+}
+
+// plainMove is whether a line is a G0 or G1 move, or a line of only
+// coordinates, a feed and a speed, which is all the optimizer rewrites.
+func plainMove(words []gcodeWord) bool {
+	gs := 0
+	for _, w := range words {
+		switch w.letter {
+		case 'G':
+			if gs++; w.value != 0 && w.value != 1 {
+				return false
+			}
+		case 'X', 'Y', 'Z', 'F', 'S':
+		default:
+			return false
+		}
+	}
+	return gs <= 1
+}
+
+func hasWord(words []gcodeWord, letter byte) bool {
+	for _, w := range words {
+		if w.letter == letter {
+			return true
+		}
+	}
+	return false
+}
+
+// track follows a line that is passed on as it is, forgetting the position
+// when it may change it in ways that aren't followed.
+func (o *moveOptimizer) track(code string) {
+	if code == "" {
+		return
+	}
+	words, err := parseWords(code)
+	if err != nil {
+		o.forget()
+		return
+	}
+	lost := false
+	for _, w := range words {
+		switch w.letter {
+		case 'G':
+			switch g := w.value; g {
+			case 0, 1, 2, 3:
+				o.motion, o.sentMotion = int(g), int(g)
+			case 90:
+				o.absolute = true
+			case 91:
+				o.absolute = false
+				o.known = [3]bool{}
+			case 17, 18, 19, 40, 49, 80, 94:
+				// Modes that don't move the tool
+			default:
+				// Units, offsets, machine coordinates, probing, homing:
+				// the position is no longer known in the job's terms
+				lost = true
+			}
+		case 'F':
+			o.feed = w.value
+		case 'S':
+			o.speed = w.value
+		case 'M':
+			// Tool changes may move the tool, program ends reset modes
+			if m := int(w.value); m == 2 || m == 6 || m == 30 {
+				lost = true
+			}
+		}
+	}
+	if lost {
+		o.forget()
+		return
+	}
+	// Moves and arcs end where their coordinates say, and leave the other
+	// axes where they are
+	for _, w := range words {
+		if w.letter >= 'X' && w.letter <= 'Z' {
+			o.pos[w.letter-'X'], o.known[w.letter-'X'] = w.value, o.absolute
+		}
+	}
+}
+
+// applyOptimizer runs the job through a moveOptimizer on its way out.
+func applyOptimizer(input *jobInput) *moveOptimizer {
+	o := newMoveOptimizer()
+	input.ReadCloser = &lineFilter{r: bufio.NewReader(input.ReadCloser), Closer: input.ReadCloser, filters: []func(string) (string, bool){o.filter}}
+	input.size = -1
+	input.path = ""
+	return o
+}
+
+// report logs how much the optimizer took out of the job.
+func (o *moveOptimizer) report() {
+	if o.lines == 0 {
+		return
+	}
+	zap.L().Info("optimized moves", zap.Int("lines", o.lines), zap.Int("lines_dropped", o.dropped), zap.Int("words_dropped", o.wordsDropped),
+		zap.Int64("bytes_before", o.bytesIn), zap.Int64("bytes_after", o.bytesOut))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func optimize(lines []string) []string {
+	o := newMoveOptimizer()
+	var out []string
+	for _, line := range lines {
+		if line, keep := o.filter(line); keep {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+func TestMoveOptimizer(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{
+			name: "repeated coordinates and modes",
+			in:   []string{"G90", "G0 X0 Y0 Z5", "G1 Z-1 F300", "G1 X10 Y0 Z-1 F300", "G1 X10 Y5", "X10 Y5"},
+			want: []string{"G90", "G0 X0 Y0 Z5", "G1 F300 Z-1", "X10", "Y5"},
+		},
+		{
+			// The G1 of a line that doesn't move is what the comment line
+			// after it cuts in
+			name: "mode change without a move before a comment",
+			in:   []string{"G90", "G0 X0 Y0", "G1 F300", "X10 (cut)"},
+			want: []string{"G90", "G0 X0 Y0", "G1 F300", "X10 (cut)"},
+		},
+		{
+			name: "mode change without a move before a line comment",
+			in:   []string{"G90", "G0 X0 Y0", "G1 X0 Y0 F300", "X20 Y3 ; cut"},
+			want: []string{"G90", "G0 X0 Y0", "G1 F300", "X20 Y3 ; cut"},
+		},
+		{
+			name: "motion word repeated without a move",
+			in:   []string{"G90", "G1 X0 F300", "G1 X0", "X5"},
+			want: []string{"G90", "G1 F300 X0", "X5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := optimize(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("optimize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var logFormat string
+
+const (
+	colorReset  = "\033[0m"
+	colorBold   = "\033[1m"
+	colorDim    = "\033[2m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+)
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// humanOutput reports whether a concise summary should be printed to out
+// instead of only logs. That is the case on a terminal unless structured
+// logs were asked for with -v, -vv or -log-format.
+func humanOutput(out *os.File) bool {
+	if logFormat != "auto" || verbose || veryVerbose {
+		return false
+	}
+	return isTerminal(out)
+}
+
+func useColor() bool {
+	return os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+}
+
+func paint(color, s string) string {
+	if !useColor() {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// progressReader draws a progress bar while the job is read by a sender.
+type progressReader struct {
+	r     io.Reader
+	out   io.Writer
+	total int64
+	n     int64
+	// lines is how many lines were read, of totalLines when that is known
+	lines      int64
+	totalLines int64
+	drawn      time.Time
+}
+
+func newProgressReader(r io.Reader, out io.Writer, total int64) *progressReader {
+	return &progressReader{r: r, out: out, total: total, totalLines: -1}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	p.lines += int64(bytes.Count(b[:n], []byte{'\n'}))
+	if p.n >= p.total || time.Since(p.drawn) >= 100*time.Millisecond {
+		p.draw()
+	}
+	return n, err
+}
+
+func (p *progressReader) draw() {
+	const width = 30
+	p.drawn = time.Now()
+	fraction := 1.0
+	if p.total > 0 {
+		fraction = float64(p.n) / float64(p.total)
+	}
+	filled := int(fraction * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	status := fmt.Sprintf("%s/%s", formatByteSize(p.n), formatByteSize(p.total))
+	if p.totalLines > 0 {
+		status += fmt.Sprintf(", line %d of %d", p.lines, p.totalLines)
+	}
+	if p.n >= p.total {
+		status = "waiting for the machine to accept it"
+	}
+	fmt.Fprintf(p.out, "\r\033[K  [%s] %3.0f%% %s", bar, fraction*100, paint(colorDim, status))
+}
+
+// clear removes the progress bar so a result can be printed in its place.
+func (p *progressReader) clear() {
+	fmt.Fprint(p.out, "\r\033[K")
+}
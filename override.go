@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// overrides are the feed, rapid and spindle override levels in percent.
+type overrides struct {
+	Feed    int `json:"feed"`
+	Rapid   int `json:"rapid"`
+	Spindle int `json:"spindle"`
+}
+
+func (o overrides) String() string {
+	return fmt.Sprintf("feed %d%%, rapid %d%%, spindle %d%%", o.Feed, o.Rapid, o.Spindle)
+}
+
+// parseOverrideLevels parses the three levels, feed first, from separate
+// fields like Carbide Motion sends or a comma separated list like GRBL's Ov:
+// field.
+func parseOverrideLevels(text string) (overrides, error) {
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(fields) != 3 {
+		return overrides{}, fmt.Errorf("invalid override levels %q", text)
+	}
+	var levels [3]int
+	for i, field := range fields {
+		level, err := strconv.Atoi(strings.TrimSuffix(field, "%"))
+		if err != nil {
+			return overrides{}, fmt.Errorf("invalid override levels %q", text)
+		}
+		levels[i] = level
+	}
+	return overrides{Feed: levels[0], Rapid: levels[1], Spindle: levels[2]}, nil
+}
+
+// overrideChange is a change of one override, either by percent points or
+// to a level.
+type overrideChange struct {
+	kind     string
+	percent  int
+	relative bool
+}
+
+func (c overrideChange) String() string {
+	if c.relative {
+		return fmt.Sprintf("%s %+d%%", c.kind, c.percent)
+	}
+	return fmt.Sprintf("%s %d%%", c.kind, c.percent)
+}
+
+// rapidLevels are the only rapid overrides GRBL offers.
+var rapidLevels = map[int]bool{25: true, 50: true, 100: true}
+
+// Override limits enforced by GRBL.
+const (
+	minOverride = 10
+	maxOverride = 200
+)
+
+// parseOverrideChange parses the change of an override command, like "feed
+// +10%", "spindle 80%" or "rapid reset".
+func parseOverrideChange(kind, value string) (overrideChange, error) {
+	c := overrideChange{kind: strings.ToLower(kind)}
+	if c.kind != "feed" && c.kind != "rapid" && c.kind != "spindle" {
+		return c, fmt.Errorf("unknown override %q, use feed, rapid or spindle", kind)
+	}
+	value = strings.TrimSuffix(strings.TrimSpace(value), "%")
+	if strings.ToLower(value) == "reset" {
+		c.percent = 100
+		return c, nil
+	}
+	c.relative = strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+	percent, err := strconv.Atoi(value)
+	if err != nil {
+		return c, fmt.Errorf("invalid override %q, use a change like +10%%, a level like 80%% or reset", value)
+	}
+	c.percent = percent
+	switch {
+	case c.kind == "rapid" && (c.relative || !rapidLevels[percent]):
+		return c, errors.New("rapid override can only be set to 25%, 50% or 100%")
+	case !c.relative && (percent < minOverride || percent > maxOverride):
+		return c, fmt.Errorf("override must be between %d%% and %d%%", minOverride, maxOverride)
+	case c.relative && percent == 0:
+		return c, errors.New("override change must not be zero")
+	}
+	return c, nil
+}
+
+// GRBL's realtime override commands. Each reset is followed by +10%, -10%,
+// +1% and -1% commands.
+const (
+	grblFeedReset    = 0x90
+	grblRapid100     = 0x95
+	grblRapid50      = 0x96
+	grblRapid25      = 0x97
+	grblSpindleReset = 0x99
+)
+
+// grblOverrideBytes returns the realtime commands that make change. GRBL
+// only steps by 10 and 1 percent points, so levels are reached by a reset
+// and steps from 100%.
+func grblOverrideBytes(change overrideChange) []byte {
+	if change.kind == "rapid" {
+		return []byte{map[int]byte{100: grblRapid100, 50: grblRapid50, 25: grblRapid25}[change.percent]}
+	}
+	base := byte(grblFeedReset)
+	if change.kind == "spindle" {
+		base = grblSpindleReset
+	}
+	var commands []byte
+	steps := change.percent
+	if !change.relative {
+		commands = append(commands, base)
+		steps -= 100
+	}
+	plus10, minus10, plus1, minus1 := base+1, base+2, base+3, base+4
+	for ; steps >= 10; steps -= 10 {
+		commands = append(commands, plus10)
+	}
+	for ; steps <= -10; steps += 10 {
+		commands = append(commands, minus10)
+	}
+	for ; steps > 0; steps-- {
+		commands = append(commands, plus1)
+	}
+	for ; steps < 0; steps++ {
+		commands = append(commands, minus1)
+	}
+	return commands
+}
+
+func overrideFlags(fs *flag.FlagSet) { controlFlags(fs, 5*time.Second) }
+
+func runOverride(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("override")
+	overrideFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) != 2 {
+		fs.PrintDefaults()
+		zap.L().Error("override needs what to change and by how much, e.g. override feed +10%", zap.Strings("args", positional))
+		return errors.New("override needs what to change and by how much")
+	}
+	change, err := parseOverrideChange(positional[0], positional[1])
+	if err != nil {
+		fs.PrintDefaults()
+		zap.L().Error("invalid override", zap.Error(err))
+		return err
+	}
+	c, err := openController()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer c.Close()
+	levels, err := c.Override(change)
+	if err != nil {
+		return err
+	}
+	zap.L().Info("changed override", zap.Stringer("change", change), zap.Stringer("overrides", levels))
+	fmt.Printf("%s on %s\n", levels, c.Target())
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/url"
+	"runtime"
+	"strings"
+)
+
+// pathArgs undoes what shells, shortcuts and wrapper scripts do to files
+// dropped on them, so a drag and drop sends the file it looks like it
+// should: paths quoted twice or split at their spaces by a script that
+// passes %* or $* on unquoted, and file:// URLs or backslash escaped paths
+// from terminals.
+func pathArgs(args []string) []string {
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		arg := cleanPathArg(args[i])
+		if !fileExists(arg) && !isRemoteSource(arg) {
+			// A path split at its spaces comes back together
+			for j := i + 1; j < len(args); j++ {
+				if joined := cleanPathArg(strings.Join(args[i:j+1], " ")); fileExists(joined) {
+					arg, i = joined, j
+					break
+				}
+			}
+		}
+		paths = append(paths, arg)
+	}
+	return paths
+}
+
+// cleanPathArg strips the quotes, whitespace and escapes a path may have
+// picked up on its way, unless it names a file as it is.
+func cleanPathArg(arg string) string {
+	if arg == "-" || isRemoteSource(arg) || fileExists(arg) {
+		return arg
+	}
+	// Windows takes the \" of a quoted path ending in a backslash for a
+	// quote, leaving it at the end
+	cleaned := strings.Trim(strings.TrimSpace(arg), `"'`)
+	if strings.HasPrefix(cleaned, "file://") {
+		if u, err := url.Parse(cleaned); err == nil {
+			cleaned = u.Path
+			if runtime.GOOS == "windows" {
+				// file:///C:/Jobs/part.nc
+				cleaned = strings.TrimPrefix(cleaned, "/")
+			}
+		}
+	}
+	if runtime.GOOS != "windows" && strings.Contains(cleaned, `\`) && !fileExists(cleaned) {
+		// Terminals escape the spaces and brackets of dropped paths
+		var b strings.Builder
+		for i := 0; i < len(cleaned); i++ {
+			if cleaned[i] == '\\' && i+1 < len(cleaned) {
+				i++
+			}
+			b.WriteByte(cleaned[i])
+		}
+		if unescaped := b.String(); fileExists(unescaped) {
+			cleaned = unescaped
+		}
+	}
+	return cleaned
+}
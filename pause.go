@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var spindleDwell time.Duration
+var pauseBelow float64
+
+// pauseInserter adds manual checkpoints to a job: a G4 dwell after every
+// spindle start, so the spindle is at speed before it cuts, and an M0
+// before every feed move that plunges deeper than below, so the depth can
+// be checked before the cut.
+type pauseInserter struct {
+	// dwell is in seconds, below in mm under the work zero, 0 to not
+	// insert them
+	dwell float64
+	below float64
+
+	metric   bool
+	absolute bool
+	motion   int
+	z        float64
+	zKnown   bool
+}
+
+func newPauseInserter(dwell, below float64) *pauseInserter {
+	return &pauseInserter{dwell: dwell, below: below, metric: true, absolute: true, motion: -1}
+}
+
+// filter is the preprocessor. It returns the inserted lines along with the
+// line.
+func (p *pauseInserter) filter(line string) (string, bool) {
+	code := strings.TrimSpace(cleanGcodeLine(line))
+	if code == "" {
+		return line, true
+	}
+	words, err := parseWords(code)
+	if err != nil {
+		return line, true
+	}
+	scale := 1.0
+	start := false
+	var z *float64
+	lost := false
+	for i := range words {
+		switch w := &words[i]; w.letter {
+		case 'G':
+			switch g := w.value; g {
+			case 0, 1, 2, 3:
+				p.motion = int(g)
+			case 20:
+				p.metric = false
+			case 21:
+				p.metric = true
+			case 90:
+				p.absolute = true
+			case 91:
+				p.absolute = false
+			case 10, 28, 30, 53, 92, 38.2, 38.3, 38.4, 38.5:
+				// Moves and offsets that aren't in the job's terms
+				lost = true
+			}
+		case 'M':
+			start = start || w.value == 3 || w.value == 4
+		case 'Z':
+			z = &w.value
+		}
+	}
+	if !p.metric {
+		scale = 25.4
+	}
+	if lost {
+		p.zKnown = false
+		z = nil
+	}
+	var before, after string
+	if z != nil {
+		target := *z * scale
+		if !p.absolute {
+			target += p.z
+		}
+		if p.below > 0 && p.motion >= 1 && p.motion <= 3 && target < -p.below && (!p.zKnown || target < p.z) && (p.absolute || p.zKnown) {
+			before = "M0\n"
+		}
+		p.z, p.zKnown = target, p.absolute || p.zKnown
+	}
+	if start && p.dwell > 0 {
+		after = "\nG4 P" + strconv.FormatFloat(p.dwell, 'f', -1, 64)
+	}
+	return before + line + after, true
+}
+
+// applyPauses inserts the dwells and pauses of the profile.
+func applyPauses(input *jobInput, profile machineProfile) {
+	if profile.SpindleDwell <= 0 && profile.PauseBelow <= 0 {
+		return
+	}
+	p := newPauseInserter(profile.SpindleDwell, profile.PauseBelow)
+	input.ReadCloser = &lineFilter{r: bufio.NewReader(input.ReadCloser), Closer: input.ReadCloser, filters: []func(string) (string, bool){p.filter}}
+	input.size = -1
+	input.path = ""
+}
+
+// pauseFlags sets the dwell and pause of the flags in the profile, where
+// they take precedence.
+func pauseFlags(profile *machineProfile) {
+	if spindleDwell > 0 {
+		profile.SpindleDwell = spindleDwell.Seconds()
+	}
+	if pauseBelow > 0 {
+		profile.PauseBelow = pauseBelow
+	}
+}
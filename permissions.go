@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// roleConfig is what the members of a role may do with the daemon's
+// machines, for a shop or makerspace where not everyone may use every
+// machine. Without roles in the config file everyone who authenticates may
+// do everything.
+type roleConfig struct {
+	// Members are the users by name, tokens by the "token 98e4e276" the
+	// audit log names them by, and "anonymous" for open listeners
+	Members []string `yaml:"members"`
+	// Machines are those the members may send to, "*" for all of them
+	Machines []string `yaml:"machines"`
+	// Abort lets the members cancel, hold and reorder the jobs others
+	// submitted to their machines, not only their own
+	Abort bool `yaml:"abort"`
+}
+
+// permissions are what an identity may do, from all its roles.
+type permissions struct {
+	machines map[string]bool
+	all      bool
+	abort    bool
+}
+
+// permissions returns what the roles let a client do, and everything when
+// there are no roles.
+func (c daemonConfig) permissions(identity string) permissions {
+	if len(c.Roles) == 0 {
+		return permissions{all: true, abort: true}
+	}
+	p := permissions{machines: map[string]bool{}}
+	member := strings.TrimPrefix(identity, "user ")
+	for _, role := range c.Roles {
+		if !containsString(role.Members, member) && !containsString(role.Members, identity) {
+			continue
+		}
+		for _, machine := range role.Machines {
+			p.all = p.all || machine == "*"
+			p.machines[machine] = true
+		}
+		p.abort = p.abort || role.Abort
+	}
+	return p
+}
+
+// send reports whether jobs may be sent to the machine.
+func (p permissions) send(machine string) bool {
+	return p.all || p.machines[machine]
+}
+
+// change reports whether a queued job may be cancelled, held or reordered
+// by identity: jobs it submitted to a machine it may send to, and those of
+// others with abort.
+func (p permissions) change(identity string, j job) bool {
+	return p.send(j.Machine) && (p.abort || j.SubmittedBy == identity)
+}
+
+// allowed refuses what entry does with 403 Forbidden, and records the
+// refusal in the audit log, when the client of the request isn't permitted
+// it.
+func (d *daemon) allowed(r *http.Request, permitted bool, entry auditEntry) error {
+	if permitted {
+		return nil
+	}
+	identity := clientIdentity(r)
+	zap.L().Warn("forbidden request", zap.String("client", identity), zap.String("action", entry.Action), zap.String("machine", entry.Machine),
+		zap.String("job", entry.Job))
+	entry.Result = "forbidden"
+	d.audit.request(r, entry)
+	return refuse(http.StatusForbidden, "%s may not %s on machine %q", identity, entry.Action, entry.Machine)
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sendPhases is how long each step of a send to Carbide Motion took, in
+// seconds, to tell a slow network from a slow receiver. Dial and handshake
+// are of the connection that was used, not of waiting for the machine to
+// become ready.
+type sendPhases struct {
+	// Dial is connecting, Handshake is waiting for the state message
+	Dial      float64 `json:"dial"`
+	Handshake float64 `json:"handshake"`
+	// Transfer is writing the header and the file, Flush is writing what
+	// was still buffered
+	Transfer float64 `json:"transfer"`
+	Flush    float64 `json:"flush"`
+	// Ack is waiting for the receiver to acknowledge the file
+	Ack    float64 `json:"ack"`
+	Verify float64 `json:"verify,omitempty"`
+}
+
+// phaseNames are the phases in the order they happen.
+var phaseNames = []string{"dial", "handshake", "transfer", "flush", "ack", "verify"}
+
+func (p *sendPhases) values() []float64 {
+	return []float64{p.Dial, p.Handshake, p.Transfer, p.Flush, p.Ack, p.Verify}
+}
+
+func (p *sendPhases) String() string {
+	s := ""
+	for i, v := range p.values() {
+		if v == 0 && phaseNames[i] == "verify" {
+			continue
+		}
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s %v", phaseNames[i], seconds(v).Round(time.Millisecond))
+	}
+	return s
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// phaseTimer is a Sender that times the phases of its last send.
+type phaseTimer interface {
+	Phases() *sendPhases
+}
+
+// phaseMetrics adds up the phases of the daemon's sends per machine, for
+// GET /metrics.
+type phaseMetrics struct {
+	mu       sync.Mutex
+	sends    map[string]int
+	failures map[string]int
+	sums     map[string][]float64
+}
+
+func newPhaseMetrics() *phaseMetrics {
+	return &phaseMetrics{sends: map[string]int{}, failures: map[string]int{}, sums: map[string][]float64{}}
+}
+
+func (m *phaseMetrics) record(machine string, phases *sendPhases, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sends[machine]++
+	if err != nil {
+		m.failures[machine]++
+	}
+	if phases == nil {
+		return
+	}
+	sums := m.sums[machine]
+	if sums == nil {
+		sums = make([]float64, len(phaseNames))
+		m.sums[machine] = sums
+	}
+	for i, v := range phases.values() {
+		sums[i] += v
+	}
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *phaseMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	machines := make([]string, 0, len(m.sends))
+	for machine := range m.sends {
+		machines = append(machines, machine)
+	}
+	sort.Strings(machines)
+	fmt.Fprintln(w, "# HELP send_carbide_sends_total Jobs the daemon sent, including failed ones.")
+	fmt.Fprintln(w, "# TYPE send_carbide_sends_total counter")
+	for _, machine := range machines {
+		fmt.Fprintf(w, "send_carbide_sends_total{machine=%q} %d\n", machine, m.sends[machine])
+	}
+	fmt.Fprintln(w, "# HELP send_carbide_send_failures_total Jobs the daemon failed to send.")
+	fmt.Fprintln(w, "# TYPE send_carbide_send_failures_total counter")
+	for _, machine := range machines {
+		fmt.Fprintf(w, "send_carbide_send_failures_total{machine=%q} %d\n", machine, m.failures[machine])
+	}
+	fmt.Fprintln(w, "# HELP send_carbide_phase_seconds_total Time spent in each phase of the daemon's sends.")
+	fmt.Fprintln(w, "# TYPE send_carbide_phase_seconds_total counter")
+	for _, machine := range machines {
+		sums := m.sums[machine]
+		if sums == nil {
+			continue
+		}
+		for i, phase := range phaseNames {
+			fmt.Fprintf(w, "send_carbide_phase_seconds_total{machine=%q,phase=%q} %g\n", machine, phase, sums[i])
+		}
+	}
+}
+
+func (d *daemon) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	d.metrics.write(w)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// pingStats accumulates latency samples.
+type pingStats struct {
+	samples []time.Duration
+}
+
+func (s *pingStats) add(d time.Duration) {
+	s.samples = append(s.samples, d)
+}
+
+// summary returns min/avg/max/stddev of the samples.
+func (s *pingStats) summary() (min, avg, max, stddev time.Duration) {
+	if len(s.samples) == 0 {
+		return 0, 0, 0, 0
+	}
+	min, max = s.samples[0], s.samples[0]
+	var total float64
+	for _, d := range s.samples {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+		total += float64(d)
+	}
+	mean := total / float64(len(s.samples))
+	var variance float64
+	for _, d := range s.samples {
+		variance += math.Pow(float64(d)-mean, 2)
+	}
+	variance /= float64(len(s.samples))
+	return min, time.Duration(mean), max, time.Duration(math.Sqrt(variance))
+}
+
+func (s *pingStats) print(name string) {
+	min, avg, max, stddev := s.summary()
+	fmt.Printf("%s min/avg/max/stddev = %v/%v/%v/%v\n", name, min, avg, max, stddev)
+}
+
+// pingOnce measures how long it takes to connect and to receive the STATE
+// message once connected.
+func pingOnce(d *dialer, timeout time.Duration) (connect, state time.Duration, err error) {
+	start := time.Now()
+	conn, err := d.dial()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	connect = time.Since(start)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := getState(newConnReader(conn)); err != nil {
+		return connect, 0, err
+	}
+	return connect, time.Since(start) - connect, nil
+}
+
+// pingAddress probes one address count times and prints statistics. It
+// reports whether any probe succeeded.
+func pingAddress(d *dialer, count int, interval, timeout time.Duration) bool {
+	var connectStats, stateStats pingStats
+	failures := 0
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		connect, state, err := pingOnce(d, timeout)
+		if err != nil {
+			failures++
+			zap.L().Debug("probe failed", zap.Int("seq", i), zap.Error(err))
+			fmt.Printf("seq=%d %s: %v\n", i, d, err)
+			continue
+		}
+		connectStats.add(connect)
+		stateStats.add(state)
+		fmt.Printf("seq=%d %s: connect=%v state=%v\n", i, d, connect, state)
+	}
+	fmt.Printf("\n--- %s ping statistics ---\n", d)
+	fmt.Printf("%d probes, %d ok, %.1f%% failed\n", count, count-failures, 100*float64(failures)/float64(count))
+	if failures < count {
+		connectStats.print("connect")
+		stateStats.print("state")
+	}
+	return failures < count
+}
+
+var pingCount int
+var pingInterval time.Duration
+var pingTimeout time.Duration
+
+func pingFlags(fs *flag.FlagSet) {
+	fs.IntVar(&pingCount, "count", 10, "number of probes to send")
+	fs.DurationVar(&pingInterval, "interval", time.Second, "time between probes")
+	fs.DurationVar(&pingTimeout, "timeout", 5*time.Second, "how long to wait for the state message of each probe")
+}
+
+func runPing(args []string) error {
+	fs := newFlagSet("ping")
+	pingFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	dialers, err := resolveDialers()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	// Probe every address separately so links can be compared
+	failed := 0
+	for _, d := range dialers {
+		if !pingAddress(d, pingCount, pingInterval, pingTimeout) {
+			failed++
+		}
+	}
+	if failed == len(dialers) {
+		return fmt.Errorf("all probes failed")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// preflightJobs checks the queued jobs and estimates how long they run
+// ahead of their turn, while other jobs are sent, so a job starts as soon
+// as its machine is free rather than after a preflight of its own. It runs
+// until stop is closed.
+func (d *daemon) preflightJobs(stop <-chan struct{}) {
+	defer d.workers.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		j := d.queue.unchecked()
+		if j == nil {
+			select {
+			case <-d.queue.checks:
+			case <-stop:
+				return
+			}
+			continue
+		}
+		d.preflightJob(j)
+	}
+}
+
+// preflightJob runs a job on a model of its machine, with the machine's
+// profile when it has one, and keeps what it found and the estimate in the
+// job. The spool file was rewritten by the profile when the job was
+// queued, so it runs as it is sent. The preflight of the job must have
+// been started with unchecked or check.
+func (d *daemon) preflightJob(j *job) {
+	m := d.cfg.Machines[j.Machine]
+	var profile *machineProfile
+	if m.Profile != "" {
+		if p, err := lookupProfile(d.cfg, m.Profile); err == nil {
+			profile = &p
+		}
+	}
+	start := time.Now()
+	findings, estimated := preflightFile(j.path, profile)
+	var expected float64
+	if estimated > 0 {
+		expected = correctedEstimate(j.Machine, m.Address, estimated).Seconds()
+	}
+	d.queue.update(j, func(j *job) {
+		defer close(j.preflighted)
+		j.estimated = estimated
+		j.Findings = findings
+		if expected > 0 {
+			j.EstimatedSeconds = expected
+		}
+	})
+	if len(findings) > 0 {
+		zap.L().Warn("preflight found problems in queued job", zap.String("job", j.ID), zap.String("machine", j.Machine), zap.String("name", j.Name),
+			zap.Int("findings", len(findings)), zap.String("first", findings[0].Message))
+	}
+	zap.L().Debug("preflighted job", zap.String("job", j.ID), zap.Duration("took", time.Since(start)), zap.Float64("estimated_seconds", estimated))
+	if checked, err := d.queue.get(j.ID); err == nil {
+		d.events.jobEvent(daemonEventChecked, checked)
+	}
+}
+
+// preflightFile is what the preflight finds in the job in a file on a
+// machine with the profile, and how long the job should run at its feeds,
+// 0 when it can't be read.
+func preflightFile(path string, profile *machineProfile) ([]simulationFinding, float64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0
+	}
+	defer f.Close()
+	s := newSimulator(profile, nil, preflightSpike)
+	if err := s.run(&jobInput{ReadCloser: f, name: filepath.Base(path), size: -1}); err != nil {
+		zap.L().Debug("failed to preflight job", zap.String("path", path), zap.Error(err))
+		return nil, 0
+	}
+	return s.findings, s.toolpath().EstimatedSeconds
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var errNothingToPreview = errors.New("the job has no moves to preview")
+
+// toolpathSegment is a straight piece of the toolpath.
+type toolpathSegment struct {
+	from, to [3]float64
+	rapid    bool
+	// feed is the feed rate of the move, in mm/min
+	feed float64
+}
+
+// toolpathTrace collects the toolpath of a job from a simulator run.
+type toolpathTrace struct {
+	segments []toolpathSegment
+	// low and high are the corners of what is drawn
+	low, high [2]float64
+	drawn     bool
+	// rapids are drawn too, not only the feed moves
+	rapids bool
+}
+
+func (t *toolpathTrace) add(from, to [3]float64, rapid bool, feed float64) {
+	if rapid && !t.rapids {
+		return
+	}
+	t.segments = append(t.segments, toolpathSegment{from: from, to: to, rapid: rapid, feed: feed})
+	for _, p := range [][3]float64{from, to} {
+		for i := 0; i < 2; i++ {
+			if !t.drawn || p[i] < t.low[i] {
+				t.low[i] = p[i]
+			}
+			if !t.drawn || p[i] > t.high[i] {
+				t.high[i] = p[i]
+			}
+		}
+		t.drawn = true
+	}
+}
+
+// brailleDots are the bits of the dots of a Braille character, by column
+// and row of its 2 by 4 grid.
+var brailleDots = [2][4]rune{{0x01, 0x02, 0x04, 0x40}, {0x08, 0x10, 0x20, 0x80}}
+
+// brailleCanvas is a top-down plot in Braille characters, each holding 2
+// by 4 dots so the plot is finer than the terminal's cells.
+type brailleCanvas struct {
+	cols, rows int
+	// cut and rapid are the dots of feed moves and of rapids
+	cut, rapid []rune
+	low        [2]float64
+	// scale is the mm per dot
+	scale float64
+	// dim paints the cells that only hold rapids
+	dim bool
+}
+
+// newBrailleCanvas fits the area from low to high into at most cols by
+// rows characters, at the same scale along both axes.
+func newBrailleCanvas(low, high [2]float64, cols, rows int) *brailleCanvas {
+	width, height := math.Max(high[0]-low[0], 1e-3), math.Max(high[1]-low[1], 1e-3)
+	scale := width / float64(2*cols-1)
+	if s := height / float64(4*rows-1); s > scale {
+		scale = s
+	}
+	c := &brailleCanvas{low: low, scale: scale}
+	c.cols = int(math.Ceil((width/scale + 1) / 2))
+	c.rows = int(math.Ceil((height/scale + 1) / 4))
+	c.cut = make([]rune, c.cols*c.rows)
+	c.rapid = make([]rune, c.cols*c.rows)
+	return c
+}
+
+func (c *brailleCanvas) dot(p [3]float64, rapid bool) {
+	x := int(math.Round((p[0] - c.low[0]) / c.scale))
+	// Rows run down, Y up
+	y := 4*c.rows - 1 - int(math.Round((p[1]-c.low[1])/c.scale))
+	if x < 0 || y < 0 || x >= 2*c.cols || y >= 4*c.rows {
+		return
+	}
+	cell := (y/4)*c.cols + x/2
+	if rapid {
+		c.rapid[cell] |= brailleDots[x%2][y%4]
+	} else {
+		c.cut[cell] |= brailleDots[x%2][y%4]
+	}
+}
+
+// line draws a segment with a dot at least every half a dot along it.
+func (c *brailleCanvas) line(s toolpathSegment) {
+	steps := int(2*math.Max(math.Abs(s.to[0]-s.from[0]), math.Abs(s.to[1]-s.from[1]))/c.scale) + 1
+	for i := 0; i <= steps; i++ {
+		f := float64(i) / float64(steps)
+		c.dot([3]float64{s.from[0] + (s.to[0]-s.from[0])*f, s.from[1] + (s.to[1]-s.from[1])*f}, s.rapid)
+	}
+}
+
+// String draws the canvas.
+func (c *brailleCanvas) String() string {
+	var b strings.Builder
+	for row := 0; row < c.rows; row++ {
+		for col := 0; col < c.cols; col++ {
+			cell := row*c.cols + col
+			switch {
+			case c.cut[cell] != 0:
+				b.WriteRune(0x2800 | c.cut[cell] | c.rapid[cell])
+			case c.rapid[cell] != 0 && c.dim:
+				b.WriteString(paint(colorDim, string(0x2800|c.rapid[cell])))
+			case c.rapid[cell] != 0:
+				b.WriteRune(0x2800 | c.rapid[cell])
+			default:
+				b.WriteRune(' ')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// terminalColumns is the width of the terminal, as the shell reports it, or
+// 80.
+func terminalColumns() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 80
+}
+
+var previewWidth, previewHeight, previewSize int
+var previewRapids bool
+var previewOut, previewColoring string
+
+func previewFlags(fs *flag.FlagSet) {
+	fs.IntVar(&previewWidth, "width", 0, "width of the plot in characters, by default that of the terminal")
+	fs.IntVar(&previewHeight, "height", 40, "height of the plot in characters at most")
+	fs.BoolVar(&previewRapids, "rapids", false, "also draw the rapids, dimmed on a terminal")
+	fs.StringVar(&previewOut, "out", "", "write the plot to this .svg or .png file instead of the terminal")
+	fs.StringVar(&previewColoring, "color", colorByDepth, "what colors the moves in the -out file: depth or feed")
+	fs.IntVar(&previewSize, "size", 1000, "length of the longer side of the -out file in pixels")
+}
+
+func runPreview(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("preview")
+	previewFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) != 1 {
+		fs.PrintDefaults()
+		zap.L().Error("preview needs the gcode file to draw", zap.Strings("args", positional))
+		return errors.New("preview needs the gcode file to draw")
+	}
+	if previewWidth <= 0 {
+		previewWidth = terminalColumns()
+	}
+	format := strings.ToLower(filepath.Ext(previewOut))
+	if previewOut != "" && format != ".svg" && format != ".png" {
+		fs.PrintDefaults()
+		return fmt.Errorf("cannot write %s, the preview is written as .svg or .png", previewOut)
+	}
+	if previewColoring != colorByDepth && previewColoring != colorByFeed {
+		fs.PrintDefaults()
+		return fmt.Errorf("unknown -color %q, use depth or feed", previewColoring)
+	}
+	if previewWidth < 2 || previewHeight < 2 || previewSize < 16 {
+		fs.PrintDefaults()
+		return errors.New("the plot must be at least 2 by 2 characters, or 16 pixels")
+	}
+	input, err := openInput(positional[0])
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	trace := &toolpathTrace{rapids: previewRapids}
+	s := newSimulator(nil, nil, 0)
+	s.measureOnly = true
+	s.trace = func(from, to [3]float64, rapid bool) { trace.add(from, to, rapid, s.feed) }
+	if err := s.run(input); err != nil {
+		zap.L().Error("failed to read job", zap.String("file", input.name), zap.Error(err))
+		return err
+	}
+	if !trace.drawn {
+		zap.L().Error("nothing to preview, the job has no moves from a known position", zap.String("file", input.name))
+		return errNothingToPreview
+	}
+	if previewOut != "" {
+		return writePreview(previewOut, format, trace, previewColoring, previewSize)
+	}
+	canvas := newBrailleCanvas(trace.low, trace.high, previewWidth, previewHeight)
+	canvas.dim = isTerminal(os.Stdout)
+	for _, segment := range trace.segments {
+		canvas.line(segment)
+	}
+	fmt.Print(canvas)
+	fmt.Printf("%s: X %s to %s, Y %s to %s mm, %s mm per dot, top-down\n", input.name, formatMM(trace.low[0]), formatMM(trace.high[0]),
+		formatMM(trace.low[1]), formatMM(trace.high[1]), formatMM(canvas.scale))
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// probeConfig describes a corner probe block like the BitZero. The block
+// sits on the front left corner of the stock and has a hole to find X and Y
+// from. Lengths are in millimetres.
+type probeConfig struct {
+	// Thickness is how far the top of the block is above the stock.
+	Thickness float64 `yaml:"thickness"`
+	// HoleX and HoleY are the centre of the hole relative to the corner
+	// of the stock.
+	HoleX float64 `yaml:"hole_x"`
+	HoleY float64 `yaml:"hole_y"`
+	// PadX and PadY are where to probe the top of the block relative to
+	// the centre of the hole.
+	PadX float64 `yaml:"pad_x"`
+	PadY float64 `yaml:"pad_y"`
+	// Lift is how far to raise the tool after probing, and out of the
+	// hole before moving to the pad.
+	Lift float64 `yaml:"lift"`
+	// Travel is the longest distance to probe before giving up.
+	Travel float64 `yaml:"travel"`
+	// Feed is the probing speed in mm/min.
+	Feed float64 `yaml:"feed"`
+}
+
+var defaultProbe = probeConfig{
+	Thickness: 12.7,
+	HoleX:     -15.875,
+	HoleY:     -15.875,
+	PadX:      12,
+	PadY:      12,
+	Lift:      10,
+	Travel:    25,
+	Feed:      80,
+}
+
+// probeBackoff is how far the tool moves away from a wall before probing
+// the opposite one.
+const probeBackoff = 1.0
+
+// merge fills the settings that p leaves unset from base.
+func (p probeConfig) merge(base probeConfig) probeConfig {
+	for _, f := range []struct{ value, base *float64 }{
+		{&p.Thickness, &base.Thickness},
+		{&p.HoleX, &base.HoleX},
+		{&p.HoleY, &base.HoleY},
+		{&p.PadX, &base.PadX},
+		{&p.PadY, &base.PadY},
+		{&p.Lift, &base.Lift},
+		{&p.Travel, &base.Travel},
+		{&p.Feed, &base.Feed},
+	} {
+		if *f.value == 0 {
+			*f.value = *f.base
+		}
+	}
+	return p
+}
+
+// configuredProbe returns the probe from the config file, preferring the
+// one of the -machine.
+func configuredProbe() (probeConfig, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return probeConfig{}, err
+	}
+	p := cfg.Probe.merge(defaultProbe)
+	if machineName != "" {
+		m, err := cfg.machine(machineName)
+		if err != nil {
+			zap.L().Error("Could not find machine in config", zap.String("machine", machineName), zap.String("config", configPath))
+			return probeConfig{}, err
+		}
+		if m.Probe != nil {
+			p = m.Probe.merge(p)
+		}
+	}
+	return p, nil
+}
+
+// prober runs a probing cycle on GRBL and sets a work offset from it.
+type prober struct {
+	c   controller
+	cfg probeConfig
+	// wcs is the G10 P number of the work coordinate system to set
+	wcs int
+}
+
+func formatMM(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+func (p *prober) run(lines ...string) error {
+	for _, line := range lines {
+		if _, err := p.c.Gcode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// probe moves along axis by up to distance until the probe touches, and
+// returns the machine position of the contact.
+func (p *prober) probe(axis string, distance float64) ([3]float64, error) {
+	var position [3]float64
+	response, err := p.c.Gcode("G38.2 " + axis + formatMM(distance) + " F" + formatMM(p.cfg.Feed))
+	if err != nil {
+		zap.L().Error("probing failed", zap.String("axis", axis), zap.Error(err))
+		return position, err
+	}
+	for _, line := range strings.Split(response, "\n") {
+		position, touched, ok := parseProbeResult(line)
+		if !ok {
+			continue
+		}
+		if !touched {
+			zap.L().Error("probe did not touch", zap.String("axis", axis), zap.Float64("travel", distance))
+			return position, fmt.Errorf("probe did not touch within %s mm along %s", formatMM(distance), axis)
+		}
+		zap.L().Debug("probe touched", zap.String("axis", axis), zap.Float64s("position", position[:]))
+		return position, nil
+	}
+	zap.L().Error("no probe result from grbl", zap.String("response", response))
+	return position, errors.New("no probe result from grbl")
+}
+
+// parseProbeResult parses GRBL's probe report, [PRB:x,y,z:success].
+func parseProbeResult(line string) (position [3]float64, touched bool, ok bool) {
+	if !strings.HasPrefix(line, "[PRB:") || !strings.HasSuffix(line, "]") {
+		return position, false, false
+	}
+	fields := strings.Split(line[len("[PRB:"):len(line)-1], ":")
+	if len(fields) != 2 {
+		return position, false, false
+	}
+	coordinates := strings.Split(fields[0], ",")
+	if len(coordinates) < len(position) {
+		return position, false, false
+	}
+	for i := range position {
+		var err error
+		if position[i], err = strconv.ParseFloat(coordinates[i], 64); err != nil {
+			return position, false, false
+		}
+	}
+	return position, fields[1] == "1", true
+}
+
+// z probes down onto the top of the block and sets Z so the stock surface
+// is zero.
+func (p *prober) z() error {
+	if _, err := p.probe("Z", -p.cfg.Travel); err != nil {
+		return err
+	}
+	return p.run(
+		fmt.Sprintf("G10 L20 P%d Z%s", p.wcs, formatMM(p.cfg.Thickness)),
+		"G0 Z"+formatMM(p.cfg.Lift),
+	)
+}
+
+// centre probes both walls of the hole along axis and moves to the middle.
+func (p *prober) centre(axis string, index int) error {
+	low, err := p.probe(axis, -p.cfg.Travel)
+	if err != nil {
+		return err
+	}
+	if err := p.run("G0 " + axis + formatMM(probeBackoff)); err != nil {
+		return err
+	}
+	high, err := p.probe(axis, p.cfg.Travel)
+	if err != nil {
+		return err
+	}
+	zap.L().Info("found hole", zap.String("axis", axis), zap.Float64("width", high[index]-low[index]))
+	return p.run("G0 " + axis + formatMM((low[index]-high[index])/2))
+}
+
+// xy finds the centre of the hole, with the tool lowered into it, and sets
+// X and Y so the corner of the stock is zero.
+func (p *prober) xy() error {
+	if err := p.centre("X", 0); err != nil {
+		return err
+	}
+	if err := p.centre("Y", 1); err != nil {
+		return err
+	}
+	return p.run(fmt.Sprintf("G10 L20 P%d X%s Y%s", p.wcs, formatMM(p.cfg.HoleX), formatMM(p.cfg.HoleY)))
+}
+
+// corner finds X and Y from the hole, then moves out of it onto the pad and
+// finds Z.
+func (p *prober) corner() error {
+	if err := p.xy(); err != nil {
+		return err
+	}
+	if err := p.run("G0 Z"+formatMM(p.cfg.Lift), "G0 X"+formatMM(p.cfg.PadX)+" Y"+formatMM(p.cfg.PadY)); err != nil {
+		return err
+	}
+	return p.z()
+}
+
+// probeOverrides are the probe block settings given as flags, which
+// override those of the config file.
+var probeOverrides probeConfig
+var probeWCS string
+
+func probeFlags(fs *flag.FlagSet) {
+	controlFlags(fs, time.Minute)
+	fs.StringVar(&probeWCS, "wcs", "", "work coordinate system to set, G54 to G59 (default the one in use)")
+	fs.Float64Var(&probeOverrides.Thickness, "thickness", 0, "height of the probe block above the stock in mm (default from the config file)")
+	fs.Float64Var(&probeOverrides.Travel, "travel", 0, "longest distance to probe in mm (default from the config file)")
+	fs.Float64Var(&probeOverrides.Feed, "feed", 0, "probing speed in mm/min (default from the config file)")
+}
+
+func runProbe(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("probe")
+	probeFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	cycles := map[string]func(*prober) error{"z": (*prober).z, "xy": (*prober).xy, "corner": (*prober).corner}
+	var cycle func(*prober) error
+	if len(positional) == 1 {
+		cycle = cycles[strings.ToLower(positional[0])]
+	}
+	if cycle == nil {
+		fs.PrintDefaults()
+		zap.L().Error("probe needs one of z, xy or corner", zap.Strings("args", positional))
+		return errors.New("probe needs one of z, xy or corner")
+	}
+	number := 0
+	if probeWCS != "" {
+		var ok bool
+		if number, ok = wcsNumbers[strings.ToUpper(probeWCS)]; !ok {
+			fs.PrintDefaults()
+			zap.L().Error("invalid work coordinate system, use G54 to G59", zap.String("wcs", probeWCS))
+			return fmt.Errorf("invalid work coordinate system %q", probeWCS)
+		}
+	}
+	cfg, err := configuredProbe()
+	if err != nil {
+		return err
+	}
+	c, err := openController()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer c.Close()
+	// Probing needs GRBL's G38.2 and its [PRB:] reports
+	if _, ok := c.(*serialSender); !ok {
+		zap.L().Error("probing needs the serial backend", zap.String("backend", backend))
+		return fmt.Errorf("probing is %w by the %s backend", errUnsupported, backend)
+	}
+	state, err := c.State()
+	if err != nil {
+		return err
+	}
+	if !state.Ready() {
+		zap.L().Error("machine must be at rest to probe", zap.Stringer("state", state))
+		return fmt.Errorf("%w: cannot probe while %s", errUnexpectedState, state)
+	}
+	p := &prober{c: c, cfg: probeOverrides.merge(cfg), wcs: number}
+	// Every move of the cycle is relative to where the tool starts
+	if err := p.run("G21 G91"); err != nil {
+		return err
+	}
+	err = cycle(p)
+	if restoreErr := p.run("G90"); restoreErr != nil && err == nil {
+		err = restoreErr
+	}
+	if err != nil {
+		return err
+	}
+	zap.L().Info("probed work offset", zap.String("cycle", positional[0]), zap.String("target", c.Target()))
+	fmt.Printf("probed %s and set the work offset on %s\n", strings.ToLower(positional[0]), c.Target())
+	return nil
+}
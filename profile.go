@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"go.uber.org/zap"
+)
+
+var profileName string
+
+// machineProfile describes what a machine can do and how jobs for it are
+// prepared. Lengths are in millimetres.
+type machineProfile struct {
+	// Base is a profile whose settings are used where this one leaves
+	// them unset.
+	Base   string        `yaml:"base"`
+	Travel machineTravel `yaml:"travel"`
+	// MaxFeed is the fastest feed rate in mm/min.
+	MaxFeed float64 `yaml:"max_feed"`
+	MaxRPM  float64 `yaml:"max_rpm"`
+	// Preamble and Footer are gcode lines sent before and after every
+	// job.
+	Preamble []string `yaml:"preamble"`
+	Footer   []string `yaml:"footer"`
+	// Preprocessors rewrite the job before it is sent, in order.
+	Preprocessors []string `yaml:"preprocessors"`
+	// SpindleDwell is how long to wait after starting the spindle, in
+	// seconds, and PauseBelow how deep a plunge may go under the work zero
+	// before the job pauses for it, in mm. 0 inserts neither.
+	SpindleDwell float64 `yaml:"spindle_dwell"`
+	PauseBelow   float64 `yaml:"pause_below"`
+	// Clamp lowers feeds and spindle speeds above MaxFeed and MaxRPM to
+	// them instead of only warning. Profiles based on one that clamps
+	// clamp too.
+	Clamp bool `yaml:"clamp"`
+	// AllowStates are the machine states that permit sending, used unless
+	// -allow-state is given.
+	AllowStates []string `yaml:"allow_states"`
+}
+
+type machineTravel struct {
+	X float64 `yaml:"x"`
+	Y float64 `yaml:"y"`
+	Z float64 `yaml:"z"`
+}
+
+// builtinProfiles are the nominal work areas and limits of stock Carbide 3D
+// machines.
+var builtinProfiles = map[string]machineProfile{
+	"shapeoko3":     {Travel: machineTravel{425, 425, 75}, MaxFeed: 5000, MaxRPM: 30000},
+	"shapeoko3-xl":  {Travel: machineTravel{838, 425, 75}, MaxFeed: 5000, MaxRPM: 30000},
+	"shapeoko3-xxl": {Travel: machineTravel{838, 838, 75}, MaxFeed: 5000, MaxRPM: 30000},
+	"nomad3":        {Travel: machineTravel{203, 203, 76}, MaxFeed: 2000, MaxRPM: 10000},
+}
+
+// preprocessors make the rewrites a profile can apply to every line of a
+// job, anew for every job since some follow the state of the machine. The
+// rewrites return false to drop the line.
+var preprocessors = map[string]func() func(line string) (string, bool){
+	// strip-comments removes comments, and lines that were only comments
+	"strip-comments": func() func(string) (string, bool) {
+		return func(line string) (string, bool) {
+			if !strings.ContainsAny(line, "(;") {
+				return line, true
+			}
+			line = cleanGcodeLine(line)
+			return line, line != ""
+		}
+	},
+	"strip-blank": func() func(string) (string, bool) {
+		return func(line string) (string, bool) {
+			return line, strings.TrimSpace(line) != ""
+		}
+	},
+	"optimize-moves": func() func(string) (string, bool) {
+		return newMoveOptimizer().filter
+	},
+}
+
+func preprocessorNames() string {
+	names := make([]string, 0, len(preprocessors))
+	for name := range preprocessors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// merge fills the settings that p leaves unset from base.
+func (p machineProfile) merge(base machineProfile) machineProfile {
+	if p.Travel == (machineTravel{}) {
+		p.Travel = base.Travel
+	}
+	if p.MaxFeed == 0 {
+		p.MaxFeed = base.MaxFeed
+	}
+	if p.MaxRPM == 0 {
+		p.MaxRPM = base.MaxRPM
+	}
+	if p.Preamble == nil {
+		p.Preamble = base.Preamble
+	}
+	if p.Footer == nil {
+		p.Footer = base.Footer
+	}
+	if p.Preprocessors == nil {
+		p.Preprocessors = base.Preprocessors
+	}
+	if p.SpindleDwell == 0 {
+		p.SpindleDwell = base.SpindleDwell
+	}
+	if p.PauseBelow == 0 {
+		p.PauseBelow = base.PauseBelow
+	}
+	p.Clamp = p.Clamp || base.Clamp
+	if p.AllowStates == nil {
+		p.AllowStates = base.AllowStates
+	}
+	return p
+}
+
+// lookupProfile finds a profile in the config file or among the built-in
+// ones, following its bases.
+func lookupProfile(cfg *config, name string) (machineProfile, error) {
+	var profile machineProfile
+	seen := map[string]bool{}
+	seenBuiltin := map[string]bool{}
+	for name != "" {
+		p, ok := cfg.Profiles[name]
+		// A profile in the config may be based on the built-in one of the
+		// same name
+		if !ok || seen[name] {
+			if p, ok = builtinProfiles[name]; !ok || seenBuiltin[name] {
+				if seen[name] {
+					return machineProfile{}, fmt.Errorf("profile %q is its own base", name)
+				}
+				return machineProfile{}, fmt.Errorf("unknown profile %q", name)
+			}
+			seenBuiltin[name] = true
+		}
+		seen[name] = true
+		profile = profile.merge(p)
+		name = p.Base
+	}
+	for _, name := range profile.Preprocessors {
+		if preprocessors[name] == nil {
+			return machineProfile{}, fmt.Errorf("unknown preprocessor %q, use %s", name, preprocessorNames())
+		}
+	}
+	return profile, nil
+}
+
+// activeProfile returns the -profile, or the profile of the -machine. ok
+// is false when neither is set.
+func activeProfile() (profile machineProfile, ok bool, err error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return machineProfile{}, false, err
+	}
+	name := profileName
+	if name == "" && machineName != "" {
+		if m, err := cfg.machine(machineName); err == nil {
+			name = m.Profile
+		}
+	}
+	if name == "" {
+		return machineProfile{}, false, nil
+	}
+	if profile, err = lookupProfile(cfg, name); err != nil {
+		zap.L().Error("invalid profile", zap.String("profile", name), zap.String("config", configPath), zap.Error(err))
+		return machineProfile{}, false, err
+	}
+	zap.L().Debug("using profile", zap.String("profile", name))
+	return profile, true, nil
+}
+
+// profileStates makes the states of the active profile those that permit
+// sending, for commands whose -allow-state was left at its default.
+func profileStates(fs *flag.FlagSet) error {
+	if flagGiven(fs, "allow-state") {
+		return nil
+	}
+	profile, ok, err := activeProfile()
+	if err != nil || !ok || len(profile.AllowStates) == 0 {
+		return err
+	}
+	allowedStates = strings.Join(profile.AllowStates, ",")
+	zap.L().Debug("sending in the profile's states", zap.String("allowed", allowedStates))
+	return nil
+}
+
+// applyProfile runs the preprocessors of the profile over the job, clamps
+// its speeds, inserts its dwells and pauses and adds its preamble and
+// footer.
+func applyProfile(input *jobInput, profile machineProfile) {
+	if len(profile.Preprocessors) > 0 || profile.Clamp {
+		var filters []func(string) (string, bool)
+		for _, name := range profile.Preprocessors {
+			filters = append(filters, preprocessors[name]())
+		}
+		if profile.Clamp {
+			filters = append(filters, newSpeedClamp(profile).filter)
+		}
+		input.ReadCloser = &lineFilter{r: bufio.NewReader(input.ReadCloser), Closer: input.ReadCloser, filters: filters}
+		// The size is only known once the job has been rewritten
+		input.size = -1
+		input.path = ""
+	}
+	applyPauses(input, profile)
+	if len(profile.Preamble) == 0 && len(profile.Footer) == 0 {
+		return
+	}
+	preamble := gcodeLines(profile.Preamble)
+	footer := gcodeLines(profile.Footer)
+	input.ReadCloser = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(preamble), &endLine{r: input.ReadCloser}, bytes.NewReader(footer)), input.ReadCloser}
+	// The job may need a newline before the footer
+	input.size = -1
+	input.path = ""
+}
+
+func gcodeLines(lines []string) []byte {
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// endLine makes sure a job ends with a newline, so a footer does not run
+// into its last line.
+type endLine struct {
+	r     io.Reader
+	ended bool
+	eof   bool
+}
+
+func (e *endLine) Read(p []byte) (int, error) {
+	if e.eof {
+		if e.ended || len(p) == 0 {
+			return 0, io.EOF
+		}
+		p[0] = '\n'
+		e.ended = true
+		return 1, nil
+	}
+	n, err := e.r.Read(p)
+	if n > 0 {
+		e.ended = p[n-1] == '\n'
+	}
+	if err == io.EOF {
+		e.eof = true
+		err = nil
+	}
+	return n, err
+}
+
+// lineFilter rewrites a job line by line.
+type lineFilter struct {
+	r *bufio.Reader
+	io.Closer
+	filters []func(string) (string, bool)
+	pending []byte
+	err     error
+}
+
+func (f *lineFilter) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		var line string
+		line, f.err = f.r.ReadString('\n')
+		if line == "" {
+			continue
+		}
+		text := strings.TrimRight(line, "\r\n")
+		keep := true
+		for _, filter := range f.filters {
+			if text, keep = filter(text); !keep {
+				break
+			}
+		}
+		if keep {
+			f.pending = append(f.pending, text...)
+			f.pending = append(f.pending, '\n')
+		}
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+var profileOut, profileImportName string
+var profileForce bool
+
+func profilesFlags(fs *flag.FlagSet) {
+	fs.StringVar(&profileOut, "out", "", "with export, the file to write the profile to, stdout by default")
+	fs.StringVar(&profileImportName, "name", "", "with import, the name to give the profile, the one it was exported with by default")
+	fs.BoolVar(&profileForce, "force", false, "with import, replace a profile of the same name")
+	fs.StringVar(&profileName, "profile", "", "with export, the profile to export, the one of the -machine by default")
+}
+
+func runProfiles(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("profiles")
+	profilesFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) > 0 {
+		switch positional[0] {
+		case "export":
+			return runProfileExport(positional, profileOut)
+		case "import":
+			return runProfileImport(positional, profileImportName, profileForce)
+		}
+		fs.PrintDefaults()
+		zap.L().Error("unknown profiles command, use export or import", zap.String("command", positional[0]))
+		return fmt.Errorf("unknown profiles command %q", positional[0])
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	names := map[string]string{}
+	for name := range builtinProfiles {
+		names[name] = "built-in"
+	}
+	for name := range cfg.Profiles {
+		names[name] = "config"
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tTRAVEL (MM)\tMAX FEED\tMAX RPM\tSOURCE")
+	for _, name := range sorted {
+		p, err := lookupProfile(cfg, name)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%v\t\t\t%s\n", name, err, names[name])
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%g x %g x %g\t%g\t%g\t%s\n", name, p.Travel.X, p.Travel.Y, p.Travel.Z, p.MaxFeed, p.MaxRPM, names[name])
+	}
+	return w.Flush()
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// profileFileVersion is the version of the files profiles export writes.
+// Import refuses newer ones, whose settings it may not understand.
+const profileFileVersion = 1
+
+// profileFile is a profile to share between config files, say to give the
+// laptops of a shop the same settings for its machines. The profile is
+// written with its bases merged in, so it doesn't depend on profiles of the
+// config it came from, and with the warm-up and probe macros of the machine
+// it was exported for.
+type profileFile struct {
+	Version int            `yaml:"send_carbide_profile"`
+	Name    string         `yaml:"name"`
+	Profile machineProfile `yaml:"profile"`
+	Warmup  *warmupConfig  `yaml:"warmup,omitempty"`
+	Probe   *probeConfig   `yaml:"probe,omitempty"`
+}
+
+// runProfileExport writes the profile given by name, or of the -machine,
+// to -out or stdout.
+func runProfileExport(positional []string, out string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var name string
+	switch {
+	case len(positional) > 1:
+		name = positional[1]
+	case profileName != "":
+		name = profileName
+	case machineName != "":
+		m, err := cfg.machine(machineName)
+		if err != nil {
+			zap.L().Error("Could not find machine in config", zap.String("machine", machineName), zap.String("config", configPath))
+			return err
+		}
+		if name = m.Profile; name == "" {
+			zap.L().Error("machine has no profile", zap.String("machine", machineName))
+			return fmt.Errorf("machine %q has no profile", machineName)
+		}
+	default:
+		zap.L().Error("profiles export needs a profile name, -profile or -machine")
+		return errors.New("no profile to export")
+	}
+	profile, err := lookupProfile(cfg, name)
+	if err != nil {
+		zap.L().Error("invalid profile", zap.String("profile", name), zap.String("config", configPath), zap.Error(err))
+		return err
+	}
+	profile.Base = ""
+	file := profileFile{Version: profileFileVersion, Name: name, Profile: profile}
+	m := cfg.Machines[machineName]
+	if m.Warmup != nil || cfg.Warmup != (warmupConfig{}) {
+		w, err := configuredWarmup()
+		if err != nil {
+			return err
+		}
+		file.Warmup = &w
+	}
+	if m.Probe != nil || cfg.Probe != (probeConfig{}) {
+		p, err := configuredProbe()
+		if err != nil {
+			return err
+		}
+		file.Probe = &p
+	}
+	var node yaml.Node
+	if err := node.Encode(file); err != nil {
+		return err
+	}
+	omitZero(&node)
+	node.HeadComment = "send-carbide profile, import it with: send-carbide profiles import <file>"
+	data, err := encodeYAML(&node)
+	if err != nil {
+		return err
+	}
+	if out == "" || out == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(out, data, 0o644); err != nil {
+		zap.L().Error("failed to write profile", zap.String("path", out), zap.Error(err))
+		return err
+	}
+	zap.L().Info("exported profile", zap.String("profile", name), zap.String("path", out))
+	return nil
+}
+
+// runProfileImport adds the profile of a file to the config file, under
+// its own name or -name, and with -machine makes it and its macros the
+// machine's.
+func runProfileImport(positional []string, name string, force bool) error {
+	if len(positional) != 2 {
+		zap.L().Error("profiles import needs the file to import", zap.Strings("args", positional[1:]))
+		return errors.New("profiles import needs one file")
+	}
+	path := positional[1]
+	file, err := readProfileFile(path)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = file.Name
+	}
+	if name == "" {
+		zap.L().Error("profile file has no name, pass -name", zap.String("path", path))
+		return errors.New("profile has no name")
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		zap.L().Error("failed to read config file", zap.String("path", configPath), zap.Error(err))
+		return err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return printProblems(os.Stderr, []configProblem{yamlProblem("", err)})
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	top := root.Content[0]
+	profiles := mappingValue(top, "profiles", true)
+	if mappingValue(profiles, name, false) != nil && !force {
+		zap.L().Error("profile exists in the config file, pass -force to replace it", zap.String("profile", name), zap.String("config", configPath))
+		return fmt.Errorf("profile %q exists", name)
+	}
+	var profile yaml.Node
+	if err := profile.Encode(file.Profile); err != nil {
+		return err
+	}
+	omitZero(&profile)
+	setMappingValue(profiles, name, &profile)
+	if machineName != "" {
+		machine := mappingValue(mappingValue(top, "machines", false), machineName, false)
+		if machine == nil {
+			zap.L().Error("Could not find machine in config", zap.String("machine", machineName), zap.String("config", configPath))
+			return fmt.Errorf("unknown machine %q", machineName)
+		}
+		setMappingValue(machine, "profile", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name})
+		for key, macro := range map[string]interface{}{"warmup": file.Warmup, "probe": file.Probe} {
+			if reflect.ValueOf(macro).IsNil() {
+				continue
+			}
+			var node yaml.Node
+			if err := node.Encode(macro); err != nil {
+				return err
+			}
+			setMappingValue(machine, key, &node)
+		}
+	} else if file.Warmup != nil || file.Probe != nil {
+		zap.L().Info("not importing the warm-up and probe of the profile, pass -machine to give them a machine", zap.String("path", path))
+	}
+	data, err = encodeYAML(&root)
+	if err != nil {
+		return err
+	}
+	// The profile is checked as part of the config it goes into, where its
+	// settings meet those of the machine
+	if _, problems := checkConfig(data, false); len(problems) > 0 {
+		for i := range problems {
+			problems[i].file, problems[i].line, problems[i].column = path, 0, 0
+		}
+		return printProblems(os.Stderr, problems)
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0o755); err != nil {
+		return err
+	}
+	tmp := configPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		zap.L().Error("failed to write config file", zap.String("path", configPath), zap.Error(err))
+		return err
+	}
+	if err := os.Rename(tmp, configPath); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("imported profile %s into %s", name, configPath)
+	if machineName != "" {
+		message += " for machine " + machineName
+	}
+	fmt.Println(message)
+	return nil
+}
+
+// readProfileFile reads and checks a file profiles export wrote.
+func readProfileFile(path string) (*profileFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		zap.L().Error("failed to read profile", zap.String("path", path), zap.Error(err))
+		return nil, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, printProblems(os.Stderr, []configProblem{yamlProblem(path, err)})
+	}
+	if len(root.Content) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	c := &configChecker{file: path, nodes: map[string]*yaml.Node{}}
+	c.check(root.Content[0], reflect.TypeOf(profileFile{}), "")
+	if len(c.problems) > 0 {
+		return nil, printProblems(os.Stderr, c.problems)
+	}
+	var file profileFile
+	if err := root.Decode(&file); err != nil {
+		return nil, err
+	}
+	switch {
+	case file.Version == 0:
+		zap.L().Error("not a profile file, export one with profiles export", zap.String("path", path))
+		return nil, fmt.Errorf("%s is not a profile file", path)
+	case file.Version > profileFileVersion:
+		zap.L().Error("profile file is from a newer send-carbide, update to import it", zap.String("path", path), zap.Int("version", file.Version))
+		return nil, fmt.Errorf("%s is version %d of the profile file", path, file.Version)
+	}
+	return &file, nil
+}
+
+// mappingValue returns the value of key in a mapping, adding an empty
+// mapping for it when add is set. It returns nil for a missing key, or when
+// n is nil.
+func mappingValue(n *yaml.Node, key string, add bool) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			if value := n.Content[i+1]; value.Kind == yaml.MappingNode || !add {
+				return value
+			}
+			n.Content[i+1] = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			return n.Content[i+1]
+		}
+	}
+	if !add {
+		return nil
+	}
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setMappingValue(n, key, value)
+	return value
+}
+
+// setMappingValue sets key in a mapping, keeping its place and comments
+// when it is there.
+func setMappingValue(n *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content[i+1] = value
+			return
+		}
+	}
+	n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// omitZero removes the settings left at their zero value from an encoded
+// mapping, which are unset in a profile.
+func omitZero(n *yaml.Node) {
+	var content []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		value := n.Content[i+1]
+		switch value.Kind {
+		case yaml.MappingNode:
+			omitZero(value)
+			if len(value.Content) == 0 {
+				continue
+			}
+		case yaml.SequenceNode:
+			if len(value.Content) == 0 {
+				continue
+			}
+		case yaml.ScalarNode:
+			switch value.Value {
+			case "", "0", "false", "null":
+				continue
+			}
+		}
+		content = append(content, n.Content[i], value)
+	}
+	n.Content = content
+}
+
+// encodeYAML writes a node with the two space indent of the config file.
+func encodeYAML(n *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	e := yaml.NewEncoder(&buf)
+	e.SetIndent(2)
+	if err := e.Encode(n); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// framing is the protocol config of the config file, Carbide Motion's
+// framing when it has none.
+var framing carbide.Framing
+
+// protocolConfig changes the framing of the protocol for forks of Carbide
+// Motion and compatible receivers.
+type protocolConfig struct {
+	// Terminator is the single character that ends messages and files
+	Terminator   string `yaml:"terminator"`
+	HeaderKey    string `yaml:"header_key"`
+	Ack          string `yaml:"ack"`
+	HeaderFormat string `yaml:"header_format"`
+	StatePrefix  string `yaml:"state_prefix"`
+}
+
+// headerFormat, ackToken and statePrefix override the protocol config for
+// one command, to try a modified Carbide Motion build.
+var headerFormat, ackToken, statePrefix string
+
+// withFlags returns the protocol config with the -header-format,
+// -ack-token and -state-prefix that were given.
+func (p protocolConfig) withFlags() protocolConfig {
+	if headerFormat != "" {
+		p.HeaderFormat = headerFormat
+	}
+	if ackToken != "" {
+		p.Ack = ackToken
+	}
+	if statePrefix != "" {
+		p.StatePrefix = statePrefix
+	}
+	return p
+}
+
+func (p protocolConfig) framing() (carbide.Framing, error) {
+	f := carbide.Framing{HeaderKey: p.HeaderKey, Ack: p.Ack, HeaderFormat: p.HeaderFormat, StateKey: strings.TrimSuffix(p.StatePrefix, ":")}
+	switch len(p.Terminator) {
+	case 0:
+	case 1:
+		f.Terminator = p.Terminator[0]
+	default:
+		return f, fmt.Errorf("protocol terminator must be a single character, not %q", p.Terminator)
+	}
+	if strings.ContainsAny(p.HeaderKey+p.Ack+f.StateKey, string(f.End())+" ") {
+		return f, fmt.Errorf("protocol header_key, ack and state_prefix must not contain spaces or the terminator")
+	}
+	if strings.Contains(f.StateKey, ":") {
+		return f, fmt.Errorf("protocol state_prefix must not contain a colon but at its end, not %q", p.StatePrefix)
+	}
+	if p.HeaderFormat != "" {
+		if !strings.Contains(p.HeaderFormat, "{size}") {
+			return f, fmt.Errorf("protocol header_format must have {size}, the receiver can't tell where the file ends without it")
+		}
+		if strings.IndexByte(p.HeaderFormat, f.End()) >= 0 {
+			return f, fmt.Errorf("protocol header_format must not contain the terminator")
+		}
+	}
+	return f, nil
+}
+
+// readBufferSize is the size of the buffer for reading from the machine.
+var readBufferSize = byteSize(16 << 10)
+
+// maxMessageSize is the longest message from the machine that is kept,
+// longer ones are truncated.
+var maxMessageSize = byteSize(carbide.DefaultMaxMessageSize)
+
+// writeBufferSize is the size of the buffer in front of the connection.
+// Large jobs go out in far fewer writes than with bufio's 4 KiB default.
+var writeBufferSize = byteSize(256 << 10)
+
+// minBufferSize is the smallest buffer bufio accepts.
+const minBufferSize = 16
+
+// framed ends a request, written with a newline, with the configured
+// terminator.
+func framed(request string) []byte {
+	return append([]byte(strings.TrimSuffix(request, "\n")), framing.End())
+}
+
+func newConnReader(conn io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(conn, int(readBufferSize))
+}
+
+// protocolRetries is how many empty messages are skipped. Messages cut in
+// pieces are read to their terminator within the read deadline.
+var protocolRetries int
+
+// strictProtocol refuses messages that Carbide Motion itself wouldn't send
+// instead of making the best of them.
+var strictProtocol bool
+
+// messageReader reads messages with the -max-message and -protocol-retries
+// settings, logging to the CLI's logger.
+func messageReader() *carbide.MessageReader {
+	return &carbide.MessageReader{
+		MaxSize:    int(maxMessageSize),
+		Retries:    protocolRetries,
+		Terminator: framing.Terminator,
+		Strict:     strictProtocol,
+		Logger:     carbide.ZapLogger(zap.L()),
+	}
+}
+
+func readMessage(r *bufio.Reader) (string, error) {
+	return messageReader().Read(r)
+}
+
+func getState(r *bufio.Reader) (carbide.State, error) {
+	statusLine, err := readMessage(r)
+	if err != nil {
+		return carbide.StateUnknown, err
+	}
+	return parseState(statusLine)
+}
+
+// parseState parses a "STATE: <state>" message. An error or alarm from the
+// controller in its place is returned as a carbide.MachineError.
+func parseState(statusLine string) (carbide.State, error) {
+	parse := framing.ParseState
+	if strictProtocol {
+		parse = framing.ParseStateStrict
+	}
+	state, err := parse(statusLine)
+	var merr *carbide.MachineError
+	switch {
+	case errors.As(err, &merr):
+		zap.L().Error("machine reported a failure", zap.String("cause", merr.Cause()), zap.String("suggestion", merr.Suggestion()))
+	case err != nil:
+		zap.L().Error("invalid status message", zap.String("message", statusLine))
+	case !strictProtocol:
+		if _, strictErr := framing.ParseStateStrict(statusLine); strictErr != nil {
+			zap.L().Debug("accepted a non-standard status message", zap.String("message", statusLine), zap.Stringer("state", state))
+		}
+	}
+	return state, err
+}
+
+// overridesKey starts the messages receivers push when an override level
+// changes, "OVERRIDES: <feed> <rapid> <spindle>".
+const overridesKey = "OVERRIDES:"
+
+// parseOverridesMessage parses an overrides message. ok is false for any
+// other message.
+func parseOverridesMessage(msg string) (levels overrides, ok bool, err error) {
+	fields := strings.Fields(msg)
+	if len(fields) == 0 || strings.ToUpper(fields[0]) != overridesKey {
+		return overrides{}, false, nil
+	}
+	levels, err = parseOverrideLevels(strings.Join(fields[1:], " "))
+	if err != nil {
+		zap.L().Error("invalid overrides message", zap.String("message", msg))
+		return overrides{}, true, &carbide.ProtocolError{Reason: "invalid overrides message", Message: msg}
+	}
+	return levels, true, nil
+}
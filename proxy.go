@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var proxyAddress string
+
+var errProxy = errors.New("proxy refused connection")
+
+// defaultProxy returns the proxy from the ALL_PROXY environment variable.
+func defaultProxy() string {
+	if proxy := os.Getenv("ALL_PROXY"); proxy != "" {
+		return proxy
+	}
+	return os.Getenv("all_proxy")
+}
+
+// bypassProxy reports whether host matches an entry in NO_PROXY.
+func bypassProxy(host string) bool {
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "*" || host == entry || strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialProxy connects to address through the configured proxy. Supported
+// schemes are socks5 (local DNS), socks5h (proxy side DNS) and http
+// (CONNECT).
+func dialProxy(address string) (net.Conn, error) {
+	u, err := url.Parse(proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", proxyAddress, err)
+	}
+	d, err := netDialer(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, u, address)
+	case "http":
+		conn, err = httpConnect(conn, u, address)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func socks5Connect(conn net.Conn, proxy *url.URL, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+	// Negotiate authentication
+	methods := []byte{0x00}
+	if proxy.User != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	switch choice[1] {
+	case 0x00:
+	case 0x02:
+		if proxy.User == nil {
+			return fmt.Errorf("%w: credentials required", errProxy)
+		}
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return err
+		}
+		if status[1] != 0x00 {
+			return fmt.Errorf("%w: authentication failed", errProxy)
+		}
+	default:
+		return fmt.Errorf("%w: no acceptable authentication method", errProxy)
+	}
+	// Request the connection
+	request := []byte{0x05, 0x01, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		addr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return err
+		}
+		ip = addr.IP
+	}
+	switch {
+	case ip == nil:
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	case ip.To4() != nil:
+		request = append(request, 0x01)
+		request = append(request, ip.To4()...)
+	default:
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("%w: socks5 reply code %d", errProxy, reply[1])
+	}
+	// Skip the bound address
+	var skip int
+	switch reply[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// bufferedConn is a connection whose first bytes were already read into a
+// buffer while parsing a proxy response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func httpConnect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return conn, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("%w: %s", errProxy, resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"go.uber.org/zap"
+)
+
+// queueActions are the queue subcommands that change a job, and the
+// method and path under /jobs/<id> of each.
+var queueActions = map[string]struct {
+	method string
+	path   string
+}{
+	"cancel":  {http.MethodDelete, ""},
+	"hold":    {http.MethodPost, "/hold"},
+	"release": {http.MethodPost, "/release"},
+	"move":    {http.MethodPost, "/priority"},
+}
+
+// runQueue lists and manages the jobs of a running daemon:
+//
+//	queue list
+//	queue inspect <id>
+//	queue cancel|hold|release <id>
+//	queue move <id> top|bottom|<priority>
+var queueDaemonURL string
+var queueJSON bool
+
+func queueFlags(fs *flag.FlagSet) {
+	fs.StringVar(&queueDaemonURL, "url", "http://127.0.0.1:6281", "URL of the daemon's HTTP API")
+	fs.StringVar(&apiToken, "token", defaultToken(), "token for a daemon that requires one, defaults to SEND_CARBIDE_TOKEN; pass a user and password in the URL for basic auth")
+	fs.BoolVar(&queueJSON, "json", false, "print the jobs as JSON")
+}
+
+func runQueue(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("queue")
+	queueFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) == 0 {
+		positional = []string{"list"}
+	}
+	endpoint := strings.TrimSuffix(queueDaemonURL, "/") + "/jobs"
+	action, positional := positional[0], positional[1:]
+	want := 1
+	switch action {
+	case "list":
+		want = 0
+	case "move":
+		want = 2
+	}
+	if _, ok := queueActions[action]; !ok && action != "list" && action != "inspect" {
+		fs.PrintDefaults()
+		zap.L().Error("unknown queue command, use list, inspect, cancel, hold, release or move", zap.String("command", action))
+		return fmt.Errorf("unknown queue command %q", action)
+	}
+	if len(positional) != want {
+		fs.PrintDefaults()
+		zap.L().Error("wrong arguments, e.g. queue cancel <id> or queue move <id> top", zap.String("command", action), zap.Strings("args", positional))
+		return fmt.Errorf("queue %s needs %d arguments", action, want)
+	}
+	if action == "list" {
+		var jobs []job
+		if err := queueRequest(http.MethodGet, endpoint, &jobs); err != nil {
+			return err
+		}
+		if machineName != "" {
+			kept := jobs[:0]
+			for _, j := range jobs {
+				if j.Machine == machineName {
+					kept = append(kept, j)
+				}
+			}
+			jobs = kept
+		}
+		if queueJSON {
+			return json.NewEncoder(os.Stdout).Encode(jobs)
+		}
+		return printJobs(jobs)
+	}
+	endpoint += "/" + url.PathEscape(positional[0])
+	method := http.MethodGet
+	if a, ok := queueActions[action]; ok {
+		method = a.method
+		endpoint += a.path
+	}
+	if action == "move" {
+		endpoint += "?" + url.Values{"priority": {positional[1]}}.Encode()
+	}
+	var j job
+	if err := queueRequest(method, endpoint, &j); err != nil {
+		return err
+	}
+	if queueJSON {
+		return json.NewEncoder(os.Stdout).Encode(j)
+	}
+	return printJobs([]job{j})
+}
+
+// queueRequest calls the daemon API and decodes its answer into v.
+func queueRequest(method, endpoint string, v interface{}) error {
+	req, err := newAPIRequest(method, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := inputClient.Do(req)
+	if err != nil {
+		zap.L().Error("failed to reach the daemon", zap.String("url", endpoint), zap.Error(err))
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		zap.L().Error("daemon refused the request", zap.String("status", resp.Status), zap.String("error", apiErr.Error))
+		return errors.New(apiErr.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func printJobs(jobs []job) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMACHINE\tNAME\tSTATUS\tPRIORITY\tSUBMITTED\tDETAIL")
+	for _, j := range jobs {
+		var detail []string
+		if j.Held {
+			detail = append(detail, "held")
+		}
+		if j.NotBefore != nil && j.Status == jobQueued {
+			detail = append(detail, "after "+j.NotBefore.Local().Format("2006-01-02 15:04"))
+		}
+		if j.ExpiresAt != nil && j.Status == jobQueued {
+			detail = append(detail, "expires "+j.ExpiresAt.Local().Format("2006-01-02 15:04"))
+		}
+		if len(j.Findings) > 0 && j.Status == jobQueued {
+			detail = append(detail, fmt.Sprintf("%d preflight problems", len(j.Findings)))
+		}
+		if j.Error != "" {
+			detail = append(detail, j.Error)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", j.ID, j.Machine, j.Name, j.Status, j.Priority,
+			j.Submitted.Local().Format("2006-01-02 15:04"), strings.Join(detail, ", "))
+	}
+	return w.Flush()
+}
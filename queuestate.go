@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// interruptedReason is the error of a job whose send the daemon gave up on
+// when it shut down.
+const interruptedReason = "interrupted by the daemon shutting down, release it to send it again"
+
+// savedQueuePath is where the daemon saves the jobs still queued when it shuts
+// down, next to their files in the spool.
+func savedQueuePath(spool string) string {
+	return filepath.Join(spool, "queue.json")
+}
+
+// save writes the queued jobs to path, and those still being sent held, as
+// the machine discards a job whose transfer was cut off and it must not
+// start again unattended. It returns how many jobs it saved.
+func (q *jobQueue) save(path string) (int, error) {
+	q.mu.Lock()
+	var jobs []job
+	for _, j := range q.order {
+		switch j.Status {
+		case jobSending:
+			interrupted := *j
+			interrupted.Status, interrupted.Started, interrupted.Held, interrupted.Error = jobQueued, nil, true, interruptedReason
+			jobs = append(jobs, interrupted)
+		case jobQueued:
+			jobs = append(jobs, *j)
+		}
+	}
+	q.mu.Unlock()
+	if len(jobs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, nil
+	}
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return 0, err
+	}
+	return len(jobs), os.Rename(tmp, path)
+}
+
+// restoreQueue queues the jobs a previous daemon saved in the spool, and
+// removes the file so they are never restored twice. Jobs whose file is
+// gone from the spool are dropped.
+func (d *daemon) restoreQueue() error {
+	path := savedQueuePath(d.spool)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var jobs []*job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		zap.L().Error("failed to read saved queue", zap.String("path", path), zap.Error(err))
+		return err
+	}
+	restored := 0
+	for _, j := range jobs {
+		j.path = filepath.Join(d.spool, j.ID+".nc")
+		if _, ok := d.cfg.Machines[j.Machine]; !ok {
+			zap.L().Warn("dropping saved job of a machine no longer in the config", zap.String("job", j.ID), zap.String("machine", j.Machine))
+			continue
+		}
+		if _, err := os.Stat(j.path); err != nil {
+			zap.L().Warn("dropping saved job whose file is gone from the spool", zap.String("job", j.ID), zap.String("path", j.path))
+			continue
+		}
+		d.queue.add(j)
+		restored++
+		if j.Error == interruptedReason {
+			zap.L().Warn("restored interrupted job held", zap.String("job", j.ID), zap.String("machine", j.Machine), zap.String("name", j.Name))
+		}
+	}
+	zap.L().Info("restored queue", zap.String("path", path), zap.Int("jobs", restored))
+	return os.Remove(path)
+}
+
+// saveQueue saves the queue for the next daemon, logging what it saved.
+func (d *daemon) saveQueue() {
+	path := savedQueuePath(d.spool)
+	saved, err := d.queue.save(path)
+	if err != nil {
+		zap.L().Error("failed to save queue, its jobs are lost", zap.String("path", path), zap.Error(err))
+		return
+	}
+	if saved > 0 {
+		zap.L().Info("saved queue for the next start", zap.String("path", path), zap.Int("jobs", saved))
+	}
+}
+
+// waitWorkers waits for the job being sent to each machine to finish, up
+// to the shutdown timeout, and reports whether they all did.
+func (d *daemon) waitWorkers() bool {
+	done := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if d.shutdownTimeout > 0 {
+		timer := time.NewTimer(d.shutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-done:
+		return true
+	case <-timeout:
+		zap.L().Warn("in-flight jobs didn't finish in time, saving them held", zap.Duration("timeout", d.shutdownTimeout))
+		return false
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rateLimitClients is how many clients the limiter tracks. A new client
+// beyond them makes it forget the one seen least recently.
+const rateLimitClients = 1024
+
+// requestLimiter caps the requests of each client using a token bucket per
+// client address, refilled at rate requests per second up to burst.
+type requestLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*list.Element
+	// seen has the buckets of the clients, the one seen most recently
+	// first
+	seen *list.List
+}
+
+type requestBucket struct {
+	client string
+	tokens float64
+	last   time.Time
+}
+
+// newRequestLimiter allows each client perMinute requests a minute, all of
+// them at once if it was idle. It returns nil for no limit.
+func newRequestLimiter(perMinute int) *requestLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &requestLimiter{rate: float64(perMinute) / 60, burst: float64(perMinute), clients: make(map[string]*list.Element), seen: list.New()}
+}
+
+// allow takes a request from the client's bucket, or returns how long until
+// it may make the next one.
+func (l *requestLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var b *requestBucket
+	if e, ok := l.clients[client]; ok {
+		l.seen.MoveToFront(e)
+		b = e.Value.(*requestBucket)
+	} else {
+		if l.seen.Len() >= rateLimitClients {
+			oldest := l.seen.Remove(l.seen.Back()).(*requestBucket)
+			delete(l.clients, oldest.client)
+		}
+		b = &requestBucket{client: client, tokens: l.burst, last: now}
+		l.clients[client] = l.seen.PushFront(b)
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limit answers 429 Too Many Requests to clients over the limit.
+func (l *requestLimiter) limit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientAddress(r)
+		ok, retry := l.allow(client)
+		if !ok {
+			zap.L().Warn("rate limited request", zap.String("remote", client), zap.String("method", r.Method), zap.String("path", r.URL.Path))
+			seconds := int(math.Ceil(retry.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeError(w, http.StatusTooManyRequests, "too many requests, retry in %ds", seconds)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRequestLimiterForgetsLeastRecentClient(t *testing.T) {
+	l := newRequestLimiter(2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("busy"); !ok {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	if ok, retry := l.allow("busy"); ok || retry <= 0 {
+		t.Fatalf("request over the burst allowed %v, retry in %v", ok, retry)
+	}
+	// Clients seen since busy push it out once there are too many
+	for i := 0; i < rateLimitClients; i++ {
+		l.allow("client-" + strconv.Itoa(i))
+		if i < rateLimitClients-1 {
+			if _, ok := l.clients["busy"]; !ok {
+				t.Fatalf("busy forgotten after %d other clients", i+1)
+			}
+		}
+	}
+	if len(l.clients) != rateLimitClients || l.seen.Len() != rateLimitClients {
+		t.Errorf("limiter tracks %d clients in %d buckets, want %d", len(l.clients), l.seen.Len(), rateLimitClients)
+	}
+	if _, ok := l.clients["busy"]; ok {
+		t.Error("busy still tracked after more than rateLimitClients newer clients")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// rawSend sends files byte for byte, as CAM wrote them, with nothing but
+// the protocol header added.
+var rawSend bool
+
+var errRawSend = errors.New("-raw sends the file as it is")
+
+// rawConflicts are the flags of send that change the job or how it is
+// read, so they can't be combined with -raw.
+var rawConflicts = []string{"clipboard", "join", "split-tools", "encoding", "allow-binary", "member", "start-line", "start-at",
+	"spindle-dwell", "pause-below", "reorder", "optimize", "queue", "manifest"}
+
+// checkRaw refuses -raw with the flags and backends that would change the
+// file on its way to the machine.
+func checkRaw(fs *flag.FlagSet) error {
+	if backend != "carbide" && backend != "file" {
+		zap.L().Error("-raw needs a backend that takes the file as a whole", zap.String("backend", backend))
+		return fmt.Errorf("%w: the %s backend sends gcode line by line", errRawSend, backend)
+	}
+	var given []string
+	for _, name := range rawConflicts {
+		if flagGiven(fs, name) {
+			given = append(given, "-"+name)
+		}
+	}
+	if len(given) > 0 {
+		zap.L().Error("-raw can't be combined with flags that change the file", zap.Strings("flags", given))
+		return fmt.Errorf("%w, it can't be combined with %s", errRawSend, strings.Join(given, ", "))
+	}
+	return nil
+}
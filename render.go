@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// The ways the moves of a rendered preview can be colored
+const (
+	colorByDepth = "depth"
+	colorByFeed  = "feed"
+)
+
+const (
+	// previewMargin is the blank border around a rendered preview, and
+	// previewLegend the band under it that holds the color scale, in pixels
+	previewMargin = 10
+	previewLegend = 30
+	// previewLevels is how many shades the color scale is cut into, so that
+	// runs of moves of about the same color can be drawn as one
+	previewLevels = 32
+)
+
+// previewRamp is the color scale from the deepest or slowest moves to the
+// shallowest or fastest, dark to light.
+var previewRamp = []color.RGBA{{68, 1, 84, 255}, {33, 145, 140, 255}, {253, 231, 37, 255}}
+
+var previewRapidColor = color.RGBA{153, 153, 153, 255}
+
+// previewPlot maps a toolpath onto the pixels of a rendered preview.
+type previewPlot struct {
+	trace         *toolpathTrace
+	coloring      string
+	width, height int
+	// scale is the pixels per mm
+	scale float64
+	// low and high are the range of depth or feed the colors span
+	low, high float64
+}
+
+func newPreviewPlot(trace *toolpathTrace, coloring string, size int) *previewPlot {
+	width := math.Max(trace.high[0]-trace.low[0], 1e-3)
+	height := math.Max(trace.high[1]-trace.low[1], 1e-3)
+	p := &previewPlot{trace: trace, coloring: coloring}
+	p.scale = float64(size-2*previewMargin) / math.Max(width, height)
+	p.width = int(math.Ceil(width*p.scale)) + 2*previewMargin
+	p.height = int(math.Ceil(height*p.scale)) + 2*previewMargin + previewLegend
+	first := true
+	for _, segment := range trace.segments {
+		if segment.rapid {
+			continue
+		}
+		v := p.value(segment)
+		if first || v < p.low {
+			p.low = v
+		}
+		if first || v > p.high {
+			p.high = v
+		}
+		first = false
+	}
+	return p
+}
+
+// value is what colors a move: the depth it reaches or its feed.
+func (p *previewPlot) value(segment toolpathSegment) float64 {
+	if p.coloring == colorByFeed {
+		return segment.feed
+	}
+	return math.Min(segment.from[2], segment.to[2])
+}
+
+// level is the shade of a feed move, from 0 for the deepest or slowest to
+// previewLevels-1.
+func (p *previewPlot) level(segment toolpathSegment) int {
+	if p.high-p.low < 1e-9 {
+		return previewLevels - 1
+	}
+	return int(math.Round((p.value(segment) - p.low) / (p.high - p.low) * (previewLevels - 1)))
+}
+
+func (p *previewPlot) point(q [3]float64) (float64, float64) {
+	return previewMargin + (q[0]-p.trace.low[0])*p.scale, previewMargin + (p.trace.high[1]-q[1])*p.scale
+}
+
+// shade is the color of a level of the scale.
+func shade(level int) color.RGBA {
+	f := float64(level) / (previewLevels - 1) * float64(len(previewRamp)-1)
+	i := int(f)
+	if i >= len(previewRamp)-1 {
+		return previewRamp[len(previewRamp)-1]
+	}
+	a, b, f := previewRamp[i], previewRamp[i+1], f-float64(i)
+	mix := func(x, y uint8) uint8 { return uint8(math.Round(float64(x) + (float64(y)-float64(x))*f)) }
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// scaleLabel describes one end of the color scale.
+func (p *previewPlot) scaleLabel(v float64) string {
+	if p.coloring == colorByFeed {
+		return fmt.Sprintf("%.0f mm/min", v)
+	}
+	return fmt.Sprintf("Z %s mm", formatMM(v))
+}
+
+// writeSVG draws the toolpath as polylines, one for every run of connected
+// moves of the same shade.
+func (p *previewPlot) writeSVG(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", p.width, p.height, p.width, p.height)
+	fmt.Fprintf(b, "<rect width=\"100%%\" height=\"100%%\" fill=\"white\"/>\n")
+	segments := p.trace.segments
+	for i := 0; i < len(segments); {
+		first := segments[i]
+		x, y := p.point(first.from)
+		fmt.Fprintf(b, "<polyline points=\"%.1f,%.1f", x, y)
+		j := i
+		for ; j < len(segments); j++ {
+			s := segments[j]
+			if j > i && (s.from != segments[j-1].to || s.rapid != first.rapid || (!s.rapid && p.level(s) != p.level(first))) {
+				break
+			}
+			x, y := p.point(s.to)
+			fmt.Fprintf(b, " %.1f,%.1f", x, y)
+		}
+		if first.rapid {
+			fmt.Fprintf(b, "\" fill=\"none\" stroke=\"%s\" stroke-width=\"1\" stroke-dasharray=\"4 3\"/>\n", hexColor(previewRapidColor))
+		} else {
+			fmt.Fprintf(b, "\" fill=\"none\" stroke=\"%s\" stroke-width=\"1.5\" stroke-linecap=\"round\" stroke-linejoin=\"round\"/>\n", hexColor(shade(p.level(first))))
+		}
+		i = j
+	}
+	// The color scale, with what its ends stand for
+	top := p.height - previewLegend + 8
+	fmt.Fprintf(b, "<defs><linearGradient id=\"scale\">")
+	for i := range previewRamp {
+		fmt.Fprintf(b, "<stop offset=\"%d%%\" stop-color=\"%s\"/>", 100*i/(len(previewRamp)-1), hexColor(previewRamp[i]))
+	}
+	fmt.Fprintf(b, "</linearGradient></defs>\n")
+	fmt.Fprintf(b, "<rect x=\"%d\" y=\"%d\" width=\"100\" height=\"10\" fill=\"url(#scale)\"/>\n", previewMargin, top)
+	fmt.Fprintf(b, "<text x=\"%d\" y=\"%d\" font-family=\"sans-serif\" font-size=\"12\">%s to %s</text>\n", previewMargin+110, top+10, p.scaleLabel(p.low), p.scaleLabel(p.high))
+	fmt.Fprintf(b, "</svg>\n")
+	return b.Flush()
+}
+
+// writePNG draws the toolpath two pixels wide, with the color scale but
+// without its labels, which the standard library has no font for.
+func (p *previewPlot) writePNG(w io.Writer) error {
+	img := image.NewRGBA(image.Rect(0, 0, p.width, p.height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	dot := func(x, y float64, c color.RGBA) {
+		px, py := int(x), int(y)
+		draw.Draw(img, image.Rect(px, py, px+2, py+2), &image.Uniform{C: c}, image.Point{}, draw.Src)
+	}
+	for _, s := range p.trace.segments {
+		x0, y0 := p.point(s.from)
+		x1, y1 := p.point(s.to)
+		steps := int(2*math.Max(math.Abs(x1-x0), math.Abs(y1-y0))) + 1
+		c := previewRapidColor
+		if !s.rapid {
+			c = shade(p.level(s))
+		}
+		for i := 0; i <= steps; i++ {
+			f := float64(i) / float64(steps)
+			// Rapids are dashed, 4 pixels on and 3 off
+			if s.rapid && int(f*float64(steps)/2)%7 >= 4 {
+				continue
+			}
+			dot(x0+(x1-x0)*f, y0+(y1-y0)*f, c)
+		}
+	}
+	top := p.height - previewLegend + 8
+	for x := 0; x < 100; x++ {
+		c := shade(int(math.Round(float64(x) / 99 * (previewLevels - 1))))
+		draw.Draw(img, image.Rect(previewMargin+x, top, previewMargin+x+1, top+10), &image.Uniform{C: c}, image.Point{}, draw.Src)
+	}
+	return png.Encode(w, img)
+}
+
+// writePreview renders the toolpath to path, as SVG or PNG by format.
+func writePreview(path, format string, trace *toolpathTrace, coloring string, size int) error {
+	p := newPreviewPlot(trace, coloring, size)
+	f, err := os.Create(path)
+	if err != nil {
+		zap.L().Error("could not create preview", zap.String("file", path), zap.Error(err))
+		return err
+	}
+	if format == ".png" {
+		err = p.writePNG(f)
+	} else {
+		err = p.writeSVG(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		zap.L().Error("could not write preview", zap.String("file", path), zap.Error(err))
+		return err
+	}
+	fmt.Printf("%s: %d by %d pixels, colored by %s from %s (dark) to %s (light)\n", path, p.width, p.height, coloring, p.scaleLabel(p.low), p.scaleLabel(p.high))
+	return nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var reorderRapids bool
+
+// reorderMargin is how close in XY, in mm, two cuts may come before the
+// later one has to stay after the earlier one: a depth pass after the pass
+// above it, or a profile after the pocket inside it. It is wider than the
+// radius of the usual end mills.
+var reorderMargin = 6.35
+
+// cutBlock is a cut that starts with a rapid in XY at the clearance height
+// and ends back there, like a pocket or a profile, and can be moved in the
+// job with that rapid.
+type cutBlock struct {
+	// lines are the block's lines, the rapid at travel and the comments
+	// before it first
+	lines  []string
+	travel int
+	// start and end are the XY positions it starts and ends at
+	start, end [2]float64
+	// low and high are the corners of what it cuts
+	low, high [2]float64
+	// feed is the feed in effect before it, in the job's units, which it
+	// needs when it makes a feed move before setting one
+	feed      string
+	needsFeed bool
+	sawFeed   bool
+	// after are the blocks it has to follow
+	after []int
+}
+
+func (b *cutBlock) extend(p [3]float64) {
+	for i := 0; i < 2; i++ {
+		b.low[i] = math.Min(b.low[i], p[i])
+		b.high[i] = math.Max(b.high[i], p[i])
+	}
+}
+
+func (b *cutBlock) overlaps(o *cutBlock, margin float64) bool {
+	for i := 0; i < 2; i++ {
+		if b.low[i]-margin > o.high[i] || o.low[i]-margin > b.high[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reorderReport is what reordering a job did.
+type reorderReport struct {
+	Blocks int `json:"blocks"`
+	// Moved is how many of them are in another place
+	Moved         int     `json:"moved"`
+	RapidBeforeMM float64 `json:"rapid_before_mm"`
+	RapidAfterMM  float64 `json:"rapid_after_mm"`
+	// SavedSeconds is estimated with the rapids at the profile's fastest
+	// feed
+	SavedSeconds float64 `json:"saved_seconds"`
+}
+
+func (r reorderReport) String() string {
+	if r.Moved == 0 {
+		if r.Blocks == 1 {
+			return "1 cut, nothing to reorder"
+		}
+		return fmt.Sprintf("%d cuts, already in a good order", r.Blocks)
+	}
+	return fmt.Sprintf("moved %d of %d cuts, rapids in XY %s -> %s, about %v less", r.Moved, r.Blocks,
+		formatDistance(r.RapidBeforeMM), formatDistance(r.RapidAfterMM), seconds(r.SavedSeconds).Round(time.Second))
+}
+
+// jobReorderer splits a job into cuts at the clearance height and puts
+// them in the order with the least rapid travel between them, as far as
+// their overlaps allow. Cuts are only moved among those between the same
+// tool change, spindle and mode changes, and at the same clearance height.
+type jobReorderer struct {
+	s   *simulator
+	out []string
+	// run are the cuts that can be reordered among themselves, from from,
+	// at the clearance height
+	run       []*cutBlock
+	from      [2]float64
+	clearance float64
+	current   *cutBlock
+	// comments are the comment lines since the last line of code, which go
+	// with the next one
+	comments []string
+	report   reorderReport
+}
+
+func newJobReorderer() *jobReorderer {
+	r := &jobReorderer{s: newSimulator(nil, nil, 0)}
+	r.s.measureOnly = true
+	r.s.trace = func(from, to [3]float64, rapid bool) {
+		if r.current != nil {
+			r.current.extend(from)
+			r.current.extend(to)
+		}
+	}
+	return r
+}
+
+// reorderable is whether a line only moves the tool, in a way the order of
+// cuts doesn't change, and if so whether it is a rapid in XY.
+func (r *jobReorderer) reorderable(words []gcodeWord) (ok, travel bool) {
+	s := r.s
+	motion, axes, z := s.motion, false, false
+	for _, w := range words {
+		switch w.letter {
+		case 'G':
+			switch w.value {
+			case 0, 1, 2, 3:
+				motion = int(w.value)
+			case 17, 90, 94:
+			default:
+				return false, false
+			}
+		case 'X', 'Y', 'Z':
+			axes = true
+			z = z || w.letter == 'Z'
+		case 'I', 'J', 'K', 'R', 'F':
+		default:
+			return false, false
+		}
+	}
+	if !s.absolute || s.plane != 17 || (axes && s.known != [3]bool{true, true, true}) {
+		return false, false
+	}
+	return true, axes && motion == 0 && !z && s.pos[2] > 0
+}
+
+func (r *jobReorderer) line(line string) {
+	code := strings.TrimSpace(cleanGcodeLine(line))
+	if code == "" || code == "%" {
+		r.comments = append(r.comments, line)
+		r.s.step(line)
+		return
+	}
+	words, err := parseWords(code)
+	ok, travel := false, false
+	if err == nil {
+		ok, travel = r.reorderable(words)
+	}
+	if !ok {
+		r.flush()
+		r.out = append(r.out, line)
+		r.s.step(line)
+		return
+	}
+	if !travel {
+		r.s.step(line)
+		if r.current == nil {
+			r.out = append(append(r.out, r.comments...), line)
+			r.comments = nil
+			return
+		}
+		r.current.lines = append(r.current.lines, r.comments...)
+		r.comments = nil
+		r.current.lines = append(r.current.lines, line)
+		if hasWord(words, 'F') {
+			r.current.sawFeed = true
+		} else if hasAxes(words) && r.s.motion > 0 && !r.current.sawFeed {
+			r.current.needsFeed = true
+		}
+		return
+	}
+	// A rapid in XY at a new height starts a run of its own
+	if r.current != nil && r.s.pos[2] != r.clearance {
+		r.flush()
+	}
+	if r.current == nil && len(r.run) == 0 {
+		r.from = [2]float64{r.s.pos[0], r.s.pos[1]}
+		r.clearance = r.s.pos[2]
+	}
+	r.closeBlock()
+	b := &cutBlock{lines: r.comments, travel: len(r.comments)}
+	r.comments = nil
+	if r.s.feed > 0 {
+		scale := 1.0
+		if !r.s.metric {
+			scale = 25.4
+		}
+		b.feed = strconv.FormatFloat(r.s.feed/scale, 'f', -1, 64)
+	}
+	b.lines = append(b.lines, travelLine(code, words, r.s))
+	r.s.step(line)
+	b.start = [2]float64{r.s.pos[0], r.s.pos[1]}
+	b.low, b.high = b.start, b.start
+	r.current = b
+}
+
+func hasAxes(words []gcodeWord) bool {
+	return hasWord(words, 'X') || hasWord(words, 'Y') || hasWord(words, 'Z')
+}
+
+// travelLine spells out the rapid that starts a cut, which may leave out
+// the G0 and an axis that didn't move from where the cut before it ended.
+func travelLine(code string, words []gcodeWord, s *simulator) string {
+	digits, scale := 3, 1.0
+	if !s.metric {
+		digits, scale = 4, 25.4
+	}
+	if !hasWord(words, 'G') {
+		code = "G0 " + code
+	}
+	for i, axis := range []byte{'X', 'Y'} {
+		if !hasWord(words, axis) {
+			code += " " + string(axis) + strconv.FormatFloat(s.pos[i]/scale, 'f', digits, 64)
+		}
+	}
+	return code
+}
+
+// closeBlock adds the current cut to the run.
+func (r *jobReorderer) closeBlock() {
+	if r.current == nil {
+		return
+	}
+	r.current.end = [2]float64{r.s.pos[0], r.s.pos[1]}
+	r.run = append(r.run, r.current)
+	r.current = nil
+}
+
+// flush puts the cuts of the run in order and writes them out. The last
+// cut stays last, as what follows the run may carry on from where it ends,
+// which need not even be at the clearance height.
+func (r *jobReorderer) flush() {
+	r.closeBlock()
+	run := r.run
+	r.run = nil
+	if len(run) > 0 {
+		order := append(orderCuts(run[:len(run)-1], r.from), len(run)-1)
+		before := rapidDistance(run, r.from, identityOrder(len(run)))
+		after := rapidDistance(run, r.from, order)
+		reordered := after < before
+		if !reordered {
+			order, after = identityOrder(len(run)), before
+		}
+		r.report.Blocks += len(run)
+		r.report.RapidBeforeMM += before
+		r.report.RapidAfterMM += after
+		for i, b := range order {
+			if b != i {
+				r.report.Moved++
+			}
+			block := run[b]
+			lines := block.lines
+			// The feed may have come from the cut that was before it
+			if reordered && block.needsFeed && block.feed != "" {
+				lines = append([]string{}, lines...)
+				lines[block.travel] += " F" + block.feed
+			}
+			r.out = append(r.out, lines...)
+		}
+	}
+	r.out = append(r.out, r.comments...)
+	r.comments = nil
+}
+
+func identityOrder(n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+func rapidDistance(run []*cutBlock, from [2]float64, order []int) float64 {
+	var total float64
+	at := from
+	for _, i := range order {
+		total += math.Hypot(run[i].start[0]-at[0], run[i].start[1]-at[1])
+		at = run[i].end
+	}
+	return total
+}
+
+// orderCuts picks the nearest cut next among those whose overlapping
+// predecessors are done.
+func orderCuts(run []*cutBlock, from [2]float64) []int {
+	for j := range run {
+		run[j].after = run[j].after[:0]
+		for i := 0; i < j; i++ {
+			if run[j].overlaps(run[i], reorderMargin) {
+				run[j].after = append(run[j].after, i)
+			}
+		}
+	}
+	done := make([]bool, len(run))
+	order := make([]int, 0, len(run))
+	at := from
+	for len(order) < len(run) {
+		best, bestDistance := -1, 0.0
+	next:
+		for j, b := range run {
+			if done[j] {
+				continue
+			}
+			for _, i := range b.after {
+				if !done[i] {
+					continue next
+				}
+			}
+			if d := math.Hypot(b.start[0]-at[0], b.start[1]-at[1]); best < 0 || d < bestDistance {
+				best, bestDistance = j, d
+			}
+		}
+		done[best] = true
+		order = append(order, best)
+		at = run[best].end
+	}
+	return order
+}
+
+// reorderJob reorders the cuts of a job, estimating the time saved with
+// the rapids at rapidRate mm/min.
+func reorderJob(r io.Reader, rapidRate float64) ([]string, reorderReport, error) {
+	j := newJobReorderer()
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			j.line(strings.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, reorderReport{}, err
+		}
+	}
+	j.flush()
+	j.report.SavedSeconds = 60 * (j.report.RapidBeforeMM - j.report.RapidAfterMM) / rapidRate
+	return j.out, j.report, nil
+}
+
+// rapidRate is the profile's fastest feed, which rapids are estimated at.
+func rapidRate(profile *machineProfile) float64 {
+	if profile != nil && profile.MaxFeed > 0 {
+		return profile.MaxFeed
+	}
+	return defaultRapidRate
+}
+
+// applyReorder reorders the cuts of the job before it is sent, which needs
+// all of it in memory.
+func applyReorder(input *jobInput, profile *machineProfile) (reorderReport, error) {
+	lines, report, err := reorderJob(input.ReadCloser, rapidRate(profile))
+	if closeErr := input.ReadCloser.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		zap.L().Error("failed to reorder job", zap.String("file", input.name), zap.Error(err))
+		return report, err
+	}
+	job := []byte(strings.Join(lines, "\n") + "\n")
+	input.ReadCloser = ioutil.NopCloser(bytes.NewReader(job))
+	input.size = int64(len(job))
+	input.path = ""
+	zap.L().Info("reordered cuts", zap.String("file", input.name), zap.Stringer("result", report))
+	return report, nil
+}
+
+var reorderOut string
+
+func reorderFlags(fs *flag.FlagSet) {
+	fs.StringVar(&reorderOut, "out", "-", "file to write the reordered job to, - for stdout")
+	fs.Float64Var(&reorderMargin, "margin", reorderMargin, "cuts that come this close in XY, in mm, keep their order")
+	fs.StringVar(&profileName, "profile", "", "machine profile whose fastest feed the time saved is estimated at, by default the -machine's profile from the config file")
+}
+
+func runReorder(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("reorder")
+	reorderFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) != 1 {
+		fs.PrintDefaults()
+		zap.L().Error("reorder needs the gcode file to reorder", zap.Strings("args", positional))
+		return errors.New("reorder needs the gcode file to reorder")
+	}
+	profile, hasProfile, err := activeProfile()
+	if err != nil {
+		return err
+	}
+	var p *machineProfile
+	if hasProfile {
+		p = &profile
+	}
+	input, err := openInput(positional[0])
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	lines, report, err := reorderJob(input, rapidRate(p))
+	if err != nil {
+		zap.L().Error("failed to read job", zap.String("file", input.name), zap.Error(err))
+		return err
+	}
+	w := os.Stdout
+	if reorderOut != "-" {
+		if w, err = os.Create(reorderOut); err != nil {
+			zap.L().Error("could not create output file", zap.String("file", reorderOut), zap.Error(err))
+			return err
+		}
+	}
+	b := bufio.NewWriter(w)
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	err = b.Flush()
+	if w != os.Stdout {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		zap.L().Error("could not write reordered job", zap.String("file", reorderOut), zap.Error(err))
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", input.name, report)
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// reportLogTail is how much of the end of each log file a report takes.
+const reportLogTail = 1 << 20
+
+// reportHistoryEntries is how many of the last history entries a report
+// takes.
+const reportHistoryEntries = 50
+
+// redacted replaces the secrets of the config file in a report.
+const redacted = "REDACTED"
+
+// secretKeys are the keys of the config file whose values are secrets,
+// every value below them.
+var secretKeys = []string{"password", "token", "tokens", "secret", "users", "headers"}
+
+// reportFile is a file of the report archive.
+type reportFile struct {
+	name string
+	data []byte
+}
+
+// runReport gathers what it takes to look into a problem into a zip file
+// to attach to an issue: the version, the platform, the config file with
+// its secrets redacted and what config check says of it, the protocol trace
+// of the last send, the end of the log files and the last sends.
+var reportOutput, reportLogs string
+
+func reportFlags(fs *flag.FlagSet) {
+	fs.StringVar(&reportOutput, "o", "", "file to write the report to (default send-carbide-report-<time>.zip)")
+	fs.StringVar(&reportLogs, "logs", "", "comma separated log files to take the end of, besides the one of -log-file and of forwarding offline jobs")
+}
+
+func runReport(args []string) error {
+	fs := newFlagSet("report")
+	reportFlags(fs)
+	// The report is most needed when the config file is broken
+	checkingConfig = true
+	fs.Parse(args)
+	initLogger()
+	if reportOutput == "" {
+		reportOutput = "send-carbide-report-" + time.Now().Format("20060102-150405") + ".zip"
+	}
+	files := []reportFile{reportVersion(), reportEnvironment()}
+	files = append(files, reportConfig()...)
+	if path := tracePath(); path != "" {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			files = append(files, reportFile{name: "last-trace.txt", data: data})
+		}
+	}
+	paths := splitAddresses(reportLogs)
+	if logFile != "" {
+		paths = append(paths, logFile)
+	}
+	// The log of forwarding offline jobs is taken when there is one
+	given := len(paths)
+	if dir := offlineDir(); dir != "" {
+		paths = append(paths, filepath.Join(dir, "forward.log"))
+	}
+	seen, names := map[string]bool{}, map[string]bool{}
+	for i, path := range paths {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		data, err := tailFile(path, reportLogTail)
+		if err != nil {
+			if !os.IsNotExist(err) || i < given {
+				zap.L().Warn("failed to read log file", zap.String("path", path), zap.Error(err))
+			}
+			continue
+		}
+		// Logs of the same name in different directories are numbered
+		name := "logs/" + filepath.Base(path)
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("logs/%d-%s", i, filepath.Base(path))
+		}
+		names[name] = true
+		files = append(files, reportFile{name: name, data: data})
+	}
+	if history := reportHistory(); history != nil {
+		files = append(files, *history)
+	}
+	if err := writeReport(reportOutput, files); err != nil {
+		zap.L().Error("failed to write report", zap.String("path", reportOutput), zap.Error(err))
+		return err
+	}
+	contents := make([]string, len(files))
+	for i, f := range files {
+		contents[i] = f.name
+	}
+	fmt.Fprintf(resultOutput(), "wrote %s with %s\nlook through it before attaching it to an issue, the secrets of the config file are redacted but addresses and file names are not\n",
+		reportOutput, strings.Join(contents, ", "))
+	return nil
+}
+
+func writeReport(path string, files []reportFile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(f)
+	for _, file := range files {
+		w, err := z.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: time.Now()})
+		if err == nil {
+			_, err = w.Write(file.data)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(path)
+			return err
+		}
+	}
+	if err := z.Close(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+func reportVersion() reportFile {
+	data, _ := json.MarshalIndent(buildVersion(), "", "  ")
+	return reportFile{name: "version.json", data: append(data, '\n')}
+}
+
+// reportEnvironment describes the computer send-carbide runs on, and the
+// environment variables that change what it does.
+func reportEnvironment() reportFile {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "platform: %s/%s, %d cpus\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	if system := operatingSystem(); system != "" {
+		fmt.Fprintf(&b, "system: %s\n", system)
+	}
+	if exe, err := os.Executable(); err == nil {
+		fmt.Fprintf(&b, "executable: %s\n", exe)
+	}
+	fmt.Fprintf(&b, "config: %s\n", configPath)
+	fmt.Fprintf(&b, "time: %s\n", time.Now().Format(time.RFC3339))
+	var env []string
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		switch {
+		case strings.HasPrefix(name, "SEND_CARBIDE_") && (strings.Contains(name, "TOKEN") || strings.Contains(name, "PASSWORD")):
+			env = append(env, name+"="+redacted)
+		case strings.HasPrefix(name, "SEND_CARBIDE_"), strings.HasPrefix(name, "LC_"),
+			name == "LANG", name == "LANGUAGE", name == "TERM", name == "NO_COLOR", name == "JOURNAL_STREAM":
+			env = append(env, variable)
+		case strings.HasSuffix(strings.ToLower(name), "_proxy"):
+			env = append(env, name+"="+redactLocation(strings.SplitN(variable, "=", 2)[1]))
+		}
+	}
+	sort.Strings(env)
+	for _, variable := range env {
+		fmt.Fprintln(&b, variable)
+	}
+	return reportFile{name: "environment.txt", data: b.Bytes()}
+}
+
+// operatingSystem is the name and version of the operating system, or ""
+// when it can't tell.
+func operatingSystem() string {
+	var out []byte
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		data, err := ioutil.ReadFile("/etc/os-release")
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "PRETTY_NAME=") {
+				return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"`)
+			}
+		}
+		return ""
+	case "darwin":
+		out, err = exec.Command("sw_vers", "-productVersion").Output()
+		out = append([]byte("macOS "), out...)
+	case "windows":
+		out, err = exec.Command("cmd", "/C", "ver").Output()
+	default:
+		return ""
+	}
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// reportConfig returns the config file with its secrets redacted, and what
+// config check says of it.
+func reportConfig() []reportFile {
+	if configPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return []reportFile{{name: "config-check.txt", data: []byte(err.Error() + "\n")}}
+	}
+	var check bytes.Buffer
+	cfg, problems := checkConfig(data, true)
+	for _, p := range problems {
+		fmt.Fprintln(&check, p)
+	}
+	if len(problems) == 0 {
+		fmt.Fprintf(&check, "valid: %d machines, %d profiles\n", len(cfg.Machines), len(cfg.Profiles))
+	}
+	files := []reportFile{{name: "config-check.txt", data: check.Bytes()}}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		// A file that doesn't parse can't be redacted, config check says
+		// where it is broken
+		return files
+	}
+	redactNode(&root, false)
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return files
+	}
+	return append(files, reportFile{name: "config.yaml", data: out.Bytes()})
+}
+
+// redactNode replaces the secrets of a config file's node: every value
+// below secretKeys, the passwords of URLs, and the paths of URLs that post
+// somewhere, which are often their secret, like those of webhooks.
+func redactNode(n *yaml.Node, secret bool) {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range n.Content {
+			redactNode(child, secret)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			name := strings.ToLower(key.Value)
+			if name == "url" && value.Kind == yaml.ScalarNode && !secret {
+				value.Value = redactURLPath(value.Value)
+				continue
+			}
+			redactNode(value, secret || containsString(secretKeys, name))
+		}
+	case yaml.ScalarNode:
+		if secret {
+			n.Value, n.Style = redacted, 0
+			return
+		}
+		n.Value = redactLocation(n.Value)
+	}
+}
+
+// redactURLPath keeps the scheme and host of a URL, and hides the rest.
+func redactURLPath(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	if u.Path == "" && u.RawQuery == "" && u.User == nil {
+		return location
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
+
+// reportHistory returns the last entries of the history as JSON lines, nil
+// when there are none.
+func reportHistory() *reportFile {
+	entries, err := readHistory()
+	if err != nil || len(entries) == 0 {
+		return nil
+	}
+	if len(entries) > reportHistoryEntries {
+		entries = entries[len(entries)-reportHistoryEntries:]
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+	return &reportFile{name: "history.jsonl", data: b.Bytes()}
+}
+
+// tailFile returns the last size bytes of a file, from the start of a line.
+func tailFile(path string, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= size {
+		return ioutil.ReadAll(f)
+	}
+	if _, err := f.Seek(info.Size()-size, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[i+1:]
+	}
+	return data, nil
+}
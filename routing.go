@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// jobRoute picks the machine of a job submitted without one, by its name
+// or tags, so submitters needn't know the machines. A route sends to the
+// machine, or to the least busy machine with the profile.
+type jobRoute struct {
+	// Name is a pattern like *_nomad.nc matched against the job's file
+	// name, ignoring case
+	Name string `yaml:"name"`
+	// Tags must all be given with the job
+	Tags    []string `yaml:"tags"`
+	Machine string   `yaml:"machine"`
+	Profile string   `yaml:"profile"`
+}
+
+var errNoRoute = errors.New("no route matches the job")
+
+// String is the route as it is logged, like "*_nomad.nc, tags aluminium".
+func (r jobRoute) String() string {
+	var parts []string
+	if r.Name != "" {
+		parts = append(parts, r.Name)
+	}
+	if len(r.Tags) > 0 {
+		parts = append(parts, "tags "+strings.Join(r.Tags, ","))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches is whether a job called name with tags takes the route.
+func (r jobRoute) matches(name string, tags []string) bool {
+	if r.Name != "" {
+		if ok, _ := path.Match(strings.ToLower(r.Name), strings.ToLower(name)); !ok {
+			return false
+		}
+	}
+	for _, tag := range r.Tags {
+		if !containsString(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// check returns what is wrong with the route in cfg, or nil.
+func (r jobRoute) check(cfg *config) error {
+	if r.Name == "" && len(r.Tags) == 0 {
+		return errors.New("no name or tags to match")
+	}
+	if _, err := path.Match(r.Name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q", r.Name)
+	}
+	switch {
+	case r.Machine != "" && r.Profile != "":
+		return errors.New("both a machine and a profile, route to one of them")
+	case r.Machine != "":
+		if _, ok := cfg.Machines[r.Machine]; !ok {
+			return fmt.Errorf("unknown machine %q", r.Machine)
+		}
+	case r.Profile != "":
+		if len(machinesWithProfile(cfg, r.Profile)) == 0 {
+			return fmt.Errorf("no machine has the profile %q", r.Profile)
+		}
+	default:
+		return errors.New("no machine or profile to route to")
+	}
+	return nil
+}
+
+// machinesWithProfile returns the machines of the profile, in name order.
+func machinesWithProfile(cfg *config, profile string) []string {
+	var machines []string
+	for _, name := range sortedKeys(cfg.Machines) {
+		if strings.EqualFold(cfg.Machines[name].Profile, profile) {
+			machines = append(machines, name)
+		}
+	}
+	return machines
+}
+
+// parseTags returns the tags of a submission, given as tag parameters,
+// several of them or separated by commas.
+func parseTags(query url.Values) []string {
+	var tags []string
+	for _, value := range query["tag"] {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !containsString(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// route returns the machine of the first route a job called name with tags
+// matches. Of the machines of a profile, it is one the submitter may send
+// to with the fewest jobs queued or being sent, the first by name of
+// equally busy ones.
+func (d *daemon) route(name string, tags []string, may func(machine string) bool) (machine string, route jobRoute, err error) {
+	for _, r := range d.cfg.Daemon.Routes {
+		if !r.matches(name, tags) {
+			continue
+		}
+		if r.Machine != "" {
+			return r.Machine, r, nil
+		}
+		var candidates []string
+		for _, m := range machinesWithProfile(d.cfg, r.Profile) {
+			if may(m) {
+				candidates = append(candidates, m)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		load := d.queue.load()
+		sort.SliceStable(candidates, func(i, j int) bool { return load[candidates[i]] < load[candidates[j]] })
+		return candidates[0], r, nil
+	}
+	if len(tags) > 0 {
+		return "", jobRoute{}, fmt.Errorf("%w %s with tags %s, give a machine", errNoRoute, name, strings.Join(tags, ","))
+	}
+	return "", jobRoute{}, fmt.Errorf("%w %s, give a machine", errNoRoute, name)
+}
+
+// load counts the jobs queued or being sent of each machine.
+func (q *jobQueue) load() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	load := make(map[string]int)
+	for _, j := range q.order {
+		if j.Status == jobQueued || j.Status == jobSending {
+			load[j.Machine]++
+		}
+	}
+	return load
+}
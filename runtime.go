@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+var trackRuntime bool
+
+// runStartWait is how long a job may wait in init after it was sent, for
+// someone to press start, before its run is given up on as not observable.
+const runStartWait = 10 * time.Minute
+
+// runtimeSamples is how many of the last runs of a machine its correction
+// of the estimates is averaged over.
+const runtimeSamples = 10
+
+// runtimeCorrection is how much longer than estimated jobs ran on a
+// machine, averaged over its last runs in the history, and how many runs
+// that is. It is 1 for a machine that never ran a tracked job, as the
+// estimate ignores acceleration, tool changes and the operator.
+func runtimeCorrection(machine, address string) (float64, int) {
+	entries, err := readHistory()
+	if err != nil {
+		zap.L().Debug("failed to read history", zap.Error(err))
+		return 1, 0
+	}
+	var sum float64
+	runs := 0
+	for i := len(entries) - 1; i >= 0 && runs < runtimeSamples; i-- {
+		e := entries[i]
+		if e.Kind != historyKindRun || e.EstimatedSeconds <= 0 || e.RuntimeSeconds <= 0 {
+			continue
+		}
+		if (machine != "" && e.Machine != machine) || (machine == "" && e.Address != address) {
+			continue
+		}
+		sum += e.RuntimeSeconds / e.EstimatedSeconds
+		runs++
+	}
+	if runs == 0 {
+		return 1, 0
+	}
+	return sum / float64(runs), runs
+}
+
+// correctedEstimate is how long a job estimated at seconds is expected to
+// run on a machine.
+func correctedEstimate(machine, address string, seconds float64) time.Duration {
+	factor, _ := runtimeCorrection(machine, address)
+	return time.Duration(seconds * factor * float64(time.Second)).Round(time.Second)
+}
+
+// watchRun polls the state of a machine that was just sent a job until it
+// returns to init, and returns how long that took. It returns false when
+// the run couldn't be observed: the machine never left init within
+// runStartWait, ended in alarm or error, or stop was closed.
+func watchRun(dialers []*dialer, interval time.Duration, stop <-chan struct{}) (time.Duration, bool) {
+	sent := time.Now()
+	started := false
+	for {
+		state, err := pooledState(dialers)
+		switch {
+		case err != nil:
+			zap.L().Debug("failed to check the state of the running job", zap.Error(err))
+		case state == carbide.StateAlarm || state == carbide.StateError || state == carbide.StateFault:
+			zap.L().Info("job ended in an alarm, not tracking its runtime", zap.Stringer("state", state))
+			return 0, false
+		case state != carbide.StateInit:
+			started = true
+		case started:
+			return time.Since(sent), true
+		case time.Since(sent) > runStartWait:
+			zap.L().Info("machine didn't start the job, not tracking its runtime", zap.Duration("waited", runStartWait))
+			return 0, false
+		}
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return 0, false
+		}
+	}
+}
+
+// recordRun adds how long a job ran next to its estimate to the history,
+// which the next estimates of the machine are corrected by.
+func recordRun(machine, address, file, job string, estimated float64, runtime time.Duration) {
+	appendHistory(historyEntry{
+		Time:             time.Now(),
+		Kind:             historyKindRun,
+		Machine:          machine,
+		Address:          address,
+		File:             file,
+		Job:              job,
+		Result:           "ok",
+		EstimatedSeconds: estimated,
+		RuntimeSeconds:   runtime.Seconds(),
+	})
+}
+
+// trackRun waits for the job just sent to finish with -track-run, records
+// its runtime and prints it next to the estimate.
+func trackRun(sender Sender, file string, stats *statsReader) error {
+	if !trackRuntime {
+		return nil
+	}
+	c, ok := sender.(*carbideSender)
+	if !ok {
+		zap.L().Warn("-track-run needs the carbide backend, not tracking the runtime", zap.String("backend", backend))
+		return nil
+	}
+	estimated := stats.estimate()
+	expected := correctedEstimate(machineName, sender.Target(), estimated)
+	zap.L().Info("waiting for the job to finish", zap.String("file", file), zap.Duration("estimated", expected))
+	runtime, ok := watchRun(c.dialers, pollInterval, nil)
+	if !ok {
+		return nil
+	}
+	recordRun(machineName, sender.Target(), file, "", estimated, runtime)
+	runtime = runtime.Round(time.Second)
+	if sendJSON {
+		zap.L().Info("job finished running", zap.String("file", file), zap.Duration("runtime", runtime), zap.Duration("estimated", expected))
+		return nil
+	}
+	message := fmt.Sprintf("%s ran for %v", filepath.Base(file), runtime)
+	if expected > 0 {
+		message += fmt.Sprintf(", estimated %v (%+.0f%%)", expected, 100*(runtime.Seconds()/expected.Seconds()-1))
+	}
+	fmt.Fprintln(resultOutput(), message)
+	return nil
+}
+
+// trackRun records how long a job the daemon sent ran, next to its
+// estimate, in the job and the history.
+func (d *daemon) trackRun(j *job, m machineConfig, estimated float64) {
+	defer d.workers.Done()
+	dialers, err := dialersFor(m.addresses())
+	if err != nil {
+		return
+	}
+	runtime, ok := watchRun(dialers, pollInterval, d.stop)
+	if !ok {
+		return
+	}
+	seconds := math.Round(runtime.Seconds())
+	d.queue.update(j, func(j *job) {
+		j.RuntimeSeconds = seconds
+	})
+	zap.L().Info("job finished running", zap.String("job", j.ID), zap.String("machine", j.Machine), zap.Duration("runtime", runtime.Round(time.Second)))
+	recordRun(j.Machine, m.Address, j.Name, j.ID, estimated, runtime)
+}
+
+// estimate is the toolpath's estimate of how long a job runs on the
+// machine, with rapids at the fastest feed of its profile. The job is
+// given the estimate corrected by the machine's past runs. A job the
+// preflight didn't get to yet is checked now, one it is checking is waited
+// for.
+func (d *daemon) estimate(j *job) float64 {
+	done, start := d.queue.check(j)
+	if start {
+		d.preflightJob(j)
+	}
+	<-done
+	checked, _ := d.queue.get(j.ID)
+	return checked.estimated
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const s3Prefix = "s3://"
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+var errNoAWSCredentials = errors.New("no AWS credentials found")
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsProfile is the profile used for the shared credentials and config
+// files.
+func awsProfile() string {
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+	return "default"
+}
+
+func awsFilePath(env, name string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+// readINISection returns the keys of one section of an AWS style ini file.
+func readINISection(path, section string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var values map[string]string
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[1:len(line)-1]), "profile "))
+			continue
+		}
+		if current != section {
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 {
+			if values == nil {
+				values = map[string]string{}
+			}
+			values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return values
+}
+
+// loadAWSCredentials follows the standard chain: environment variables,
+// the shared credentials file, then the EC2 instance metadata service.
+func loadAWSCredentials() (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if values := readINISection(awsFilePath("AWS_SHARED_CREDENTIALS_FILE", "credentials"), awsProfile()); values["aws_access_key_id"] != "" {
+		return awsCredentials{
+			AccessKeyID:     values["aws_access_key_id"],
+			SecretAccessKey: values["aws_secret_access_key"],
+			SessionToken:    values["aws_session_token"],
+		}, nil
+	}
+	if os.Getenv("AWS_EC2_METADATA_DISABLED") != "true" {
+		if creds, err := instanceCredentials(); err == nil {
+			return creds, nil
+		}
+	}
+	return awsCredentials{}, errNoAWSCredentials
+}
+
+const imdsAddress = "http://169.254.169.254"
+
+// instanceCredentials fetches the role credentials of an EC2 instance using
+// IMDSv2.
+func instanceCredentials() (awsCredentials, error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	req, _ := http.NewRequest(http.MethodPut, imdsAddress+"/latest/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	get := func(p string) ([]byte, error) {
+		req, _ := http.NewRequest(http.MethodGet, imdsAddress+p, nil)
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("instance metadata %s: %s", p, resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+	role, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	data, err := get("/latest/meta-data/iam/security-credentials/" + strings.TrimSpace(string(role)))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var creds struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return awsCredentials{}, err
+	}
+	return awsCredentials{AccessKeyID: creds.AccessKeyID, SecretAccessKey: creds.SecretAccessKey, SessionToken: creds.Token}, nil
+}
+
+func awsRegion() string {
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); region != "" {
+			return region
+		}
+	}
+	if region := readINISection(awsFilePath("AWS_CONFIG_FILE", "config"), awsProfile())["region"]; region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// s3ObjectURL returns the URL of an object. AWS_ENDPOINT_URL_S3 or
+// AWS_ENDPOINT_URL select an S3 compatible server such as MinIO, which is
+// addressed path style.
+func s3ObjectURL(bucket, key, region string) string {
+	escaped := "/" + awsURIEncode(key)
+	for _, env := range []string{"AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"} {
+		if endpoint := os.Getenv(env); endpoint != "" {
+			return strings.TrimSuffix(endpoint, "/") + "/" + bucket + escaped
+		}
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", bucket, region, escaped)
+}
+
+// awsURIEncode escapes everything but unreserved characters and slashes, as
+// signature version 4 expects of object keys.
+func awsURIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req,
+// signing the host and every header already set on it.
+func signV4(req *http.Request, creds awsCredentials, region, service, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// openS3 streams an object from s3://bucket/key.
+func openS3(source string) (*jobInput, error) {
+	location := strings.TrimPrefix(source, s3Prefix)
+	i := strings.Index(location, "/")
+	if i <= 0 || i == len(location)-1 {
+		return nil, fmt.Errorf("invalid S3 location %q, expected s3://bucket/key", source)
+	}
+	bucket, key := location[:i], location[i+1:]
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		zap.L().Error("Could not find AWS credentials, set AWS_ACCESS_KEY_ID or AWS_PROFILE", zap.String("source", source))
+		return nil, err
+	}
+	region := awsRegion()
+	req, err := http.NewRequest(http.MethodGet, s3ObjectURL(bucket, key, region), nil)
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, creds, region, "s3", unsignedPayload, time.Now())
+	return openHTTP(req, source, path.Base(key))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseStartTime parses when a queued job may start: a time like
+// "2026-10-15T07:00:00+02:00" or "2026-10-15 07:00", a time of day like
+// "7am", "7:30 pm" or "19:00", which is the next one to come, or a delay
+// like "2h". A leading "after" or "in" is allowed, as in "after 7 am".
+func parseStartTime(text string, now time.Time) (time.Time, error) {
+	value := strings.ToLower(strings.TrimSpace(text))
+	value = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(value, "after "), "in "))
+	if t, err := time.Parse(time.RFC3339, strings.ToUpper(value)); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", value, now.Location()); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(d), nil
+	}
+	if hour, minute, ok := parseTimeOfDay(value); ok {
+		t := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid start time %q, use a time like 7am or 19:30, a date and time like 2026-10-15 07:00, or a delay like 2h", text)
+}
+
+// parseTimeOfDay parses "7", "7am", "7:30pm" or "19:30".
+func parseTimeOfDay(value string) (hour, minute int, ok bool) {
+	value = strings.Replace(value, " ", "", -1)
+	meridiem := ""
+	for _, suffix := range []string{"am", "pm"} {
+		if strings.HasSuffix(value, suffix) {
+			meridiem = suffix
+			value = strings.TrimSuffix(value, suffix)
+		}
+	}
+	parts := strings.SplitN(value, ":", 2)
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	if len(parts) == 2 {
+		if minute, err = strconv.Atoi(parts[1]); err != nil || len(parts[1]) != 2 || minute > 59 {
+			return 0, 0, false
+		}
+	}
+	switch {
+	case meridiem == "" && hour <= 23:
+	case meridiem != "" && hour >= 1 && hour <= 12:
+		hour %= 12
+		if meridiem == "pm" {
+			hour += 12
+		}
+	default:
+		return 0, 0, false
+	}
+	return hour, minute, true
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const releaseRepository = "bobcob7/send-carbide"
+const checksumsAsset = "checksums.txt"
+
+// releasePublicKey is the base64 ed25519 key release checksums are signed
+// with. Release builds set it with -ldflags "-X main.releasePublicKey=...",
+// and refuse updates without a valid checksums.txt.sig. Builds without it
+// refuse to update at all unless -insecure is passed.
+var releasePublicKey = ""
+
+var errUpdateVerification = errors.New("update verification failed")
+
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+func (r *release) asset(name string) (releaseAsset, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return releaseAsset{}, false
+}
+
+// releaseAssetName is the binary asset for this platform, for example
+// send-carbide_linux_amd64 or send-carbide_windows_amd64.exe.
+func releaseAssetName() string {
+	name := fmt.Sprintf("send-carbide_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchRelease looks up the latest release or the one with the given tag.
+// GITHUB_API_URL points it at a GitHub Enterprise server or a mirror.
+func fetchRelease(repository, tag string) (*release, error) {
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	url := fmt.Sprintf("%s/repos/%s/releases/latest", strings.TrimSuffix(api, "/"), repository)
+	if tag != "" {
+		url = fmt.Sprintf("%s/repos/%s/releases/tags/%s", strings.TrimSuffix(api, "/"), repository, tag)
+	}
+	data, err := httpGet(url)
+	if err != nil {
+		return nil, err
+	}
+	r := &release{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseChecksums reads sha256sum output into a map of file name to hash.
+func parseChecksums(data []byte) map[string]string {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+		}
+	}
+	return sums
+}
+
+// verifyChecksums checks the signature of the checksum file against the
+// release key of this build. Without a key it fails, unless insecure says
+// to trust the checksum file as it is.
+func verifyChecksums(r *release, checksums []byte, insecure bool) error {
+	if releasePublicKey == "" {
+		if !insecure {
+			return fmt.Errorf("%w: this build has no release key to check %s with, pass -insecure to trust it unsigned", errUpdateVerification, checksumsAsset)
+		}
+		zap.L().Warn("this build has no release key, trusting the checksums unsigned", zap.String("release", r.TagName))
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(releasePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: invalid release public key", errUpdateVerification)
+	}
+	asset, ok := r.asset(checksumsAsset + ".sig")
+	if !ok {
+		return fmt.Errorf("%w: release %s has no %s.sig", errUpdateVerification, r.TagName, checksumsAsset)
+	}
+	data, err := httpGet(asset.URL)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		signature = data
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), checksums, signature) {
+		return fmt.Errorf("%w: bad signature on %s", errUpdateVerification, checksumsAsset)
+	}
+	return nil
+}
+
+// compareVersions compares two vMAJOR.MINOR.PATCH versions, ignoring any
+// pre-release or build suffix.
+func compareVersions(a, b string) int {
+	parse := func(v string) [3]int {
+		var parts [3]int
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		for i, part := range strings.SplitN(v, ".", 3) {
+			parts[i], _ = strconv.Atoi(part)
+		}
+		return parts
+	}
+	pa, pb := parse(a), parse(b)
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// replaceExecutable swaps the running binary for the new one. The old one
+// is moved aside first because Windows cannot overwrite a running program.
+func replaceExecutable(exe string, binary []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), ".send-carbide-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return err
+	}
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		os.Rename(old, exe)
+		return err
+	}
+	// Fails on Windows while the old binary is still running, it is
+	// removed by the next update instead
+	os.Remove(old)
+	return nil
+}
+
+var updateCheckOnly bool
+var updateForce bool
+var updateTag string
+var updateRepository string
+var updateInsecure bool
+
+func selfUpdateFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&updateCheckOnly, "check", false, "only report whether an update is available")
+	fs.BoolVar(&updateForce, "force", false, "install the release even if it is not newer")
+	fs.StringVar(&updateTag, "version", "", "install this release tag instead of the latest")
+	fs.StringVar(&updateRepository, "repo", releaseRepository, "GitHub repository to take releases from")
+	fs.BoolVar(&updateInsecure, "insecure", false, "update a build without a release key, trusting checksums.txt unsigned")
+}
+
+func runSelfUpdate(args []string) error {
+	fs := newFlagSet("self-update")
+	selfUpdateFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	current := buildVersion().Version
+	r, err := fetchRelease(updateRepository, updateTag)
+	if err != nil {
+		zap.L().Error("failed to look up release", zap.String("repo", updateRepository), zap.Error(err))
+		return err
+	}
+	newer := compareVersions(r.TagName, current) > 0
+	if updateCheckOnly {
+		if newer {
+			fmt.Printf("update available: %s -> %s\n", current, r.TagName)
+		} else {
+			fmt.Printf("up to date: %s\n", current)
+		}
+		return nil
+	}
+	if !newer && !updateForce && updateTag == "" {
+		fmt.Printf("already up to date: %s\n", current)
+		return nil
+	}
+	asset, ok := r.asset(releaseAssetName())
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s/%s", r.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	sumsAsset, ok := r.asset(checksumsAsset)
+	if !ok {
+		return fmt.Errorf("%w: release %s has no %s", errUpdateVerification, r.TagName, checksumsAsset)
+	}
+	checksums, err := httpGet(sumsAsset.URL)
+	if err != nil {
+		return err
+	}
+	if err := verifyChecksums(r, checksums, updateInsecure); err != nil {
+		zap.L().Error("refusing update", zap.Error(err))
+		return err
+	}
+	expected, ok := parseChecksums(checksums)[asset.Name]
+	if !ok {
+		return fmt.Errorf("%w: %s is not listed in %s", errUpdateVerification, asset.Name, checksumsAsset)
+	}
+	zap.L().Info("downloading", zap.String("release", r.TagName), zap.String("asset", asset.Name))
+	binary, err := httpGet(asset.URL)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(binary)
+	if hex.EncodeToString(sum[:]) != expected {
+		zap.L().Error("refusing update", zap.String("asset", asset.Name), zap.String("expected", expected), zap.String("got", hex.EncodeToString(sum[:])))
+		return fmt.Errorf("%w: checksum mismatch for %s", errUpdateVerification, asset.Name)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	if err := replaceExecutable(exe, binary); err != nil {
+		zap.L().Error("failed to replace executable, try again with permission to write it", zap.String("path", exe), zap.Error(err))
+		return err
+	}
+	fmt.Printf("updated %s -> %s\n", current, r.TagName)
+	return nil
+}
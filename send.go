@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var inputFile string
+var backend string
+var sendJSON bool
+
+// sendFlags adds the flags of send.
+func sendFlags(fs *flag.FlagSet) {
+	fs.StringVar(&inputFile, "file", "", "gcode file that you want to send, - for stdin")
+	fs.StringVar(&queueURL, "queue", "", "submit the files to the job queue of a send-carbide daemon at this URL (e.g. http://cnc-pc:6281) instead of sending them")
+	fs.StringVar(&apiToken, "token", defaultToken(), "with -queue, token for a daemon that requires one, defaults to SEND_CARBIDE_TOKEN")
+	fs.IntVar(&queuePriority, "priority", 0, "with -queue, start the job before queued jobs of lower priority")
+	fs.StringVar(&queueAfter, "after", "", "with -queue, don't start the job before this time, like 7am, 2026-10-15 07:00 or 2h")
+	fs.BoolVar(&queueHold, "hold", false, "with -queue, keep the job from starting until it is released")
+	fs.DurationVar(&queueTTL, "ttl", 0, "with -queue, expire the job if it is still queued this long after it was submitted or may start, instead of the daemon's -job-ttl")
+	fs.BoolVar(&offlineSpool, "offline", false, "when the machine can't be reached, keep the job and send it in the background once the machine is online, see offline")
+	fs.StringVar(&queueTags, "tag", "", "with -queue, tags of the job separated by commas, which the daemon's routes pick its machine by when -machine isn't given")
+	fs.StringVar(&manifestPath, "manifest", "", "send the steps of a YAML or JSON job manifest in order, with the machine, profile and pauses of each")
+	fs.Var(manifestVars, "var", "with -manifest, set a variable of the manifest as name=value, repeat for several")
+	fs.IntVar(&startStep, "step", 1, "with -manifest, start at this step, to resume a manifest that stopped")
+	fs.StringVar(&execCommand, "exec", "", "run this shell command and send its output, e.g. a CAM post-processor")
+	fs.BoolVar(&clipboardInput, "clipboard", false, "send the gcode text on the clipboard")
+	fs.BoolVar(&joinFiles, "join", false, "send the files given as arguments as one job, separated by a safe retract")
+	fs.StringVar(&joinRetract, "join-retract", "G53 G0 Z0", "gcode run between joined files, empty to disable")
+	fs.BoolVar(&joinPause, "join-pause", false, "pause with M0 between joined files")
+	fs.BoolVar(&splitTools, "split-tools", false, "send each tool's part of the job separately, asking to change the tool in between. Use -wait so each part waits for the previous one to finish")
+	fs.StringVar(&inputEncoding, "encoding", "auto", "text encoding of the file, converted to UTF-8 before sending: auto, utf-8, utf-16le, utf-16be or latin1")
+	fs.BoolVar(&rawSend, "raw", false, "send the file byte for byte as it is, with only the protocol header added: no decompression, conversion, checks, profile or other changes")
+	fs.BoolVar(&allowBinary, "allow-binary", false, "send the file even if it has NUL bytes or control characters, which gcode doesn't")
+	fs.StringVar(&archiveMember, "member", "", "file or pattern to send from a zip archive, by default its only gcode file")
+	fs.DurationVar(&waitTimeout, "wait", 0, "wait up to this long for the machine to become ready instead of failing (e.g. 10m)")
+	fs.DurationVar(&pollInterval, "poll-interval", 5*time.Second, "how often to check the machine state while waiting")
+	fs.BoolVar(&trackRuntime, "track-run", false, "once the machine acknowledges the job, wait for it to return to init and record how long the job ran, which corrects the runtime estimates of the machine")
+	fs.StringVar(&allowedStates, "allow-state", "init", "comma separated list of machine states that permit sending, by default the profile's allow_states or init")
+	fs.DurationVar(&ackTimeout, "ack-timeout", 10*time.Minute, "how long to wait for the machine to acknowledge the file, 0 waits forever")
+	fs.DurationVar(&heartbeatInterval, "heartbeat", 0, "send an empty message this often while waiting for the ack, 0 disables (only for receivers that tolerate it)")
+	fs.Var(&maxRate, "max-rate", "cap the send rate in bytes per second (e.g. 200k), 0 is unlimited")
+	fs.Var(&spoolMemory, "spool-memory", "keep inputs of unknown size up to this size in memory before sending, larger ones go to a temporary file")
+	fs.BoolVar(&mmapInput, "mmap", false, "map local files into memory instead of reading them, faster for very large files")
+	fs.BoolVar(&verifySend, "verify", false, "after the ack, ask the machine how many bytes it got and their checksum, and fail if they differ from what was sent (receivers that support it)")
+	fs.Var(&chunkSize, "chunk-size", "send the file in chunks of this size and wait for an ack after each one (receiver must support it), 0 disables")
+	fs.DurationVar(&chunkTimeout, "chunk-timeout", 30*time.Second, "how long to wait for each chunk ack")
+	fs.BoolVar(&keepOpen, "keep-open", false, "keep the connection open after a send for the next file of the batch or of watch-file, with receivers that announce sessions")
+	fs.DurationVar(&lockWait, "lock-wait", 0, "wait up to this long for another send to the same machine to finish instead of failing")
+	fs.BoolVar(&forceSend, "force", false, "send jobs larger than -confirm-above without asking")
+	fs.Var(&confirmAbove, "confirm-above", "ask before sending jobs larger than this (e.g. 100M), by default the config's confirm_above or 50MiB")
+	fs.BoolVar(&sendJSON, "json", false, "print the transfer summary as JSON")
+	fs.BoolVar(&eventsMode, "events", false, "write what happens during the send as lines of JSON as it happens, followed by the JSON summary")
+	fs.IntVar(&startLine, "start-line", 0, "resume the job from this line, restoring the units, work offset, feed and spindle of the lines skipped")
+	fs.StringVar(&startAt, "start-at", "", "resume the job from the first use of this tool (e.g. T2), like -start-line")
+	fs.StringVar(&checkpointMode, "checkpoint", "ask", "save the progress of jobs streamed to GRBL so an interrupted one can resume: ask, resume or restart when a checkpoint exists, or off")
+	fs.StringVar(&profileName, "profile", "", "machine profile to prepare the job for and check it against, by default the -machine's profile from the config file")
+	fs.DurationVar(&spindleDwell, "spindle-dwell", 0, "wait this long with a G4 after every spindle start (M3/M4), overriding the profile's spindle_dwell")
+	fs.Float64Var(&pauseBelow, "pause-below", 0, "pause with M0 before every feed move that plunges more than this many mm under the work zero, overriding the profile's pause_below")
+	fs.BoolVar(&reorderRapids, "reorder", false, "put the cuts between rapids at the clearance height in the order with the least rapid travel, keeping cuts that overlap in their order")
+	fs.BoolVar(&optimizeMoves, "optimize", false, "drop moves to where the tool already is, coordinates that don't change and repeated G0/G1, F and S words before sending")
+	fs.BoolVar(&droMode, "dro", false, "show the live position, line and state while the job runs (serial backend)")
+	fs.BoolVar(&droJSONStream, "json-stream", false, "like -dro, but write each position as a line of JSON, followed by the JSON summary")
+	addBackendFlags(fs)
+	fs.StringVar(&outputPath, "output", "-", "output path for the file backend, - for stdout")
+}
+
+func runSend(args []string) (err error) {
+	defer func() {
+		if err != nil {
+			emitEvent(sendEvent{Event: eventError, Error: err.Error()})
+		}
+		err = sendExitError(err)
+	}()
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("send")
+	sendFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	files := pathArgs(append(positional, fs.Args()...))
+	if inputFile != "" {
+		inputFile = cleanPathArg(inputFile)
+	}
+	if droJSONStream {
+		droMode, sendJSON = true, true
+	}
+	if eventsMode {
+		sendJSON = true
+	}
+	if droMode && backend != "serial" {
+		fs.PrintDefaults()
+		zap.L().Error("only the serial backend reports the position during a job", zap.String("backend", backend))
+		return fmt.Errorf("live position is %w by the %s backend", errUnsupported, backend)
+	}
+	if verifySend && backend != "carbide" {
+		fs.PrintDefaults()
+		zap.L().Error("only the carbide backend can verify the transfer", zap.String("backend", backend))
+		return fmt.Errorf("verification is %w by the %s backend", errUnsupported, backend)
+	}
+	if rawSend {
+		if err := checkRaw(fs); err != nil {
+			fs.PrintDefaults()
+			return err
+		}
+	}
+	switch checkpointMode {
+	case "ask", "resume", "restart", "off":
+	default:
+		fs.PrintDefaults()
+		zap.L().Error("invalid -checkpoint, use ask, resume, restart or off", zap.String("checkpoint", checkpointMode))
+		return fmt.Errorf("invalid -checkpoint %q", checkpointMode)
+	}
+	if manifestPath != "" {
+		if len(files) > 0 || inputFile != "" || joinFiles || execCommand != "" || clipboardInput || queueURL != "" || startLine > 0 || startAt != "" {
+			zap.L().Error("-manifest names the files to send itself")
+			return fmt.Errorf("%w: -manifest can't be combined with files, -join, -exec, -clipboard, -queue or a start", errManifest)
+		}
+		return runManifest(fs, manifestPath)
+	}
+	if err := profileStates(fs); err != nil {
+		return err
+	}
+	startTool := 0
+	if startAt != "" {
+		if startTool, err = parseStartTool(startAt); err != nil || startLine > 0 {
+			if err == nil {
+				err = errors.New("use either -start-line or -start-at")
+			}
+			fs.PrintDefaults()
+			zap.L().Error("invalid start", zap.Error(err))
+			return err
+		}
+	}
+	if !joinFiles && execCommand == "" && !clipboardInput {
+		if inputFile != "" {
+			files = append([]string{inputFile}, files...)
+		}
+		sources, batch, err := expandSources(files)
+		if err != nil {
+			return err
+		}
+		if (batch || queueURL != "") && (startLine > 0 || startTool > 0) {
+			zap.L().Error("a job can only be resumed when sending one file")
+			return errors.New("a job can only be resumed when sending one file")
+		}
+		if batch || queueURL != "" {
+			if len(splitAddresses(machineName)) > 1 {
+				zap.L().Error("several files can only be sent to one machine at a time")
+				return errSeveralMachines
+			}
+			return runBatch(sources)
+		}
+		if len(sources) == 1 {
+			inputFile = sources[0]
+		}
+	}
+	var input *jobInput
+	switch {
+	case joinFiles:
+		inputFile = strings.Join(files, ",")
+		input, err = joinInputs(files)
+	case execCommand != "":
+		inputFile = execCommand
+		input, err = openExec(execCommand)
+	case clipboardInput:
+		inputFile = "clipboard"
+		input, err = openClipboard()
+	default:
+		input, err = openInput(inputFile)
+	}
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	// Broadcasts may swap the reader for a local copy
+	defer func() {
+		input.Close()
+	}()
+	readMetadata(input)
+	// Only jobs GRBL is fed line by line from a file can be picked up again;
+	// Carbide Motion runs a job on its own once it has it
+	var jobHash string
+	if backend == "serial" && checkpointMode != "off" && input.path != "" && !splitTools {
+		if jobHash, err = fileSHA256(input.path); err != nil {
+			zap.L().Error("failed to hash input file", zap.String("file", input.path), zap.Error(err))
+			return err
+		}
+	}
+	if startLine > 0 || startTool > 0 {
+		applyStart(input, startLine, startTool)
+	}
+	profile, hasProfile, err := activeProfile()
+	if err != nil {
+		return err
+	}
+	pauseFlags(&profile)
+	switch {
+	case rawSend:
+		zap.L().Debug("sending the file raw, the profile's changes are not applied", zap.String("file", input.name))
+	case hasProfile:
+		applyProfile(input, profile)
+	default:
+		applyPauses(input, profile)
+	}
+	if reorderRapids {
+		var p *machineProfile
+		if hasProfile {
+			p = &profile
+		}
+		if _, err := applyReorder(input, p); err != nil {
+			return err
+		}
+	}
+	if optimizeMoves {
+		defer applyOptimizer(input).report()
+	}
+	if machines := splitAddresses(machineName); len(machines) > 1 {
+		if backend != "carbide" {
+			zap.L().Error("broadcasting is only supported by the carbide backend", zap.String("backend", backend))
+			return errSeveralMachines
+		}
+		return runBroadcast(machines, input)
+	}
+	var checkpoints *checkpointer
+	if jobHash != "" {
+		checkpoints = startCheckpoint(input, jobHash)
+	}
+	// The carbide protocol announces the size before the file
+	if backend == "carbide" {
+		if err := spoolInput(input); err != nil {
+			return err
+		}
+	}
+	if err := confirmLargeJob(input); err != nil {
+		return err
+	}
+	// Setup machine connection
+	sender, err := openSender(backend)
+	if err != nil {
+		fs.PrintDefaults()
+		zap.L().Error("failed to set up backend", zap.String("backend", backend), zap.Error(err))
+		return err
+	}
+	defer sender.Close()
+	defer func() {
+		err = spoolOffline(sender, inputFile, input, err)
+		recordSend(machineName, sender.Target(), inputFile, input, err)
+		err = offlineResult(err)
+	}()
+	if s, ok := sender.(*serialSender); ok && checkpoints != nil {
+		s.grbl.onAck = checkpoints.ack
+		defer func() {
+			checkpoints.finish(err)
+		}()
+	}
+	zap.L().Info("sending gcode file", zap.String("file", inputFile), zap.String("backend", backend), zap.String("target", sender.Target()))
+	if splitTools {
+		return sendByTool(sender, input)
+	}
+	stats := newStatsReader(input.ReadCloser)
+	if hasProfile {
+		stats.profile = &profile
+	}
+	stats.metadata = input.metadata
+	input.ReadCloser = stats
+	out := resultOutput()
+	switch {
+	case input.size < 0:
+		if err = sendStreamed(sender, input); err != nil {
+			err = withSentLines(err, sender, input)
+		}
+	case humanOutput(out) && !sendJSON && !droMode:
+		if err = sendWithProgress(out, sender, input, stats); err != nil {
+			return err
+		}
+		return trackRun(sender, inputFile, stats)
+	default:
+		if err = sender.Send(input.name, input, input.size); err != nil {
+			err = withSentLines(err, sender, input)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	zap.L().Info("done")
+	summary := stats.summary(inputFile, sender.Target())
+	if timer, ok := sender.(phaseTimer); ok {
+		summary.Phases = timer.Phases()
+	}
+	if sendJSON {
+		if err := json.NewEncoder(out).Encode(summary); err != nil {
+			return err
+		}
+		return trackRun(sender, inputFile, stats)
+	}
+	for _, warning := range summary.Warnings {
+		zap.L().Warn(warning, zap.String("file", inputFile))
+	}
+	fmt.Fprintf(out, "sent %s (%s) to %s\n", inputFile, summary, sender.Target())
+	return trackRun(sender, inputFile, stats)
+}
+
+// sendWithProgress sends the job with a progress bar and a colored summary
+// for people watching the terminal.
+func sendWithProgress(out *os.File, sender Sender, input *jobInput, stats *statsReader) error {
+	target := sender.Target()
+	if machineName != "" {
+		target = machineName
+	}
+	fmt.Fprintf(out, "%s %s (%s) to %s\n", paint(colorBold, "Sending"), filepath.Base(input.name), formatByteSize(input.size), target)
+	if m := input.metadata; m != nil {
+		if job := m.String(); job != "" {
+			fmt.Fprintf(out, "  %s %s\n", paint(colorDim, "Job:"), job)
+		}
+		for _, tool := range m.Tools {
+			fmt.Fprintf(out, "  %s %s\n", paint(colorDim, "Tool:"), tool)
+		}
+	}
+	start := time.Now()
+	progress := newProgressReader(input, out, input.size)
+	progress.totalLines = countLines(input.path)
+	err := sender.Send(input.name, progress, input.size)
+	progress.clear()
+	if err != nil {
+		err = withSentLines(err, sender, input)
+		fmt.Fprintf(out, "%s %v\n", paint(colorRed, "Failed:"), err)
+		return err
+	}
+	fmt.Fprintf(out, "%s to %s in %v\n", paint(colorGreen, "Sent"), sender.Target(), time.Since(start).Round(100*time.Millisecond))
+	summary := stats.summary(inputFile, sender.Target())
+	fmt.Fprintf(out, "  %s\n", summary)
+	if summary.Toolpath != nil {
+		fmt.Fprintf(out, "  %s %s\n", paint(colorDim, "Toolpath:"), summary.Toolpath)
+	}
+	if summary.EstimatedSeconds > 0 {
+		fmt.Fprintf(out, "  %s about %v\n", paint(colorDim, "Runtime:"), time.Duration(summary.EstimatedSeconds*float64(time.Second)))
+	}
+	for _, warning := range summary.Warnings {
+		fmt.Fprintf(out, "  %s %s\n", paint(colorYellow, tr("label.warning")), warning)
+	}
+	return nil
+}
+
+// sendStreamed sends an input of unknown size to a backend that streams it
+// line by line, and checks that the input ended cleanly. The size is known
+// afterwards.
+func sendStreamed(sender Sender, input *jobInput) error {
+	counter := &countingReader{ReadCloser: input.ReadCloser}
+	input.ReadCloser = counter
+	err := sender.Send(input.name, counter, -1)
+	input.size = counter.n
+	if closeErr := counter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// resultOutput is where the final result is printed. It is stdout unless
+// the file backend is writing the job there.
+func resultOutput() *os.File {
+	if backend == "file" && outputPath == "-" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// recordSend adds the outcome of a send to the job history, together with the
+// last known identification of the receiver.
+func recordSend(machine, target, file string, input *jobInput, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	appendHistory(historyEntry{
+		Time:     time.Now(),
+		Kind:     historyKindSend,
+		Machine:  machine,
+		Address:  target,
+		File:     file,
+		Size:     input.size,
+		Result:   result,
+		Info:     lastMachineInfo(target),
+		Metadata: input.metadata,
+	})
+	notifySend(machine, file, err)
+}
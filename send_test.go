@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSender takes jobs in place of a machine, failing them with err.
+type fakeSender struct {
+	target string
+	err    error
+	name   string
+	data   []byte
+	closed bool
+}
+
+func (f *fakeSender) Send(name string, r io.Reader, size int64) error {
+	f.name = name
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.data = data
+	return f.err
+}
+
+func (f *fakeSender) Target() string {
+	return f.target
+}
+
+func (f *fakeSender) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestRunSendRecordsSend(t *testing.T) {
+	errRefused := errors.New("machine refused the file")
+	tests := []struct {
+		name   string
+		err    error
+		result string
+	}{
+		{"sent", nil, "ok"},
+		{"failed", errRefused, errRefused.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			job := filepath.Join(dir, "part.nc")
+			gcode := "G21\nG0 X10 Y10\nM30\n"
+			if err := ioutil.WriteFile(job, []byte(gcode), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			fake := &fakeSender{target: "fake:6280", err: tt.err}
+			saved := openSender
+			defer func() { openSender = saved }()
+			var opened string
+			openSender = func(name string) (Sender, error) {
+				opened = name
+				return fake, nil
+			}
+
+			err := runSend([]string{"-q", "-config", filepath.Join(dir, "config.yaml"), "-file", job})
+			if !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+				t.Fatalf("runSend returned %v, want %v", err, tt.err)
+			}
+			if opened != "carbide" || !fake.closed {
+				t.Errorf("opened backend %q, closed %v, want the carbide backend opened and closed", opened, fake.closed)
+			}
+			if fake.name != job || string(fake.data) != gcode {
+				t.Errorf("sent %q as %q, want %q as %s", fake.data, fake.name, gcode, job)
+			}
+			entries, err := readHistory()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("history has %d entries, want 1: %+v", len(entries), entries)
+			}
+			entry := entries[0]
+			if entry.Kind != historyKindSend || entry.Address != fake.target || entry.File != job || entry.Result != tt.result {
+				t.Errorf("recorded %+v, want a send of %s to %s with result %q", entry, job, fake.target, tt.result)
+			}
+		})
+	}
+}
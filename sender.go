@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Sender delivers a gcode job to a machine. Implementations own their
+// connection and are selected with the -backend flag.
+type Sender interface {
+	// Send transmits size bytes of gcode read from r. The name identifies
+	// the job to the receiver.
+	Send(name string, r io.Reader, size int64) error
+	// Target describes where the sender delivers to, for logs and history.
+	Target() string
+	Close() error
+}
+
+// backendConfig is what a backend is set up with. newSender takes it from
+// the flags.
+type backendConfig struct {
+	// addresses are the machine addresses the carbide backend tries, in
+	// order
+	addresses  []string
+	serialPort string
+	serialBaud int
+	// outputPath is where the file backend writes, - for stdout
+	outputPath string
+}
+
+// backends maps -backend values to constructors. A new target only needs
+// to register itself here.
+var backends = map[string]func(cfg backendConfig) (Sender, error){
+	"carbide": newCarbideSender,
+	"serial":  newSerialSender,
+	"file":    newFileSender,
+}
+
+func backendNames() string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newSender creates the sender for the named backend, set up by the flags.
+func newSender(name string) (Sender, error) {
+	constructor, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, expected one of %s", name, backendNames())
+	}
+	cfg := backendConfig{serialPort: serialPort, serialBaud: serialBaud, outputPath: outputPath}
+	// Only the carbide backend reaches the machine by its addresses
+	if name == "carbide" {
+		addresses, err := machineAddresses()
+		if err != nil {
+			return nil, err
+		}
+		cfg.addresses = addresses
+	}
+	return constructor(cfg)
+}
+
+// openSender creates the sender of send. Tests replace it to send without
+// a machine.
+var openSender = newSender
+
+// addBackendFlags registers the flags that select and configure a backend.
+func addBackendFlags(fs *flag.FlagSet) {
+	fs.StringVar(&backend, "backend", "carbide", "how to reach the machine: "+backendNames())
+	fs.StringVar(&serialPort, "port", "", "serial device for the serial backend (e.g. /dev/ttyUSB0)")
+	fs.IntVar(&serialBaud, "baud", 115200, "baud rate for the serial backend")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// grblResponseTimeout is how long GRBL has to answer a request. While a
+// job streams it is how long GRBL may be quiet before it is asked for a
+// status report, which it has as long again to answer.
+const grblResponseTimeout = 30 * time.Second
+
+var serialPort string
+var serialBaud int
+
+// serialSender streams jobs straight to a GRBL controller, bypassing
+// Carbide Motion.
+type serialSender struct {
+	name string
+	port *os.File
+	grbl *grblStreamer
+}
+
+func newSerialSender(cfg backendConfig) (Sender, error) {
+	port, err := openSerial(cfg.serialPort, cfg.serialBaud)
+	if err != nil {
+		zap.L().Error("failed to open serial port", zap.String("port", cfg.serialPort), zap.Error(err))
+		return nil, err
+	}
+	g := newGRBLStreamer(port, grblResponseTimeout)
+	// Opening the port resets most GRBL boards, which then print a banner.
+	banner, err := g.waitBanner()
+	if err != nil {
+		port.Close()
+		zap.L().Error("did not receive grbl banner", zap.Error(err))
+		return nil, err
+	}
+	zap.L().Debug("connected", zap.String("banner", banner))
+	return &serialSender{name: cfg.serialPort, port: port, grbl: g}, nil
+}
+
+func (s *serialSender) Target() string {
+	return s.name
+}
+
+func (s *serialSender) Close() error {
+	return s.port.Close()
+}
+
+func (s *serialSender) Send(name string, input io.Reader, size int64) error {
+	stream := s.grbl.stream
+	if droMode {
+		stream = s.sendWithDRO
+	}
+	lines, err := stream(input)
+	if err != nil {
+		zap.L().Error("failed streaming gcode", zap.Error(err), zap.Int("lines", lines))
+		return err
+	}
+	zap.L().Debug("streamed gcode", zap.Int("lines", lines))
+	return nil
+}
+
+// SentLines is the last line of the last send GRBL acknowledged.
+func (s *serialSender) SentLines() (int64, bool) {
+	return int64(s.grbl.acked), true
+}
+
+// grblSoftReset is GRBL's realtime reset command. It stops motion and
+// drops everything buffered, then GRBL prints its banner again.
+const grblSoftReset = 0x18
+
+// Abort soft resets the controller, discarding the job it is running.
+func (s *serialSender) Abort() error {
+	if _, err := s.port.Write([]byte{grblSoftReset}); err != nil {
+		zap.L().Error("failed sending reset", zap.Error(err))
+		return err
+	}
+	banner, err := s.grbl.waitBanner()
+	if err != nil {
+		zap.L().Error("grbl did not restart after reset", zap.Error(err))
+		return err
+	}
+	zap.L().Debug("grbl reset", zap.String("banner", banner))
+	return nil
+}
+
+// EStop sends a feed hold and a soft reset in one write. The reset stops
+// the steppers at once; the hold before it lets GRBL decelerate if it
+// gets to act on it first. GRBL then raises an alarm since the position
+// may be lost.
+func (s *serialSender) EStop() error {
+	if _, err := s.port.Write([]byte{'!', grblSoftReset}); err != nil {
+		zap.L().Error("failed sending reset", zap.Error(err))
+		return err
+	}
+	timeout := s.grbl.timeout
+	if controlTimeout > 0 {
+		timeout = controlTimeout
+	}
+	for {
+		line, err := s.grbl.nextWithin(timeout)
+		if err != nil {
+			// The reset went out, GRBL just didn't confirm it in time
+			zap.L().Warn("grbl did not confirm the reset", zap.Error(err))
+			return nil
+		}
+		if strings.HasPrefix(line, "Grbl") {
+			zap.L().Debug("grbl reset", zap.String("banner", line))
+			return nil
+		}
+	}
+}
+
+// State asks GRBL for a status report.
+func (s *serialSender) State() (carbide.State, error) {
+	state, err := s.grbl.status()
+	if err != nil {
+		zap.L().Error("failed to read grbl status", zap.Error(err))
+	}
+	return state, err
+}
+
+// Pause sends GRBL's feed hold, which decelerates to a stop.
+func (s *serialSender) Pause() error {
+	_, err := s.port.Write([]byte{'!'})
+	return err
+}
+
+// Resume sends GRBL's cycle start to continue after a feed hold.
+func (s *serialSender) Resume() error {
+	_, err := s.port.Write([]byte{'~'})
+	return err
+}
+
+// Override sends the realtime override commands for change and returns the
+// levels GRBL reports afterwards.
+func (s *serialSender) Override(change overrideChange) (overrides, error) {
+	if _, err := s.port.Write(grblOverrideBytes(change)); err != nil {
+		zap.L().Error("failed sending override", zap.Stringer("change", change), zap.Error(err))
+		return overrides{}, err
+	}
+	levels, err := s.grbl.overrides()
+	if err != nil {
+		zap.L().Error("failed to read override levels", zap.Error(err))
+	}
+	return levels, err
+}
+
+// Home runs GRBL's homing cycle. GRBL answers ok once it has finished.
+func (s *serialSender) Home() error {
+	_, err := s.Gcode("$H")
+	return err
+}
+
+// Gcode sends one line to GRBL and waits, for at most -timeout, for it to
+// be acknowledged. It returns what GRBL printed up to and including the ok.
+func (s *serialSender) Gcode(line string) (string, error) {
+	if _, err := io.WriteString(s.port, line+"\n"); err != nil {
+		zap.L().Error("failed sending command", zap.String("command", line), zap.Error(err))
+		return "", err
+	}
+	timeout := s.grbl.timeout
+	if controlTimeout > 0 {
+		timeout = controlTimeout
+	}
+	var output []string
+	for {
+		response, err := s.grbl.nextWithin(timeout)
+		if err != nil {
+			zap.L().Error("no answer from grbl", zap.String("command", line), zap.Error(err))
+			return "", err
+		}
+		switch {
+		case response == "ok":
+			return strings.Join(append(output, response), "\n"), nil
+		case strings.HasPrefix(response, "error:") || strings.HasPrefix(response, "ALARM:"):
+			zap.L().Error("grbl rejected command", zap.String("command", line), zap.String("response", response))
+			return "", &grblError{line: 1, text: line, response: response}
+		case strings.HasPrefix(response, "Grbl ") || strings.HasPrefix(response, "<"):
+			// Banners and status reports are not answers to the line
+		default:
+			output = append(output, response)
+		}
+	}
+}
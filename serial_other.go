@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// openSerial is not implemented on this platform.
+func openSerial(path string, baud int) (*os.File, error) {
+	return nil, errors.New("serial backend is not supported on this platform")
+}
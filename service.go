@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const serviceName = "send-carbide"
+const serviceDescription = "send-carbide gcode job queue"
+
+var serviceUser bool
+var servicePrint bool
+
+// serviceCommand returns the executable and arguments a service manager
+// should run for the daemon. The config path is made absolute because
+// services start in a different working directory, often as another user.
+func serviceCommand(daemonArgs []string) (string, []string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	args := append([]string{"daemon"}, daemonArgs...)
+	if configPath != "" && !hasFlag(daemonArgs, "config") {
+		abs, err := filepath.Abs(configPath)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, "-config", abs)
+	}
+	return exe, args, nil
+}
+
+// hasFlag reports whether args set the named flag in any of the forms the
+// flag package accepts.
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		arg = strings.TrimLeft(arg, "-")
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func daemonInstallFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&serviceUser, "user", false, "install a per-user service (systemd --user) instead of a system one")
+	fs.BoolVar(&servicePrint, "print", false, "only print the service definition instead of installing it")
+}
+
+func runDaemonInstall(args []string) error {
+	fs := newFlagSet("daemon install")
+	daemonInstallFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	exe, daemonArgs, err := serviceCommand(fs.Args())
+	if err != nil {
+		return err
+	}
+	return installService(exe, daemonArgs)
+}
+
+func daemonUninstallFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&serviceUser, "user", false, "remove the per-user service (systemd --user)")
+}
+
+func runDaemonUninstall(args []string) error {
+	fs := newFlagSet("daemon uninstall")
+	daemonUninstallFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	return uninstallService()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// systemdQuote quotes an ExecStart argument when needed.
+func systemdQuote(arg string) string {
+	arg = strings.Replace(arg, "%", "%%", -1)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;$") {
+		return arg
+	}
+	arg = strings.Replace(arg, `\`, `\\`, -1)
+	arg = strings.Replace(arg, `"`, `\"`, -1)
+	return `"` + arg + `"`
+}
+
+func systemdUnit(exe string, args []string) string {
+	command := []string{systemdQuote(exe)}
+	for _, arg := range args {
+		command = append(command, systemdQuote(arg))
+	}
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "[Unit]\nDescription=%s\nAfter=network-online.target\nWants=network-online.target\n\n", serviceDescription)
+	fmt.Fprintf(&unit, "[Service]\nExecStart=%s\nRestart=on-failure\nRestartSec=5\n", strings.Join(command, " "))
+	// Run as the invoking user under sudo so the config and spool stay theirs
+	if user := os.Getenv("SUDO_USER"); user != "" && !serviceUser {
+		fmt.Fprintf(&unit, "User=%s\n", user)
+	}
+	target := "multi-user.target"
+	if serviceUser {
+		target = "default.target"
+	}
+	fmt.Fprintf(&unit, "\n[Install]\nWantedBy=%s\n", target)
+	return unit.String()
+}
+
+func systemdUnitPath() (string, error) {
+	if !serviceUser {
+		return filepath.Join("/etc/systemd/system", serviceName+".service"), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "systemd", "user", serviceName+".service"), nil
+}
+
+func systemctl(args ...string) error {
+	if serviceUser {
+		args = append([]string{"--user"}, args...)
+	}
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// installService writes a systemd unit for the daemon and starts it.
+func installService(exe string, args []string) error {
+	unit := systemdUnit(exe, args)
+	if servicePrint {
+		fmt.Print(unit)
+		return nil
+	}
+	path, err := systemdUnitPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, []byte(unit), 0o644); err != nil {
+		zap.L().Error("failed to write systemd unit", zap.String("path", path), zap.Error(err))
+		return err
+	}
+	zap.L().Info("wrote systemd unit", zap.String("path", path))
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", "--now", serviceName+".service")
+}
+
+// uninstallService stops the daemon and removes its systemd unit.
+func uninstallService() error {
+	path, err := systemdUnitPath()
+	if err != nil {
+		return err
+	}
+	if err := systemctl("disable", "--now", serviceName+".service"); err != nil {
+		zap.L().Warn("failed to disable service", zap.Error(err))
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	zap.L().Info("removed systemd unit", zap.String("path", path))
+	return systemctl("daemon-reload")
+}
+
+// runUnderServiceManager is only needed on Windows; systemd runs the daemon
+// as a normal process and stops it with SIGTERM.
+func runUnderServiceManager(serve func(stop <-chan struct{}) error) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import "errors"
+
+var errServiceUnsupported = errors.New("service installation is only supported with systemd on Linux and on Windows")
+
+func installService(exe string, args []string) error {
+	return errServiceUnsupported
+}
+
+func uninstallService() error {
+	return errServiceUnsupported
+}
+
+func runUnderServiceManager(serve func(stop <-chan struct{}) error) (bool, error) {
+	return false, nil
+}
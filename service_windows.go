@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// windowsService adapts the daemon to the Windows service control manager.
+type windowsService struct {
+	serve func(stop <-chan struct{}) error
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(stop)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return true, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				if err := <-done; err != nil {
+					return true, 1
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// runUnderServiceManager runs the daemon through the service control
+// manager when the process was started as a Windows service.
+func runUnderServiceManager(serve func(stop <-chan struct{}) error) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, nil
+	}
+	return true, svc.Run(serviceName, &windowsService{serve: serve})
+}
+
+// installService registers the daemon as an automatically started Windows
+// service and starts it.
+func installService(exe string, args []string) error {
+	if servicePrint {
+		fmt.Printf("%s %q\n", exe, args)
+		return nil
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		zap.L().Error("failed to connect to the service manager, try an administrator prompt", zap.Error(err))
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		zap.L().Error("failed to create service", zap.Error(err))
+		return err
+	}
+	defer s.Close()
+	zap.L().Info("installed service", zap.String("name", serviceName))
+	return s.Start()
+}
+
+// uninstallService stops and removes the Windows service.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		zap.L().Error("failed to connect to the service manager, try an administrator prompt", zap.Error(err))
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if _, err := s.Control(svc.Stop); err == nil {
+		// Give in-flight jobs a moment before the service is removed
+		for i := 0; i < 30; i++ {
+			if status, err := s.Query(); err != nil || status.State == svc.Stopped {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	zap.L().Info("removed service", zap.String("name", serviceName))
+	return nil
+}
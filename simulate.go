@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var errSimulationProblems = errors.New("the simulation found problems")
+
+// simulationFinding is a problem with one line of a job.
+type simulationFinding struct {
+	Line    int    `json:"line"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// Kinds of simulation findings.
+const (
+	findingLimit = "limit"
+	findingRapid = "rapid"
+	findingFeed  = "feed"
+	findingGcode = "gcode"
+)
+
+// axisRange is the lowest and highest position reached along an axis.
+type axisRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// simulationReport is what simulate prints.
+type simulationReport struct {
+	File     string               `json:"file"`
+	Lines    int                  `json:"lines"`
+	Moves    int                  `json:"moves"`
+	Extent   map[string]axisRange `json:"extent"`
+	Toolpath toolpathStats        `json:"toolpath"`
+	Findings []simulationFinding  `json:"findings"`
+}
+
+var axisNames = [3]string{"X", "Y", "Z"}
+
+// arcStep is the largest angle between the points an arc is checked at.
+const arcStep = math.Pi / 18
+
+// simulator runs gcode on a model of the machine that only knows where the
+// tool is. Positions are in work coordinates and millimetres.
+type simulator struct {
+	profile *machineProfile
+	// origin is the machine position of the work zero, if it is known
+	origin *[3]float64
+	// spike is how many times faster than the previous one a feed may be
+	// before it is reported, 0 to not compare feeds
+	spike float64
+
+	pos    [3]float64
+	known  [3]bool
+	metric bool
+	// absolute is G90, incremental is G91
+	absolute bool
+	motion   int
+	plane    int
+	feed     float64
+	lastFeed float64
+	// The rest of the modal state only matters to resuming a job
+	wcs     int
+	spindle int
+	speed   float64
+	coolant int
+	tool    int
+
+	line    int
+	moves   int
+	low     [3]float64
+	high    [3]float64
+	reached [3]bool
+	spanned [3]bool
+	// flagged is the axes already reported past the travel in this move
+	flagged  [3]bool
+	findings []simulationFinding
+	// measureOnly drops the findings, for the preflight, which only wants
+	// the toolpath
+	measureOnly bool
+	// trace is called with every straight piece of the toolpath whose
+	// ends are known, arcs being split into several
+	trace func(from, to [3]float64, rapid bool)
+
+	// The distances moved in mm, and the minutes spent feeding
+	cutDistance   float64
+	rapidDistance float64
+	feedTime      float64
+	airFeedTime   float64
+}
+
+func newSimulator(profile *machineProfile, origin *[3]float64, spike float64) *simulator {
+	return &simulator{profile: profile, origin: origin, spike: spike, metric: true, absolute: true, motion: -1, plane: 17, wcs: 54, spindle: 5, coolant: 9}
+}
+
+// report adds a finding with the message of key in the active locale.
+func (s *simulator) report(kind, key string, args ...interface{}) {
+	if s.measureOnly {
+		return
+	}
+	s.findings = append(s.findings, simulationFinding{Line: s.line, Kind: kind, Message: tr(key, args...)})
+}
+
+// gcodeWord is a letter and its value, like X12.5.
+type gcodeWord struct {
+	letter byte
+	value  float64
+}
+
+func parseWords(code string) ([]gcodeWord, error) {
+	words := make([]gcodeWord, 0, 8)
+	code = strings.ToUpper(code)
+	for i := 0; i < len(code); {
+		c := code[i]
+		if c == ' ' || c == '\t' {
+			i++
+			continue
+		}
+		if c < 'A' || c > 'Z' {
+			return words, fmt.Errorf("unexpected %q", c)
+		}
+		j := i + 1
+		for j < len(code) && (code[j] == ' ' || code[j] == '.' || code[j] == '-' || code[j] == '+' || (code[j] >= '0' && code[j] <= '9')) {
+			j++
+		}
+		// Spaces after the number separate it from the next word, spaces
+		// within it are allowed by GRBL
+		number := strings.TrimRight(code[i+1:j], " ")
+		if strings.IndexByte(number, ' ') >= 0 {
+			number = strings.Replace(number, " ", "", -1)
+		}
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return words, fmt.Errorf("invalid number after %c", c)
+		}
+		words = append(words, gcodeWord{letter: c, value: value})
+		i = j
+	}
+	return words, nil
+}
+
+// step runs one line of gcode.
+func (s *simulator) step(code string) {
+	s.line++
+	code = strings.TrimSpace(cleanGcodeLine(code))
+	if code == "" || code == "%" {
+		return
+	}
+	words, err := parseWords(code)
+	if err != nil {
+		s.report(findingGcode, "finding.unreadable", code, err)
+		return
+	}
+	scale := 1.0
+	var target [3]*float64
+	var offsets [3]*float64
+	var radius *float64
+	l := 0.0
+	nonModal := -1
+	motion := s.motion
+	for i := range words {
+		w := &words[i]
+		switch w.letter {
+		case 'G':
+			switch g := math.Round(w.value * 10); g {
+			case 0, 10, 20, 30:
+				motion = int(g / 10)
+			case 800:
+				motion = -1
+			case 170, 180, 190:
+				s.plane = int(g / 10)
+			case 200:
+				s.metric = false
+			case 210:
+				s.metric = true
+			case 900:
+				s.absolute = true
+			case 910:
+				s.absolute = false
+			case 40, 100, 280, 300, 530, 920:
+				nonModal = int(g / 10)
+			case 382, 383, 384, 385:
+				// Probing stops wherever it touches
+				motion = -2
+			case 540, 550, 560, 570, 580, 590:
+				s.wcs = int(g / 10)
+			}
+		case 'M':
+			switch m := int(w.value); m {
+			case 3, 4, 5:
+				s.spindle = m
+			case 7, 8, 9:
+				s.coolant = m
+			}
+		case 'S':
+			s.speed = w.value
+		case 'T':
+			s.tool = int(w.value)
+		case 'X', 'Y', 'Z':
+			target[w.letter-'X'] = &w.value
+		case 'I', 'J', 'K':
+			offsets[w.letter-'I'] = &w.value
+		case 'R':
+			radius = &w.value
+		case 'L':
+			l = w.value
+		}
+	}
+	// The units may change on this line, so scale once all G words are in
+	if !s.metric {
+		scale = 25.4
+	}
+	for _, w := range words {
+		if w.letter == 'F' {
+			s.feed = w.value * scale
+		}
+	}
+	hasAxes := target[0] != nil || target[1] != nil || target[2] != nil
+	s.motion = motion
+	switch nonModal {
+	case 4:
+		return
+	case 10:
+		if l == 2 {
+			s.setOrigin(target, scale)
+		} else {
+			s.setPosition(target, scale)
+		}
+		return
+	case 92:
+		s.setPosition(target, scale)
+		return
+	case 28, 30:
+		// Either moves to the stored position, which the model can't know
+		s.known = [3]bool{}
+		return
+	case 53:
+		s.machineMove(target, scale)
+		return
+	}
+	if !hasAxes {
+		return
+	}
+	switch motion {
+	case -1:
+		s.report(findingGcode, "finding.no-motion")
+		return
+	case -2:
+		for i := range target {
+			if target[i] != nil {
+				s.known[i] = false
+			}
+		}
+		return
+	}
+	end := s.pos
+	endKnown := s.known
+	for i, v := range target {
+		if v == nil {
+			continue
+		}
+		switch {
+		case s.absolute:
+			end[i], endKnown[i] = *v*scale, true
+		default:
+			end[i] += *v * scale
+		}
+	}
+	s.moves++
+	s.flagged = [3]bool{}
+	if motion == 0 {
+		s.checkRapid(end, endKnown)
+	} else {
+		s.checkFeed()
+	}
+	length, measured := moveLength(s.pos, end, s.known, endKnown)
+	if motion >= 2 {
+		length, measured = 0, false
+		if s.known == [3]bool{true, true, true} && endKnown == [3]bool{true, true, true} {
+			length, measured = s.arc(end, offsets, radius, scale, motion == 2), true
+		}
+	}
+	if measured {
+		s.account(length, motion == 0, s.known[2] && endKnown[2] && s.pos[2] > 0 && end[2] > 0)
+		if s.trace != nil && motion < 2 {
+			s.trace(s.pos, end, motion == 0)
+		}
+	}
+	s.visit(end, endKnown)
+	s.pos, s.known = end, endKnown
+}
+
+// setOrigin moves the work zero to the given machine position, like G10
+// L2 does.
+func (s *simulator) setOrigin(target [3]*float64, scale float64) {
+	for i, v := range target {
+		if v == nil {
+			continue
+		}
+		if s.origin == nil || !s.known[i] {
+			s.known[i] = false
+			continue
+		}
+		machine := s.pos[i] + s.origin[i]
+		s.origin[i] = *v * scale
+		s.pos[i] = machine - s.origin[i]
+	}
+}
+
+// setPosition makes the current position the given one, like G10 L20 and
+// G92 do.
+func (s *simulator) setPosition(target [3]*float64, scale float64) {
+	for i, v := range target {
+		if v == nil {
+			continue
+		}
+		// The work zero moves so the machine stays where it is
+		if s.origin != nil && s.known[i] {
+			s.origin[i] += s.pos[i] - *v*scale
+		}
+		s.pos[i], s.known[i] = *v*scale, true
+	}
+}
+
+func (s *simulator) machineMove(target [3]*float64, scale float64) {
+	end, endKnown := s.pos, s.known
+	for i, v := range target {
+		if v == nil {
+			continue
+		}
+		if s.origin == nil {
+			endKnown[i] = false
+			continue
+		}
+		end[i], endKnown[i] = *v*scale-s.origin[i], true
+	}
+	s.moves++
+	s.flagged = [3]bool{}
+	s.visit(end, endKnown)
+	s.pos, s.known = end, endKnown
+}
+
+func (s *simulator) checkRapid(end [3]float64, endKnown [3]bool) {
+	switch {
+	case endKnown[2] && end[2] < 0 && (!s.known[2] || end[2] < s.pos[2]):
+		s.report(findingRapid, "finding.rapid-down", length(end[2]))
+	case s.known[2] && s.pos[2] < 0 && (end[0] != s.pos[0] || end[1] != s.pos[1]):
+		s.report(findingRapid, "finding.rapid-sideways", length(s.pos[2]))
+	}
+}
+
+func (s *simulator) checkFeed() {
+	if s.feed <= 0 {
+		s.report(findingFeed, "finding.no-feed")
+		return
+	}
+	// Only a change of feed needs checking
+	if s.feed == s.lastFeed {
+		return
+	}
+	if p := s.profile; p != nil && p.MaxFeed > 0 && s.feed > p.MaxFeed {
+		s.report(findingFeed, "finding.feed-above", feedRate(s.feed), feedRate(p.MaxFeed))
+	} else if s.spike > 0 && s.lastFeed > 0 && s.feed > s.lastFeed*s.spike {
+		s.report(findingFeed, "finding.feed-jump", feedRate(s.lastFeed), feedRate(s.feed))
+	}
+	s.lastFeed = s.feed
+}
+
+// arc checks the points along an arc to end, the way GRBL works out its
+// centre from IJK offsets or a radius, and returns its length.
+func (s *simulator) arc(end [3]float64, offsets [3]*float64, radius *float64, scale float64, clockwise bool) float64 {
+	// The two axes of the plane and the one the arc is a helix along
+	a0, a1, a2 := 0, 1, 2
+	switch s.plane {
+	case 18:
+		a0, a1, a2 = 2, 0, 1
+	case 19:
+		a0, a1, a2 = 1, 2, 0
+	}
+	var c0, c1 float64
+	switch {
+	case radius != nil:
+		x, y := end[a0]-s.pos[a0], end[a1]-s.pos[a1]
+		r := *radius * scale
+		h := 4*r*r - x*x - y*y
+		if h < 0 || (x == 0 && y == 0) {
+			s.report(findingGcode, "finding.arc-radius", length(r))
+			return 0
+		}
+		h = -math.Sqrt(h) / math.Hypot(x, y)
+		if !clockwise {
+			h = -h
+		}
+		if r < 0 {
+			h = -h
+		}
+		c0 = s.pos[a0] + 0.5*(x-y*h)
+		c1 = s.pos[a1] + 0.5*(y+x*h)
+	default:
+		if offsets[a0] != nil {
+			c0 = *offsets[a0] * scale
+		}
+		if offsets[a1] != nil {
+			c1 = *offsets[a1] * scale
+		}
+		c0 += s.pos[a0]
+		c1 += s.pos[a1]
+	}
+	r := math.Hypot(s.pos[a0]-c0, s.pos[a1]-c1)
+	start := math.Atan2(s.pos[a1]-c1, s.pos[a0]-c0)
+	travel := math.Atan2(end[a1]-c1, end[a0]-c0) - start
+	switch {
+	case clockwise && travel >= -1e-9:
+		travel -= 2 * math.Pi
+	case !clockwise && travel <= 1e-9:
+		travel += 2 * math.Pi
+	}
+	n := int(math.Ceil(math.Abs(travel) / arcStep))
+	previous := s.pos
+	for i := 1; i < n; i++ {
+		f := float64(i) / float64(n)
+		var p [3]float64
+		p[a0] = c0 + r*math.Cos(start+travel*f)
+		p[a1] = c1 + r*math.Sin(start+travel*f)
+		p[a2] = s.pos[a2] + (end[a2]-s.pos[a2])*f
+		s.visit(p, [3]bool{true, true, true})
+		if s.trace != nil {
+			s.trace(previous, p, false)
+		}
+		previous = p
+	}
+	if s.trace != nil {
+		s.trace(previous, end, false)
+	}
+	return math.Hypot(r*math.Abs(travel), end[a2]-s.pos[a2])
+}
+
+// visit records that the tool reaches p and checks it is within the
+// travel of the profile.
+func (s *simulator) visit(p [3]float64, known [3]bool) {
+	for i := range p {
+		if !known[i] {
+			continue
+		}
+		if !s.reached[i] || p[i] < s.low[i] {
+			s.low[i] = p[i]
+		}
+		if !s.reached[i] || p[i] > s.high[i] {
+			s.high[i] = p[i]
+		}
+		s.reached[i] = true
+		if s.profile == nil {
+			continue
+		}
+		travel := [3]float64{s.profile.Travel.X, s.profile.Travel.Y, s.profile.Travel.Z}[i]
+		if travel <= 0 {
+			continue
+		}
+		if s.origin != nil {
+			// GRBL's machine coordinates run from minus the travel to 0
+			// once homed
+			machine := p[i] + s.origin[i]
+			if !s.flagged[i] && (machine > 1e-6 || machine < -travel-1e-6) {
+				s.flagged[i] = true
+				s.report(findingLimit, "finding.outside-travel", axisNames[i], length(p[i]), length(machine), length(-travel))
+			}
+			continue
+		}
+		if !s.spanned[i] && s.high[i]-s.low[i] > travel+1e-6 {
+			s.spanned[i] = true
+			s.report(findingLimit, "finding.spans-travel", length(s.high[i]-s.low[i]), axisNames[i], length(travel))
+		}
+	}
+}
+
+func (s *simulator) run(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			s.step(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *simulator) result(file string) simulationReport {
+	report := simulationReport{File: file, Lines: s.line, Moves: s.moves, Extent: map[string]axisRange{}, Toolpath: s.toolpath(), Findings: s.findings}
+	for i, name := range axisNames {
+		if s.reached[i] {
+			report.Extent[name] = axisRange{Min: s.low[i], Max: s.high[i]}
+		}
+	}
+	if report.Findings == nil {
+		report.Findings = []simulationFinding{}
+	}
+	return report
+}
+
+// parseOrigin parses the machine position of the work zero, like
+// "-400,-200,-30".
+func parseOrigin(text string) (*[3]float64, error) {
+	fields := strings.Split(text, ",")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid origin %q, use x,y,z in machine coordinates", text)
+	}
+	var origin [3]float64
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin %q, use x,y,z in machine coordinates", text)
+		}
+		origin[i] = v
+	}
+	return &origin, nil
+}
+
+// simulationShown is how many findings are printed before they are only
+// counted.
+const simulationShown = 50
+
+var simulateOrigin string
+var simulateSpike float64
+var simulateJSON bool
+
+func simulateFlags(fs *flag.FlagSet) {
+	fs.StringVar(&profileName, "profile", "", "machine profile to check the travel and feed rate against, by default the -machine's profile from the config file")
+	fs.StringVar(&simulateOrigin, "origin", "", "machine position of the work zero as x,y,z in mm, to check every move against the travel instead of only the size of the job")
+	fs.Float64Var(&simulateSpike, "spike", 4, "report feed moves this many times faster than the previous one, 0 to not compare feeds")
+	fs.BoolVar(&simulateJSON, "json", false, "print the report as JSON")
+}
+
+func runSimulate(args []string) error {
+	positional, args := leadingArgs(args)
+	fs := newFlagSet("simulate")
+	simulateFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	positional = append(positional, fs.Args()...)
+	if len(positional) != 1 {
+		fs.PrintDefaults()
+		zap.L().Error("simulate needs the gcode file to run", zap.Strings("args", positional))
+		return errors.New("simulate needs the gcode file to run")
+	}
+	var origin *[3]float64
+	if simulateOrigin != "" {
+		var err error
+		if origin, err = parseOrigin(simulateOrigin); err != nil {
+			fs.PrintDefaults()
+			zap.L().Error("invalid origin", zap.Error(err))
+			return err
+		}
+	}
+	profile, hasProfile, err := activeProfile()
+	if err != nil {
+		return err
+	}
+	input, err := openInput(positional[0])
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	name := input.name
+	var s *simulator
+	if hasProfile {
+		// Run what would be sent, with the preamble and footer
+		applyProfile(input, profile)
+		s = newSimulator(&profile, origin, simulateSpike)
+	} else {
+		zap.L().Info("no profile, the travel is not checked")
+		s = newSimulator(nil, origin, simulateSpike)
+	}
+	if err := s.run(input); err != nil {
+		zap.L().Error("failed to read job", zap.String("file", name), zap.Error(err))
+		return err
+	}
+	report := s.result(name)
+	if simulateJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printSimulation(report)
+	}
+	if len(report.Findings) > 0 {
+		zap.L().Error("simulation found problems", zap.String("file", name), zap.Int("findings", len(report.Findings)))
+		return fmt.Errorf("%w: %d in %s", errSimulationProblems, len(report.Findings), name)
+	}
+	return nil
+}
+
+func printSimulation(report simulationReport) {
+	for i, finding := range report.Findings {
+		if i == simulationShown {
+			fmt.Printf("... and %d more\n", len(report.Findings)-simulationShown)
+			break
+		}
+		message := finding.Message
+		if isTerminal(os.Stdout) {
+			message = paint(colorRed, message)
+		}
+		fmt.Printf("line %d: %s\n", finding.Line, message)
+	}
+	var extent []string
+	for _, name := range axisNames {
+		if r, ok := report.Extent[name]; ok {
+			extent = append(extent, fmt.Sprintf("%s %s to %s", name, formatMM(r.Min), formatMM(r.Max)))
+		}
+	}
+	fmt.Printf("%s: %d lines, %d moves", report.File, report.Lines, report.Moves)
+	if len(extent) > 0 {
+		fmt.Printf(", %s mm", strings.Join(extent, ", "))
+	}
+	if report.Toolpath.moved() {
+		fmt.Printf(", %s", report.Toolpath)
+	}
+	if len(report.Findings) == 0 {
+		fmt.Println(", no problems found")
+		return
+	}
+	fmt.Printf(", %d problems found\n", len(report.Findings))
+}
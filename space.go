@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// spaceCheckAbove is the size from which a file is checked against the
+// room the receiver has before it is sent. Smaller files aren't worth the
+// round trip.
+const spaceCheckAbove = 1 << 20
+
+// checkReceiverSpace refuses a file the receiver has no room for before
+// any of it is sent, instead of it failing part way. A receiver that
+// announces INFO is asked for its free space and largest file. Of others,
+// like Carbide Motion, only the history tells: a file no smaller than one
+// the receiver last refused as too large is refused too, unless -force.
+func checkReceiverSpace(conn net.Conn, r *bufio.Reader, d *dialer, size int64) error {
+	if size < spaceCheckAbove {
+		return nil
+	}
+	if d.caps.Has(carbide.FeatureInfo) {
+		info, err := queryInfo(conn, r, connectTimeout)
+		if err != nil {
+			zap.L().Debug("receiver didn't say how much room it has", zap.String("address", d.String()), zap.Error(err))
+			return nil
+		}
+		for _, key := range []string{"max_size", "free"} {
+			limit, err := strconv.ParseInt(info[key], 10, 64)
+			if err != nil || size <= limit {
+				continue
+			}
+			message := fmt.Sprintf("the file is %s, the receiver has %s free", formatByteSize(size), formatByteSize(limit))
+			if key == "max_size" {
+				message = fmt.Sprintf("the file is %s, the receiver takes files up to %s", formatByteSize(size), formatByteSize(limit))
+			}
+			zap.L().Error("receiver has no room for the file", zap.String("address", d.String()), zap.Int64("size", size), zap.Int64(key, limit))
+			return &carbide.ReceiverError{Reason: carbide.RejectTooLarge, Message: message}
+		}
+		return nil
+	}
+	if forceSend {
+		return nil
+	}
+	if refused := refusedSize(d.String(), size); refused > 0 {
+		zap.L().Error("the receiver refused a file this large before, pass -force to try anyway", zap.String("address", d.String()), zap.Int64("size", size), zap.Int64("refused", refused))
+		return &carbide.ReceiverError{Reason: carbide.RejectTooLarge,
+			Message: fmt.Sprintf("the file is %s, the receiver last refused %s as too large", formatByteSize(size), formatByteSize(refused))}
+	}
+	return nil
+}
+
+// refusedSize is the size of the file the receiver at address refused as
+// too large, when that is the last send to it of a file no larger than
+// size, and 0 otherwise.
+func refusedSize(address string, size int64) int64 {
+	entries, err := readHistory()
+	if err != nil {
+		zap.L().Debug("failed to read history", zap.Error(err))
+		return 0
+	}
+	tooLarge := (&carbide.ReceiverError{Reason: carbide.RejectTooLarge}).Error()
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Kind != historyKindSend || e.Address != address || e.Size <= 0 || e.Size > size {
+			continue
+		}
+		if strings.Contains(e.Result, tooLarge) {
+			return e.Size
+		}
+		return 0
+	}
+	return 0
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var splitTools bool
+
+var errSplitStopped = errors.New("stopped before all tools were sent")
+
+var toolChangePattern = regexp.MustCompile(`(?i)(^|[^A-Z])M0*6(\D|$)`)
+var toolNumberPattern = regexp.MustCompile(`(?i)(^|[^A-Z])T(\d+)`)
+var motionPattern = regexp.MustCompile(`(?i)[XYZIJKR]|(^|[^0-9])G0*[0-3](\D|$)`)
+
+// toolSegment is the part of a job cut by one tool, stored in a temporary
+// file.
+type toolSegment struct {
+	tool string
+	path string
+	size int64
+}
+
+// splitByTool cuts the job at every M6. Each later segment starts with the
+// non-motion setup lines that came before the first tool change, such as
+// units and distance mode, and the M6 itself is replaced by a comment since
+// the tool is changed between sends.
+func splitByTool(input io.Reader) ([]toolSegment, error) {
+	var segments []toolSegment
+	var preamble []string
+	var current *os.File
+	var w *bufio.Writer
+	tool := ""
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		size, _ := current.Seek(0, io.SeekCurrent)
+		segments = append(segments, toolSegment{tool: tool, path: current.Name(), size: size})
+		return current.Close()
+	}
+	start := func() error {
+		f, err := ioutil.TempFile("", "send-carbide-tool-*.nc")
+		if err != nil {
+			return err
+		}
+		current, w = f, bufio.NewWriter(f)
+		for _, line := range preamble {
+			fmt.Fprintln(w, line)
+		}
+		return nil
+	}
+	if err := start(); err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	changes := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		code := cleanGcodeLine(line)
+		if toolChangePattern.MatchString(code) {
+			// Keep what came before the first change with the first tool
+			if changes > 0 {
+				if err := finish(); err != nil {
+					return nil, err
+				}
+				if err := start(); err != nil {
+					return nil, err
+				}
+			}
+			changes++
+			if m := toolNumberPattern.FindStringSubmatch(code); m != nil {
+				tool = "T" + m[2]
+			} else {
+				tool = fmt.Sprintf("tool %d", changes)
+			}
+			fmt.Fprintf(w, "(%s change handled by send-carbide: %s)\n", tool, strings.TrimSpace(line))
+			continue
+		}
+		if changes == 0 && code != "" && !motionPattern.MatchString(code) && code != "%" {
+			preamble = append(preamble, line)
+		}
+		fmt.Fprintln(w, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// sendByTool sends each tool's segment on its own and asks on the terminal
+// to change the tool before the next one.
+func sendByTool(sender Sender, input *jobInput) error {
+	segments, err := splitByTool(input)
+	defer func() {
+		for _, segment := range segments {
+			os.Remove(segment.path)
+		}
+	}()
+	if err != nil {
+		zap.L().Error("failed to split job by tool", zap.Error(err))
+		return err
+	}
+	zap.L().Info("split job by tool", zap.Int("segments", len(segments)))
+	base := strings.TrimSuffix(filepath.Base(input.name), filepath.Ext(input.name))
+	prompt := bufio.NewReader(os.Stdin)
+	for i, segment := range segments {
+		if i > 0 {
+			fmt.Fprintf(os.Stderr, "Part %d of %d: load %s, then press Enter to send it (q to stop): ", i+1, len(segments), segment.tool)
+			answer, err := prompt.ReadString('\n')
+			if err != nil || strings.EqualFold(strings.TrimSpace(answer), "q") {
+				return errSplitStopped
+			}
+		}
+		f, err := os.Open(segment.path)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s-%d-%s.nc", base, i+1, strings.Replace(segment.tool, " ", "", -1))
+		err = sender.Send(name, f, segment.size)
+		f.Close()
+		if err != nil {
+			zap.L().Error("failed to send tool segment", zap.String("tool", segment.tool), zap.Int("part", i+1), zap.Error(err))
+			return err
+		}
+		fmt.Fprintf(resultOutput(), "sent part %d of %d (%s, %s) to %s\n", i+1, len(segments), segment.tool, formatByteSize(segment.size), sender.Target())
+	}
+	return nil
+}
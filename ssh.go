@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var sshGateway string
+
+// sshConn is a connection forwarded by an `ssh -W` subprocess. Using the
+// system ssh client means keys, agents, known hosts and ~/.ssh/config all
+// work exactly as they do for the user's own logins.
+type sshConn struct {
+	cmd    *exec.Cmd
+	stdout *os.File
+	stdin  *os.File
+	target string
+}
+
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
+
+// dialSSH opens a tunnel through the -ssh gateway to address.
+func dialSSH(address string) (net.Conn, error) {
+	args := []string{"-W", address, "-o", "ExitOnForwardFailure=yes"}
+	if connectTimeout > 0 {
+		args = append(args, "-o", "ConnectTimeout="+strings.TrimSuffix(connectTimeout.Round(time.Second).String(), "s"))
+	}
+	gateway := sshGateway
+	if host, port, err := net.SplitHostPort(gateway); err == nil {
+		gateway = host
+		args = append(args, "-p", port)
+	}
+	args = append(args, gateway)
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		stdoutReader.Close()
+		stdoutWriter.Close()
+		return nil, err
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = os.Stderr
+	zap.L().Debug("starting ssh tunnel", zap.Strings("args", args))
+	if err := cmd.Start(); err != nil {
+		for _, f := range []*os.File{stdoutReader, stdoutWriter, stdinReader, stdinWriter} {
+			f.Close()
+		}
+		zap.L().Error("failed to start ssh", zap.Error(err))
+		return nil, err
+	}
+	// The child owns its ends of the pipes now.
+	stdoutWriter.Close()
+	stdinReader.Close()
+	return &sshConn{cmd: cmd, stdout: stdoutReader, stdin: stdinWriter, target: address}, nil
+}
+
+func (c *sshConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *sshConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *sshConn) Close() error {
+	c.stdin.Close()
+	c.stdout.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr {
+	return sshAddr(sshGateway)
+}
+
+func (c *sshConn) RemoteAddr() net.Addr {
+	return sshAddr(c.target)
+}
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
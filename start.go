@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var startLine int
+var startAt string
+
+// startSpindleDwell is how long to wait for the spindle to get up to speed
+// before moving back into the cut.
+const startSpindleDwell = 3
+
+// resumeLines returns the gcode that puts the machine in the state the
+// skipped lines left it in: units, distance mode, plane, work coordinate
+// system and feed. Mid-cut it also restores the spindle and coolant and
+// moves the tool back where it was, going there from above and feeding
+// down. At a tool change the job does that itself.
+func (s *simulator) resumeLines(midCut bool) []string {
+	lines := []string{
+		fmt.Sprintf("G21 G90 G%d G%d", s.plane, s.wcs),
+	}
+	feed := "F" + strconv.FormatFloat(s.feed, 'f', -1, 64)
+	if !midCut {
+		if s.feed > 0 {
+			lines = append(lines, feed)
+		}
+	} else if s.spindle != 5 {
+		line := fmt.Sprintf("M%d", s.spindle)
+		if s.speed > 0 {
+			line += " S" + strconv.FormatFloat(s.speed, 'f', -1, 64)
+		}
+		lines = append(lines, line, fmt.Sprintf("G4 P%d", startSpindleDwell))
+	}
+	if midCut {
+		if s.coolant != 9 {
+			lines = append(lines, fmt.Sprintf("M%d", s.coolant))
+		}
+		fed := false
+		if s.known[0] && s.known[1] {
+			lines = append(lines, "G53 G0 Z0", "G0 X"+formatMM(s.pos[0])+" Y"+formatMM(s.pos[1]))
+			switch {
+			case s.known[2] && s.feed > 0:
+				lines = append(lines, "G1 Z"+formatMM(s.pos[2])+" "+feed)
+				fed = true
+			case s.known[2]:
+				lines = append(lines, "G0 Z"+formatMM(s.pos[2]))
+			}
+		}
+		if s.feed > 0 && !fed {
+			lines = append(lines, feed)
+		}
+	}
+	var modes []string
+	// GRBL refuses G2 and G3 without a target, and arcs always carry one
+	if s.motion == 0 || s.motion == 1 {
+		modes = append(modes, fmt.Sprintf("G%d", s.motion))
+	}
+	if !s.metric {
+		modes = append(modes, "G20")
+	}
+	if !s.absolute {
+		modes = append(modes, "G91")
+	}
+	if len(modes) > 0 {
+		lines = append(lines, strings.Join(modes, " "))
+	}
+	return lines
+}
+
+// startReader skips the start of a job up to the line or the tool to
+// resume from, and replaces it with the gcode that restores the state the
+// skipped part left the machine in.
+type startReader struct {
+	r     *bufio.Reader
+	line  int
+	tool  int
+	begun bool
+	// pending is what is read next, the resume gcode and then the rest of
+	// the job
+	pending []byte
+	// from is the line of the job resumed from, and header the number of
+	// lines of resume gcode before it
+	from   int
+	header int
+}
+
+// originalLine returns the line of the job a line that was read is.
+// Lines of the resume gcode count as the last one skipped.
+func (s *startReader) originalLine(line int) int {
+	if line <= s.header {
+		return s.from - 1
+	}
+	return line - s.header + s.from - 1
+}
+
+func (s *startReader) Read(p []byte) (int, error) {
+	if !s.begun {
+		s.begun = true
+		if err := s.skip(); err != nil {
+			return 0, err
+		}
+	}
+	if len(s.pending) > 0 {
+		n := copy(p, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+	return s.r.Read(p)
+}
+
+// skip runs the lines before the start on a model of the machine.
+func (s *startReader) skip() error {
+	sim := newSimulator(nil, nil, 0)
+	for number := 1; ; number++ {
+		line, err := s.r.ReadString('\n')
+		if line == "" && err == io.EOF {
+			if s.tool > 0 {
+				return fmt.Errorf("tool T%d is not used by the job", s.tool)
+			}
+			return fmt.Errorf("line %d is past the end of the job, which has %d lines", s.line, number-1)
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if (s.line > 0 && number == s.line) || (s.tool > 0 && usesTool(line, s.tool)) {
+			var b bytes.Buffer
+			fmt.Fprintf(&b, "(resumed by send-carbide at line %d)\n", number)
+			restored := sim.resumeLines(s.tool == 0)
+			for _, restore := range restored {
+				fmt.Fprintln(&b, restore)
+			}
+			b.WriteString(line)
+			s.pending = b.Bytes()
+			s.from, s.header = number, len(restored)+1
+			zap.L().Info("resuming job", zap.Int("line", number), zap.Int("skipped", number-1), zap.Strings("restored", restored))
+			return nil
+		}
+		sim.step(line)
+	}
+}
+
+// usesTool reports whether a line of gcode selects tool.
+func usesTool(line string, tool int) bool {
+	for _, m := range toolNumberPattern.FindAllStringSubmatch(cleanGcodeLine(line), -1) {
+		if n, err := strconv.Atoi(m[2]); err == nil && n == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStartTool parses a tool like "T2" or "2".
+func parseStartTool(text string) (int, error) {
+	tool, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(text)), "T"))
+	if err != nil || tool <= 0 {
+		return 0, fmt.Errorf("invalid tool %q, use a tool number like T2", text)
+	}
+	return tool, nil
+}
+
+// applyStart makes the job resume from a line or the first use of a tool.
+func applyStart(input *jobInput, line, tool int) *startReader {
+	start := &startReader{r: bufio.NewReader(input.ReadCloser), line: line, tool: tool}
+	input.ReadCloser = struct {
+		io.Reader
+		io.Closer
+	}{start, input.ReadCloser}
+	input.size = -1
+	input.path = ""
+	return start
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// statsReader counts what is read from a job on its way to the machine: the
+// bytes, the gcode lines and what the preflight checks want to know.
+type statsReader struct {
+	io.ReadCloser
+	start      time.Time
+	bytes      int64
+	lines      int64
+	line       []byte
+	units      map[string]bool
+	programEnd bool
+	// maxFeed and maxRPM are the largest F and S words, checked against
+	// the limits of profile when there is one
+	maxFeed float64
+	maxRPM  float64
+	profile *machineProfile
+	// metadata is added to the summary as it is
+	metadata *jobMetadata
+	// toolpath measures the moves
+	toolpath *simulator
+}
+
+func newStatsReader(r io.ReadCloser) *statsReader {
+	toolpath := newSimulator(nil, nil, 0)
+	toolpath.measureOnly = true
+	return &statsReader{ReadCloser: r, start: time.Now(), units: map[string]bool{}, toolpath: toolpath}
+}
+
+func (s *statsReader) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.scan(p[:n])
+	return n, err
+}
+
+func (s *statsReader) scan(data []byte) {
+	s.bytes += int64(len(data))
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			s.line = append(s.line, data...)
+			return
+		}
+		s.line = append(s.line, data[:i]...)
+		s.endLine()
+		data = data[i+1:]
+	}
+}
+
+func (s *statsReader) endLine() {
+	code := bytes.TrimSpace(s.line)
+	s.line = s.line[:0]
+	// Most lines are moves, so look for what could matter in one pass and
+	// only run the patterns when it is there
+	comment, units, end, speeds := false, false, false, false
+	for i, c := range code {
+		switch c {
+		case '(', ';':
+			comment = true
+		case 'M', 'm':
+			end = true
+		case 'G', 'g':
+			units = units || (i+1 < len(code) && code[i+1] == '2')
+		case 'F', 'f', 'S', 's':
+			speeds = true
+		}
+	}
+	if comment {
+		code = []byte(cleanGcodeLine(string(code)))
+	}
+	if len(code) == 0 || (len(code) == 1 && code[0] == '%') {
+		return
+	}
+	s.lines++
+	s.toolpath.step(string(code))
+	if units {
+		if m := unitsPattern.FindSubmatch(code); m != nil {
+			s.units["G"+string(m[1])] = true
+		}
+	}
+	if end && programEndPattern.Match(code) {
+		s.programEnd = true
+	}
+	if speeds {
+		s.maxFeed = maxWord(code, 'F', s.maxFeed)
+		s.maxRPM = maxWord(code, 'S', s.maxRPM)
+	}
+}
+
+// maxWord returns the largest of max and the values of the letter's words
+// in code.
+func maxWord(code []byte, letter byte, max float64) float64 {
+	for i := 0; i < len(code); i++ {
+		if code[i]&^0x20 != letter {
+			continue
+		}
+		j := i + 1
+		for j < len(code) && (code[j] == '.' || code[j] == '-' || code[j] == '+' || (code[j] >= '0' && code[j] <= '9')) {
+			j++
+		}
+		if v, err := strconv.ParseFloat(string(code[i+1:j]), 64); err == nil && v > max {
+			max = v
+		}
+		i = j - 1
+	}
+	return max
+}
+
+// transferSummary is printed once the machine has acknowledged a job.
+type transferSummary struct {
+	File           string       `json:"file"`
+	Target         string       `json:"target"`
+	Bytes          int64        `json:"bytes"`
+	Lines          int64        `json:"lines"`
+	Seconds        float64      `json:"seconds"`
+	BytesPerSecond float64      `json:"bytes_per_second"`
+	Warnings       []string     `json:"warnings,omitempty"`
+	Metadata       *jobMetadata `json:"metadata,omitempty"`
+	// Toolpath is left out for jobs without measurable moves
+	Toolpath *toolpathStats `json:"toolpath,omitempty"`
+	// Phases are how long the steps of a send to Carbide Motion took
+	Phases *sendPhases `json:"phases,omitempty"`
+	// EstimatedSeconds is how long the job should run on the machine, the
+	// toolpath's estimate corrected by how long its past jobs ran
+	EstimatedSeconds float64 `json:"estimated_seconds,omitempty"`
+}
+
+func (s *statsReader) summary(file, target string) transferSummary {
+	if len(s.line) > 0 {
+		s.endLine()
+	}
+	elapsed := time.Since(s.start)
+	summary := transferSummary{
+		File:     file,
+		Target:   target,
+		Bytes:    s.bytes,
+		Lines:    s.lines,
+		Seconds:  elapsed.Seconds(),
+		Metadata: s.metadata,
+	}
+	if elapsed > 0 {
+		summary.BytesPerSecond = float64(s.bytes) / elapsed.Seconds()
+	}
+	switch {
+	case len(s.units) == 0:
+		summary.Warnings = append(summary.Warnings, tr("warning.no-units"))
+	case len(s.units) > 1:
+		summary.Warnings = append(summary.Warnings, tr("warning.mixed-units"))
+	}
+	if !s.programEnd {
+		summary.Warnings = append(summary.Warnings, tr("warning.no-program-end"))
+	}
+	// The profile only sets the rapid rate here, its travel was not
+	// checked along the way
+	s.toolpath.profile = s.profile
+	if toolpath := s.toolpath.toolpath(); toolpath.moved() {
+		summary.Toolpath = &toolpath
+		summary.EstimatedSeconds = correctedEstimate(machineName, target, toolpath.EstimatedSeconds).Seconds()
+		if toolpath.AirTimePercent > airTimeWarning {
+			summary.Warnings = append(summary.Warnings, tr("warning.air-time", toolpath.AirTimePercent))
+		}
+	}
+	if p := s.profile; p != nil {
+		feed := s.maxFeed
+		if s.units["G20"] && !s.units["G21"] {
+			feed *= 25.4
+		}
+		if p.MaxFeed > 0 && feed > p.MaxFeed {
+			summary.Warnings = append(summary.Warnings, tr("warning.feed-above", feedRate(feed), feedRate(p.MaxFeed)))
+		}
+		if p.MaxRPM > 0 && s.maxRPM > p.MaxRPM {
+			summary.Warnings = append(summary.Warnings, tr("warning.spindle-above", s.maxRPM, p.MaxRPM))
+		}
+	}
+	return summary
+}
+
+// estimate is the toolpath's estimate of how long the job runs.
+func (s *statsReader) estimate() float64 {
+	s.toolpath.profile = s.profile
+	return s.toolpath.toolpath().EstimatedSeconds
+}
+
+func (t transferSummary) String() string {
+	return fmt.Sprintf("%s, %d lines in %v, %s/s", formatByteSize(t.Bytes), t.Lines,
+		time.Duration(t.Seconds*float64(time.Second)).Round(time.Millisecond), formatByteSize(int64(t.BytesPerSecond)))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+// Exit codes of the status command so scripts can gate sends on the state.
+const (
+	statusExitReady   = 0
+	statusExitBusy    = 2
+	statusExitFault   = 3
+	statusExitUnknown = 4
+)
+
+// stateExitCode maps a machine state to the status command exit code.
+func stateExitCode(state carbide.State) int {
+	switch {
+	case state.Ready():
+		return statusExitReady
+	case state.Busy():
+		return statusExitBusy
+	case state.Faulted():
+		return statusExitFault
+	default:
+		return statusExitUnknown
+	}
+}
+
+type statusOutput struct {
+	Machine string        `json:"machine,omitempty"`
+	Address string        `json:"address"`
+	State   carbide.State `json:"state"`
+}
+
+var statusJSON bool
+
+func statusFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&statusJSON, "json", false, "print the status as JSON")
+}
+
+func runStatus(args []string) error {
+	fs := newFlagSet("status")
+	statusFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	dialers, err := resolveDialers()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	conn, _, state, d, err := dialAny(dialers)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	out := statusOutput{Machine: machineName, Address: d.String(), State: state}
+	if statusJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println(state)
+	}
+	if code := stateExitCode(state); code != statusExitReady {
+		return &exitError{code: code, err: fmt.Errorf("machine is %s", state)}
+	}
+	return nil
+}
+
+var watchReconnectInterval time.Duration
+
+func watchStatusFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&watchReconnectInterval, "reconnect-interval", 5*time.Second, "how long to wait before reconnecting after the connection drops")
+}
+
+func runWatchStatus(args []string) error {
+	fs := newFlagSet("watch-status")
+	watchStatusFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	dialers, err := resolveDialers()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	// Keep reading state messages, reconnecting whenever the machine drops
+	// the connection, and only print when the state actually changes.
+	// Receivers may also push override levels, which are printed the same
+	// way.
+	lastState := carbide.State("")
+	var lastOverrides overrides
+	for {
+		conn, r, state, _, err := dialAny(dialers)
+		if err == nil {
+			for err == nil {
+				if state != lastState {
+					fmt.Printf("%s %s\n", time.Now().Format(time.RFC3339), state)
+					lastState = state
+				}
+				state, err = readWatchMessage(r, state, &lastOverrides)
+			}
+			conn.Close()
+		}
+		zap.L().Debug("connection lost, reconnecting", zap.Error(err), zap.Duration("retry_in", watchReconnectInterval))
+		time.Sleep(watchReconnectInterval)
+	}
+}
+
+// readWatchMessage reads the next message while watching. State messages
+// return the new state, and override messages are printed when the levels
+// change and leave the state as it was.
+func readWatchMessage(r *bufio.Reader, state carbide.State, lastOverrides *overrides) (carbide.State, error) {
+	msg, err := readMessage(r)
+	if err != nil {
+		return carbide.StateUnknown, err
+	}
+	// Errors and alarms are reported and watching goes on
+	if merr := carbide.ParseMachineError(msg); merr != nil {
+		if suggestion := merr.Suggestion(); suggestion != "" {
+			fmt.Printf("%s %v (%s)\n", time.Now().Format(time.RFC3339), merr, suggestion)
+		} else {
+			fmt.Printf("%s %v\n", time.Now().Format(time.RFC3339), merr)
+		}
+		return state, nil
+	}
+	levels, ok, err := parseOverridesMessage(msg)
+	if !ok {
+		return parseState(msg)
+	}
+	if err != nil {
+		return "", err
+	}
+	if levels != *lastOverrides {
+		fmt.Printf("%s overrides %s\n", time.Now().Format(time.RFC3339), levels)
+		*lastOverrides = levels
+	}
+	return state, nil
+}
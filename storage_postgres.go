@@ -0,0 +1,8 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// The PostgreSQL driver is linked in with -tags postgres, for storage in a
+// postgres:// database.
+import _ "github.com/lib/pq"
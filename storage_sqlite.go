@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// The SQLite driver is linked in with -tags sqlite, for storage in a
+// sqlite: database. It needs no cgo.
+import _ "modernc.org/sqlite"
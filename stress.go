@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// stressResources is what the process uses at one point of a stress run.
+type stressResources struct {
+	HeapBytes  uint64 `json:"heap_bytes"`
+	Goroutines int    `json:"goroutines"`
+	// OpenFiles is -1 where the process can't list its descriptors
+	OpenFiles int `json:"open_files"`
+}
+
+func sampleResources() stressResources {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return stressResources{HeapBytes: mem.HeapAlloc, Goroutines: runtime.NumGoroutine(), OpenFiles: openFiles()}
+}
+
+// openFiles counts the descriptors the process has open.
+func openFiles() int {
+	entries, err := ioutil.ReadDir("/dev/fd")
+	if err != nil {
+		return -1
+	}
+	// Reading the directory opens one more
+	return len(entries) - 1
+}
+
+// stressReport summarises a stress run.
+type stressReport struct {
+	Target    string `json:"target"`
+	Count     int    `json:"count"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	// Failures counts the sends that failed by error
+	Failures map[string]int `json:"failures,omitempty"`
+	// Latencies are those of the successful sends, in seconds
+	Latencies struct {
+		Min float64 `json:"min"`
+		P50 float64 `json:"p50"`
+		P90 float64 `json:"p90"`
+		P99 float64 `json:"p99"`
+		Max float64 `json:"max"`
+	} `json:"latency_seconds"`
+	Start    stressResources `json:"start"`
+	End      stressResources `json:"end"`
+	PeakHeap uint64          `json:"peak_heap_bytes"`
+}
+
+// percentile returns the p-th percentile of sorted samples, by nearest rank.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// stressSend opens source anew and sends it, as a real send would.
+func stressSend(sender Sender, source string) error {
+	input, err := openInput(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	if err := spoolInput(input); err != nil {
+		return err
+	}
+	return sender.Send(input.name, input, input.size)
+}
+
+func (r *stressReport) print() {
+	fmt.Printf("%s: %d of %d sends succeeded (%.1f%%)\n", r.Target, r.Succeeded, r.Count, 100*float64(r.Succeeded)/float64(r.Count))
+	if r.Succeeded > 0 {
+		l := r.Latencies
+		ms := func(s float64) time.Duration { return seconds(s).Round(time.Millisecond) }
+		fmt.Printf("latency min/p50/p90/p99/max = %v/%v/%v/%v/%v\n", ms(l.Min), ms(l.P50), ms(l.P90), ms(l.P99), ms(l.Max))
+	}
+	failures := make([]string, 0, len(r.Failures))
+	for failure := range r.Failures {
+		failures = append(failures, failure)
+	}
+	sort.Strings(failures)
+	for _, failure := range failures {
+		fmt.Printf("%5d× %s\n", r.Failures[failure], failure)
+	}
+	fmt.Printf("heap %s at the end, %s at the peak (%s at the start)\n", formatByteSize(int64(r.End.HeapBytes)), formatByteSize(int64(r.PeakHeap)), formatByteSize(int64(r.Start.HeapBytes)))
+	fmt.Printf("goroutines %d -> %d\n", r.Start.Goroutines, r.End.Goroutines)
+	if r.Start.OpenFiles >= 0 {
+		fmt.Printf("open files %d -> %d\n", r.Start.OpenFiles, r.End.OpenFiles)
+	}
+}
+
+var stressCount int
+var stressInterval time.Duration
+var stressMock, stressJSON bool
+
+func stressFlags(fs *flag.FlagSet) {
+	fs.StringVar(&inputFile, "file", "", "gcode file to send")
+	fs.IntVar(&stressCount, "count", 100, "number of times to send the file, at least 1")
+	fs.DurationVar(&stressInterval, "interval", 0, "time between sends")
+	fs.BoolVar(&stressMock, "mock", false, "send to a mock receiver run by this command instead of -address")
+	fs.StringVar(&allowedStates, "allow-state", "init", "comma separated list of machine states that permit sending")
+	fs.DurationVar(&ackTimeout, "ack-timeout", 10*time.Minute, "how long to wait for the machine to acknowledge each send, 0 waits forever")
+	fs.BoolVar(&stressJSON, "json", false, "print the report as JSON")
+}
+
+func runStress(args []string) error {
+	fs := newFlagSet("stress")
+	stressFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	if stressCount < 1 {
+		stressCount = 1
+	}
+	if inputFile == "" {
+		fs.PrintDefaults()
+		return errors.New("no file to send, use -file")
+	}
+	if stressMock {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		go newMockReceiver().serve(l)
+		serverAddress = l.Addr().String()
+	}
+	sender, err := newSender("carbide")
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer sender.Close()
+	report := stressReport{Target: sender.Target(), Count: stressCount, Failures: map[string]int{}}
+	report.Start = sampleResources()
+	report.PeakHeap = report.Start.HeapBytes
+	var latencies []time.Duration
+	for i := 0; i < stressCount; i++ {
+		if i > 0 && stressInterval > 0 {
+			time.Sleep(stressInterval)
+		}
+		start := time.Now()
+		err := stressSend(sender, inputFile)
+		elapsed := time.Since(start)
+		if err != nil {
+			report.Failed++
+			report.Failures[err.Error()]++
+			zap.L().Warn("send failed", zap.Int("seq", i), zap.Duration("elapsed", elapsed), zap.Error(err))
+		} else {
+			report.Succeeded++
+			latencies = append(latencies, elapsed)
+			zap.L().Info("send succeeded", zap.Int("seq", i), zap.Duration("elapsed", elapsed))
+		}
+		if heap := sampleResources().HeapBytes; heap > report.PeakHeap {
+			report.PeakHeap = heap
+		}
+	}
+	// Let connections and their goroutines wind down before the last sample
+	runtime.GC()
+	time.Sleep(100 * time.Millisecond)
+	report.End = sampleResources()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if len(latencies) > 0 {
+		report.Latencies.Min = latencies[0].Seconds()
+		report.Latencies.P50 = percentile(latencies, 0.5).Seconds()
+		report.Latencies.P90 = percentile(latencies, 0.9).Seconds()
+		report.Latencies.P99 = percentile(latencies, 0.99).Seconds()
+		report.Latencies.Max = latencies[len(latencies)-1].Seconds()
+	}
+	if stressJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return err
+		}
+	} else {
+		report.print()
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d sends failed", report.Failed, stressCount)
+	}
+	return nil
+}
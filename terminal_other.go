@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Other platforms read whole lines without editing.
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errors.New("line editing is not supported on this platform")
+}
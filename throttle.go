@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// rateLimitedWriter caps the throughput of an underlying writer using a
+// token bucket refilled at rate bytes per second.
+type rateLimitedWriter struct {
+	w      io.Writer
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimitedWriter(w io.Writer, bytesPerSecond int64) *rateLimitedWriter {
+	rate := float64(bytesPerSecond)
+	// Allow roughly a tenth of a second worth of data in a single burst so
+	// writes stay smooth without exceeding the cap on average.
+	burst := rate / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimitedWriter{w: w, rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (l *rateLimitedWriter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+func (l *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		l.refill()
+		if l.tokens < 1 {
+			time.Sleep(time.Duration((1 - l.tokens) / l.rate * float64(time.Second)))
+			continue
+		}
+		n := len(p)
+		if float64(n) > l.tokens {
+			n = int(l.tokens)
+		}
+		m, err := l.w.Write(p[:n])
+		written += m
+		l.tokens -= float64(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[m:]
+	}
+	return written, nil
+}
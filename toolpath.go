@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// defaultRapidRate is the speed rapids are estimated at without a profile,
+// in mm/min, about that of a Shapeoko.
+const defaultRapidRate = 5000
+
+// airTimeWarning is the share of the estimated time in the air, in
+// percent, above which the preflight warns about the toolpath.
+const airTimeWarning = 50
+
+// toolpathStats are how far a job moves the tool, and how much of its
+// estimated time the tool spends in the air: in rapids, and in feed moves
+// above the work zero, which Carbide Create puts on top of the stock.
+type toolpathStats struct {
+	CutMM          float64 `json:"cut_mm"`
+	RapidMM        float64 `json:"rapid_mm"`
+	AirTimePercent float64 `json:"air_time_percent"`
+	// EstimatedSeconds is how long the moves take at their feeds, with
+	// rapids at the profile's fastest feed
+	EstimatedSeconds float64 `json:"estimated_seconds"`
+}
+
+// moveLength is the distance from one point to another, if it is known:
+// the axes that move must be known at both ends.
+func moveLength(from, to [3]float64, fromKnown, toKnown [3]bool) (float64, bool) {
+	var squares float64
+	for i := range from {
+		if !toKnown[i] {
+			continue
+		}
+		if !fromKnown[i] {
+			return 0, false
+		}
+		squares += (to[i] - from[i]) * (to[i] - from[i])
+	}
+	return math.Sqrt(squares), true
+}
+
+// account adds a move of length mm to the distances and times.
+func (s *simulator) account(length float64, rapid, inAir bool) {
+	if rapid {
+		s.rapidDistance += length
+		return
+	}
+	s.cutDistance += length
+	if s.feed <= 0 {
+		return
+	}
+	s.feedTime += length / s.feed
+	if inAir {
+		s.airFeedTime += length / s.feed
+	}
+}
+
+// toolpath sums up the moves so far, with rapids at the profile's fastest
+// feed.
+func (s *simulator) toolpath() toolpathStats {
+	t := toolpathStats{CutMM: s.cutDistance, RapidMM: s.rapidDistance}
+	rate := float64(defaultRapidRate)
+	if s.profile != nil && s.profile.MaxFeed > 0 {
+		rate = s.profile.MaxFeed
+	}
+	rapidTime := s.rapidDistance / rate
+	if total := rapidTime + s.feedTime; total > 0 {
+		t.AirTimePercent = 100 * (rapidTime + s.airFeedTime) / total
+		// Feeds are per minute
+		t.EstimatedSeconds = total * 60
+	}
+	return t
+}
+
+func (t toolpathStats) moved() bool {
+	return t.CutMM > 0 || t.RapidMM > 0
+}
+
+func (t toolpathStats) String() string {
+	return fmt.Sprintf("cutting %s, rapids %s, %.0f%% of the time in the air", formatDistance(t.CutMM), formatDistance(t.RapidMM), t.AirTimePercent)
+}
+
+// formatDistance formats a distance in mm, in metres from a metre.
+func formatDistance(mm float64) string {
+	if mm < 1000 {
+		return fmt.Sprintf("%.0f mm", mm)
+	}
+	return fmt.Sprintf("%.1f m", mm/1000)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// traceEntries is how many reads and writes a trace keeps, the last ones.
+const traceEntries = 1000
+
+// traceWriteHead and traceWriteTail are how much of a write a trace shows,
+// enough for the header and the end of the file without all of the gcode.
+const (
+	traceWriteHead = 96
+	traceWriteTail = 16
+)
+
+// tracedConn records what is exchanged with the machine, for the protocol
+// trace of report. Reads are kept in full, writes by their start and end.
+type tracedConn struct {
+	net.Conn
+	mu      sync.Mutex
+	start   time.Time
+	address string
+	entries []string
+	dropped int
+}
+
+func newTracedConn(conn net.Conn, address string) *tracedConn {
+	return &tracedConn{Conn: conn, start: time.Now(), address: address}
+}
+
+func (t *tracedConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	if n > 0 {
+		t.record("<", strconv.Quote(string(b[:n])))
+	}
+	if err != nil {
+		t.record("<", err.Error())
+	}
+	return n, err
+}
+
+func (t *tracedConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	written := b[:n]
+	detail := strconv.Quote(string(written))
+	if len(written) > traceWriteHead+traceWriteTail {
+		detail = fmt.Sprintf("%d bytes %s ... %s", len(written), strconv.Quote(string(written[:traceWriteHead])), strconv.Quote(string(written[len(written)-traceWriteTail:])))
+	}
+	if n > 0 {
+		t.record(">", detail)
+	}
+	if err != nil {
+		t.record(">", err.Error())
+	}
+	return n, err
+}
+
+func (t *tracedConn) Close() error {
+	t.record("-", "closed")
+	return t.Conn.Close()
+}
+
+func (t *tracedConn) record(direction, detail string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.entries) == traceEntries {
+		t.entries = t.entries[1:]
+		t.dropped++
+	}
+	t.entries = append(t.entries, fmt.Sprintf("%+9.3fs %s %s", time.Since(t.start).Seconds(), direction, detail))
+}
+
+// tracePath is where the trace of the last send is kept, next to the
+// config file.
+func tracePath() string {
+	if configPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(configPath), "last-trace.txt")
+}
+
+// saveTrace keeps the trace of the connection of a send, replacing the one
+// before. Failures are logged and otherwise ignored, as they must never
+// fail a send.
+func saveTrace(conn net.Conn, sendErr error) {
+	t, ok := conn.(*tracedConn)
+	path := tracePath()
+	if !ok || path == "" {
+		return
+	}
+	var b bytes.Buffer
+	t.mu.Lock()
+	fmt.Fprintf(&b, "protocol trace of %s, connected %s\n", t.address, t.start.Format(time.RFC3339))
+	if t.dropped > 0 {
+		fmt.Fprintf(&b, "(%d earlier reads and writes dropped)\n", t.dropped)
+	}
+	for _, entry := range t.entries {
+		b.WriteString(entry + "\n")
+	}
+	t.mu.Unlock()
+	result := "ok"
+	if sendErr != nil {
+		result = sendErr.Error()
+	}
+	fmt.Fprintf(&b, "result: %s\n", result)
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, b.Bytes(), 0o644)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		zap.L().Debug("failed to save protocol trace", zap.String("path", path), zap.Error(err))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobcob7/send-carbide/carbide"
+	"go.uber.org/zap"
+)
+
+var verifySend bool
+
+const verifyRequest = "VERIFY\n"
+
+// verifyTimeout is how long the receiver has to answer a verify request.
+// It has the file already, so the answer should be immediate.
+const verifyTimeout = 5 * time.Second
+
+// verifyTransfer asks the receiver what it recorded of the file it just
+// acknowledged. Receivers that support it answer "VERIFY_ACK <bytes>
+// <crc32>", with the checksum in hex and optional. Receivers without the
+// exchange cannot be checked, which is logged but not an error.
+func verifyTransfer(conn net.Conn, r *bufio.Reader, sent int64, crc uint32) error {
+	zap.L().Debug("requesting transfer verification")
+	if _, err := conn.Write(framed(verifyRequest)); err != nil {
+		zap.L().Warn("failed sending verify request, the transfer is not verified", zap.Error(err))
+		return nil
+	}
+	conn.SetReadDeadline(time.Now().Add(verifyTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	msg, err := readMessage(r)
+	var netErr net.Error
+	switch {
+	case err == io.EOF || (errors.As(err, &netErr) && netErr.Timeout()):
+		zap.L().Warn("receiver does not support verification, the transfer is not verified")
+		return nil
+	case err != nil:
+		zap.L().Warn("failed reading verify answer, the transfer is not verified", zap.Error(err))
+		return nil
+	}
+	tokens := strings.Fields(msg)
+	if len(tokens) < 2 || len(tokens) > 3 || tokens[0] != "VERIFY_ACK" {
+		zap.L().Warn("receiver does not support verification, the transfer is not verified", zap.String("answer", msg))
+		return nil
+	}
+	received, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil {
+		return &carbide.ProtocolError{Reason: "invalid byte count in verify answer", Message: msg}
+	}
+	mismatch := &carbide.MismatchError{SentBytes: sent, SentCRC: crc, ReceivedBytes: received}
+	if len(tokens) == 3 {
+		receivedCRC, err := strconv.ParseUint(tokens[2], 16, 32)
+		if err != nil {
+			return &carbide.ProtocolError{Reason: "invalid checksum in verify answer", Message: msg}
+		}
+		mismatch.ReceivedCRC = uint32(receivedCRC)
+	} else {
+		// Only the byte count can be compared
+		mismatch.SentCRC = 0
+	}
+	if mismatch.SentBytes != mismatch.ReceivedBytes || mismatch.SentCRC != mismatch.ReceivedCRC {
+		zap.L().Error("machine's copy of the file differs from what was sent", zap.Int64("sent_bytes", sent), zap.Int64("received_bytes", received),
+			zap.String("answer", msg))
+		return mismatch
+	}
+	zap.L().Info("transfer verified", zap.Int64("bytes", sent), zap.Bool("checksum", len(tokens) == 3))
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=abc123 -X main.buildDate=2024-01-02T15:04:05Z".
+// Otherwise they are filled in from the module build info where possible.
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+func buildVersion() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && build.Main.Version != "(devel)" {
+			info.Version = build.Main.Version
+		}
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			case setting.Key == "vcs.modified" && setting.Value == "true" && commit == "":
+				info.Commit += "-dirty"
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
+
+func (v versionInfo) String() string {
+	s := "send-carbide " + v.Version
+	if v.Commit != "" {
+		s += " (" + v.Commit
+		if v.BuildDate != "" {
+			s += ", built " + v.BuildDate
+		}
+		s += ")"
+	}
+	return s + " " + v.GoVersion + " " + v.Platform
+}
+
+var versionJSON bool
+
+func versionFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&versionJSON, "json", false, "print the version as JSON")
+}
+
+func runVersion(args []string) error {
+	fs := newFlagSet("version")
+	versionFlags(fs)
+	fs.Parse(args)
+	v := buildVersion()
+	if versionJSON {
+		return json.NewEncoder(os.Stdout).Encode(v)
+	}
+	fmt.Println(v)
+	return nil
+}
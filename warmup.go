@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// warmupConfig is a spindle warm-up macro. The spindle runs at Steps speeds
+// spread evenly from From to To RPM, for Minutes in total.
+type warmupConfig struct {
+	From    int     `yaml:"from"`
+	To      int     `yaml:"to"`
+	Minutes float64 `yaml:"minutes"`
+	Steps   int     `yaml:"steps"`
+}
+
+var defaultWarmup = warmupConfig{From: 8000, To: 24000, Minutes: 10, Steps: 4}
+
+// warmupStep is one speed of a warm-up.
+type warmupStep struct {
+	rpm      int
+	duration time.Duration
+}
+
+// merge fills the settings that w leaves unset from base.
+func (w warmupConfig) merge(base warmupConfig) warmupConfig {
+	if w.From == 0 {
+		w.From = base.From
+	}
+	if w.To == 0 {
+		w.To = base.To
+	}
+	if w.Minutes == 0 {
+		w.Minutes = base.Minutes
+	}
+	if w.Steps == 0 {
+		w.Steps = base.Steps
+	}
+	return w
+}
+
+// plan returns the speeds of the warm-up in order.
+func (w warmupConfig) plan() ([]warmupStep, error) {
+	if w.From <= 0 || w.To <= 0 || w.Minutes <= 0 || w.Steps <= 0 {
+		return nil, fmt.Errorf("invalid warm-up: from %d to %d RPM over %g minutes in %d steps", w.From, w.To, w.Minutes, w.Steps)
+	}
+	duration := time.Duration(w.Minutes * float64(time.Minute) / float64(w.Steps)).Round(time.Second)
+	steps := make([]warmupStep, w.Steps)
+	for i := range steps {
+		rpm := w.To
+		if w.Steps > 1 {
+			rpm = w.From + (w.To-w.From)*i/(w.Steps-1)
+		}
+		steps[i] = warmupStep{rpm: rpm, duration: duration}
+	}
+	return steps, nil
+}
+
+// configuredWarmup returns the warm-up from the config file, preferring the
+// one of the -machine.
+func configuredWarmup() (warmupConfig, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return warmupConfig{}, err
+	}
+	w := cfg.Warmup.merge(defaultWarmup)
+	if machineName != "" {
+		m, err := cfg.machine(machineName)
+		if err != nil {
+			zap.L().Error("Could not find machine in config", zap.String("machine", machineName), zap.String("config", configPath))
+			return warmupConfig{}, err
+		}
+		if m.Warmup != nil {
+			w = m.Warmup.merge(w)
+		}
+	}
+	return w, nil
+}
+
+// warmupOverrides are the warm-up settings given as flags, which override
+// those of the config file.
+var warmupOverrides warmupConfig
+var warmupDryRun bool
+
+func warmupFlags(fs *flag.FlagSet) {
+	controlFlags(fs, 30*time.Second)
+	fs.IntVar(&warmupOverrides.From, "from", 0, "starting spindle speed in RPM (default from the config file)")
+	fs.IntVar(&warmupOverrides.To, "to", 0, "final spindle speed in RPM (default from the config file)")
+	fs.Float64Var(&warmupOverrides.Minutes, "minutes", 0, "how long the whole warm-up takes (default from the config file)")
+	fs.IntVar(&warmupOverrides.Steps, "steps", 0, "how many speeds to run (default from the config file)")
+	fs.BoolVar(&warmupDryRun, "dry-run", false, "print the warm-up without running it")
+}
+
+func runWarmup(args []string) error {
+	fs := newFlagSet("warmup")
+	warmupFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	w, err := configuredWarmup()
+	if err != nil {
+		return err
+	}
+	plan, err := warmupOverrides.merge(w).plan()
+	if err != nil {
+		fs.PrintDefaults()
+		zap.L().Error("invalid warm-up", zap.Error(err))
+		return err
+	}
+	if warmupDryRun {
+		for i, step := range plan {
+			fmt.Printf("step %d/%d: %d RPM for %v\n", i+1, len(plan), step.rpm, step.duration)
+		}
+		return nil
+	}
+	c, err := openController()
+	if err != nil {
+		fs.PrintDefaults()
+		return err
+	}
+	defer c.Close()
+	state, err := c.State()
+	if err != nil {
+		return err
+	}
+	if stateExitCode(state) != statusExitReady {
+		zap.L().Error("machine is not ready for a warm-up", zap.Stringer("state", state))
+		return fmt.Errorf("%w: cannot warm up while %s", errUnexpectedState, state)
+	}
+	return warmup(c, plan)
+}
+
+// warmup runs the steps of a warm-up and stops the spindle at the end, or
+// early on an interrupt.
+func warmup(c controller, plan []warmupStep) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	var err error
+	start := time.Now()
+steps:
+	for i, step := range plan {
+		if _, err = c.Gcode(fmt.Sprintf("M3 S%d", step.rpm)); err != nil {
+			zap.L().Error("failed to set spindle speed", zap.Int("rpm", step.rpm), zap.Error(err))
+			break
+		}
+		zap.L().Info("warming up", zap.Int("step", i+1), zap.Int("rpm", step.rpm), zap.Duration("duration", step.duration))
+		fmt.Printf("step %d/%d: %d RPM for %v\n", i+1, len(plan), step.rpm, step.duration)
+		select {
+		case <-time.After(step.duration):
+		case sig := <-signals:
+			zap.L().Warn("warm-up interrupted", zap.String("signal", sig.String()))
+			err = errors.New("warm-up interrupted")
+			break steps
+		}
+	}
+	// Always try to stop the spindle, even when a step failed
+	if _, stopErr := c.Gcode("M5"); stopErr != nil {
+		zap.L().Error("failed to stop the spindle", zap.Error(stopErr))
+		if err == nil {
+			err = stopErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("warmed up %s in %v\n", c.Target(), time.Since(start).Round(time.Second))
+	return nil
+}
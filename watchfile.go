@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fileVersion tells one write of a file from the next.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statVersion(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// waitForChange polls path until it differs from last and has then stayed
+// the same for settle, since CAM tools write a job in several goes or
+// replace it through a temporary file.
+func waitForChange(path string, last fileVersion, interval, settle time.Duration) fileVersion {
+	var seen fileVersion
+	var since time.Time
+	for {
+		time.Sleep(interval)
+		current, err := statVersion(path)
+		switch {
+		case err != nil:
+			// Removed while it is rewritten
+			zap.L().Debug("cannot stat watched file", zap.String("file", path), zap.Error(err))
+			since = time.Time{}
+		case current == last:
+			since = time.Time{}
+		case current != seen || since.IsZero():
+			seen, since = current, time.Now()
+		case time.Since(since) >= settle:
+			return current
+		}
+	}
+}
+
+// validateJob runs the checks of a send on the job at path without sending
+// it: that it opens as gcode, and the preflight warnings.
+func validateJob(path string) (transferSummary, error) {
+	input, err := openInput(path)
+	if err != nil {
+		return transferSummary{}, err
+	}
+	defer input.Close()
+	readMetadata(input)
+	stats := newStatsReader(input.ReadCloser)
+	stats.metadata = input.metadata
+	if _, err := io.Copy(ioutil.Discard, stats); err != nil {
+		return transferSummary{}, err
+	}
+	return stats.summary(path, ""), nil
+}
+
+// printValidation reports the outcome of validateJob and whether the job
+// is fit to send.
+func printValidation(path string, summary transferSummary, err error) bool {
+	stamp := time.Now().Format("15:04:05")
+	if err != nil {
+		fmt.Printf("%s %s %s %v\n", stamp, filepath.Base(path), paint(colorRed, "invalid:"), err)
+		return false
+	}
+	fmt.Printf("%s %s %s, %d lines\n", stamp, filepath.Base(path), formatByteSize(summary.Bytes), summary.Lines)
+	if m := summary.Metadata; m != nil {
+		if job := m.String(); job != "" {
+			fmt.Printf("  %s %s\n", paint(colorDim, "Job:"), job)
+		}
+	}
+	if summary.Toolpath != nil {
+		fmt.Printf("  %s %s\n", paint(colorDim, "Toolpath:"), summary.Toolpath)
+	}
+	for _, warning := range summary.Warnings {
+		fmt.Printf("  %s %s\n", paint(colorYellow, tr("label.warning")), warning)
+	}
+	return true
+}
+
+var watchInterval, watchSettle time.Duration
+var watchYes bool
+
+func watchFileFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&watchInterval, "interval", time.Second, "how often to check the file for changes")
+	fs.DurationVar(&watchSettle, "settle", time.Second, "how long the file must stay unchanged after a write before it is checked")
+	fs.BoolVar(&watchYes, "yes", false, "send the file whenever it changes and passes the checks, without asking")
+}
+
+func runWatchFile(args []string) error {
+	fs := newFlagSet("watch-file")
+	watchFileFlags(fs)
+	fs.Parse(args)
+	initLogger()
+	if fs.NArg() == 0 {
+		fs.PrintDefaults()
+		return errors.New("no file to watch, use watch-file [flags] job.nc [-- send flags]")
+	}
+	path := fs.Arg(0)
+	// The rest is for send, which sets up the machine and backend itself
+	sendArgs := fs.Args()[1:]
+	if len(sendArgs) > 0 && sendArgs[0] == "--" {
+		sendArgs = sendArgs[1:]
+	}
+	version, err := statVersion(path)
+	if err != nil {
+		zap.L().Error("Could not find input file", zap.String("file", path))
+		return err
+	}
+	interactive := isTerminal(os.Stdin)
+	if !watchYes && !interactive {
+		zap.L().Warn("not on a terminal, the file is only checked; pass -yes to send it on every change")
+	}
+	answers := bufio.NewReader(os.Stdin)
+	summary, err := validateJob(path)
+	printValidation(path, summary, err)
+	fmt.Printf("watching %s, press Ctrl-C to stop\n", path)
+	for {
+		version = waitForChange(path, version, watchInterval, watchSettle)
+		summary, err := validateJob(path)
+		if !printValidation(path, summary, err) || (!watchYes && !interactive) {
+			continue
+		}
+		if !watchYes {
+			fmt.Printf("Send %s? [y/N] ", filepath.Base(path))
+			answer, err := answers.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+				continue
+			}
+		}
+		if err := runSend(append(append([]string{}, sendArgs...), path)); err != nil {
+			fmt.Printf("%s %v\n", paint(colorRed, "Failed:"), err)
+		}
+		// A rewrite while asking or sending differs from version, so it
+		// is picked up next
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// preflightSpike is the feed spike the preflight reports, as simulate does
+// by default.
+const preflightSpike = 4
+
+// preflightReport is what the daemon found in a job before it is queued.
+type preflightReport struct {
+	Machine  string       `json:"machine"`
+	Profile  string       `json:"profile,omitempty"`
+	Metadata *jobMetadata `json:"metadata,omitempty"`
+	simulationReport
+}
+
+// preflight runs the request body on a model of the machine, with the
+// machine's profile when it has one, without queueing it.
+func (d *daemon) preflight(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	machine := r.URL.Query().Get("machine")
+	m, ok := d.cfg.Machines[machine]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "unknown machine %q", machine)
+		return
+	}
+	body, ok := d.uploadBody(w, r)
+	if !ok {
+		return
+	}
+	report := preflightReport{Machine: machine, Profile: m.Profile}
+	counted := &countingReader{ReadCloser: ioutil.NopCloser(body)}
+	input := &jobInput{ReadCloser: counted, name: filepath.Base(r.URL.Query().Get("name")), size: r.ContentLength}
+	report.Metadata = peekMetadata(input)
+	var s *simulator
+	if m.Profile != "" {
+		profile, err := lookupProfile(d.cfg, m.Profile)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		applyProfile(input, profile)
+		s = newSimulator(&profile, nil, preflightSpike)
+	} else {
+		s = newSimulator(nil, nil, preflightSpike)
+	}
+	if err := s.run(input); err != nil {
+		zap.L().Warn("failed to read preflight job", zap.String("machine", machine), zap.Error(err))
+		writeError(w, http.StatusBadRequest, "failed to read job: %v", err)
+		return
+	}
+	if d.tooLarge(w, counted.n) {
+		return
+	}
+	report.simulationReport = s.result(input.name)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// uploadPage serves the page to drop a job on, check it and queue it.
+func uploadPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, uploadHTML)
+}
+
+const uploadHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>send-carbide</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; padding: 0 1em; }
+#drop { border: 2px dashed #888; border-radius: 8px; padding: 3em; text-align: center; color: #555; }
+#drop.over { border-color: #1a73e8; background: #eef4fd; }
+.problem { color: #b3261e; }
+.ok { color: #137333; }
+table { border-collapse: collapse; }
+td { padding: 0.1em 1em 0.1em 0; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>Send a job</h1>
+<p><label>Machine <select id="machine"></select></label></p>
+<div id="drop">Drop a gcode file here, or <input type="file" id="file" accept=".nc,.gcode,.ngc,.tap,.txt"></div>
+<div id="report"></div>
+<p><button id="send" disabled>Queue job</button> <span id="result"></span></p>
+<script>
+var file = null;
+var machine = document.getElementById("machine");
+var drop = document.getElementById("drop");
+var report = document.getElementById("report");
+var send = document.getElementById("send");
+var result = document.getElementById("result");
+
+function size(n) {
+	var units = ["B", "KiB", "MiB", "GiB"];
+	var i = 0;
+	while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+	return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function text(tag, content, cls) {
+	var e = document.createElement(tag);
+	e.textContent = content;
+	if (cls) { e.className = cls; }
+	return e;
+}
+
+function row(table, key, value) {
+	var tr = table.insertRow();
+	tr.appendChild(text("td", key));
+	tr.appendChild(text("td", value));
+}
+
+function error(response) {
+	return response.json().then(function (body) { throw new Error(body.error || response.statusText); });
+}
+
+function preflight() {
+	send.disabled = true;
+	result.textContent = "";
+	report.textContent = "";
+	if (!file || !machine.value) { return; }
+	report.appendChild(text("p", file.name + ", " + size(file.size) + ", checking..."));
+	var query = "?machine=" + encodeURIComponent(machine.value) + "&name=" + encodeURIComponent(file.name);
+	fetch("preflight" + query, {method: "POST", body: file}).then(function (response) {
+		return response.ok ? response.json() : error(response);
+	}).then(function (r) {
+		report.textContent = "";
+		var table = document.createElement("table");
+		row(table, "File", file.name + ", " + size(file.size) + ", " + r.lines + " lines, " + r.moves + " moves");
+		if (r.metadata) {
+			["name", "stock", "generator", "date"].forEach(function (key) {
+				if (r.metadata[key]) { row(table, key.charAt(0).toUpperCase() + key.slice(1), r.metadata[key]); }
+			});
+			(r.metadata.tools || []).forEach(function (tool) { row(table, "Tool", tool); });
+		}
+		row(table, "Profile", r.profile || "none, the travel is not checked");
+		Object.keys(r.extent).sort().forEach(function (axis) {
+			row(table, axis, r.extent[axis].min.toFixed(3) + " to " + r.extent[axis].max.toFixed(3) + " mm");
+		});
+		if (r.toolpath.cut_mm || r.toolpath.rapid_mm) {
+			row(table, "Toolpath", "cutting " + r.toolpath.cut_mm.toFixed(0) + " mm, rapids " + r.toolpath.rapid_mm.toFixed(0) + " mm, " +
+				r.toolpath.air_time_percent.toFixed(0) + "% of the time in the air");
+		}
+		report.appendChild(table);
+		if (r.findings.length == 0) {
+			report.appendChild(text("p", "No problems found.", "ok"));
+		} else {
+			var list = document.createElement("ul");
+			r.findings.slice(0, 50).forEach(function (f) {
+				list.appendChild(text("li", "line " + f.line + ": " + f.message, "problem"));
+			});
+			if (r.findings.length > 50) { list.appendChild(text("li", "... and " + (r.findings.length - 50) + " more")); }
+			report.appendChild(list);
+		}
+		send.disabled = false;
+		send.textContent = r.findings.length ? "Queue job anyway" : "Queue job";
+	}).catch(function (e) {
+		report.textContent = "";
+		report.appendChild(text("p", e.message, "problem"));
+	});
+}
+
+function choose(f) {
+	file = f;
+	preflight();
+}
+
+drop.addEventListener("dragover", function (e) { e.preventDefault(); drop.className = "over"; });
+drop.addEventListener("dragleave", function () { drop.className = ""; });
+drop.addEventListener("drop", function (e) {
+	e.preventDefault();
+	drop.className = "";
+	if (e.dataTransfer.files.length) { choose(e.dataTransfer.files[0]); }
+});
+document.getElementById("file").addEventListener("change", function (e) { choose(e.target.files[0]); });
+machine.addEventListener("change", preflight);
+
+send.addEventListener("click", function () {
+	send.disabled = true;
+	var query = "?machine=" + encodeURIComponent(machine.value) + "&name=" + encodeURIComponent(file.name);
+	fetch("jobs" + query, {method: "POST", body: file}).then(function (response) {
+		return response.ok ? response.json() : error(response);
+	}).then(function (j) {
+		result.className = "ok";
+		result.textContent = "Queued as job " + j.id + ".";
+	}).catch(function (e) {
+		result.className = "problem";
+		result.textContent = e.message;
+		send.disabled = false;
+	});
+});
+
+fetch("machines").then(function (response) { return response.json(); }).then(function (machines) {
+	machines.forEach(function (m) {
+		if (m.permitted === false) { return; }
+		var option = text("option", m.name + " (" + m.queued + " queued)");
+		option.value = m.name;
+		machine.appendChild(option);
+	});
+});
+</script>
+</body>
+</html>
+`
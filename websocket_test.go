@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWebSocketReadUnmasksAcrossReads(t *testing.T) {
+	payload := []byte("G1 X10 Y10 F300\nG0 Z5\n")
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | wsOpBinary, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	c := &wsConn{r: bufio.NewReader(bytes.NewReader(frame))}
+	var got []byte
+	// Reads of 3 bytes start at every offset into the mask
+	buf := make([]byte, 3)
+	for len(got) < len(payload) {
+		n, err := c.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("read %q, want %q", got, payload)
+	}
+}